@@ -2,17 +2,14 @@
 
 set -e
 
-echo "Building incident-worker with optimized pool..."
-
-# Clean previous builds
-rm -f bin/incident-worker-optimized
-
-# Build the optimized version
-go build -o bin/incident-worker-optimized ./cmd/incident-worker/main_optimized.go
-
-echo "Build completed: bin/incident-worker-optimized"
-
-# Make executable
-chmod +x bin/incident-worker-optimized
-
-echo "Ready to test with: ./test_optimized.sh"
+# 各后端已合并为同一个 incident-worker，通过 QPROXY_BACKEND 选择
+echo "Building incident-worker..."
+go build -o bin/incident-worker ./cmd/incident-worker
+
+echo "Build completed: bin/incident-worker"
+echo ""
+echo "Usage:"
+echo "  export QPROXY_BACKEND=optimized"
+echo "  export Q_BIN=q"
+echo "  export QPROXY_POOL_SIZE=2"
+echo "  ./bin/incident-worker"
@@ -2,17 +2,14 @@
 
 set -e
 
-echo "Building incident-worker with persistent pool..."
-
-# Clean previous builds
-rm -f bin/incident-worker-persistent
-
-# Build the persistent version
-go build -o bin/incident-worker-persistent ./cmd/incident-worker/main_persistent.go
-
-echo "Build completed: bin/incident-worker-persistent"
-
-# Make executable
-chmod +x bin/incident-worker-persistent
-
-echo "Ready to test with: ./test_persistent.sh"
+# 各后端已合并为同一个 incident-worker，通过 QPROXY_BACKEND 选择
+echo "Building incident-worker..."
+go build -o bin/incident-worker ./cmd/incident-worker
+
+echo "Build completed: bin/incident-worker"
+echo ""
+echo "Usage:"
+echo "  export QPROXY_BACKEND=persistent"
+echo "  export Q_BIN=q"
+echo "  export QPROXY_POOL_SIZE=2"
+echo "  ./bin/incident-worker"
@@ -2,17 +2,14 @@
 
 set -e
 
-echo "Building pooled incident-worker..."
+# 各后端已合并为同一个 incident-worker，通过 QPROXY_BACKEND 选择
+echo "Building incident-worker..."
+go build -o bin/incident-worker ./cmd/incident-worker
 
-# Build the pooled version
-echo "Compiling pooled version..."
-go build -o bin/incident-worker-pooled cmd/incident-worker/main_pooled.go
-
-echo "Build completed: bin/incident-worker-pooled"
+echo "Build completed: bin/incident-worker"
 echo ""
 echo "Usage:"
+echo "  export QPROXY_BACKEND=oneshot"
 echo "  export Q_BIN=q"
-echo "  export QPROXY_POOL_SIZE=3"
-echo "  export QPROXY_CONV_ROOT=./conversations"
-echo "  export QPROXY_HTTP_ADDR=:8080"
-echo "  ./bin/incident-worker-pooled"
+echo "  export QPROXY_POOL_SIZE=2"
+echo "  ./bin/incident-worker"
@@ -51,7 +51,7 @@ func main() {
 		Handshake: 10 * time.Second,
 	}
 
-	p, err := pool.New(ctx, n, qo)
+	p, err := pool.New(ctx, pool.Options{Size: n, Factory: pool.SessionFactory(qo)})
 	if err != nil {
 		log.Fatalf("pool init: %v", err)
 	}
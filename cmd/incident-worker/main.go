@@ -1,7 +1,6 @@
 package main
 
 import (
-	"bufio"
 	"bytes"
 	"context"
 	"crypto/sha1"
@@ -10,26 +9,38 @@ import (
 	"errors"
 	"fmt"
 	"io"
-	"io/fs"
 	"log"
 	"net/http"
 	_ "net/http/pprof"
 	"os"
 	"os/exec"
+	"os/signal"
 	"path/filepath"
-	"regexp"
 	"runtime"
 	"runtime/pprof"
-	"sort"
 	"strconv"
 	"strings"
 	"sync"
+	"syscall"
 	"time"
 
+	"aiops-qproxy/internal/alertmanager"
+	"aiops-qproxy/internal/dedup"
+	"aiops-qproxy/internal/drain"
+	"aiops-qproxy/internal/history"
+	"aiops-qproxy/internal/httpauth"
+	"aiops-qproxy/internal/jobs"
+	"aiops-qproxy/internal/logx"
+	"aiops-qproxy/internal/metrics"
 	"aiops-qproxy/internal/pool"
+	"aiops-qproxy/internal/qerr"
 	"aiops-qproxy/internal/qflow"
 	"aiops-qproxy/internal/runner"
+	"aiops-qproxy/internal/schema"
+	"aiops-qproxy/internal/sop"
 	"aiops-qproxy/internal/store"
+	"aiops-qproxy/internal/tracing"
+	"aiops-qproxy/internal/ttyd"
 )
 
 func getenv(k, def string) string {
@@ -41,29 +52,6 @@ func getenv(k, def string) string {
 
 // =========== SOP 相关结构体和函数 ===========
 
-type Alert struct {
-	Service   string          `json:"service"`
-	Category  string          `json:"category"`
-	Severity  string          `json:"severity"`
-	Region    string          `json:"region"`
-	GroupID   string          `json:"group_id"`
-	Path      string          `json:"path"`
-	Metadata  json.RawMessage `json:"metadata"`
-	Threshold json.RawMessage `json:"threshold"`
-}
-
-type SopLine struct {
-	SopID       string   `json:"sop_id"`       // SOP 唯一标识（用于会话关联）
-	IncidentKey string   `json:"incident_key"` // 规范化的 incident_key
-	Keys        []string `json:"keys"`         // 匹配条件: svc:omada cat:cpu
-	Priority    string   `json:"priority"`     // HIGH/MIDDLE/LOW
-	Command     []string `json:"command"`      // 诊断命令列表
-	Metric      []string `json:"metric"`       // 需要检查的指标
-	Log         []string `json:"log"`          // 需要检查的日志
-	Parameter   []string `json:"parameter"`    // 需要检查的参数
-	FixAction   []string `json:"fix_action"`   // 修复操作
-}
-
 func jsonRawToString(raw json.RawMessage) string {
 	if len(raw) == 0 {
 		return ""
@@ -81,343 +69,222 @@ func jsonRawToString(raw json.RawMessage) string {
 	return strings.Trim(string(raw), "\"")
 }
 
-func parseSopJSONL(path string) ([]SopLine, error) {
-	f, err := os.Open(path)
-	if err != nil {
-		return nil, err
+// buildSopContextWithID 匹配并合并 SOP，返回渲染文本、主 sop_id 与参与合并的 sop_id
+func buildSopContextWithID(ctx context.Context, a sop.Alert, repo sop.Repository, opt sop.ComposeOptions) sop.Composition {
+	if repo == nil {
+		return sop.Composition{}
 	}
-	defer f.Close()
-
-	var out []SopLine
-	sc := bufio.NewScanner(f)
-	for sc.Scan() {
-		line := strings.TrimSpace(sc.Text())
-		if line == "" || strings.HasPrefix(line, "#") {
-			continue
-		}
-		var one SopLine
-		if err := json.Unmarshal([]byte(line), &one); err != nil {
-			continue
-		}
-		out = append(out, one)
+	_, sp := tracing.Start(ctx, "sop.match")
+	m := sop.MatchAlert(repo.Snapshot().Lines, a, false)
+	c := m.Compose(a, opt)
+	sp.SetAttr("method", m.Method)
+	sp.SetAttr("sop_id", m.SopID)
+	sp.SetAttr("merged", len(c.SopIDs))
+	sp.End()
+	ctx = logx.With(ctx, logx.IncidentKey, m.IncidentKey, logx.SopID, m.SopID)
+	logx.Infof(ctx, "sop: expected=%s method=%s merged=%v dropped=%d",
+		m.ExpectedSopID, m.Method, c.SopIDs, c.Dropped)
+	for _, w := range c.Warnings {
+		logx.Warnf(ctx, "sop: template warning: %s", w)
 	}
-	return out, sc.Err()
+	return c
 }
 
-func collectSopLines(dir string) ([]SopLine, error) {
-	var merged []SopLine
-	walkFn := func(path string, d fs.DirEntry, err error) error {
-		if err != nil {
-			return nil
-		}
-		if d.IsDir() {
-			return nil
-		}
-		if strings.HasSuffix(path, ".jsonl") {
-			lines, e := parseSopJSONL(path)
-			if e == nil {
-				merged = append(merged, lines...)
-			}
-		}
-		return nil
-	}
-	_ = filepath.WalkDir(dir, walkFn)
-	return merged, nil
-}
-
-// 全局 SOP 缓存（只加载一次）
-var (
-	sopCacheOnce sync.Once
-	sopCache     []SopLine
-)
-
-func getCachedSopLines(dir string) []SopLine {
-	sopCacheOnce.Do(func() {
-		lines, err := collectSopLines(dir)
-		if err == nil {
-			sopCache = lines
-		} else {
-			sopCache = nil
-		}
-	})
-	return sopCache
+// buildSopContext 已废弃，请使用 buildSopContextWithID
+// 保留此函数仅为向后兼容，但不推荐使用
+func buildSopContext(a sop.Alert, repo sop.Repository) string {
+	// 直接调用新函数，只返回内容部分
+	return buildSopContextWithID(context.Background(), a, repo, sop.ComposeOptions{}).Text
 }
 
-func wildcardMatch(patt, val string) bool {
-	if patt == "*" {
-		return true
+// sopComposeOptionsFromEnv 读取多 SOP 合并配置
+func sopComposeOptionsFromEnv() sop.ComposeOptions {
+	opt := sop.ComposeOptions{MaxSOPs: 1, Budget: 4096} // 默认只用主 SOP，与合并功能之前的 prompt 一致
+	if v, err := strconv.Atoi(getenv("QPROXY_SOP_MAX", "")); err == nil && v > 0 {
+		opt.MaxSOPs = v
 	}
-	if !strings.Contains(patt, "*") {
-		return patt == val
+	if v, err := strconv.Atoi(getenv("QPROXY_SOP_BUDGET", "")); err == nil {
+		opt.Budget = v
 	}
-	reStr := "^" + regexp.QuoteMeta(patt)
-	reStr = strings.ReplaceAll(reStr, "\\*", ".*") + "$"
-	re := regexp.MustCompile(reStr)
-	return re.MatchString(val)
-}
-
-func keyMatches(keys []string, a Alert) bool {
-	if len(keys) == 0 {
-		return false
-	}
-	matches := 0
-L:
-	for _, k := range keys {
-		k = strings.TrimSpace(strings.ToLower(k))
-		parts := strings.SplitN(k, ":", 2)
-		if len(parts) != 2 {
-			continue
-		}
-		field, patt := parts[0], parts[1]
-		val := ""
-		switch field {
-		case "svc", "service":
-			val = strings.ToLower(a.Service)
-		case "cat", "category":
-			val = strings.ToLower(a.Category)
-		case "sev", "severity":
-			val = strings.ToLower(a.Severity)
-		case "region":
-			val = strings.ToLower(a.Region)
-		default:
-			continue L
+	// 形如 "command=5,metric=5,log=3"，未列出的段使用默认值
+	if v := getenv("QPROXY_SOP_LIMITS", ""); v != "" {
+		opt.Limits = map[string]int{}
+		for k, n := range sop.DefaultLimits {
+			opt.Limits[k] = n
 		}
-		if wildcardMatch(patt, val) {
-			matches++
-			continue
+		for _, kv := range strings.Split(v, ",") {
+			parts := strings.SplitN(strings.TrimSpace(kv), "=", 2)
+			if len(parts) != 2 {
+				continue
+			}
+			if n, err := strconv.Atoi(parts[1]); err == nil && n >= 0 {
+				opt.Limits[strings.TrimSpace(parts[0])] = n
+			}
 		}
-		return false
 	}
-	return matches > 0
+	return opt
 }
 
-func replaceSOPTemplates(sop string, a Alert) string {
-	var metadata map[string]interface{}
-	if len(a.Metadata) > 0 {
-		json.Unmarshal(a.Metadata, &metadata)
-	}
-
-	getStr := func(m map[string]interface{}, keys ...string) string {
-		for _, k := range keys {
-			if v, ok := m[k]; ok {
-				if s, ok := v.(string); ok && strings.TrimSpace(s) != "" {
-					return s
-				}
-			}
-		}
+func readFileSafe(path string) string {
+	b, err := os.ReadFile(path)
+	if err != nil {
 		return ""
 	}
+	return string(b)
+}
 
-	if expr, ok := metadata["expression"].(string); ok && expr != "" {
-		sop = strings.ReplaceAll(sop, "{{expression}}", expr)
+func trimToBytesUTF8(s string, maxBytes int) string {
+	if len(s) <= maxBytes {
+		return s
 	}
-	if a.Path != "" {
-		sop = strings.ReplaceAll(sop, "{{alert_path}}", a.Path)
+	// 简单截断到 maxBytes，避免切断 UTF-8 字符
+	b := []byte(s)
+	if len(b) <= maxBytes {
+		return s
 	}
-	if a.Service != "" {
-		sop = strings.ReplaceAll(sop, "{{service_name}}", a.Service)
-		sop = strings.ReplaceAll(sop, "{{service名}}", a.Service)
+	// 回退到有效的 UTF-8 边界
+	cut := maxBytes
+	for cut > 0 && (b[cut]&0xC0) == 0x80 {
+		cut--
 	}
+	return string(b[:cut]) + "\n..."
+}
 
-	startTime := getStr(metadata, "alert_start_time", "start_time", "start", "startsAt")
-	endTime := getStr(metadata, "alert_end_time", "end_time", "end", "endsAt")
-	if strings.TrimSpace(startTime) == "" {
-		startTime = "now-10m"
+// extractJSONObject 从清洗后的回答中取出 JSON 对象：整体即 JSON 时直接返回，
+// 否则取首个 '{' 到最后一个 '}' 之间的内容再校验。
+func extractJSONObject(s string) (json.RawMessage, bool) {
+	s = strings.TrimSpace(s)
+	if json.Valid([]byte(s)) && strings.HasPrefix(s, "{") {
+		return json.RawMessage(s), true
 	}
-	if strings.TrimSpace(endTime) == "" {
-		endTime = "now"
+	i, j := strings.Index(s, "{"), strings.LastIndex(s, "}")
+	if i < 0 || j <= i {
+		return nil, false
 	}
-	sop = strings.ReplaceAll(sop, "{{alert_start_time}}", startTime)
-	sop = strings.ReplaceAll(sop, "{{alert_end_time}}", endTime)
-
-	pointTime := getStr(metadata, "alert_time", "timestamp", "ts")
-	if strings.TrimSpace(pointTime) == "" {
-		pointTime = "now-10m"
+	if sub := s[i : j+1]; json.Valid([]byte(sub)) {
+		return json.RawMessage(sub), true
 	}
-	sop = strings.ReplaceAll(sop, "alert_time", pointTime)
-
-	return sop
+	return nil, false
 }
 
-// 生成规范化的 incident_key: service_category_severity_region_alertname_groupid
-func buildIncidentKey(a Alert) string {
-	// 从 metadata 提取 alert_name
-	var metadata map[string]interface{}
-	alertName := ""
-	if len(a.Metadata) > 0 {
-		if err := json.Unmarshal(a.Metadata, &metadata); err == nil {
-			if name, ok := metadata["alert_name"].(string); ok && name != "" {
-				alertName = name
-			} else if name, ok := metadata["alertname"].(string); ok && name != "" {
-				alertName = name
-			}
-		}
-	}
-
-	// 规范化函数：替换空格和特殊字符为下划线
-	normalize := func(s string) string {
-		s = strings.ReplaceAll(s, " ", "_")
-		s = strings.ReplaceAll(s, "-", "_")
-		s = strings.ToLower(s)
-		return s
-	}
+// statusWriter 记录响应状态码（用于 trace），并透传 Flush 以支持 SSE
+type statusWriter struct {
+	http.ResponseWriter
+	status int
+}
 
-	// 规范化所有字段
-	service := normalize(a.Service)
-	category := normalize(a.Category)
-	severity := normalize(a.Severity)
-	region := normalize(a.Region)
-	alertName = normalize(alertName)
-	groupID := normalize(a.GroupID)
+func (w *statusWriter) WriteHeader(code int) {
+	w.status = code
+	w.ResponseWriter.WriteHeader(code)
+}
 
-	// 格式：service_category_severity_region_alertname_groupid
-	parts := []string{service, category, severity, region}
-	if alertName != "" {
-		parts = append(parts, alertName)
-	}
-	if groupID != "" {
-		parts = append(parts, groupID)
+func (w *statusWriter) Flush() {
+	if f, ok := w.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
 	}
+}
 
-	return strings.Join(parts, "_")
+// sseWriter 以 Server-Sent Events 格式写事件，写入与 flush 串行化（输出回调与心跳并发）
+type sseWriter struct {
+	mu sync.Mutex
+	w  http.ResponseWriter
+	f  http.Flusher
 }
 
-// buildSopContext 返回 SOP 内容和匹配到的 sop_id
-func buildSopContextWithID(a Alert, dir string) (string, string) {
-	if strings.TrimSpace(dir) == "" {
-		return "", ""
+func newSSEWriter(w http.ResponseWriter) (*sseWriter, bool) {
+	f, ok := w.(http.Flusher)
+	if !ok {
+		return nil, false
 	}
+	h := w.Header()
+	h.Set("Content-Type", "text/event-stream")
+	h.Set("Cache-Control", "no-cache")
+	h.Set("Connection", "keep-alive")
+	h.Set("X-Accel-Buffering", "no") // 关闭 nginx 缓冲
+	w.WriteHeader(http.StatusOK)
+	f.Flush()
+	return &sseWriter{w: w, f: f}, true
+}
 
-	// 生成 incident_key
-	incidentKey := buildIncidentKey(a)
-
-	// 通过 SHA1 生成 sop_id
-	h := sha1.Sum([]byte(incidentKey))
-	expectedSopID := "sop_" + hex.EncodeToString(h[:])[:12]
-
-	// 加载所有 SOP（缓存）
-	lines := getCachedSopLines(dir)
-	if len(lines) == 0 {
-		return "", ""
+// Event 写出一个命名事件，data 为 v 的 JSON 编码
+func (s *sseWriter) Event(name string, v any) error {
+	b, err := json.Marshal(v)
+	if err != nil {
+		return err
 	}
-
-	// 优先通过 sop_id 精确匹配
-	var matchedSop *SopLine
-	for i := range lines {
-		if lines[i].SopID == expectedSopID {
-			matchedSop = &lines[i]
-			break
-		}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, err := fmt.Fprintf(s.w, "event: %s\ndata: %s\n\n", name, b); err != nil {
+		return err
 	}
+	s.f.Flush()
+	return nil
+}
 
-	// 如果没有精确匹配，则通过 keys 模糊匹配
-	if matchedSop == nil {
-		var hit []SopLine
-		for _, l := range lines {
-			if keyMatches(l.Keys, a) {
-				hit = append(hit, l)
+// KeepAlive 周期性写注释帧，返回停止函数（等待心跳 goroutine 退出，保证 handler 返回后不再写）
+func (s *sseWriter) KeepAlive(every time.Duration) func() {
+	done := make(chan struct{})
+	exited := make(chan struct{})
+	go func() {
+		defer close(exited)
+		t := time.NewTicker(every)
+		defer t.Stop()
+		for {
+			select {
+			case <-done:
+				return
+			case <-t.C:
+				s.mu.Lock()
+				_, _ = io.WriteString(s.w, ": keepalive\n\n")
+				s.f.Flush()
+				s.mu.Unlock()
 			}
 		}
-		if len(hit) == 0 {
-			return "", ""
-		}
-		// 按优先级排序，取第一个
-		sort.SliceStable(hit, func(i, j int) bool {
-			pi := strings.ToUpper(hit[i].Priority)
-			pj := strings.ToUpper(hit[j].Priority)
-			order := map[string]int{"HIGH": 0, "MIDDLE": 1, "LOW": 2}
-			return order[pi] < order[pj]
-		})
-		matchedSop = &hit[0]
-	}
-
-	// 使用匹配到的 SOP 的 sop_id（如果有的话）
-	finalSopID := matchedSop.SopID
-	if finalSopID == "" {
-		// 如果 SOP 没有 sop_id，使用生成的
-		finalSopID = expectedSopID
+	}()
+	var once sync.Once
+	return func() {
+		once.Do(func() { close(done) })
+		<-exited
 	}
+}
 
-	// 构建 SOP 内容
-	var b strings.Builder
-	b.WriteString("### [SOP] Preloaded knowledge (high priority)\n")
-	b.WriteString(fmt.Sprintf("Matched SOP ID: %s\n", finalSopID))
-	if matchedSop.IncidentKey != "" {
-		b.WriteString(fmt.Sprintf("Incident Key: %s\n", matchedSop.IncidentKey))
+func main() {
+	// 结构化日志：JSON 行（QPROXY_LOG_FORMAT=text 为单行文本），QPROXY_TTYD_DEBUG=1 等同 debug 级别
+	logLevel := logx.ParseLevel(getenv("QPROXY_LOG_LEVEL", "info"))
+	if getenv("QPROXY_TTYD_DEBUG", "") == "1" {
+		logLevel = logx.LevelDebug
 	}
-	b.WriteString("\n")
-
-	seen := map[string]bool{}
-	appendList := func(prefix string, arr []string, limit int) {
-		cnt := 0
-		for _, x := range arr {
-			x = strings.TrimSpace(x)
-			if x == "" {
-				continue
+	logx.Setup(getenv("QPROXY_LOG_FORMAT", "json"), logLevel)
+
+	// 追踪：设置 OTLP collector 时以 OTLP/HTTP 导出，设置 QPROXY_TRACE_FILE 时写本地 JSONL（按大小轮转），
+	// 都没有时只生成 trace_id 供日志关联；QPROXY_TRACE_ENABLED=0 关闭
+	if getenv("QPROXY_TRACE_ENABLED", "1") != "0" {
+		var exp tracing.Exporter = tracing.NopExporter{}
+		if ep := getenv("QPROXY_OTLP_ENDPOINT", getenv("OTEL_EXPORTER_OTLP_ENDPOINT", "")); ep != "" {
+			headers := tracing.ParseHeaders(getenv("QPROXY_OTLP_HEADERS", getenv("OTEL_EXPORTER_OTLP_HEADERS", "")))
+			exp = tracing.NewOTLPExporter(ep, getenv("OTEL_SERVICE_NAME", "incident-worker"), headers)
+			log.Printf("tracing: exporting spans to OTLP collector %s", ep)
+		} else if path := getenv("QPROXY_TRACE_FILE", ""); path != "" {
+			maxMB := 100
+			if v, err := strconv.Atoi(getenv("QPROXY_TRACE_FILE_MAX_MB", "")); err == nil && v > 0 {
+				maxMB = v
 			}
-			x = replaceSOPTemplates(x, a)
-			key := prefix + "::" + x
-			if seen[key] {
-				continue
-			}
-			seen[key] = true
-			b.WriteString("- " + prefix + ": " + x + "\n")
-			cnt++
-			if limit > 0 && cnt >= limit {
-				break
+			fe, err := tracing.NewFileExporter(path, int64(maxMB)<<20)
+			if err != nil {
+				log.Printf("tracing: cannot open %s, spans are not exported: %v", path, err)
+			} else {
+				exp = fe
+				log.Printf("tracing: writing spans to %s (rotated at %dMB)", path, maxMB)
 			}
 		}
+		tracing.Setup(tracing.Options{Exporter: exp})
 	}
 
-	appendList("Command", matchedSop.Command, 5)
-	appendList("Metric", matchedSop.Metric, 5)
-	appendList("Log", matchedSop.Log, 3)
-	appendList("Parameter", matchedSop.Parameter, 3)
-	appendList("FixAction", matchedSop.FixAction, 3)
-
-	return b.String(), finalSopID
-}
-
-// buildSopContext 已废弃，请使用 buildSopContextWithID
-// 保留此函数仅为向后兼容，但不推荐使用
-// 注意：此函数可能返回多个 SOP 的合并内容，与新的单一 SOP 逻辑不一致
-func buildSopContext(a Alert, dir string) string {
-	// 直接调用新函数，只返回内容部分
-	content, _ := buildSopContextWithID(a, dir)
-	return content
-}
-
-func readFileSafe(path string) string {
-	b, err := os.ReadFile(path)
-	if err != nil {
-		return ""
-	}
-	return string(b)
-}
-
-func trimToBytesUTF8(s string, maxBytes int) string {
-	if len(s) <= maxBytes {
-		return s
-	}
-	// 简单截断到 maxBytes，避免切断 UTF-8 字符
-	b := []byte(s)
-	if len(b) <= maxBytes {
-		return s
-	}
-	// 回退到有效的 UTF-8 边界
-	cut := maxBytes
-	for cut > 0 && (b[cut]&0xC0) == 0x80 {
-		cut--
-	}
-	return string(b[:cut]) + "\n..."
-}
-
-func main() {
 	// 默认裸跑直连 localhost
 	wsURL := getenv("QPROXY_WS_URL", "ws://127.0.0.1:7682/ws")
 	user := getenv("QPROXY_WS_USER", "")
 	pass := getenv("QPROXY_WS_PASS", "")
-	nStr := getenv("QPROXY_WS_POOL", "2")
+	nStr := getenv("QPROXY_WS_POOL", getenv("QPROXY_POOL_SIZE", "2"))
 	root := getenv("QPROXY_CONV_ROOT", "/tmp/conversations")
 	mpath := getenv("QPROXY_SOPMAP_PATH", root+"/_sopmap.json")
 	sopDir := getenv("QPROXY_SOP_DIR", "./ctx/sop") // SOP 目录
@@ -436,6 +303,12 @@ func main() {
 	}
 	wake := strings.ToLower(getenv("QPROXY_Q_WAKE", "newline")) // ctrlc/newline/none (默认 newline 避免 Q CLI 退出)
 
+	// 聊天后端：ttyd（默认）/pty/persistent/optimized/oneshot/simple；兼容旧的 QPROXY_MODE=exec-pool
+	backend, err := qflow.ParseBackend(getenv("QPROXY_BACKEND", getenv("QPROXY_MODE", qflow.BackendTTYD)))
+	if err != nil {
+		log.Fatalf("invalid QPROXY_BACKEND: %v", err)
+	}
+
 	n, _ := strconv.Atoi(nStr)
 	ctx := context.Background()
 	qo := qflow.Opts{
@@ -452,11 +325,22 @@ func main() {
 		TokenURL:       tokenURL,
 		AuthHeaderName: authHeaderName,
 		AuthHeaderVal:  authHeaderVal,
-		ExecMode:       strings.ToLower(getenv("QPROXY_MODE", "")) == "exec-pool",
+		Backend:        backend,
 		QBin:           getenv("Q_BIN", "q"),
+		RecordDir:      getenv("QPROXY_RECORD_DIR", ""), // 录制 ttyd 原始帧，用 qproxy replay 回放
+	}
+	if v, err := strconv.Atoi(getenv("QPROXY_Q_CMD_TIMEOUT_SEC", "")); err == nil && v > 0 {
+		qo.CmdTO = time.Duration(v) * time.Second
+	}
+	if qo.RecordDir != "" {
+		log.Printf("incident-worker: recording ttyd frames to %s", qo.RecordDir)
 	}
 
-	p, err := pool.New(ctx, n, qo)
+	dialTO := 45 * time.Second
+	if backend != qflow.BackendTTYD {
+		dialTO = 30 * time.Second // 本地进程启动更快
+	}
+	p, err := pool.New(ctx, pool.Options{Size: n, Factory: pool.SessionFactory(qo), DialTimeout: dialTO})
 	if err != nil {
 		log.Fatalf("pool init failed: %v", err)
 	}
@@ -469,15 +353,70 @@ func main() {
 	if err != nil {
 		log.Fatalf("sopmap load failed: %v", err)
 	}
+	// 亲和租用：保留最近服务过的 sop_id 对话，跳过 /load 与 /clear；0 关闭
+	affinityMax := n
+	if v, err := strconv.Atoi(getenv("QPROXY_AFFINITY_MAX", "")); err == nil && v >= 0 {
+		affinityMax = v
+	}
+	if !qflow.Stateful(backend) {
+		affinityMax = 0 // 无状态后端没有可保留的对话
+	}
+	p.SetAffinity(affinityMax)
 	orc := runner.NewOrchestrator(p, sm, cs)
-	log.Printf("incident-worker: ws=%s noauth=%v pool=%d", wsURL, noauth, n)
+	// 输出 schema：文件不存在时仅做 JSON 解析，不校验/修复
+	schemaPath := getenv("QPROXY_OUTPUT_SCHEMA", "./ctx/output_schema.json")
+	repairMax := 1
+	if v, err := strconv.Atoi(getenv("QPROXY_REPAIR_MAX", "")); err == nil && v >= 0 {
+		repairMax = v
+	}
+	if sch, err := schema.Load(schemaPath); err == nil {
+		orc.SetOutputSchema(sch, repairMax)
+		log.Printf("incident-worker: output schema %s loaded, repair_max=%d", schemaPath, repairMax)
+	} else {
+		log.Printf("incident-worker: output schema disabled: %v", err)
+	}
+	if backend == qflow.BackendTTYD {
+		log.Printf("incident-worker: backend=%s ws=%s noauth=%v pool=%d", backend, wsURL, noauth, n)
+	} else {
+		log.Printf("incident-worker: backend=%s q_bin=%s pool=%d", backend, qo.QBin, n)
+	}
+
+	// SOP 仓库：轮询 QPROXY_SOP_DIR，文件变更后整体重载，无需重启（重启会丢失池中的长连接）
+	var sopRepo *sop.DirRepository
+	if sopEnabled == "1" {
+		reloadSec := 5
+		if v, err := strconv.Atoi(getenv("QPROXY_SOP_RELOAD_SEC", "")); err == nil && v >= 0 {
+			reloadSec = v
+		}
+		sopRepo = sop.NewDirRepository(sopDir, time.Duration(reloadSec)*time.Second)
+	}
+	sopCompose := sopComposeOptionsFromEnv()
 
 	mux := http.NewServeMux()
+	inflight := drain.New() // 进行中的 incident 处理，优雅关闭时等待
 	mux.HandleFunc("/healthz", func(w http.ResponseWriter, r *http.Request) {
 		ready, size := p.Stats()
 		w.Header().Set("content-type", "application/json")
-		_ = json.NewEncoder(w).Encode(map[string]int{"ready": ready, "size": size})
+		_ = json.NewEncoder(w).Encode(map[string]any{"ready": ready, "size": size, "backend": backend})
+	})
+
+	// Prometheus 指标：池状态在抓取时读取，其余由 runner 等环节埋点
+	metrics.NewGaugeFunc("qproxy_pool_ready_sessions", "Idle sessions ready in the pool.", func() float64 {
+		return float64(p.Snapshot().Ready)
+	})
+	metrics.NewGaugeFunc("qproxy_pool_size", "Configured pool size.", func() float64 {
+		return float64(p.Snapshot().Size)
+	})
+	metrics.NewGaugeFunc("qproxy_pool_filling_workers", "Background goroutines refilling the pool.", func() float64 {
+		return float64(p.Snapshot().FillingWorkers)
 	})
+	metrics.NewGaugeFunc("qproxy_pool_failed_attempts", "Consecutive failed session dials.", func() float64 {
+		return float64(p.Snapshot().FailedAttempts)
+	})
+	metrics.NewGaugeFunc("qproxy_pool_warm_sessions", "Idle sessions holding a conversation for affinity reuse.", func() float64 {
+		return float64(p.Snapshot().Warm)
+	})
+	mux.Handle("/metrics", metrics.Handler())
 
 	// 可选：周期性内存/协程日志（线上快速定位泄漏/增长），默认关闭
 	if secStr := getenv("QPROXY_MEMLOG_SEC", ""); strings.TrimSpace(secStr) != "" {
@@ -495,8 +434,13 @@ func main() {
 		}
 	}
 
-	// 就绪探针：至少有一个可用连接
+	// 就绪探针：至少有一个可用连接；关闭排空期间返回 503，让负载均衡摘除本实例
 	mux.HandleFunc("/readyz", func(w http.ResponseWriter, r *http.Request) {
+		if inflight.Draining() {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			_, _ = w.Write([]byte("draining"))
+			return
+		}
 		ready, _ := p.Stats()
 		if ready > 0 {
 			w.WriteHeader(http.StatusOK)
@@ -507,6 +451,178 @@ func main() {
 		_, _ = w.Write([]byte("warming"))
 	})
 
+	// SOP 管理：GET /sops 查看加载状态、被拒绝的行与全部 SOP；POST /sops 新增（?file=xxx.jsonl，默认 custom.jsonl）；
+	// GET/PUT/DELETE /sops/{id} 查询、替换、删除。写操作原子写回 JSONL 并立即重载
+	writeSopError := func(w http.ResponseWriter, err error) {
+		status := http.StatusInternalServerError
+		body := map[string]any{"error": err.Error()}
+		var ve *sop.ValidationError
+		switch {
+		case errors.As(err, &ve):
+			status = http.StatusBadRequest
+			body = map[string]any{"error": "invalid sop", "problems": ve.Problems}
+		case errors.Is(err, sop.ErrNotFound):
+			status = http.StatusNotFound
+		case errors.Is(err, sop.ErrDuplicate):
+			status = http.StatusConflict
+		}
+		w.Header().Set("content-type", "application/json")
+		w.WriteHeader(status)
+		_ = json.NewEncoder(w).Encode(body)
+	}
+	decodeSop := func(r *http.Request) (sop.Line, error) {
+		var l sop.Line
+		dec := json.NewDecoder(io.LimitReader(r.Body, 1<<20))
+		dec.DisallowUnknownFields()
+		if err := dec.Decode(&l); err != nil {
+			return l, &sop.ValidationError{Problems: []string{"invalid JSON: " + err.Error()}}
+		}
+		return l, nil
+	}
+	mux.HandleFunc("/sops", func(w http.ResponseWriter, r *http.Request) {
+		if sopRepo == nil {
+			if r.Method != http.MethodGet {
+				http.Error(w, "sop disabled", http.StatusNotFound)
+				return
+			}
+			w.Header().Set("content-type", "application/json")
+			_ = json.NewEncoder(w).Encode(map[string]any{"enabled": false})
+			return
+		}
+		switch r.Method {
+		case http.MethodGet:
+			snap := sopRepo.Snapshot()
+			w.Header().Set("content-type", "application/json")
+			_ = json.NewEncoder(w).Encode(map[string]any{
+				"enabled":    true,
+				"dir":        sopRepo.Dir(),
+				"count":      snap.Count,
+				"files":      snap.Files,
+				"loaded_at":  snap.LoadedAt,
+				"errors":     snap.Errors,
+				"last_error": sopRepo.LastError(),
+				"sops":       snap.Lines,
+			})
+		case http.MethodPost:
+			l, err := decodeSop(r)
+			if err == nil {
+				l, err = sopRepo.Create(r.URL.Query().Get("file"), l)
+			}
+			if err != nil {
+				writeSopError(w, err)
+				return
+			}
+			w.Header().Set("content-type", "application/json")
+			w.Header().Set("Location", "/sops/"+l.SopID)
+			w.WriteHeader(http.StatusCreated)
+			_ = json.NewEncoder(w).Encode(l)
+		default:
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		}
+	})
+	mux.HandleFunc("/sops/", func(w http.ResponseWriter, r *http.Request) {
+		id := strings.TrimPrefix(r.URL.Path, "/sops/")
+		if sopRepo == nil || id == "" || strings.Contains(id, "/") {
+			http.NotFound(w, r)
+			return
+		}
+		var (
+			l   sop.Line
+			err error
+		)
+		switch r.Method {
+		case http.MethodGet:
+			var ok bool
+			if l, ok = sopRepo.Snapshot().Get(id); !ok {
+				err = fmt.Errorf("%w: %s", sop.ErrNotFound, id)
+			}
+		case http.MethodPut:
+			if l, err = decodeSop(r); err == nil {
+				l, err = sopRepo.Update(id, l)
+			}
+		case http.MethodDelete:
+			if err = sopRepo.Delete(id); err == nil {
+				w.WriteHeader(http.StatusNoContent)
+				return
+			}
+		default:
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		if err != nil {
+			writeSopError(w, err)
+			return
+		}
+		w.Header().Set("content-type", "application/json")
+		_ = json.NewEncoder(w).Encode(l)
+	})
+
+	// SOP 匹配试运行：POST /sops/match[?explain=1]，body 为告警 JSON（或 Alertmanager webhook，取首条 firing 告警）。
+	// 只做匹配与模板渲染，不调用 Q
+	mux.HandleFunc("/sops/match", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		if sopRepo == nil {
+			http.Error(w, "sop disabled", http.StatusNotFound)
+			return
+		}
+		raw, err := io.ReadAll(io.LimitReader(r.Body, 10<<20))
+		if err != nil {
+			http.Error(w, "read body: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+		var m map[string]any
+		_ = json.Unmarshal(raw, &m)
+		if alertmanager.Detect(m) {
+			wh, err := alertmanager.Parse(raw)
+			if err != nil {
+				http.Error(w, "invalid alertmanager payload: "+err.Error(), http.StatusBadRequest)
+				return
+			}
+			for _, a := range wh.Alerts {
+				if a.Status != "resolved" {
+					raw, _ = json.Marshal(wh.Flatten(a))
+					break
+				}
+			}
+		}
+		var alert sop.Alert
+		if err := json.Unmarshal(raw, &alert); err != nil || alert.Service == "" {
+			http.Error(w, "body must be an alert JSON with a service field", http.StatusBadRequest)
+			return
+		}
+		explain := r.URL.Query().Get("explain") == "1"
+		snap := sopRepo.Snapshot()
+		match := sop.MatchAlert(snap.Lines, alert, explain)
+		logx.Infof(logx.With(r.Context(), logx.IncidentKey, match.IncidentKey, logx.SopID, match.SopID),
+			"sop: dry-run match expected=%s method=%s", match.ExpectedSopID, match.Method)
+
+		comp := match.Compose(alert, sopCompose)
+		w.Header().Set("content-type", "application/json")
+		if explain {
+			_ = json.NewEncoder(w).Encode(struct {
+				*sop.Match
+				Text     string    `json:"text"`
+				SopIDs   []string  `json:"sop_ids"`
+				Dropped  int       `json:"dropped"`
+				Warnings []string  `json:"warnings,omitempty"`
+				LoadedAt time.Time `json:"sops_loaded_at"`
+			}{match, comp.Text, comp.SopIDs, comp.Dropped, comp.Warnings, snap.LoadedAt})
+			return
+		}
+		_ = json.NewEncoder(w).Encode(map[string]any{
+			"incident_key":    match.IncidentKey,
+			"expected_sop_id": match.ExpectedSopID,
+			"method":          match.Method,
+			"sop_id":          match.SopID,
+			"sop_ids":         comp.SopIDs,
+			"text":            comp.Text,
+			"warnings":        comp.Warnings,
+		})
+	})
+
 	// 工具：读取 body 并尝试解析为 map（容错）
 	readBody := func(r *http.Request) ([]byte, map[string]any, string, error) {
 		b, err := io.ReadAll(r.Body)
@@ -547,8 +663,8 @@ func main() {
 		}
 		return ""
 	}
-	// buildPrompt 返回 (prompt, incident_key, sop_id, error)
-	buildPrompt := func(ctx context.Context, raw []byte, m map[string]any) (string, string, string, error) {
+	// buildPrompt 返回 (prompt, incident_key, sop_id, 参与合并的 sop_ids, error)
+	buildPrompt := func(ctx context.Context, raw []byte, m map[string]any) (string, string, string, []string, error) {
 		// 可调预算与格式选项
 		tdBudget := 2048
 		if v := getenv("QPROXY_TASK_DOC_BUDGET", ""); strings.TrimSpace(v) != "" {
@@ -564,13 +680,13 @@ func main() {
 			go func() { _, _ = stdin.Write(raw); _ = stdin.Close() }()
 			out, err := c.Output()
 			if err != nil {
-				return "", "", "", err
+				return "", "", "", nil, err
 			}
 			p := strings.TrimSpace(string(out))
 			if p == "" {
-				return "", "", "", errors.New("builder returned empty prompt")
+				return "", "", "", nil, errors.New("builder returned empty prompt")
 			}
-			return p, "", "", nil // 外部构建器不返回 incident_key 和 sop_id
+			return p, "", "", nil, nil // 外部构建器不返回 incident_key 和 sop_id
 		}
 
 		// 2. 加载 task instructions（如果存在）
@@ -586,18 +702,22 @@ func main() {
 		}
 
 		// 3. 尝试解析为 Alert 并集成 SOP
-		var alert Alert
+		var alert sop.Alert
 		if err := json.Unmarshal(raw, &alert); err == nil && alert.Service != "" {
 			// 这是一个完整的 Alert，构建包含 SOP + Task Instructions 的 prompt
 
 			// 3.1) 生成 incident_key
-			incidentKey := buildIncidentKey(alert)
+			incidentKey := sop.IncidentKey(alert)
 
 			// 3.2) 加载 SOP 并获取 sop_id
-			sopText := ""
-			sopID := ""
-			if sopEnabled == "1" {
-				sopText, sopID = buildSopContextWithID(alert, sopDir)
+			var sopC sop.Composition
+			if sopRepo != nil {
+				sopC = buildSopContextWithID(ctx, alert, sopRepo, sopCompose)
+				if sopC.Text != "" {
+					metrics.SopMatches.With("hit").Inc()
+				} else {
+					metrics.SopMatches.With("miss").Inc()
+				}
 			}
 
 			// 3.2) 规范化 Alert JSON
@@ -632,12 +752,12 @@ func main() {
 				b.WriteString("\n\n")
 
 				// SOP
-				if sopText != "" {
-					b.WriteString(sopText)
+				if sopC.Text != "" {
+					b.WriteString(sopC.Text)
 					b.WriteString("\n")
 				}
 
-				return b.String(), incidentKey, sopID, nil
+				return b.String(), incidentKey, sopC.SopID, sopC.SopIDs, nil
 			}
 		}
 
@@ -667,56 +787,147 @@ func main() {
 			b.WriteString(userPrompt)
 			b.WriteString("\n")
 
-			return b.String(), "", "", nil // 简单 prompt 不返回 incident_key 和 sop_id
-		}
-
-		return "", "", "", errors.New("no prompt (set QPROXY_PROMPT_BUILDER_CMD or provide Alert JSON or include prompt field)")
-	}
-
-	// 清洗 ANSI/控制字符，避免 spinner/颜色污染响应
-	csi := regexp.MustCompile(`\x1b\[[0-9;?]*[A-Za-z]`)
-	osc := regexp.MustCompile(`\x1b\][^\a]*\x07`)
-	ctrl := regexp.MustCompile(`[\x00-\x08\x0b\x0c\x0e-\x1f]`)     // 保留\t\n\r
-	spinner := regexp.MustCompile(`[⠋⠙⠹⠸⠼⠴⠦⠧⠇⠏]\s*Thinking\.\.\.`) // 清除 spinner 动画
-	// 与旧 HTTP runner 对齐：去除 TUI 前缀（>、!>、\x1b[0m 等）
-	tuiPrefixRE := regexp.MustCompile(`(?m)^(>|!>|\s*\x1b\[0m)+\s*`)
-	cleanText := func(s string) string {
-		s = csi.ReplaceAllString(s, "")
-		s = osc.ReplaceAllString(s, "")
-		s = ctrl.ReplaceAllString(s, "")
-		s = spinner.ReplaceAllString(s, "") // 移除 spinner
-		// 解码常见的 JSON unicode 转义（与旧 HTTP runner 对齐）
-		s = strings.ReplaceAll(s, "\\u003e", ">")
-		s = strings.ReplaceAll(s, "\\u003c", "<")
-		s = strings.ReplaceAll(s, "\\u0026", "&")
-		s = strings.ReplaceAll(s, "\\u0022", "\"")
-		s = strings.ReplaceAll(s, "\\u0027", "'")
-		// 去除每行开头的 TUI 前缀
-		s = tuiPrefixRE.ReplaceAllString(s, "")
-		// 归一化换行
-		s = strings.ReplaceAll(s, "\r\n", "\n")
-		s = strings.ReplaceAll(s, "\r", "\n")
-		// 压缩多个连续换行为最多2个
-		for strings.Contains(s, "\n\n\n") {
-			s = strings.ReplaceAll(s, "\n\n\n", "\n\n")
-		}
-		// 去除多余首尾空白
-		return strings.TrimSpace(s)
-	}
-
-	mux.HandleFunc("/incident", func(w http.ResponseWriter, r *http.Request) {
-		if r.Method != http.MethodPost {
-			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
-			return
+			return b.String(), "", "", nil, nil // 简单 prompt 不返回 incident_key 和 sop_id
 		}
-		raw, m, ct, err := readBody(r)
-		if err != nil {
-			http.Error(w, "read body: "+err.Error(), http.StatusBadRequest)
+
+		return "", "", "", nil, errors.New("no prompt (set QPROXY_PROMPT_BUILDER_CMD or provide Alert JSON or include prompt field)")
+	}
+
+	// 清洗 ANSI/控制字符，避免 spinner/颜色污染响应（实现见 qflow.CleanText，qproxy replay 共用）
+	cleanText := qflow.CleanText
+	cleanTextCtx := func(ctx context.Context, s string) string {
+		_, sp := tracing.Start(ctx, "cleanText", tracing.Attr{Key: "raw_len", Value: len(s)})
+		out := cleanText(s)
+		sp.SetAttr("cleaned_len", len(out))
+		sp.End()
+		return out
+	}
+
+	// 去重：同一 incident_key 且 prompt 相同的重复请求合并到同一次运行，完成后 TTL 内直接返回缓存（force 跳过）；
+	// 合并的运行不随任何一个请求取消，上限与请求超时相同（5 分钟）
+	dedupTTL := 5 * time.Minute
+	if v, err := strconv.Atoi(getenv("QPROXY_DEDUP_TTL_SEC", "")); err == nil {
+		dedupTTL = time.Duration(v) * time.Second
+	}
+	dd := dedup.New(dedupTTL, 5*time.Minute)
+
+	// 事件历史：每次处理（含失败、缓存命中）追加一条记录，原始回答单独存文件；GET /incidents 查询
+	var hist *history.Store
+	if getenv("QPROXY_HISTORY_ENABLED", "1") != "0" {
+		retention := 30 * 24 * time.Hour
+		if v, err := strconv.Atoi(getenv("QPROXY_HISTORY_RETENTION_DAYS", "")); err == nil {
+			retention = time.Duration(v) * 24 * time.Hour
+		}
+		histDir := getenv("QPROXY_HISTORY_DIR", filepath.Join(root, "_history"))
+		if hist, err = history.Open(histDir, retention); err != nil {
+			log.Fatalf("history init failed: %v", err)
+		}
+		log.Printf("incident-worker: incident history in %s (retention=%v)", histDir, retention)
+	}
+	recordIncident := func(ctx context.Context, in runner.IncidentInput, res *runner.Result, src dedup.Source, err error, latency time.Duration) {
+		if hist == nil {
 			return
 		}
+		sum := sha1.Sum([]byte(in.Prompt))
+		rec := history.Record{
+			IncidentKey: in.IncidentKey,
+			Service:     in.Service,
+			SopID:       in.SopID,
+			SopIDs:      in.SopIDs,
+			RequestID:   logx.Field(ctx, logx.RequestID),
+			TraceID:     logx.Field(ctx, logx.TraceID),
+			PromptSHA1:  hex.EncodeToString(sum[:]),
+			PromptLen:   len(in.Prompt),
+			LatencyMS:   latency.Milliseconds(),
+		}
+		if rec.SopID == "" {
+			rec.SopID = orc.SopIDFor(in.IncidentKey)
+		}
+		if src != dedup.Fresh {
+			rec.Dedup = string(src)
+		}
+		answer := ""
+		switch {
+		case err != nil:
+			e := qerr.BodyOf(err)
+			rec.Outcome, rec.ErrorCode, rec.Error = history.OutcomeFailed, e.Code, e.Error
+		case res != nil:
+			answer = res.Answer
+			rec.Outcome = history.OutcomeSucceeded
+			if !res.Valid {
+				rec.Outcome = history.OutcomeInvalid
+			}
+			rec.Valid, rec.RepairAttempts = res.Valid, res.RepairAttempts
+			if res.Parsed != nil {
+				rec.RootCause = res.Parsed.RootCause
+				c := res.Parsed.Confidence
+				rec.Confidence = &c
+			}
+		}
+		if e := hist.Append(&rec, answer); e != nil {
+			logx.Warnf(ctx, "history: append failed: %v", e)
+		}
+	}
+	process := func(ctx context.Context, in runner.IncidentInput, force bool) (*runner.Result, dedup.Source, error) {
+		// 通过 rejectDraining 后才进入排空的请求在此拒绝，避免排空结束、会话关闭后才开始 /load /save
+		done, ok := inflight.Begin()
+		if !ok {
+			return nil, dedup.Fresh, drain.ErrDraining
+		}
+		defer done()
+		ctx = logx.With(ctx, logx.IncidentKey, in.IncidentKey)
+		t0 := time.Now()
+		res, src, err := dd.Do(ctx, dedup.Key(in), force, func(ctx context.Context) (*runner.Result, error) {
+			// 等待方可能先于执行返回（断开/超时），执行本身单独计入进行中的处理
+			done, ok := inflight.Begin()
+			if !ok {
+				return nil, drain.ErrDraining
+			}
+			defer done()
+			return orc.ProcessResult(ctx, in)
+		})
+		if src != dedup.Fresh {
+			metrics.DedupHits.With(string(src)).Inc()
+			logx.Infof(ctx, "dedup: %s result", src)
+		}
+		recordIncident(ctx, in, res, src, err, time.Since(t0))
+		return res, src, err
+	}
 
-		// 兼容 text/plain：整个 body 即 prompt
+	// 异步 job：POST /jobs 立即返回 job ID，GET /jobs/{id} 轮询状态；
+	// job 持久化在 $QPROXY_CONV_ROOT/_jobs 下，重启后未完成的 job 会重新排队
+	jobWorkers := n
+	if v, err := strconv.Atoi(getenv("QPROXY_JOB_WORKERS", "")); err == nil && v > 0 {
+		jobWorkers = v
+	}
+	jobRetention := 72 * time.Hour
+	if v, err := strconv.Atoi(getenv("QPROXY_JOB_RETENTION_HOURS", "")); err == nil {
+		jobRetention = time.Duration(v) * time.Hour
+	}
+	jm, err := jobs.NewManager(jobs.Options{
+		Dir:       getenv("QPROXY_JOB_DIR", filepath.Join(root, "_jobs")),
+		Workers:   jobWorkers,
+		Timeout:   5 * time.Minute,
+		Retention: jobRetention,
+		// callback_url 主机白名单（逗号分隔，支持 *.domain）；未配置时拒绝回调到内部地址
+		CallbackAllowHosts: strings.FieldsFunc(getenv("QPROXY_CALLBACK_ALLOW_HOSTS", ""), func(r rune) bool { return r == ',' || r == ' ' }),
+	}, func(ctx context.Context, in runner.IncidentInput) (*runner.Result, error) {
+		res, _, err := process(ctx, in, false)
+		if err != nil {
+			return nil, err
+		}
+		// 去重缓存的 Result 为多个请求共享，复制后再替换回答
+		out := *res
+		out.Answer = cleanTextCtx(ctx, res.Answer)
+		return &out, nil
+	})
+	if err != nil {
+		log.Fatalf("jobs init failed: %v", err)
+	}
+	// parseIncident 把请求体解析为 IncidentInput（/incident、/jobs、/alertmanager 共用）
+	parseIncident := func(ctx context.Context, raw []byte, m map[string]any, ct string) (runner.IncidentInput, error) {
 		var in runner.IncidentInput
+		// 兼容 text/plain：整个 body 即 prompt
 		if strings.HasPrefix(ct, "text/plain") && len(raw) > 0 {
 			in.Prompt = string(raw)
 			if m != nil {
@@ -725,10 +936,15 @@ func main() {
 		} else {
 			// 尝试灵活解析
 			if m != nil {
-				if ptxt, incidentKey, sopID, err := buildPrompt(r.Context(), raw, m); err == nil {
+				bctx, sp := tracing.Start(ctx, "buildPrompt")
+				ptxt, incidentKey, sopID, sopIDs, err := buildPrompt(bctx, raw, m)
+				sp.RecordError(err)
+				sp.End()
+				if err == nil {
 					in.Prompt = ptxt
 					in.IncidentKey = incidentKey // 使用 buildPrompt 返回的 incident_key
 					in.SopID = sopID             // 设置 sop_id（如果有）
+					in.SopIDs = sopIDs           // 参与合并的 SOP
 					// 如果 buildPrompt 没有返回 incident_key，尝试从 JSON 中提取
 					if in.IncidentKey == "" {
 						in.IncidentKey = extractIncidentKey(m)
@@ -754,9 +970,153 @@ func main() {
 		}
 
 		if strings.TrimSpace(in.IncidentKey) == "" || strings.TrimSpace(in.Prompt) == "" {
-			http.Error(w, "incident_key and prompt required", http.StatusBadRequest)
+			return in, qerr.Errorf(qerr.ErrBadInput, "incident_key and prompt required")
+		}
+		if m != nil {
+			in.Service, _ = digStr(m, "service")
+		}
+		return in, nil
+	}
+
+	// handleAlertmanager 处理 Alertmanager webhook v4：每条 firing 告警展开为一个 incident，
+	// 并发处理（上限为池大小），结果按 groupKey 汇总返回；resolved 告警跳过。
+	// ?async=1 时改为提交 job 并立即返回 job ID（Alertmanager 默认 webhook 超时较短）。
+	handleAlertmanager := func(w http.ResponseWriter, r *http.Request, raw []byte) {
+		wh, err := alertmanager.Parse(raw)
+		if err != nil {
+			http.Error(w, "invalid alertmanager payload: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+		async := r.URL.Query().Get("async") == "1"
+		force := r.URL.Query().Get("force") == "1"
+		callbackURL := r.URL.Query().Get("callback_url")
+		// 与 /jobs 相同的校验；不合法时整批拒绝，而不是每条告警各自失败
+		if callbackURL != "" {
+			if err := jm.ValidateCallbackURL(callbackURL); err != nil {
+				qerr.WriteHTTP(w, err)
+				return
+			}
+		}
+
+		type alertResult struct {
+			Fingerprint string   `json:"fingerprint,omitempty"`
+			AlertName   string   `json:"alertname,omitempty"`
+			Status      string   `json:"status"` // succeeded/failed/skipped/queued
+			IncidentKey string   `json:"incident_key,omitempty"`
+			SopID       string   `json:"sop_id,omitempty"`
+			SopIDs      []string `json:"sop_ids,omitempty"`
+			JobID       string   `json:"job_id,omitempty"`
+			Answer      string   `json:"answer,omitempty"`
+			Cached      bool     `json:"cached,omitempty"`
+			Error       string   `json:"error,omitempty"`
+			Code        string   `json:"code,omitempty"` // 失败时的错误码（见 qerr）
+			Retryable   bool     `json:"retryable,omitempty"`
+		}
+		results := make([]alertResult, len(wh.Alerts))
+		logx.Infof(r.Context(), "alertmanager: received group_key=%s status=%s alerts=%d async=%v",
+			wh.GroupKey, wh.Status, len(wh.Alerts), async)
+
+		sem := make(chan struct{}, n)
+		var wg sync.WaitGroup
+		for i, a := range wh.Alerts {
+			res := &results[i]
+			res.Fingerprint = a.Fingerprint
+			res.AlertName = a.Labels["alertname"]
+			if a.Status == "resolved" {
+				res.Status = "skipped"
+				continue
+			}
+			flat := wh.Flatten(a)
+			b, _ := json.Marshal(flat)
+			var fm map[string]any
+			_ = json.Unmarshal(b, &fm)
+			in, err := parseIncident(r.Context(), b, fm, "application/json")
+			if err != nil {
+				res.Status = "failed"
+				e := qerr.BodyOf(err)
+				res.Error, res.Code, res.Retryable = e.Error, e.Code, e.Retryable
+				continue
+			}
+			res.IncidentKey, res.SopID, res.SopIDs = in.IncidentKey, in.SopID, in.SopIDs
+			if async {
+				j, err := jm.SubmitContext(r.Context(), in, callbackURL)
+				if err != nil {
+					res.Status = "failed"
+					e := qerr.BodyOf(err)
+					res.Error, res.Code, res.Retryable = e.Error, e.Code, e.Retryable
+					continue
+				}
+				res.Status, res.JobID = string(j.Status), j.ID
+				continue
+			}
+			wg.Add(1)
+			go func(res *alertResult, in runner.IncidentInput) {
+				defer wg.Done()
+				sem <- struct{}{}
+				defer func() { <-sem }()
+				ctx, cancel := context.WithTimeout(logx.With(r.Context(), logx.IncidentKey, in.IncidentKey, logx.SopID, in.SopID), 5*time.Minute)
+				defer cancel()
+				out, src, err := process(ctx, in, force)
+				if err != nil {
+					logx.Warnf(ctx, "alertmanager: processing failed: %v", err)
+					res.Status = "failed"
+					e := qerr.BodyOf(err)
+					res.Error, res.Code, res.Retryable = e.Error, e.Code, e.Retryable
+					return
+				}
+				res.Status = "succeeded"
+				res.Answer = cleanTextCtx(ctx, out.Answer)
+				res.Cached = src == dedup.Cached
+			}(res, in)
+		}
+		wg.Wait()
+
+		w.Header().Set("content-type", "application/json")
+		_ = json.NewEncoder(w).Encode(map[string]any{
+			"groupKey": wh.GroupKey,
+			"status":   wh.Status,
+			"receiver": wh.Receiver,
+			"results":  results,
+		})
+	}
+	mux.HandleFunc("/alertmanager", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		raw, _, _, err := readBody(r)
+		if err != nil {
+			http.Error(w, "read body: "+err.Error(), http.StatusBadRequest)
 			return
 		}
+		handleAlertmanager(w, r, raw)
+	})
+
+	// /incident?stream=1 或 /incident/stream：以 SSE 推送 Q 的输出帧，最后推送结果
+	handleIncident := func(w http.ResponseWriter, r *http.Request) {
+		stream := r.URL.Path == "/incident/stream" || r.URL.Query().Get("stream") == "1"
+		if r.Method != http.MethodPost {
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		raw, m, ct, err := readBody(r)
+		if err != nil {
+			http.Error(w, "read body: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+		// 自动识别 Alertmanager webhook（可直接把 Alertmanager 指向 /incident）
+		if !stream && alertmanager.Detect(m) {
+			handleAlertmanager(w, r, raw)
+			return
+		}
+		in, err := parseIncident(r.Context(), raw, m, ct)
+		if err != nil {
+			qerr.WriteHTTP(w, err)
+			return
+		}
+
+		ctx, cancel := context.WithTimeout(logx.With(r.Context(), logx.IncidentKey, in.IncidentKey, logx.SopID, in.SopID), 5*time.Minute)
+		defer cancel()
 
 		// 记录收到的请求（含 prompt 指纹）
 		sum := sha1.Sum([]byte(in.Prompt))
@@ -764,8 +1124,7 @@ func main() {
 		if len(phash) > 12 {
 			phash = phash[:12]
 		}
-		log.Printf("incident: received request - incident_key=%s, sop_id=%s, prompt_len=%d, prompt_sha1=%s",
-			in.IncidentKey, in.SopID, len(in.Prompt), phash)
+		logx.Infof(ctx, "incident: received request - prompt_len=%d, prompt_sha1=%s", len(in.Prompt), phash)
 
 		// 保存完整的 prompt 到日志（默认关闭；QPROXY_LOG_PAYLOAD=1 时开启，截断 2048B）
 		if getenv("QPROXY_LOG_PAYLOAD", "0") == "1" {
@@ -773,13 +1132,88 @@ func main() {
 			if len(pl) > 2048 {
 				pl = pl[:2048] + "\n..."
 			}
-			log.Printf("=== PROMPT START (incident_key=%s, sop_id=%s) ===", in.IncidentKey, in.SopID)
-			log.Printf("%s", pl)
-			log.Printf("=== PROMPT END ===")
+			logx.Infof(ctx, "incident: prompt:\n%s", pl)
 		}
 
-		ctx, cancel := context.WithTimeout(r.Context(), 5*time.Minute)
-		defer cancel()
+		var sse *sseWriter
+		if stream {
+			var ok bool
+			if sse, ok = newSSEWriter(w); !ok {
+				http.Error(w, "streaming not supported", http.StatusInternalServerError)
+				return
+			}
+			_ = sse.Event("start", map[string]any{"incident_key": in.IncidentKey, "sop_id": in.SopID, "sop_ids": in.SopIDs})
+			// 每个 OUTPUT 帧去掉 ANSI 后立即推送；跨帧的 ESC 序列与 UTF-8 字符拼齐后再清洗
+			term := &qflow.TermStream{}
+			ctx = ttyd.WithOutputFunc(ctx, func(data []byte) {
+				if t := term.Write(data); t != "" {
+					_ = sse.Event("output", map[string]string{"text": t})
+				}
+			})
+			// 长时间无输出（MCP 工具运行中）时发送注释帧，避免代理断开
+			stopKeepAlive := sse.KeepAlive(15 * time.Second)
+			defer stopKeepAlive()
+		}
+
+		fail := func(err error) {
+			logx.Warnf(ctx, "incident: processing failed: %v", err)
+			if sse != nil {
+				_ = sse.Event("error", qerr.BodyOf(err))
+				return
+			}
+			qerr.WriteHTTP(w, err)
+		}
+		force := r.URL.Query().Get("force") == "1"
+		if v, ok := m["force"].(bool); ok && v {
+			force = true
+		}
+		reply := func(res *runner.Result, src dedup.Source) {
+			out := res.Answer
+			cleanedOut := cleanTextCtx(ctx, out)
+			rsum := sha1.Sum([]byte(cleanedOut))
+			rhash := hex.EncodeToString(rsum[:])
+			if len(rhash) > 12 {
+				rhash = rhash[:12]
+			}
+			logx.Infof(ctx, "incident: processing completed, raw_response_len=%d, cleaned_len=%d, response_sha1=%s",
+				len(out), len(cleanedOut), rhash)
+
+			// 保存完整的 response 到日志（默认关闭；QPROXY_LOG_PAYLOAD=1 时开启，截断 2048B）
+			if getenv("QPROXY_LOG_PAYLOAD", "0") == "1" {
+				ro := cleanedOut
+				if len(ro) > 2048 {
+					ro = ro[:2048] + "\n..."
+				}
+				logx.Infof(ctx, "incident: response:\n%s", ro)
+			}
+
+			body := map[string]any{
+				"answer":          cleanedOut,
+				"result":          res.Parsed,
+				"valid":           res.Valid,
+				"repair_attempts": res.RepairAttempts,
+				"incident_key":    in.IncidentKey,
+				"sop_id":          in.SopID,
+				"sop_ids":         in.SopIDs,
+			}
+			switch src {
+			case dedup.Cached:
+				body["cached"] = true
+			case dedup.Inflight:
+				body["coalesced"] = true
+			}
+			if len(res.ValidationErrors) > 0 {
+				body["validation_errors"] = res.ValidationErrors
+			}
+			if sse != nil {
+				if js, ok := extractJSONObject(cleanedOut); ok {
+					body["json"] = js
+				}
+				_ = sse.Event("result", body)
+				return
+			}
+			_ = json.NewEncoder(w).Encode(body)
+		}
 
 		// 若设置 QPROXY_CPU_PROFILE_SEC，临时采样 CPU（避免容器挂之前拿不到 profile）
 		if secStr := getenv("QPROXY_CPU_PROFILE_SEC", ""); strings.TrimSpace(secStr) != "" {
@@ -795,54 +1229,147 @@ func main() {
 					// 采样 sec 秒，不阻塞主路径：通过 context.WithTimeout 来包裹 Process
 					procCtx, cancelProc := context.WithTimeout(ctx, time.Duration(sec)*time.Second)
 					defer cancelProc()
-					out, err := orc.Process(procCtx, in)
+					res, src, err := process(procCtx, in, force)
 					if err != nil {
-						log.Printf("incident: processing failed for %s: %v", in.IncidentKey, err)
-						http.Error(w, fmt.Sprintf("process error: %v", err), http.StatusBadGateway)
+						fail(err)
 						return
 					}
-					cleanedOut := cleanText(out)
-					rsum := sha1.Sum([]byte(cleanedOut))
-					rhash := hex.EncodeToString(rsum[:])
-					if len(rhash) > 12 {
-						rhash = rhash[:12]
-					}
-					log.Printf("incident: processing completed for %s, raw_response_len=%d, cleaned_len=%d, response_sha1=%s",
-						in.IncidentKey, len(out), len(cleanedOut), rhash)
-					_ = json.NewEncoder(w).Encode(map[string]any{"answer": cleanedOut})
+					reply(res, src)
 					return
 				}
 			}
 		}
 
-		out, err := orc.Process(ctx, in)
+		res, src, err := process(ctx, in, force)
 		if err != nil {
-			log.Printf("incident: processing failed for %s: %v", in.IncidentKey, err)
-			http.Error(w, fmt.Sprintf("process error: %v", err), http.StatusBadGateway)
+			fail(err)
 			return
 		}
+		reply(res, src)
+	}
+	mux.HandleFunc("/incident", handleIncident)
+	mux.HandleFunc("/incident/stream", handleIncident)
 
-		cleanedOut := cleanText(out)
-		rsum := sha1.Sum([]byte(cleanedOut))
-		rhash := hex.EncodeToString(rsum[:])
-		if len(rhash) > 12 {
-			rhash = rhash[:12]
+	writeJob := func(w http.ResponseWriter, status int, j jobs.Job) {
+		w.Header().Set("content-type", "application/json")
+		w.WriteHeader(status)
+		_ = json.NewEncoder(w).Encode(j.Redacted())
+	}
+	mux.HandleFunc("/jobs", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
 		}
-		log.Printf("incident: processing completed for %s, raw_response_len=%d, cleaned_len=%d, response_sha1=%s",
-			in.IncidentKey, len(out), len(cleanedOut), rhash)
-
-		// 保存完整的 response 到日志（默认关闭；QPROXY_LOG_PAYLOAD=1 时开启，截断 2048B）
-		if getenv("QPROXY_LOG_PAYLOAD", "0") == "1" {
-			ro := cleanedOut
-			if len(ro) > 2048 {
-				ro = ro[:2048] + "\n..."
+		raw, m, ct, err := readBody(r)
+		if err != nil {
+			http.Error(w, "read body: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+		in, err := parseIncident(r.Context(), raw, m, ct)
+		if err != nil {
+			qerr.WriteHTTP(w, err)
+			return
+		}
+		callbackURL := r.URL.Query().Get("callback_url")
+		if callbackURL == "" && m != nil {
+			callbackURL, _ = digStr(m, "callback_url")
+		}
+		if callbackURL != "" {
+			if err := jm.ValidateCallbackURL(callbackURL); err != nil {
+				qerr.WriteHTTP(w, err)
+				return
 			}
-			log.Printf("=== RESPONSE START (incident_key=%s, sop_id=%s) ===", in.IncidentKey, in.SopID)
-			log.Printf("%s", ro)
-			log.Printf("=== RESPONSE END ===")
 		}
+		j, err := jm.SubmitContext(r.Context(), in, callbackURL)
+		if err != nil {
+			qerr.WriteHTTP(w, err)
+			return
+		}
+		w.Header().Set("Location", "/jobs/"+j.ID)
+		writeJob(w, http.StatusAccepted, j)
+	})
+	mux.HandleFunc("/jobs/", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		id := strings.Trim(strings.TrimPrefix(r.URL.Path, "/jobs/"), "/")
+		j, ok := jm.Get(id)
+		if !ok {
+			http.Error(w, "job not found", http.StatusNotFound)
+			return
+		}
+		writeJob(w, http.StatusOK, j)
+	})
 
-		_ = json.NewEncoder(w).Encode(map[string]any{"answer": cleanedOut})
+	// GET /incidents?service=&sop_id=&incident_key=&outcome=&since=&until=&limit=：事件历史（最新在前，不含回答正文）
+	// GET /incidents/{id}：单条记录与原始回答
+	mux.HandleFunc("/incidents", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		if hist == nil {
+			http.Error(w, "history disabled", http.StatusNotFound)
+			return
+		}
+		qv := r.URL.Query()
+		now := time.Now()
+		since, err := history.ParseSince(qv.Get("since"), now)
+		if err != nil {
+			qerr.WriteHTTP(w, qerr.Errorf(qerr.ErrBadInput, "since: %v", err))
+			return
+		}
+		until, err := history.ParseSince(qv.Get("until"), now)
+		if err != nil {
+			qerr.WriteHTTP(w, qerr.Errorf(qerr.ErrBadInput, "until: %v", err))
+			return
+		}
+		limit, _ := strconv.Atoi(qv.Get("limit"))
+		recs, err := hist.List(history.Query{
+			Service:     qv.Get("service"),
+			SopID:       qv.Get("sop_id"),
+			IncidentKey: qv.Get("incident_key"),
+			Outcome:     qv.Get("outcome"),
+			Since:       since,
+			Until:       until,
+			Limit:       limit,
+		})
+		if err != nil {
+			qerr.WriteHTTP(w, err)
+			return
+		}
+		w.Header().Set("content-type", "application/json")
+		_ = json.NewEncoder(w).Encode(map[string]any{"count": len(recs), "incidents": recs})
+	})
+	mux.HandleFunc("/incidents/", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		if hist == nil {
+			http.Error(w, "history disabled", http.StatusNotFound)
+			return
+		}
+		id := strings.Trim(strings.TrimPrefix(r.URL.Path, "/incidents/"), "/")
+		rec, err := hist.Get(id)
+		if errors.Is(err, history.ErrNotFound) {
+			http.Error(w, "incident not found", http.StatusNotFound)
+			return
+		}
+		if err != nil {
+			qerr.WriteHTTP(w, err)
+			return
+		}
+		answer, err := hist.Answer(rec)
+		if err != nil {
+			logx.Warnf(r.Context(), "history: read answer %s: %v", rec.AnswerPath, err)
+		}
+		w.Header().Set("content-type", "application/json")
+		_ = json.NewEncoder(w).Encode(struct {
+			history.Record
+			Answer string `json:"answer"`
+		}{rec, answer})
 	})
 
 	// 可选开启 pprof（在独立端口上使用 DefaultServeMux）
@@ -856,9 +1383,118 @@ func main() {
 		}()
 	}
 
+	// API 鉴权（Bearer token 文件 / HMAC 签名）+ 按客户端限流；健康检查与指标免鉴权
+	guard, err := httpauth.New(httpauth.OptionsFromEnv([]string{"/healthz", "/readyz", "/metrics"}))
+	if err != nil {
+		log.Fatalf("http auth init failed: %v", err)
+	}
+	if !guard.AuthEnabled() {
+		log.Printf("incident-worker: WARNING http api auth disabled (set QPROXY_AUTH_TOKEN_FILE or QPROXY_AUTH_HMAC_SECRET_FILE)")
+	}
+
+	// 请求 ID：沿用 X-Request-ID（需为可打印字符且不超过 128 字节），否则生成；写回响应头并经 context 传到各层日志
+	withRequestID := func(h http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			id := strings.TrimSpace(r.Header.Get("X-Request-ID"))
+			if id == "" || len(id) > 128 || strings.IndexFunc(id, func(c rune) bool { return c <= ' ' || c > '~' }) >= 0 {
+				id = logx.NewID("req")
+			}
+			w.Header().Set("X-Request-ID", id)
+			h.ServeHTTP(w, r.WithContext(logx.With(r.Context(), logx.RequestID, id)))
+		})
+	}
+
+	// 追踪：每个请求一个 server span，父 span 取自请求头 traceparent；trace_id 写入日志字段
+	withTrace := func(h http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			switch r.URL.Path {
+			case "/metrics", "/healthz", "/readyz":
+				h.ServeHTTP(w, r)
+				return
+			}
+			ctx := r.Context()
+			if sc, err := tracing.ParseTraceparent(r.Header.Get("traceparent")); err == nil {
+				ctx = tracing.WithRemote(ctx, sc)
+			}
+			ctx, sp := tracing.StartKind(ctx, r.Method+" "+r.URL.Path, tracing.KindServer,
+				tracing.Attr{Key: "http.method", Value: r.Method},
+				tracing.Attr{Key: "http.target", Value: r.URL.Path},
+				tracing.Attr{Key: "request_id", Value: logx.Field(ctx, logx.RequestID)})
+			if sp == nil {
+				h.ServeHTTP(w, r)
+				return
+			}
+			ctx = logx.With(ctx, logx.TraceID, sp.Context().TraceID.String())
+			sw := &statusWriter{ResponseWriter: w, status: http.StatusOK}
+			h.ServeHTTP(sw, r.WithContext(ctx))
+			sp.SetAttr("http.status_code", sw.status)
+			if sw.status >= 500 {
+				sp.RecordError(fmt.Errorf("HTTP %d", sw.status))
+			}
+			sp.End()
+		})
+	}
+
+	// 排空期间拒绝新的 incident（/incident、/incident/stream、/jobs、/alertmanager 的 POST）
+	rejectDraining := func(h http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if r.Method == http.MethodPost && inflight.Draining() {
+				switch r.URL.Path {
+				case "/incident", "/incident/stream", "/jobs", "/alertmanager":
+					w.Header().Set("Retry-After", "5")
+					http.Error(w, "shutting down", http.StatusServiceUnavailable)
+					return
+				}
+			}
+			h.ServeHTTP(w, r)
+		})
+	}
+
 	addr := getenv("QPROXY_HTTP_ADDR", ":8080")
-	log.Printf("incident-worker listening on %s (ws=%s noauth=%v)", addr, wsURL, noauth)
-	if err := http.ListenAndServe(addr, mux); err != nil {
-		log.Fatalf("http serve: %v", err)
+	srv := &http.Server{Addr: addr, Handler: withRequestID(withTrace(guard.Wrap(rejectDraining(mux))))}
+	go func() {
+		log.Printf("incident-worker listening on %s (ws=%s noauth=%v)", addr, wsURL, noauth)
+		if err := srv.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+			log.Fatalf("http serve: %v", err)
+		}
+	}()
+
+	// 优雅关闭：SIGTERM/SIGINT 后 /readyz 返回 503 并拒绝新 incident，等待进行中的处理
+	// （含 /save）与执行中的 job 完成，超时后仍继续关闭；最后关闭 HTTP 服务与池中所有会话
+	shutdownTO := 60 * time.Second
+	if v, err := strconv.Atoi(getenv("QPROXY_SHUTDOWN_TIMEOUT_SEC", "")); err == nil && v >= 0 {
+		shutdownTO = time.Duration(v) * time.Second
+	}
+	sigCh := make(chan os.Signal, 1)
+	signal.Notify(sigCh, syscall.SIGINT, syscall.SIGTERM)
+	sig := <-sigCh
+	signal.Stop(sigCh)
+	log.Printf("incident-worker: received %v, draining (in_flight=%d timeout=%v)", sig, inflight.InFlight(), shutdownTO)
+	inflight.Start()
+
+	sctx, cancel := context.WithTimeout(context.Background(), shutdownTO)
+	defer cancel()
+	if err := jm.Shutdown(sctx); err != nil {
+		log.Printf("incident-worker: running jobs did not finish: %v (they will be requeued on restart)", err)
+	}
+	if err := inflight.Wait(sctx); err != nil {
+		log.Printf("incident-worker: %d request(s) still in flight at deadline: %v", inflight.InFlight(), err)
+	}
+	// SSE/长请求在此之后仍未结束的，强制关闭
+	hctx, hcancel := context.WithTimeout(context.Background(), 5*time.Second)
+	if err := srv.Shutdown(hctx); err != nil {
+		log.Printf("incident-worker: http shutdown: %v", err)
+		_ = srv.Close()
+	}
+	hcancel()
+	_ = p.Close()
+	if sopRepo != nil {
+		sopRepo.Close()
+	}
+	tctx, tcancel := context.WithTimeout(context.Background(), 5*time.Second)
+	if err := tracing.Shutdown(tctx); err != nil {
+		log.Printf("incident-worker: tracing shutdown: %v", err)
 	}
+	tcancel()
+	log.Printf("incident-worker: shutdown complete")
 }
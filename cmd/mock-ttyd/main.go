@@ -1,6 +1,7 @@
 package main
 
 import (
+	"bytes"
 	"context"
 	"crypto/subtle"
 	"encoding/base64"
@@ -8,15 +9,32 @@ import (
 	"flag"
 	"fmt"
 	"log"
+	"math/rand"
 	"net/http"
 	"os"
 	"path/filepath"
+	"regexp"
 	"strings"
+	"sync/atomic"
 	"time"
 
+	"aiops-qproxy/internal/transcript"
+
 	"github.com/gorilla/websocket"
 )
 
+/*
+ mock-ttyd：按 ttyd 1.7 协议模拟 "ttyd + q chat"
+
+ 客户端 → 服务端：首帧 JSON hello {"AuthToken","columns","rows"}；之后为带类型前缀的消息
+   '0' INPUT（按键输入）、'1' RESIZE_TERMINAL（{"columns","rows"}）、'2' PAUSE、'3' RESUME
+ 服务端 → 客户端：'0' OUTPUT（二进制帧）、'1' SET_WINDOW_TITLE、'2' SET_PREFERENCES
+
+ 输入按终端行编辑处理：回显按键，'\r' 提交，'\n'（Ctrl-J）在 prompt 中换行，Ctrl-C 中断，Ctrl-D 退出。
+ -user/-pass 为空时不鉴权（同 ttyd 不带 -c）；设置后 /token 需 Basic 认证并返回 base64(user:pass)，
+ hello 中的 AuthToken（或握手的 Basic 头）不匹配时以 1008 关闭连接。
+*/
+
 type conv struct {
 	History []string `json:"history"`
 }
@@ -27,15 +45,122 @@ type sessionState struct {
 	root    string
 }
 
+// rule 是 -script 中的一条规则：prompt 匹配 match（正则）时使用该规则的回答/延迟/配额行为
+type rule struct {
+	Match   string `json:"match"`
+	Answer  string `json:"answer"`
+	Latency string `json:"latency"` // 如 "3s"，为空时用 -latency
+	Quota   bool   `json:"quota"`   // 返回配额耗尽提示
+
+	re      *regexp.Regexp
+	latency time.Duration
+}
+
+type config struct {
+	answered int64 // 已回答的 prompt 数（所有连接共享，模拟账号级配额）；首字段保证 32 位平台 atomic 对齐
+
+	root       string
+	credential string // base64(user:pass)，为空表示不鉴权
+	title      string
+	startup    time.Duration
+	latency    time.Duration
+	jitter     time.Duration
+	chunk      int
+	spinner    bool
+	quotaAfter int64
+	rules      []rule
+}
+
+const (
+	promptStr    = "\x1b[35m> \x1b[39m"
+	quotaMessage = "\x1b[31mYou've reached the monthly request limit for Amazon Q Developer. Please try again next month.\x1b[0m"
+)
+
+var spinnerFrames = []string{"⠋", "⠙", "⠹", "⠸", "⠼", "⠴", "⠦", "⠧", "⠇", "⠏"}
+
 func main() {
 	addr := flag.String("addr", ":7682", "listen address")
-	user := flag.String("user", "demo", "basic auth user")
-	pass := flag.String("pass", "password123", "basic auth pass")
+	user := flag.String("user", "", "credential user (empty = no auth, like ttyd without -c)")
+	pass := flag.String("pass", "", "credential password")
 	root := flag.String("root", "/tmp/conversations", "conversation root")
+	title := flag.String("title", "q chat (mock-ttyd)", "window title sent after hello")
+	startup := flag.Duration("startup", 0, "delay before the first prompt (MCP server initialisation)")
+	latency := flag.Duration("latency", 500*time.Millisecond, "think time before each answer")
+	jitter := flag.Duration("jitter", 0, "random extra think time, up to this value")
+	chunk := flag.Int("chunk", 0, "split output into frames of at most N bytes (may split ANSI and UTF-8); 0 = one frame per write")
+	spinner := flag.Bool("spinner", true, "emit the ⠋ Thinking... spinner while thinking")
+	quotaAfter := flag.Int64("quota-after", 0, "answer N prompts, then report the monthly limit as reached (0 = never)")
+	script := flag.String("script", "", `JSON rules file: [{"match":"(?i)cpu","answer":"...","latency":"3s","quota":false}]`)
+	replayPath := flag.String("replay", "", "replay a recorded transcript (QPROXY_RECORD_DIR) instead of the mock q chat")
+	replaySpeed := flag.Float64("replay-speed", 1, "replay speed: 0 = no delay, 1 = recorded frame timing")
 	flag.Parse()
 
 	_ = os.MkdirAll(*root, 0o755)
 
+	cfg := &config{
+		root:       *root,
+		title:      *title,
+		startup:    *startup,
+		latency:    *latency,
+		jitter:     *jitter,
+		chunk:      *chunk,
+		spinner:    *spinner,
+		quotaAfter: *quotaAfter,
+	}
+	if *user != "" || *pass != "" {
+		cfg.credential = base64.StdEncoding.EncodeToString([]byte(*user + ":" + *pass))
+	}
+	if *script != "" {
+		rules, err := loadRules(*script)
+		if err != nil {
+			log.Fatalf("load script: %v", err)
+		}
+		cfg.rules = rules
+	}
+
+	// basicOK 握手/token 请求是否带了匹配的 Basic 头（未配置凭证时总是通过）
+	basicOK := func(r *http.Request) bool {
+		if cfg.credential == "" {
+			return true
+		}
+		given := r.Header.Get("Authorization")
+		return subtle.ConstantTimeCompare([]byte(given), []byte("Basic "+cfg.credential)) == 1
+	}
+
+	// ttyd 的 /token：鉴权模式下需 Basic 认证，返回 hello 中应携带的 AuthToken
+	http.HandleFunc("/token", func(w http.ResponseWriter, r *http.Request) {
+		if !basicOK(r) {
+			w.Header().Set("WWW-Authenticate", `Basic realm="ttyd"`)
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		_ = json.NewEncoder(w).Encode(map[string]string{"token": cfg.credential})
+	})
+
+	// 回放模式：每条连接都从头逐帧回放录制内容（保留 ANSI、spinner 与帧拆分）
+	if *replayPath != "" {
+		t, err := transcript.Load(*replayPath)
+		if err != nil {
+			log.Fatalf("load transcript: %v", err)
+		}
+		h := transcript.Handler(t, transcript.ServeOptions{
+			Speed: *replaySpeed,
+			OnMismatch: func(i int, want, got []byte) {
+				log.Printf("replay: input mismatch at event %d: want %q, got %q", i, want, got)
+			},
+		})
+		http.HandleFunc("/ws", func(w http.ResponseWriter, r *http.Request) {
+			if !basicOK(r) {
+				http.Error(w, "unauthorized", http.StatusUnauthorized)
+				return
+			}
+			h.ServeHTTP(w, r)
+		})
+		log.Printf("mock-ttyd replaying %s (%d events) on %s", *replayPath, len(t.Events), *addr)
+		log.Fatal(http.ListenAndServe(*addr, nil))
+	}
+
 	up := websocket.Upgrader{
 		Subprotocols: []string{"tty"},
 		CheckOrigin: func(r *http.Request) bool {
@@ -44,44 +169,333 @@ func main() {
 	}
 
 	http.HandleFunc("/ws", func(w http.ResponseWriter, r *http.Request) {
-		given := r.Header.Get("Authorization")
-		want := "Basic " + base64.StdEncoding.EncodeToString([]byte(*user+":"+*pass))
-		if subtle.ConstantTimeCompare([]byte(given), []byte(want)) != 1 {
-			w.Header().Set("WWW-Authenticate", `Basic realm="mock-ttyd"`)
-			http.Error(w, "unauthorized", http.StatusUnauthorized)
-			return
-		}
+		headerOK := cfg.credential != "" && basicOK(r)
 		conn, err := up.Upgrade(w, r, nil)
 		if err != nil {
 			log.Printf("upgrade: %v", err)
 			return
 		}
 		defer conn.Close()
+		conn.SetReadLimit(1 << 20)
+		serveConn(r.Context(), cfg, conn, headerOK)
+	})
+
+	log.Printf("mock-ttyd listening on %s (auth=%v)", *addr, cfg.credential != "")
+	log.Fatal(http.ListenAndServe(*addr, nil))
+}
+
+func loadRules(path string) ([]rule, error) {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var rules []rule
+	if err := json.Unmarshal(b, &rules); err != nil {
+		return nil, err
+	}
+	for i := range rules {
+		if rules[i].re, err = regexp.Compile(rules[i].Match); err != nil {
+			return nil, fmt.Errorf("rule %d: %w", i, err)
+		}
+		if rules[i].Latency != "" {
+			if rules[i].latency, err = time.ParseDuration(rules[i].Latency); err != nil {
+				return nil, fmt.Errorf("rule %d: %w", i, err)
+			}
+		}
+	}
+	return rules, nil
+}
+
+// session 是一条 ttyd 连接上的 q chat：只有 run 所在的 goroutine 写输出，读取在单独的 goroutine
+type session struct {
+	ctx     context.Context
+	cfg     *config
+	conn    *websocket.Conn
+	st      *sessionState
+	in      chan []byte // INPUT 内容（已去掉 '0' 前缀）；读取结束时关闭
+	queued  [][]byte    // 思考期间收到的预输入
+	line    []byte      // 行编辑缓冲
+	out     bytes.Buffer
+	confirm func(answer string) string // 等待 y/n 确认时非 nil
+	closed  bool
+}
+
+func serveConn(ctx context.Context, cfg *config, conn *websocket.Conn, headerOK bool) {
+	// ---- hello ----
+	_, data, err := conn.ReadMessage()
+	if err != nil {
+		return
+	}
+	var hello struct {
+		AuthToken string `json:"AuthToken"`
+		Columns   int    `json:"columns"`
+		Rows      int    `json:"rows"`
+	}
+	if len(data) == 0 || data[0] != '{' || json.Unmarshal(data, &hello) != nil {
+		log.Printf("ttyd: invalid hello %q", data)
+		closeWith(conn, websocket.CloseUnsupportedData, "invalid hello")
+		return
+	}
+	if cfg.credential != "" && !headerOK &&
+		subtle.ConstantTimeCompare([]byte(hello.AuthToken), []byte(cfg.credential)) != 1 {
+		log.Printf("ttyd: authentication failed")
+		closeWith(conn, websocket.ClosePolicyViolation, "authentication failed")
+		return
+	}
+	log.Printf("ttyd: client connected (columns=%d rows=%d)", hello.Columns, hello.Rows)
 
-		st := &sessionState{history: []string{}, context: []string{}, root: *root}
+	s := &session{
+		ctx:  ctx,
+		cfg:  cfg,
+		conn: conn,
+		st:   &sessionState{history: []string{}, context: []string{}, root: cfg.root},
+		in:   make(chan []byte, 64),
+	}
+	go s.readLoop()
 
-		_ = conn.WriteMessage(websocket.TextMessage, []byte("Amazon Q CLI (mock)\n> "))
+	_ = conn.WriteMessage(websocket.BinaryMessage, append([]byte{'1'}, cfg.title...))
+	_ = conn.WriteMessage(websocket.BinaryMessage, []byte(`2{}`))
+	if cfg.startup > 0 && !s.think(cfg.startup, "Initializing MCP servers...") {
+		return
+	}
+	// 与 q chat 一致：欢迎信息后不直接给提示符，收到第一次输入（客户端的唤醒空行/Ctrl-C）才出现
+	s.print("\x1b[1mWelcome to Amazon Q (mock-ttyd)\x1b[0m\r\n\r\n")
+	s.flush()
+	s.run()
+}
 
-		conn.SetReadLimit(1 << 20)
-		_ = conn.SetReadDeadline(time.Now().Add(5 * time.Minute))
+func closeWith(conn *websocket.Conn, code int, text string) {
+	_ = conn.WriteControl(websocket.CloseMessage, websocket.FormatCloseMessage(code, text), time.Now().Add(time.Second))
+}
 
-		for {
-			typ, data, err := conn.ReadMessage()
-			if err != nil {
+// readLoop 解析客户端消息：INPUT 交给 run，RESIZE 记录，PAUSE/RESUME 为流控（mock 忽略）
+func (s *session) readLoop() {
+	defer close(s.in)
+	for {
+		_, data, err := s.conn.ReadMessage()
+		if err != nil {
+			return
+		}
+		if len(data) == 0 {
+			continue
+		}
+		switch data[0] {
+		case '0':
+			s.in <- data[1:]
+		case '1':
+			var sz struct {
+				Columns int `json:"columns"`
+				Rows    int `json:"rows"`
+			}
+			if json.Unmarshal(data[1:], &sz) == nil {
+				log.Printf("ttyd: resize to %dx%d", sz.Columns, sz.Rows)
+			}
+		case '2', '3':
+		default:
+			log.Printf("ttyd: unknown message type %q", data[0])
+		}
+	}
+}
+
+func (s *session) run() {
+	for !s.closed {
+		var data []byte
+		if len(s.queued) > 0 {
+			data, s.queued = s.queued[0], s.queued[1:]
+		} else {
+			var ok bool
+			if data, ok = <-s.in; !ok {
 				return
 			}
-			if typ != websocket.TextMessage {
-				continue
+		}
+		s.feed(data)
+	}
+}
+
+// feed 按终端行编辑处理按键：回显、提交、换行、退格、Ctrl-C/Ctrl-D
+func (s *session) feed(data []byte) {
+	for _, b := range data {
+		if s.closed {
+			return
+		}
+		switch b {
+		case 0x03: // Ctrl-C
+			s.line = s.line[:0]
+			s.confirm = nil
+			s.print("^C\r\n\r\n" + promptStr)
+		case 0x04: // Ctrl-D：空行时退出 q chat，ttyd 随之关闭连接
+			if len(s.line) == 0 {
+				s.print("\r\n")
+				s.flush()
+				closeWith(s.conn, websocket.CloseNormalClosure, "")
+				s.closed = true
+				return
+			}
+		case 0x7f, 0x08:
+			if len(s.line) > 0 {
+				s.line = s.line[:len(s.line)-1]
+				s.print("\b \b")
 			}
-			line := strings.TrimRight(string(data), "\r\n")
-			reply := handleLine(r.Context(), st, line)
-			_ = conn.WriteMessage(websocket.TextMessage, []byte(reply+"\n> "))
-			_ = conn.SetReadDeadline(time.Now().Add(5 * time.Minute))
+		case '\r':
+			s.print("\r\n")
+			line := string(s.line)
+			s.line = s.line[:0]
+			s.submit(line)
+		case '\n': // Ctrl-J：多行 prompt
+			s.line = append(s.line, '\n')
+			s.print("\r\n")
+		default:
+			s.line = append(s.line, b)
+			s.out.WriteByte(b)
 		}
-	})
+	}
+	s.flush()
+}
 
-	log.Printf("mock-ttyd listening on %s", *addr)
-	log.Fatal(http.ListenAndServe(*addr, nil))
+func (s *session) submit(line string) {
+	if s.confirm != nil {
+		reply := s.confirm(strings.TrimSpace(line))
+		s.confirm = nil
+		s.print("\r\n" + reply + "\r\n\r\n" + promptStr)
+		return
+	}
+	// 斜杠命令只取第一行，其余行视为紧随其后的输入（如 "/clear\ny" 中的确认）
+	cmd, rest, multi := strings.Cut(line, "\n")
+	if !strings.HasPrefix(strings.TrimSpace(cmd), "/") {
+		cmd, rest, multi = line, "", false
+	}
+	cmd = strings.TrimSpace(cmd)
+	switch {
+	case cmd == "":
+		s.print(promptStr)
+	case cmd == "/clear":
+		// 确认问题后不输出提示符：客户端读到第一个 "> " 即认为回答结束，
+		// 提前出现的提示符会让确认结果残留到下一次回答开头
+		s.print("\r\nAre you sure? This will erase the conversation history and context from hooks for the current session. [y/n]: ")
+		s.confirm = func(answer string) string {
+			if strings.EqualFold(answer, "y") || strings.EqualFold(answer, "yes") {
+				return doClear(s.st)
+			}
+			return "Cancelled."
+		}
+		if multi {
+			s.submit(rest)
+		}
+	case strings.HasPrefix(cmd, "/"):
+		s.print("\r\n" + crlf(handleLine(s.ctx, s.st, cmd)) + "\r\n\r\n" + promptStr)
+	default:
+		s.ask(cmd)
+	}
+}
+
+// ask 模拟一次提问：配额检查、思考（spinner）、输出回答
+func (s *session) ask(prompt string) {
+	var r *rule
+	for i := range s.cfg.rules {
+		if s.cfg.rules[i].re.MatchString(prompt) {
+			r = &s.cfg.rules[i]
+			break
+		}
+	}
+	quota := r != nil && r.Quota
+	if q := s.cfg.quotaAfter; q > 0 && atomic.LoadInt64(&s.cfg.answered) >= q {
+		quota = true
+	}
+	if quota {
+		s.print("\r\n" + quotaMessage + "\r\n\r\n" + promptStr)
+		return
+	}
+	d := s.cfg.latency
+	if r != nil && r.Latency != "" {
+		d = r.latency
+	}
+	if s.cfg.jitter > 0 {
+		d += time.Duration(rand.Int63n(int64(s.cfg.jitter)))
+	}
+	s.flush() // 先发出回显
+	if !s.think(d, "Thinking...") {
+		return
+	}
+	answer := "MOCK ANSWER: " + summarize(prompt)
+	if r != nil && r.Answer != "" {
+		answer = r.Answer
+	}
+	atomic.AddInt64(&s.cfg.answered, 1)
+	s.st.history = append(s.st.history, "USER: "+prompt, "ASSISTANT: "+answer)
+	s.print("\r\n" + crlf(answer) + "\r\n\r\n" + promptStr)
+}
+
+// think 等待 d（期间每 100ms 刷新 spinner）；收到 Ctrl-C 时中断并返回 false，其他输入留待之后处理
+func (s *session) think(d time.Duration, label string) bool {
+	if d <= 0 {
+		return true
+	}
+	done := time.NewTimer(d)
+	defer done.Stop()
+	tick := time.NewTicker(100 * time.Millisecond)
+	defer tick.Stop()
+	frame := 0
+	show := func() {
+		if s.cfg.spinner {
+			s.print("\r\x1b[K\x1b[36m" + spinnerFrames[frame%len(spinnerFrames)] + "\x1b[0m " + label)
+			s.flush()
+			frame++
+		}
+	}
+	if s.cfg.spinner {
+		s.print("\x1b[?25l") // 隐藏光标
+	}
+	show()
+	for {
+		select {
+		case <-done.C:
+			if s.cfg.spinner {
+				s.print("\r\x1b[K\x1b[?25h")
+			}
+			return true
+		case <-tick.C:
+			show()
+		case data, ok := <-s.in:
+			if !ok {
+				s.closed = true
+				return false
+			}
+			if i := bytes.IndexByte(data, 0x03); i >= 0 {
+				s.print("\r\x1b[K\x1b[?25h^C\r\n\r\n" + promptStr)
+				s.flush()
+				if rest := data[i+1:]; len(rest) > 0 {
+					s.queued = append(s.queued, rest)
+				}
+				return false
+			}
+			s.queued = append(s.queued, data)
+		}
+	}
+}
+
+// print 追加到待发送输出；flush 以 OUTPUT 帧发出（-chunk 时按字节数拆帧）
+func (s *session) print(text string) {
+	s.out.WriteString(text)
+}
+
+func (s *session) flush() {
+	b := s.out.Bytes()
+	for len(b) > 0 {
+		n := len(b)
+		if s.cfg.chunk > 0 && n > s.cfg.chunk {
+			n = s.cfg.chunk
+		}
+		if err := s.conn.WriteMessage(websocket.BinaryMessage, append([]byte{'0'}, b[:n]...)); err != nil {
+			s.closed = true
+			break
+		}
+		b = b[n:]
+	}
+	s.out.Reset()
+}
+
+func crlf(s string) string {
+	return strings.ReplaceAll(strings.ReplaceAll(s, "\r\n", "\n"), "\n", "\r\n")
 }
 
 func handleLine(ctx context.Context, st *sessionState, line string) string {
@@ -98,8 +512,6 @@ func handleLine(ctx context.Context, st *sessionState, line string) string {
 		return doSave(st, path)
 	case strings.HasPrefix(line, "/compact"):
 		return doCompact(st)
-	case strings.HasPrefix(line, "/clear"):
-		return doClear(st)
 	case strings.HasPrefix(line, "/context clear"):
 		st.context = nil
 		return "Context cleared."
@@ -126,15 +538,12 @@ func handleLine(ctx context.Context, st *sessionState, line string) string {
 	case strings.HasPrefix(line, "!"):
 		return "mock shell: " + strings.TrimPrefix(line, "!")
 	default:
-		st.history = append(st.history, "USER: "+line)
-		ans := "MOCK ANSWER: " + summarize(line)
-		st.history = append(st.history, "ASSISTANT: "+ans)
-		return ans
+		return "Unknown command: " + strings.Fields(line)[0]
 	}
 }
 
 func doLoad(st *sessionState, path string) string {
-	full := absOrJoin(st.root, path)
+	full := absOrJoin(st.root, unquote(path))
 	b, err := os.ReadFile(full)
 	if err != nil {
 		return "Load failed: " + err.Error()
@@ -148,7 +557,7 @@ func doLoad(st *sessionState, path string) string {
 }
 
 func doSave(st *sessionState, path string) string {
-	full := absOrJoin(st.root, path)
+	full := absOrJoin(st.root, unquote(path))
 	_ = os.MkdirAll(filepath.Dir(full), 0o755)
 	b, _ := json.MarshalIndent(conv{History: st.history}, "", "  ")
 	tmp := full + ".tmp"
@@ -170,7 +579,7 @@ func doCompact(st *sessionState) string {
 
 func doClear(st *sessionState) string {
 	st.history = nil
-	return "Cleared."
+	return "Conversation history cleared."
 }
 
 func absOrJoin(root, p string) string {
@@ -180,6 +589,14 @@ func absOrJoin(root, p string) string {
 	return filepath.Join(root, p)
 }
 
+// unquote 去掉 qflow 为含空格路径加的双引号
+func unquote(p string) string {
+	if len(p) >= 2 && p[0] == '"' && p[len(p)-1] == '"' {
+		return p[1 : len(p)-1]
+	}
+	return p
+}
+
 func summarize(s string) string {
 	s = strings.TrimSpace(s)
 	if len(s) > 80 {
@@ -0,0 +1,383 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"aiops-qproxy/internal/logx"
+	"aiops-qproxy/internal/qerr"
+	"aiops-qproxy/internal/qflow"
+	"aiops-qproxy/internal/transcript"
+	"aiops-qproxy/internal/ttyd"
+)
+
+/*
+ qproxy 运维/调试命令
+
+   qproxy replay [-golden DIR] [-update] [-speed N] [-timeout D] [-v] <transcript.jsonl|目录>...
+
+ replay：把 incident-worker 录制的 ttyd 帧（QPROXY_RECORD_DIR）在进程内回放给真实的 ttyd 客户端，
+ 依次经过提示符检测（hasPromptFast）、回显清理（stripPromptEcho）、cleanText 与 JSON 提取，
+ 与 golden 文件（默认 <transcript>.golden.json）逐字段比较；-update 重写 golden。
+ 有差异或缺少 golden 时退出码为 1。
+*/
+
+func main() {
+	if len(os.Args) < 2 {
+		usage()
+		os.Exit(2)
+	}
+	switch os.Args[1] {
+	case "replay":
+		os.Exit(runReplay(os.Args[2:]))
+	case "-h", "--help", "help":
+		usage()
+	default:
+		fmt.Fprintf(os.Stderr, "qproxy: unknown command %q\n", os.Args[1])
+		usage()
+		os.Exit(2)
+	}
+}
+
+func usage() {
+	fmt.Fprintln(os.Stderr, "usage: qproxy replay [-golden DIR] [-update] [-speed N] [-timeout D] [-v] <transcript.jsonl|dir>...")
+}
+
+// exchangeResult 是一次输入经过客户端与清洗流程后的各阶段输出（golden 的比较单位）
+type exchangeResult struct {
+	Seq       int    `json:"seq"`
+	RequestID string `json:"request_id,omitempty"`
+	Input     string `json:"input"`
+	Raw       string `json:"raw"`            // ttyd.Client.Ask 的原始输出（提示符检测决定在哪里截止）
+	Answer    string `json:"answer"`         // qflow.ParseAnswer：配额/仅提示符识别与回显清理
+	Cleaned   string `json:"cleaned"`        // qflow.CleanText：incident-worker 返回给调用方的文本
+	JSON      string `json:"json,omitempty"` // 输出校验取到的首个 JSON 对象
+	ErrorCode string `json:"error_code,omitempty"`
+	Error     string `json:"error,omitempty"`
+}
+
+type goldenFile struct {
+	Transcript      string           `json:"transcript"`
+	DialError       string           `json:"dial_error,omitempty"`
+	InputMismatches []string         `json:"input_mismatches,omitempty"`
+	Exchanges       []exchangeResult `json:"exchanges"`
+}
+
+func runReplay(args []string) int {
+	fs := flag.NewFlagSet("replay", flag.ExitOnError)
+	goldenDir := fs.String("golden", "", "golden 文件目录（默认与录制文件同目录）")
+	update := fs.Bool("update", false, "用本次结果重写 golden 文件")
+	speed := fs.Float64("speed", 0, "回放速度：0 不等待，1 按录制时的帧间隔，2 两倍速")
+	timeout := fs.Duration("timeout", 30*time.Second, "单次交互（以及建连）的超时")
+	verbose := fs.Bool("v", false, "输出 ttyd 客户端日志")
+	_ = fs.Parse(args)
+	logx.Setup("text", logx.LevelInfo)
+	if !*verbose {
+		logx.SetOutput(io.Discard)
+	}
+	if fs.NArg() == 0 {
+		usage()
+		return 2
+	}
+
+	paths, err := collectTranscripts(fs.Args())
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "replay: %v\n", err)
+		return 2
+	}
+	if len(paths) == 0 {
+		fmt.Fprintln(os.Stderr, "replay: no transcripts found")
+		return 2
+	}
+
+	failed := 0
+	for _, p := range paths {
+		t, err := transcript.Load(p)
+		if err != nil {
+			fmt.Printf("ERROR %s: %v\n", p, err)
+			failed++
+			continue
+		}
+		got := replayTranscript(t, *speed, *timeout)
+		gpath := goldenPath(p, *goldenDir)
+		if *update {
+			if err := writeGolden(gpath, got); err != nil {
+				fmt.Printf("ERROR %s: %v\n", gpath, err)
+				failed++
+				continue
+			}
+			fmt.Printf("wrote %s (%d exchanges)\n", gpath, len(got.Exchanges))
+			continue
+		}
+		want, err := readGolden(gpath)
+		if errors.Is(err, os.ErrNotExist) {
+			fmt.Printf("MISSING %s: no golden %s (run with -update to create)\n", p, gpath)
+			failed++
+			continue
+		}
+		if err != nil {
+			fmt.Printf("ERROR %s: %v\n", gpath, err)
+			failed++
+			continue
+		}
+		if diffs := compareGolden(want, got); len(diffs) > 0 {
+			fmt.Printf("FAIL %s\n", p)
+			for _, d := range diffs {
+				fmt.Println(d)
+			}
+			failed++
+			continue
+		}
+		fmt.Printf("ok   %s (%d exchanges)\n", p, len(got.Exchanges))
+	}
+	if failed > 0 {
+		fmt.Printf("%d of %d transcript(s) failed\n", failed, len(paths))
+		return 1
+	}
+	return 0
+}
+
+// collectTranscripts 展开参数中的目录（取其中的 *.jsonl），结果排序去重
+func collectTranscripts(args []string) ([]string, error) {
+	seen := map[string]bool{}
+	var out []string
+	add := func(p string) {
+		if !seen[p] {
+			seen[p] = true
+			out = append(out, p)
+		}
+	}
+	for _, a := range args {
+		st, err := os.Stat(a)
+		if err != nil {
+			return nil, err
+		}
+		if !st.IsDir() {
+			add(a)
+			continue
+		}
+		err = filepath.Walk(a, func(p string, info os.FileInfo, err error) error {
+			if err != nil {
+				return err
+			}
+			if !info.IsDir() && strings.HasSuffix(p, ".jsonl") {
+				add(p)
+			}
+			return nil
+		})
+		if err != nil {
+			return nil, err
+		}
+	}
+	sort.Strings(out)
+	return out, nil
+}
+
+func goldenPath(transcriptPath, dir string) string {
+	name := strings.TrimSuffix(filepath.Base(transcriptPath), ".jsonl") + ".golden.json"
+	if dir == "" {
+		dir = filepath.Dir(transcriptPath)
+	}
+	return filepath.Join(dir, name)
+}
+
+var loopbackRE = regexp.MustCompile(`127\.0\.0\.1:\d+`)
+
+// replayTranscript 启动进程内的 ttyd 回放端点，用真实客户端依次发送录制中的每次输入
+func replayTranscript(t *transcript.Transcript, speed float64, timeout time.Duration) *goldenFile {
+	res := &goldenFile{Transcript: filepath.Base(t.Path), Exchanges: []exchangeResult{}}
+	var mu sync.Mutex
+	mux := http.NewServeMux()
+	mux.Handle("/ws", transcript.Handler(t, transcript.ServeOptions{
+		Speed: speed,
+		Once:  true,
+		OnMismatch: func(i int, want, got []byte) {
+			mu.Lock()
+			res.InputMismatches = append(res.InputMismatches, fmt.Sprintf("event %d: want %q, got %q", i, want, got))
+			mu.Unlock()
+		},
+	}))
+	srv := httptest.NewServer(mux)
+	defer srv.Close()
+	endpoint := "ws" + strings.TrimPrefix(srv.URL, "http") + "/ws"
+	// 错误信息中的地址与临时端口每次不同，替换掉以便与 golden 比较
+	sanitize := func(err error) string {
+		s := strings.ReplaceAll(err.Error(), endpoint, "ttyd")
+		return loopbackRE.ReplaceAllString(s, "127.0.0.1:PORT")
+	}
+
+	dctx, cancel := context.WithTimeout(context.Background(), timeout)
+	cli, err := ttyd.Dial(dctx, ttyd.DialOptions{
+		Endpoint:    endpoint,
+		NoAuth:      true,
+		WakeMode:    t.Header.WakeMode,
+		HandshakeTO: timeout,
+		ConnectTO:   timeout,
+		ReadIdleTO:  timeout,
+	})
+	cancel()
+	if err != nil {
+		res.DialError = sanitize(err)
+		return res
+	}
+	defer cli.Close()
+
+	for _, x := range t.Exchanges() {
+		r := exchangeResult{Seq: x.Seq, RequestID: x.RequestID, Input: x.Input}
+		ctx, cancel := context.WithTimeout(context.Background(), timeout)
+		raw, err := cli.Ask(ctx, x.Input, timeout)
+		cancel()
+		r.Raw = raw
+		// 斜杠命令的输出只用于确认命令完成，不经过回答清洗
+		if err == nil && !strings.HasPrefix(x.Input, "/") {
+			r.Answer, err = qflow.ParseAnswer(raw, x.Input)
+			r.Cleaned = qflow.CleanText(r.Answer)
+			r.JSON, _ = qflow.ExtractFirstJSON(qflow.StripTerminal(r.Answer))
+		}
+		if err != nil {
+			r.ErrorCode = qerr.BodyOf(err).Code
+			r.Error = sanitize(err)
+		}
+		res.Exchanges = append(res.Exchanges, r)
+	}
+	return res
+}
+
+func readGolden(path string) (*goldenFile, error) {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var g goldenFile
+	if err := json.Unmarshal(b, &g); err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	return &g, nil
+}
+
+func writeGolden(path string, g *goldenFile) error {
+	var buf bytes.Buffer
+	enc := json.NewEncoder(&buf)
+	enc.SetEscapeHTML(false)
+	enc.SetIndent("", "  ")
+	if err := enc.Encode(g); err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+		return err
+	}
+	return os.WriteFile(path, buf.Bytes(), 0o644)
+}
+
+// compareGolden 逐字段比较，返回可读的差异说明（多行文本按行 diff）
+func compareGolden(want, got *goldenFile) []string {
+	var out []string
+	field := func(where, name, w, g string) {
+		if w != g {
+			out = append(out, fmt.Sprintf("  %s %s:\n%s", where, name, lineDiff(w, g)))
+		}
+	}
+	field("transcript", "dial_error", want.DialError, got.DialError)
+	field("transcript", "input_mismatches", strings.Join(want.InputMismatches, "\n"), strings.Join(got.InputMismatches, "\n"))
+	n := len(want.Exchanges)
+	if len(got.Exchanges) > n {
+		n = len(got.Exchanges)
+	}
+	for i := 0; i < n; i++ {
+		if i >= len(want.Exchanges) {
+			out = append(out, fmt.Sprintf("  exchange %d: not in golden (input %q)", i+1, preview(got.Exchanges[i].Input)))
+			continue
+		}
+		if i >= len(got.Exchanges) {
+			out = append(out, fmt.Sprintf("  exchange %d: missing from replay (input %q)", i+1, preview(want.Exchanges[i].Input)))
+			continue
+		}
+		w, g := want.Exchanges[i], got.Exchanges[i]
+		where := fmt.Sprintf("exchange %d", w.Seq)
+		if w.RequestID != "" {
+			where += " [" + w.RequestID + "]"
+		}
+		field(where, "input", w.Input, g.Input)
+		field(where, "raw", w.Raw, g.Raw)
+		field(where, "answer", w.Answer, g.Answer)
+		field(where, "cleaned", w.Cleaned, g.Cleaned)
+		field(where, "json", w.JSON, g.JSON)
+		field(where, "error_code", w.ErrorCode, g.ErrorCode)
+		field(where, "error", w.Error, g.Error)
+	}
+	return out
+}
+
+func preview(s string) string {
+	if len(s) > 60 {
+		return s[:60] + "..."
+	}
+	return s
+}
+
+// lineDiff 输出 golden（-）与本次结果（+）的行级差异；行数过多时只给出首个不同的行
+func lineDiff(want, got string) string {
+	a, b := strings.Split(want, "\n"), strings.Split(got, "\n")
+	var sb strings.Builder
+	if len(a)*len(b) > 4_000_000 {
+		for i := 0; i < len(a) || i < len(b); i++ {
+			var x, y string
+			if i < len(a) {
+				x = a[i]
+			}
+			if i < len(b) {
+				y = b[i]
+			}
+			if x != y {
+				fmt.Fprintf(&sb, "    first difference at line %d:\n    - %q\n    + %q", i+1, x, y)
+				break
+			}
+		}
+		return sb.String()
+	}
+	// 最长公共子序列
+	lcs := make([][]int, len(a)+1)
+	for i := range lcs {
+		lcs[i] = make([]int, len(b)+1)
+	}
+	for i := len(a) - 1; i >= 0; i-- {
+		for j := len(b) - 1; j >= 0; j-- {
+			if a[i] == b[j] {
+				lcs[i][j] = lcs[i+1][j+1] + 1
+			} else if lcs[i+1][j] >= lcs[i][j+1] {
+				lcs[i][j] = lcs[i+1][j]
+			} else {
+				lcs[i][j] = lcs[i][j+1]
+			}
+		}
+	}
+	i, j := 0, 0
+	for i < len(a) || j < len(b) {
+		switch {
+		case i < len(a) && j < len(b) && a[i] == b[j]:
+			i++
+			j++
+		case i < len(a) && (j == len(b) || lcs[i+1][j] >= lcs[i][j+1]):
+			fmt.Fprintf(&sb, "    - %q\n", a[i])
+			i++
+		default:
+			fmt.Fprintf(&sb, "    + %q\n", b[j])
+			j++
+		}
+	}
+	return strings.TrimRight(sb.String(), "\n")
+}
@@ -0,0 +1,48 @@
+package main
+
+import (
+	"flag"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"aiops-qproxy/internal/transcript"
+)
+
+var update = flag.Bool("update", false, "rewrite testdata/*.golden.json")
+
+// testdata 中的录制由 mock-ttyd 生成：拆帧（-chunk）、spinner、配额、仅提示符、/clear 确认 y/n
+func TestReplayGolden(t *testing.T) {
+	paths, err := filepath.Glob("testdata/*.jsonl")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(paths) == 0 {
+		t.Fatal("no transcripts in testdata")
+	}
+	for _, p := range paths {
+		p := p
+		t.Run(strings.TrimSuffix(filepath.Base(p), ".jsonl"), func(t *testing.T) {
+			tr, err := transcript.Load(p)
+			if err != nil {
+				t.Fatal(err)
+			}
+			got := replayTranscript(tr, 0, 10*time.Second)
+			gpath := goldenPath(p, "")
+			if *update {
+				if err := writeGolden(gpath, got); err != nil {
+					t.Fatal(err)
+				}
+				return
+			}
+			want, err := readGolden(gpath)
+			if err != nil {
+				t.Fatalf("%v (run go test -update to create)", err)
+			}
+			if diffs := compareGolden(want, got); len(diffs) > 0 {
+				t.Errorf("replay differs from %s:\n%s", gpath, strings.Join(diffs, "\n"))
+			}
+		})
+	}
+}
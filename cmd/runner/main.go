@@ -21,6 +21,8 @@ import (
 	"strings"
 	"syscall"
 	"time"
+
+	"aiops-qproxy/internal/httpauth"
 )
 
 /*
@@ -32,6 +34,7 @@ import (
   - Q_SOP_DIR        : 额外 SOP JSONL 目录（可选，启用后每次都会作为前置 context）
   - Q_SOP_PREPEND    : "1" = 启用 SOP 预加载（默认启用）
   - NO_COLOR/CLICOLOR/TERM : 抑制 q 彩色输出（建议 systemd 中设置）
+  - QPROXY_AUTH_TOKEN_FILE / QPROXY_AUTH_HMAC_SECRET_FILE / QPROXY_RATE_RPS : HTTP 鉴权与限流（见 README）
 */
 
 type Alert struct {
@@ -909,12 +912,6 @@ func (s *Server) handleAlert(w http.ResponseWriter, r *http.Request) {
 		}
 	}
 
-	// 设置响应头
-	w.Header().Set("Content-Type", "application/json")
-	w.Header().Set("Access-Control-Allow-Origin", "*")
-	w.Header().Set("Access-Control-Allow-Methods", "POST, OPTIONS")
-	w.Header().Set("Access-Control-Allow-Headers", "Content-Type")
-
 	// 返回结果
 	response := map[string]any{
 		"success":   true,
@@ -978,9 +975,19 @@ func main() {
 		http.Error(w, "Not found", http.StatusNotFound)
 	})
 
+	// API 鉴权（Bearer token 文件 / HMAC 签名）+ 按客户端限流
+	guard, err := httpauth.New(httpauth.OptionsFromEnv([]string{"/health"}))
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "http auth init failed: %v\n", err)
+		os.Exit(1)
+	}
+	if !guard.AuthEnabled() {
+		fmt.Printf("WARNING: http api auth disabled (set QPROXY_AUTH_TOKEN_FILE or QPROXY_AUTH_HMAC_SECRET_FILE)\n")
+	}
+
 	srv := &http.Server{
 		Addr:    *listenAddr,
-		Handler: mux,
+		Handler: guard.Wrap(mux),
 	}
 
 	// 优雅关闭
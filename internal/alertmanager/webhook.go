@@ -0,0 +1,174 @@
+// Package alertmanager 解析 Prometheus Alertmanager webhook（v4）并展开为
+// incident-worker 使用的扁平告警结构（service/category/severity/region/group_id/metadata）。
+package alertmanager
+
+import (
+	"encoding/json"
+	"strings"
+	"time"
+)
+
+// Webhook 是 Alertmanager webhook v4 的请求体
+type Webhook struct {
+	Version           string            `json:"version"`
+	GroupKey          string            `json:"groupKey"`
+	TruncatedAlerts   int               `json:"truncatedAlerts"`
+	Status            string            `json:"status"`
+	Receiver          string            `json:"receiver"`
+	GroupLabels       map[string]string `json:"groupLabels"`
+	CommonLabels      map[string]string `json:"commonLabels"`
+	CommonAnnotations map[string]string `json:"commonAnnotations"`
+	ExternalURL       string            `json:"externalURL"`
+	Alerts            []Alert           `json:"alerts"`
+}
+
+// Alert 是 webhook 中的单条告警
+type Alert struct {
+	Status       string            `json:"status"`
+	Labels       map[string]string `json:"labels"`
+	Annotations  map[string]string `json:"annotations"`
+	StartsAt     time.Time         `json:"startsAt"`
+	EndsAt       time.Time         `json:"endsAt"`
+	GeneratorURL string            `json:"generatorURL"`
+	Fingerprint  string            `json:"fingerprint"`
+}
+
+// Detect 粗略判断一个已解析的 JSON body 是否为 Alertmanager webhook
+func Detect(m map[string]any) bool {
+	if m == nil {
+		return false
+	}
+	if _, ok := m["alerts"].([]any); !ok {
+		return false
+	}
+	_, hasGroupKey := m["groupKey"]
+	_, hasVersion := m["version"]
+	return hasGroupKey || hasVersion
+}
+
+// Parse 解析 webhook body
+func Parse(raw []byte) (*Webhook, error) {
+	var wh Webhook
+	if err := json.Unmarshal(raw, &wh); err != nil {
+		return nil, err
+	}
+	return &wh, nil
+}
+
+// 各字段的候选 label 名（按优先级）
+var (
+	serviceLabels  = []string{"service", "service_name", "app", "app_kubernetes_io_name", "job"}
+	categoryLabels = []string{"category", "cat", "type"}
+	severityLabels = []string{"severity", "level", "priority"}
+	regionLabels   = []string{"region", "datasource_cluster", "cluster"}
+	groupLabels    = []string{"group_id", "alertgroup"}
+)
+
+// 从 alertname 推断 category 的关键字（label 中没有 category 时使用）
+var categoryHints = []struct{ kw, cat string }{
+	{"cpu", "cpu"},
+	{"memory", "memory"},
+	{"oom", "memory"},
+	{"disk", "disk"},
+	{"latency", "latency"},
+	{"timeout", "timeout"},
+	{"error", "error"},
+	{"5xx", "error"},
+	{"restart", "restart"},
+}
+
+// Flatten 把一条告警展开为扁平告警 JSON 对象：labels 先取 alert 自身，再回落到 commonLabels，
+// 全部 labels/annotations 与 startsAt/endsAt/generatorURL 放入 metadata，
+// 模板占位符（{{alert_start_time}} 等）从 metadata 中取值。
+func (wh *Webhook) Flatten(a Alert) map[string]any {
+	lookup := func(names []string) string {
+		for _, src := range []map[string]string{a.Labels, wh.CommonLabels} {
+			for _, n := range names {
+				if v := strings.TrimSpace(src[n]); v != "" {
+					return v
+				}
+			}
+		}
+		return ""
+	}
+	annotation := func(name string) string {
+		if v := strings.TrimSpace(a.Annotations[name]); v != "" {
+			return v
+		}
+		return strings.TrimSpace(wh.CommonAnnotations[name])
+	}
+
+	alertName := lookup([]string{"alertname"})
+	category := lookup(categoryLabels)
+	if category == "" {
+		low := strings.ToLower(alertName)
+		for _, h := range categoryHints {
+			if strings.Contains(low, h.kw) {
+				category = h.cat
+				break
+			}
+		}
+	}
+
+	meta := map[string]any{}
+	for k, v := range wh.CommonLabels {
+		meta[k] = v
+	}
+	for k, v := range a.Labels {
+		meta[k] = v
+	}
+	for k, v := range wh.CommonAnnotations {
+		meta[k] = v
+	}
+	for k, v := range a.Annotations {
+		meta[k] = v
+	}
+	if alertName != "" {
+		meta["alert_name"] = alertName
+	}
+	if !a.StartsAt.IsZero() {
+		meta["alert_start_time"] = a.StartsAt.UTC().Format(time.RFC3339)
+	}
+	if a.Status == "resolved" && !a.EndsAt.IsZero() { // firing 告警的 endsAt 只是预计超时时间
+		meta["alert_end_time"] = a.EndsAt.UTC().Format(time.RFC3339)
+	}
+	if a.GeneratorURL != "" {
+		meta["generator_url"] = a.GeneratorURL
+	}
+	if a.Fingerprint != "" {
+		meta["fingerprint"] = a.Fingerprint
+	}
+	if wh.GroupKey != "" {
+		meta["group_key"] = wh.GroupKey
+	}
+
+	out := map[string]any{
+		"status":   a.Status,
+		"service":  lookup(serviceLabels),
+		"category": category,
+		"severity": lookup(severityLabels),
+		"region":   lookup(regionLabels),
+		"group_id": lookup(groupLabels),
+		"metadata": meta,
+	}
+	if v := lookup([]string{"env", "environment"}); v != "" {
+		out["env"] = v
+	}
+	if v := lookup([]string{"path"}); v != "" {
+		out["path"] = v
+	}
+	if v := lookup([]string{"method"}); v != "" {
+		out["method"] = v
+	}
+	if v := annotation("summary"); v != "" {
+		out["title"] = v
+	} else if alertName != "" {
+		out["title"] = alertName
+	}
+	if v := annotation("threshold"); v != "" {
+		out["threshold"] = v
+	} else if v := lookup([]string{"threshold"}); v != "" {
+		out["threshold"] = v
+	}
+	return out
+}
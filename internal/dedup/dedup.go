@@ -0,0 +1,159 @@
+package dedup
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"aiops-qproxy/internal/logx"
+	"aiops-qproxy/internal/runner"
+	"aiops-qproxy/internal/ttyd"
+)
+
+// Source 表示结果的来源
+type Source string
+
+const (
+	Fresh    Source = ""         // 本次请求实际执行
+	Inflight Source = "inflight" // 合并到同 key 正在执行的请求
+	Cached   Source = "cached"   // TTL 内已完成的结果
+)
+
+// Group 按 Key（incident_key）去重：执行中的重复请求等待同一结果，完成后 TTL 内直接返回缓存。
+// 执行运行在与请求分离的 context 上（保留日志与 trace 字段，超时为 runTimeout），发起方断开或超时
+// 不影响执行与其他等待方；执行期间的 ttyd 输出帧转发给所有仍在等待的请求（见 ttyd.WithOutputFunc）。
+// nil *Group 表示关闭去重，Do 直接以调用方 ctx 执行 fn。
+type Group struct {
+	ttl     time.Duration
+	timeout time.Duration
+	mu      sync.Mutex
+	calls   map[string]*call
+	cache   map[string]entry
+}
+
+type call struct {
+	done chan struct{}
+	res  *runner.Result
+	err  error
+
+	mu   sync.Mutex
+	outs map[int]ttyd.OutputFunc // 仍在等待的请求的输出回调
+	next int
+}
+
+type entry struct {
+	res *runner.Result
+	exp time.Time
+}
+
+// New 创建去重组；ttl<=0 返回 nil（关闭去重）。runTimeout 是单次执行的上限，<=0 不限
+func New(ttl, runTimeout time.Duration) *Group {
+	if ttl <= 0 {
+		return nil
+	}
+	return &Group{ttl: ttl, timeout: runTimeout, calls: make(map[string]*call), cache: make(map[string]entry)}
+}
+
+// Key 返回去重键，即 incident_key（告警请求由 sop.IncidentKey 生成）；prompt 不参与，
+// 需要对同一 incident 重新分析时由调用方显式 force。incident_key 为空时返回 ""（不去重）
+func Key(in runner.IncidentInput) string {
+	return in.IncidentKey
+}
+
+// Do 执行或复用 key 对应的处理结果。force 为 true 时跳过缓存与合并，重新执行并刷新缓存。
+// 只缓存成功的结果；每个等待方（包括发起方）只在自己的 ctx 取消时提前返回，执行继续并照常缓存。
+func (g *Group) Do(ctx context.Context, key string, force bool, fn func(ctx context.Context) (*runner.Result, error)) (*runner.Result, Source, error) {
+	if g == nil || key == "" {
+		res, err := fn(ctx)
+		return res, Fresh, err
+	}
+
+	g.mu.Lock()
+	g.pruneLocked()
+	if !force {
+		if e, ok := g.cache[key]; ok {
+			g.mu.Unlock()
+			return e.res, Cached, nil
+		}
+		if c, ok := g.calls[key]; ok {
+			g.mu.Unlock()
+			return c.wait(ctx, Inflight)
+		}
+	}
+	c := &call{done: make(chan struct{}), outs: make(map[int]ttyd.OutputFunc)}
+	g.calls[key] = c
+	g.mu.Unlock()
+
+	unsub := c.subscribe(ttyd.OutputFuncFrom(ctx)) // 先订阅，不漏掉最早的输出
+	go g.run(ctx, key, c, fn)
+	defer unsub()
+	return c.wait(ctx, Fresh)
+}
+
+// run 在分离的 context 上执行 fn，结束后缓存结果并唤醒所有等待方
+func (g *Group) run(ctx context.Context, key string, c *call, fn func(ctx context.Context) (*runner.Result, error)) {
+	rctx := logx.Detach(ctx)
+	if g.timeout > 0 {
+		var cancel context.CancelFunc
+		rctx, cancel = context.WithTimeout(rctx, g.timeout)
+		defer cancel()
+	}
+	c.res, c.err = fn(ttyd.WithOutputFunc(rctx, c.broadcast))
+
+	g.mu.Lock()
+	if g.calls[key] == c {
+		delete(g.calls, key)
+	}
+	if c.err == nil {
+		g.cache[key] = entry{res: c.res, exp: time.Now().Add(g.ttl)}
+	}
+	g.mu.Unlock()
+	close(c.done)
+}
+
+// wait 等待执行结束或 ctx 取消；订阅期间收到执行的输出帧
+func (c *call) wait(ctx context.Context, src Source) (*runner.Result, Source, error) {
+	if src == Inflight {
+		defer c.subscribe(ttyd.OutputFuncFrom(ctx))()
+	}
+	select {
+	case <-c.done:
+		return c.res, src, c.err
+	case <-ctx.Done():
+		return nil, src, ctx.Err()
+	}
+}
+
+func (c *call) subscribe(fn ttyd.OutputFunc) func() {
+	if fn == nil {
+		return func() {}
+	}
+	c.mu.Lock()
+	id := c.next
+	c.next++
+	c.outs[id] = fn
+	c.mu.Unlock()
+	return func() {
+		c.mu.Lock()
+		delete(c.outs, id)
+		c.mu.Unlock()
+	}
+}
+
+// broadcast 把一帧输出转发给所有订阅者（在 ttyd 读取 goroutine 中同步调用）
+func (c *call) broadcast(data []byte) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for _, fn := range c.outs {
+		fn(data)
+	}
+}
+
+func (g *Group) pruneLocked() {
+	now := time.Now()
+	for k, e := range g.cache {
+		if now.After(e.exp) {
+			delete(g.cache, k)
+		}
+	}
+}
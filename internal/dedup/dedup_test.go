@@ -0,0 +1,188 @@
+package dedup
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"aiops-qproxy/internal/runner"
+	"aiops-qproxy/internal/ttyd"
+)
+
+func TestKey(t *testing.T) {
+	tests := []struct {
+		name string
+		a, b runner.IncidentInput
+		same bool
+	}{
+		{"same input", runner.IncidentInput{IncidentKey: "k", Prompt: "p"}, runner.IncidentInput{IncidentKey: "k", Prompt: "p"}, true},
+		{"sop_id ignored", runner.IncidentInput{IncidentKey: "k", Prompt: "p", SopID: "a"}, runner.IncidentInput{IncidentKey: "k", Prompt: "p", SopID: "b"}, true},
+		{"prompt ignored", runner.IncidentInput{IncidentKey: "k", Prompt: "p1"}, runner.IncidentInput{IncidentKey: "k", Prompt: "p2"}, true},
+		{"different key", runner.IncidentInput{IncidentKey: "k1", Prompt: "p"}, runner.IncidentInput{IncidentKey: "k2", Prompt: "p"}, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := Key(tt.a) == Key(tt.b); got != tt.same {
+				t.Fatalf("Key(%+v)=%s Key(%+v)=%s", tt.a, Key(tt.a), tt.b, Key(tt.b))
+			}
+		})
+	}
+	if k := Key(runner.IncidentInput{Prompt: "p"}); k != "" {
+		t.Fatalf("empty incident_key: Key = %q, want \"\"", k)
+	}
+}
+
+func TestDisabled(t *testing.T) {
+	if g := New(0, time.Minute); g != nil {
+		t.Fatal("New(0) should disable dedup")
+	}
+	var g *Group
+	var n int32
+	fn := func(ctx context.Context) (*runner.Result, error) {
+		atomic.AddInt32(&n, 1)
+		return &runner.Result{Answer: "a"}, nil
+	}
+	for i := 0; i < 2; i++ {
+		if _, src, err := g.Do(context.Background(), "k", false, fn); err != nil || src != Fresh {
+			t.Fatalf("src=%q err=%v", src, err)
+		}
+	}
+	if n != 2 {
+		t.Fatalf("fn ran %d times, want 2", n)
+	}
+}
+
+func TestCache(t *testing.T) {
+	tests := []struct {
+		name  string
+		key   string
+		force bool
+		err   error
+		want  Source
+		runs  int32
+	}{
+		{"cached", "k", false, nil, Cached, 1},
+		{"force", "k", true, nil, Fresh, 2},
+		{"empty key", "", false, nil, Fresh, 2},
+		{"errors are not cached", "k", false, errors.New("boom"), Fresh, 2},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			g := New(time.Minute, time.Minute)
+			var n int32
+			fn := func(ctx context.Context) (*runner.Result, error) {
+				atomic.AddInt32(&n, 1)
+				return &runner.Result{Answer: "a"}, tt.err
+			}
+			_, _, _ = g.Do(context.Background(), tt.key, false, fn)
+			_, src, _ := g.Do(context.Background(), tt.key, tt.force, fn)
+			if src != tt.want || n != tt.runs {
+				t.Fatalf("src=%q runs=%d, want %q %d", src, n, tt.want, tt.runs)
+			}
+		})
+	}
+}
+
+func TestCacheExpires(t *testing.T) {
+	g := New(20*time.Millisecond, time.Minute)
+	fn := func(ctx context.Context) (*runner.Result, error) { return &runner.Result{}, nil }
+	_, _, _ = g.Do(context.Background(), "k", false, fn)
+	time.Sleep(40 * time.Millisecond)
+	if _, src, _ := g.Do(context.Background(), "k", false, fn); src != Fresh {
+		t.Fatalf("src = %q after ttl, want fresh", src)
+	}
+}
+
+// 发起方断开后执行继续：合并进来的等待方拿到结果与输出，结果照常缓存
+func TestInflightSurvivesInitiatorCancel(t *testing.T) {
+	g := New(time.Minute, time.Minute)
+	started, release := make(chan struct{}), make(chan struct{})
+	fn := func(ctx context.Context) (*runner.Result, error) {
+		close(started)
+		<-release
+		if ctx.Err() != nil {
+			return nil, ctx.Err()
+		}
+		ttyd.OutputFuncFrom(ctx)([]byte("frame"))
+		return &runner.Result{Answer: "done"}, nil
+	}
+
+	ictx, cancel := context.WithCancel(context.Background())
+	initErr := make(chan error, 1)
+	go func() {
+		_, _, err := g.Do(ictx, "k", false, fn)
+		initErr <- err
+	}()
+	<-started
+
+	var mu sync.Mutex
+	var frames []string
+	wctx := ttyd.WithOutputFunc(context.Background(), func(b []byte) {
+		mu.Lock()
+		frames = append(frames, string(b))
+		mu.Unlock()
+	})
+	type result struct {
+		res *runner.Result
+		src Source
+		err error
+	}
+	waiter := make(chan result, 1)
+	go func() {
+		res, src, err := g.Do(wctx, "k", false, fn)
+		waiter <- result{res, src, err}
+	}()
+
+	cancel()
+	if err := <-initErr; !errors.Is(err, context.Canceled) {
+		t.Fatalf("initiator err = %v, want context.Canceled", err)
+	}
+	// 等待方已在等待后再放行执行，确保它订阅了输出
+	waitFor(t, func() bool {
+		g.mu.Lock()
+		defer g.mu.Unlock()
+		c := g.calls["k"]
+		c.mu.Lock()
+		defer c.mu.Unlock()
+		return len(c.outs) == 1
+	})
+	close(release)
+
+	r := <-waiter
+	if r.err != nil || r.src != Inflight || r.res.Answer != "done" {
+		t.Fatalf("waiter: %+v", r)
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	if len(frames) != 1 || frames[0] != "frame" {
+		t.Fatalf("waiter frames = %q", frames)
+	}
+	if _, src, _ := g.Do(context.Background(), "k", false, fn); src != Cached {
+		t.Fatalf("src = %q, want cached", src)
+	}
+}
+
+func TestRunTimeout(t *testing.T) {
+	g := New(time.Minute, 20*time.Millisecond)
+	_, _, err := g.Do(context.Background(), "k", false, func(ctx context.Context) (*runner.Result, error) {
+		<-ctx.Done()
+		return nil, ctx.Err()
+	})
+	if !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("err = %v, want deadline exceeded", err)
+	}
+}
+
+func waitFor(t *testing.T, cond func() bool) {
+	t.Helper()
+	deadline := time.Now().Add(2 * time.Second)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatal("condition not reached")
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
@@ -0,0 +1,83 @@
+package drain
+
+import (
+	"context"
+	"sync"
+
+	"aiops-qproxy/internal/qerr"
+)
+
+// ErrDraining 表示已进入排空状态，不再开始新的处理（HTTP 返回 503 + Retry-After）
+var ErrDraining = qerr.Errorf(qerr.ErrPoolExhausted, "shutting down")
+
+// Tracker 统计进行中的处理；关闭时先 Start 标记排空（不再接收新请求），再 Wait 等待已有处理结束
+type Tracker struct {
+	mu       sync.Mutex
+	n        int
+	draining bool
+	changed  chan struct{} // 每次 n 变化时关闭并替换，用于唤醒 Wait
+}
+
+func New() *Tracker {
+	return &Tracker{changed: make(chan struct{})}
+}
+
+// Begin 登记一个进行中的处理，返回结束时调用的函数；已进入排空状态时返回 ok=false，不登记。
+// 与 Start 在同一把锁内判断，Wait 返回后不会再有新的处理开始
+func (t *Tracker) Begin() (done func(), ok bool) {
+	t.mu.Lock()
+	if t.draining {
+		t.mu.Unlock()
+		return func() {}, false
+	}
+	t.n++
+	t.mu.Unlock()
+	var once sync.Once
+	return func() {
+		once.Do(func() {
+			t.mu.Lock()
+			t.n--
+			close(t.changed)
+			t.changed = make(chan struct{})
+			t.mu.Unlock()
+		})
+	}, true
+}
+
+// Start 进入排空状态
+func (t *Tracker) Start() {
+	t.mu.Lock()
+	t.draining = true
+	t.mu.Unlock()
+}
+
+// Draining 是否已进入排空状态
+func (t *Tracker) Draining() bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.draining
+}
+
+// InFlight 进行中的处理数
+func (t *Tracker) InFlight() int {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.n
+}
+
+// Wait 等待进行中的处理全部结束；ctx 到期时返回 ctx.Err()
+func (t *Tracker) Wait(ctx context.Context) error {
+	for {
+		t.mu.Lock()
+		n, ch := t.n, t.changed
+		t.mu.Unlock()
+		if n == 0 {
+			return nil
+		}
+		select {
+		case <-ch:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
@@ -268,7 +268,7 @@ func (c *OptimizedClient) Ask(ctx context.Context, prompt string, timeout time.D
 	case err := <-errChan:
 		return "", err
 	case <-time.After(timeout):
-		return "", fmt.Errorf("timeout waiting for response after %v", timeout)
+		return "", fmt.Errorf("timeout waiting for response after %v: %w", timeout, context.DeadlineExceeded)
 	case <-ctx.Done():
 		return "", ctx.Err()
 	}
@@ -0,0 +1,320 @@
+package history
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// 事件历史：按天分段的追加写 JSONL（<dir>/2006-01-02.jsonl），原始回答单独存放在
+// <dir>/answers/2006-01-02/<id>.txt。记录只追加不修改；超过保留天数的整天分段连同回答一起删除。
+
+// 结果分类
+const (
+	OutcomeSucceeded = "succeeded" // 回答可用且通过 schema 校验（或未配置 schema）
+	OutcomeInvalid   = "invalid"   // 有回答，但修复后仍未通过 schema 校验
+	OutcomeFailed    = "failed"    // 处理出错，没有回答
+)
+
+// Record 是一次 incident 处理的历史记录
+type Record struct {
+	ID             string    `json:"id"`
+	Time           time.Time `json:"ts"`
+	IncidentKey    string    `json:"incident_key"`
+	Service        string    `json:"service,omitempty"`
+	SopID          string    `json:"sop_id,omitempty"`
+	SopIDs         []string  `json:"sop_ids,omitempty"`
+	RequestID      string    `json:"request_id,omitempty"`
+	TraceID        string    `json:"trace_id,omitempty"`
+	PromptSHA1     string    `json:"prompt_sha1"`
+	PromptLen      int       `json:"prompt_len"`
+	LatencyMS      int64     `json:"latency_ms"`
+	Outcome        string    `json:"outcome"`
+	Dedup          string    `json:"dedup,omitempty"` // cached/coalesced：回答来自缓存或合并的同一次运行
+	ErrorCode      string    `json:"error_code,omitempty"`
+	Error          string    `json:"error,omitempty"`
+	Valid          bool      `json:"valid"`
+	RepairAttempts int       `json:"repair_attempts,omitempty"`
+	RootCause      string    `json:"root_cause,omitempty"`
+	Confidence     *float64  `json:"confidence,omitempty"`
+	AnswerPath     string    `json:"answer_path,omitempty"`
+	AnswerLen      int       `json:"answer_len"`
+}
+
+// ErrNotFound 记录不存在（或已过保留期）
+var ErrNotFound = errors.New("incident not found")
+
+const dayLayout = "2006-01-02"
+
+type Store struct {
+	dir       string
+	retention time.Duration // <=0 表示不清理
+
+	mu        sync.Mutex
+	lastPrune string // 上次清理的日期，每天最多清理一次
+}
+
+// Open 打开（必要时创建）历史目录，并清理过期分段
+func Open(dir string, retention time.Duration) (*Store, error) {
+	if err := os.MkdirAll(filepath.Join(dir, "answers"), 0o755); err != nil {
+		return nil, err
+	}
+	s := &Store{dir: dir, retention: retention}
+	s.mu.Lock()
+	s.pruneLocked(time.Now().UTC())
+	s.mu.Unlock()
+	return s, nil
+}
+
+// newID 生成带日期的 ID（inc_20060102T150405Z_<hex>），Get 据此定位分段
+func newID(t time.Time) string {
+	b := make([]byte, 6)
+	_, _ = rand.Read(b)
+	return "inc_" + t.Format("20060102T150405Z") + "_" + hex.EncodeToString(b)
+}
+
+// dayOf 从 ID 取出所在分段的日期
+func dayOf(id string) (string, bool) {
+	if !strings.HasPrefix(id, "inc_") || len(id) < 12 {
+		return "", false
+	}
+	t, err := time.Parse("20060102", id[4:12])
+	if err != nil {
+		return "", false
+	}
+	return t.Format(dayLayout), true
+}
+
+// Append 写入回答文件并追加一条记录；ID/Time 为空时自动填充
+func (s *Store) Append(r *Record, answer string) error {
+	if r.Time.IsZero() {
+		r.Time = time.Now().UTC()
+	}
+	r.Time = r.Time.UTC()
+	if r.ID == "" {
+		r.ID = newID(r.Time)
+	}
+	day := r.Time.Format(dayLayout)
+	r.AnswerLen = len(answer)
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.pruneLocked(r.Time)
+	if answer != "" {
+		adir := filepath.Join(s.dir, "answers", day)
+		if err := os.MkdirAll(adir, 0o755); err != nil {
+			return err
+		}
+		r.AnswerPath = filepath.Join(adir, r.ID+".txt")
+		if err := os.WriteFile(r.AnswerPath, []byte(answer), 0o644); err != nil {
+			return err
+		}
+	}
+	b, err := json.Marshal(r)
+	if err != nil {
+		return err
+	}
+	f, err := os.OpenFile(filepath.Join(s.dir, day+".jsonl"), os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0o644)
+	if err != nil {
+		return err
+	}
+	if _, err := f.Write(append(b, '\n')); err != nil {
+		_ = f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+// Get 按 ID 查找记录
+func (s *Store) Get(id string) (Record, error) {
+	day, ok := dayOf(id)
+	if !ok {
+		return Record{}, ErrNotFound
+	}
+	var found *Record
+	err := s.scan(day, func(r Record) bool {
+		if r.ID == id {
+			found = &r
+			return false
+		}
+		return true
+	})
+	if err != nil && !os.IsNotExist(err) {
+		return Record{}, err
+	}
+	if found == nil {
+		return Record{}, ErrNotFound
+	}
+	return *found, nil
+}
+
+// Answer 读取记录的原始回答
+func (s *Store) Answer(r Record) (string, error) {
+	if r.AnswerPath == "" {
+		return "", nil
+	}
+	b, err := os.ReadFile(r.AnswerPath)
+	return string(b), err
+}
+
+// Query 是 List 的过滤条件；字符串条件为空表示不过滤（service 不区分大小写）
+type Query struct {
+	Service     string
+	SopID       string
+	IncidentKey string
+	Outcome     string
+	Since       time.Time
+	Until       time.Time
+	Limit       int // 默认 50，最大 1000
+}
+
+func (q Query) match(r Record) bool {
+	switch {
+	case q.Service != "" && !strings.EqualFold(q.Service, r.Service):
+		return false
+	case q.SopID != "" && q.SopID != r.SopID:
+		return false
+	case q.IncidentKey != "" && q.IncidentKey != r.IncidentKey:
+		return false
+	case q.Outcome != "" && q.Outcome != r.Outcome:
+		return false
+	case !q.Since.IsZero() && r.Time.Before(q.Since):
+		return false
+	case !q.Until.IsZero() && !r.Time.Before(q.Until):
+		return false
+	}
+	return true
+}
+
+// List 返回符合条件的记录，最新的在前
+func (s *Store) List(q Query) ([]Record, error) {
+	if q.Limit <= 0 {
+		q.Limit = 50
+	}
+	if q.Limit > 1000 {
+		q.Limit = 1000
+	}
+	days, err := s.days()
+	if err != nil {
+		return nil, err
+	}
+	out := []Record{}
+	for i := len(days) - 1; i >= 0 && len(out) < q.Limit; i-- {
+		day := days[i]
+		// 按日期跳过整段（分段日期为 UTC）
+		if !q.Since.IsZero() && day < q.Since.UTC().Format(dayLayout) {
+			break
+		}
+		if !q.Until.IsZero() && day > q.Until.UTC().Format(dayLayout) {
+			continue
+		}
+		var recs []Record
+		if err := s.scan(day, func(r Record) bool {
+			if q.match(r) {
+				recs = append(recs, r)
+			}
+			return true
+		}); err != nil && !os.IsNotExist(err) {
+			return nil, err
+		}
+		// 分段内按追加顺序（时间升序），倒序取最新
+		for j := len(recs) - 1; j >= 0 && len(out) < q.Limit; j-- {
+			out = append(out, recs[j])
+		}
+	}
+	return out, nil
+}
+
+// days 返回已有分段的日期（升序）
+func (s *Store) days() ([]string, error) {
+	ents, err := os.ReadDir(s.dir)
+	if err != nil {
+		return nil, err
+	}
+	var days []string
+	for _, e := range ents {
+		name := e.Name()
+		if e.IsDir() || !strings.HasSuffix(name, ".jsonl") {
+			continue
+		}
+		day := strings.TrimSuffix(name, ".jsonl")
+		if _, err := time.Parse(dayLayout, day); err == nil {
+			days = append(days, day)
+		}
+	}
+	sort.Strings(days)
+	return days, nil
+}
+
+// scan 逐行读取某天的分段，fn 返回 false 时停止；损坏的行跳过
+func (s *Store) scan(day string, fn func(Record) bool) error {
+	b, err := os.ReadFile(filepath.Join(s.dir, day+".jsonl"))
+	if err != nil {
+		return err
+	}
+	sc := bufio.NewScanner(bytes.NewReader(b))
+	sc.Buffer(make([]byte, 64*1024), 4<<20)
+	for sc.Scan() {
+		line := bytes.TrimSpace(sc.Bytes())
+		if len(line) == 0 {
+			continue
+		}
+		var r Record
+		if json.Unmarshal(line, &r) != nil {
+			continue
+		}
+		if !fn(r) {
+			return nil
+		}
+	}
+	return sc.Err()
+}
+
+// pruneLocked 删除超过保留期的分段与回答目录（每天最多执行一次）
+func (s *Store) pruneLocked(now time.Time) {
+	today := now.Format(dayLayout)
+	if s.retention <= 0 || s.lastPrune == today {
+		return
+	}
+	s.lastPrune = today
+	cutoff := now.Add(-s.retention).Format(dayLayout)
+	days, err := s.days()
+	if err != nil {
+		return
+	}
+	for _, day := range days {
+		if day >= cutoff {
+			break
+		}
+		_ = os.Remove(filepath.Join(s.dir, day+".jsonl"))
+		_ = os.RemoveAll(filepath.Join(s.dir, "answers", day))
+	}
+}
+
+// ParseSince 解析 since/until 参数：RFC3339 时间、日期（2006-01-02，UTC）或相对时长（如 12h、30m，表示距今）
+func ParseSince(s string, now time.Time) (time.Time, error) {
+	s = strings.TrimSpace(s)
+	if s == "" {
+		return time.Time{}, nil
+	}
+	if t, err := time.Parse(time.RFC3339, s); err == nil {
+		return t, nil
+	}
+	if t, err := time.Parse(dayLayout, s); err == nil {
+		return t, nil
+	}
+	if d, err := time.ParseDuration(s); err == nil && d > 0 {
+		return now.Add(-d), nil
+	}
+	return time.Time{}, fmt.Errorf("invalid time %q (want RFC3339, 2006-01-02 or a duration like 12h)", s)
+}
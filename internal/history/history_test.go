@@ -0,0 +1,169 @@
+package history
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestAppendGet(t *testing.T) {
+	s, err := Open(t.TempDir(), 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	r := &Record{IncidentKey: "k", Outcome: OutcomeSucceeded}
+	if err := s.Append(r, "root cause: gc"); err != nil {
+		t.Fatal(err)
+	}
+	if r.ID == "" || r.Time.IsZero() || r.AnswerLen != len("root cause: gc") || r.AnswerPath == "" {
+		t.Fatalf("Append did not fill the record: %+v", r)
+	}
+	got, err := s.Get(r.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got.ID != r.ID || got.IncidentKey != "k" {
+		t.Fatalf("Get = %+v", got)
+	}
+	if ans, err := s.Answer(got); err != nil || ans != "root cause: gc" {
+		t.Fatalf("Answer = %q, %v", ans, err)
+	}
+
+	empty := &Record{IncidentKey: "k", Outcome: OutcomeFailed}
+	if err := s.Append(empty, ""); err != nil {
+		t.Fatal(err)
+	}
+	if empty.AnswerPath != "" {
+		t.Fatalf("failed record without answer got answer_path %q", empty.AnswerPath)
+	}
+	if ans, err := s.Answer(*empty); err != nil || ans != "" {
+		t.Fatalf("Answer = %q, %v", ans, err)
+	}
+
+	for _, id := range []string{"", "nope", "inc_2020", "inc_20200101T000000Z_abc", r.ID + "x"} {
+		if _, err := s.Get(id); !errors.Is(err, ErrNotFound) {
+			t.Errorf("Get(%q) err = %v, want ErrNotFound", id, err)
+		}
+	}
+}
+
+func TestList(t *testing.T) {
+	dir := t.TempDir()
+	s, err := Open(dir, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	day1 := time.Date(2024, 5, 1, 10, 0, 0, 0, time.UTC)
+	day2 := day1.Add(24 * time.Hour)
+	recs := []Record{
+		{ID: "inc_20240501T100000Z_a", Time: day1, Service: "API", SopID: "sop_a", IncidentKey: "k1", Outcome: OutcomeSucceeded},
+		{ID: "inc_20240501T110000Z_b", Time: day1.Add(time.Hour), Service: "db", SopID: "sop_b", IncidentKey: "k2", Outcome: OutcomeFailed},
+		{ID: "inc_20240502T100000Z_c", Time: day2, Service: "api", SopID: "sop_a", IncidentKey: "k1", Outcome: OutcomeInvalid},
+		{ID: "inc_20240502T120000Z_d", Time: day2.Add(2 * time.Hour), Service: "api", SopID: "sop_a", IncidentKey: "k3", Outcome: OutcomeSucceeded},
+	}
+	for i := range recs {
+		if err := s.Append(&recs[i], ""); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// 损坏的行跳过，不影响其余记录
+	f, err := os.OpenFile(filepath.Join(dir, "2024-05-02.jsonl"), os.O_APPEND|os.O_WRONLY, 0o644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, _ = f.WriteString("{not json\n")
+	_ = f.Close()
+
+	tests := []struct {
+		name string
+		q    Query
+		want []string
+	}{
+		{"all newest first", Query{}, []string{"d", "c", "b", "a"}},
+		{"limit", Query{Limit: 3}, []string{"d", "c", "b"}},
+		{"service ignores case", Query{Service: "api"}, []string{"d", "c", "a"}},
+		{"sop_id", Query{SopID: "sop_b"}, []string{"b"}},
+		{"incident_key", Query{IncidentKey: "k1"}, []string{"c", "a"}},
+		{"outcome", Query{Outcome: OutcomeSucceeded}, []string{"d", "a"}},
+		{"since", Query{Since: day1.Add(30 * time.Minute)}, []string{"d", "c", "b"}},
+		{"until is exclusive", Query{Until: day2}, []string{"b", "a"}},
+		{"since and until", Query{Since: day1.Add(time.Hour), Until: day2.Add(time.Hour)}, []string{"c", "b"}},
+		{"no match", Query{Service: "nope"}, nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := s.List(tt.q)
+			if err != nil {
+				t.Fatal(err)
+			}
+			var ids []string
+			for _, r := range got {
+				ids = append(ids, r.ID[len(r.ID)-1:])
+			}
+			if len(ids) != len(tt.want) {
+				t.Fatalf("List = %v, want %v", ids, tt.want)
+			}
+			for i := range ids {
+				if ids[i] != tt.want[i] {
+					t.Fatalf("List = %v, want %v", ids, tt.want)
+				}
+			}
+		})
+	}
+}
+
+func TestRetention(t *testing.T) {
+	dir := t.TempDir()
+	s, err := Open(dir, 48*time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	now := time.Now().UTC()
+	old := &Record{Time: now.Add(-5 * 24 * time.Hour), IncidentKey: "old"}
+	// 写入旧记录时以记录时间为准，不会清理自己
+	if err := s.Append(old, "stale answer"); err != nil {
+		t.Fatal(err)
+	}
+	recent := &Record{Time: now, IncidentKey: "new"}
+	if err := s.Append(recent, "fresh"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.Get(old.ID); !errors.Is(err, ErrNotFound) {
+		t.Fatalf("old record still present: %v", err)
+	}
+	if _, err := os.Stat(filepath.Dir(old.AnswerPath)); !os.IsNotExist(err) {
+		t.Fatalf("old answers dir still present: %v", err)
+	}
+	if _, err := s.Get(recent.ID); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestParseSince(t *testing.T) {
+	now := time.Date(2024, 5, 2, 12, 0, 0, 0, time.UTC)
+	tests := []struct {
+		in      string
+		want    time.Time
+		wantErr bool
+	}{
+		{"", time.Time{}, false},
+		{"2024-05-01T08:30:00Z", time.Date(2024, 5, 1, 8, 30, 0, 0, time.UTC), false},
+		{"2024-05-01", time.Date(2024, 5, 1, 0, 0, 0, 0, time.UTC), false},
+		{" 12h ", now.Add(-12 * time.Hour), false},
+		{"30m", now.Add(-30 * time.Minute), false},
+		{"-1h", time.Time{}, true},
+		{"0s", time.Time{}, true},
+		{"yesterday", time.Time{}, true},
+		{"2024-13-01", time.Time{}, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.in, func(t *testing.T) {
+			got, err := ParseSince(tt.in, now)
+			if (err != nil) != tt.wantErr || !got.Equal(tt.want) {
+				t.Fatalf("ParseSince(%q) = %v, %v; want %v (err %v)", tt.in, got, err, tt.want, tt.wantErr)
+			}
+		})
+	}
+}
@@ -0,0 +1,344 @@
+package httpauth
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// HMAC 签名请求头：signature = hex(HMAC-SHA256(secret, timestamp + "." + body))
+	TimestampHeader = "X-QProxy-Timestamp"
+	SignatureHeader = "X-QProxy-Signature"
+)
+
+// Options 鉴权与限流配置；TokenFile 与 HMACSecretFile 都为空时不鉴权（仍可限流，按 IP 区分客户端）
+type Options struct {
+	TokenFile      string        // 每行 "<token> [client]"，# 开头为注释；文件变更后自动重载
+	HMACSecretFile string        // 每行 "<secret> [client]"
+	MaxSkew        time.Duration // HMAC 时间戳允许的偏差，默认 5 分钟
+	RatePerSec     float64       // 每个客户端的令牌补充速率；<=0 不限流
+	Burst          int           // 桶容量，默认 max(1, RatePerSec)
+	MaxBody        int64         // HMAC 校验时读取 body 的上限，默认 10MB
+	Exempt         []string      // 免鉴权/限流的路径（精确匹配），如 /healthz
+}
+
+// OptionsFromEnv 读取 HTTP API 鉴权/限流环境变量（incident-worker 与 runner 共用）：
+// QPROXY_AUTH_TOKEN_FILE、QPROXY_AUTH_HMAC_SECRET_FILE、QPROXY_AUTH_MAX_SKEW_SEC、QPROXY_RATE_RPS、QPROXY_RATE_BURST
+func OptionsFromEnv(exempt []string) Options {
+	env := func(k string) string { return strings.TrimSpace(os.Getenv(k)) }
+	opt := Options{
+		TokenFile:      env("QPROXY_AUTH_TOKEN_FILE"),
+		HMACSecretFile: env("QPROXY_AUTH_HMAC_SECRET_FILE"),
+		Exempt:         exempt,
+	}
+	if v, err := strconv.Atoi(env("QPROXY_AUTH_MAX_SKEW_SEC")); err == nil && v > 0 {
+		opt.MaxSkew = time.Duration(v) * time.Second
+	}
+	if v, err := strconv.ParseFloat(env("QPROXY_RATE_RPS"), 64); err == nil {
+		opt.RatePerSec = v
+	}
+	if v, err := strconv.Atoi(env("QPROXY_RATE_BURST")); err == nil {
+		opt.Burst = v
+	}
+	return opt
+}
+
+// Guard 是 HTTP 鉴权 + 限流中间件
+type Guard struct {
+	opt     Options
+	tokens  *keyFile
+	secrets *keyFile
+	exempt  map[string]bool
+
+	mu      sync.Mutex
+	buckets map[string]*bucket
+}
+
+// New 创建 Guard；配置的 key 文件读取失败时返回错误
+func New(opt Options) (*Guard, error) {
+	if opt.MaxSkew <= 0 {
+		opt.MaxSkew = 5 * time.Minute
+	}
+	if opt.Burst <= 0 {
+		opt.Burst = int(opt.RatePerSec)
+		if opt.Burst < 1 {
+			opt.Burst = 1
+		}
+	}
+	if opt.MaxBody <= 0 {
+		opt.MaxBody = 10 << 20
+	}
+	g := &Guard{opt: opt, exempt: map[string]bool{}, buckets: map[string]*bucket{}}
+	for _, p := range opt.Exempt {
+		g.exempt[p] = true
+	}
+	if opt.TokenFile != "" {
+		g.tokens = &keyFile{path: opt.TokenFile}
+		if err := g.tokens.load(); err != nil {
+			return nil, fmt.Errorf("token file: %w", err)
+		}
+	}
+	if opt.HMACSecretFile != "" {
+		g.secrets = &keyFile{path: opt.HMACSecretFile}
+		if err := g.secrets.load(); err != nil {
+			return nil, fmt.Errorf("hmac secret file: %w", err)
+		}
+	}
+	return g, nil
+}
+
+// AuthEnabled 是否配置了 token 或 HMAC
+func (g *Guard) AuthEnabled() bool { return g.tokens != nil || g.secrets != nil }
+
+type ctxKey struct{}
+
+// ClientFrom 返回中间件识别出的客户端身份（token/secret 对应的名字，或未鉴权时的 IP）
+func ClientFrom(ctx context.Context) string {
+	s, _ := ctx.Value(ctxKey{}).(string)
+	return s
+}
+
+// Wrap 包装 handler：鉴权失败返回 401，超出限流返回 429，错误体为 JSON
+func (g *Guard) Wrap(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if g.exempt[r.URL.Path] {
+			h.ServeHTTP(w, r)
+			return
+		}
+		client, err := g.authenticate(r)
+		if err != nil {
+			log.Printf("httpauth: rejected %s %s from %s: %v", r.Method, r.URL.Path, remoteIP(r), err)
+			w.Header().Set("WWW-Authenticate", `Bearer realm="qproxy"`)
+			writeError(w, http.StatusUnauthorized, "unauthorized", err.Error(), 0)
+			return
+		}
+		if wait, ok := g.allow(client); !ok {
+			secs := int(wait/time.Second) + 1
+			log.Printf("httpauth: rate limited client=%s path=%s retry_after=%ds", client, r.URL.Path, secs)
+			writeError(w, http.StatusTooManyRequests, "rate_limited",
+				fmt.Sprintf("rate limit exceeded for client %q", client), secs)
+			return
+		}
+		h.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), ctxKey{}, client)))
+	})
+}
+
+func writeError(w http.ResponseWriter, status int, code, msg string, retryAfter int) {
+	w.Header().Set("content-type", "application/json")
+	body := map[string]any{"error": code, "message": msg}
+	if retryAfter > 0 {
+		w.Header().Set("Retry-After", strconv.Itoa(retryAfter))
+		body["retry_after"] = retryAfter
+	}
+	w.WriteHeader(status)
+	_ = json.NewEncoder(w).Encode(body)
+}
+
+// authenticate 依次尝试 Bearer token 与 HMAC 签名；未配置鉴权时以客户端 IP 作为身份
+func (g *Guard) authenticate(r *http.Request) (string, error) {
+	if !g.AuthEnabled() {
+		return remoteIP(r), nil
+	}
+	if g.tokens != nil {
+		if tok, ok := bearer(r); ok {
+			if name, ok := g.tokens.match(func(key string) bool {
+				return subtle.ConstantTimeCompare([]byte(key), []byte(tok)) == 1
+			}); ok {
+				return name, nil
+			}
+			return "", fmt.Errorf("invalid bearer token")
+		}
+	}
+	if g.secrets != nil && r.Header.Get(SignatureHeader) != "" {
+		return g.verifyHMAC(r)
+	}
+	switch {
+	case g.tokens != nil && g.secrets != nil:
+		return "", fmt.Errorf("missing bearer token or %s header", SignatureHeader)
+	case g.tokens != nil:
+		return "", fmt.Errorf("missing bearer token")
+	default:
+		return "", fmt.Errorf("missing %s header", SignatureHeader)
+	}
+}
+
+func bearer(r *http.Request) (string, bool) {
+	h := r.Header.Get("Authorization")
+	if len(h) > 7 && strings.EqualFold(h[:7], "bearer ") {
+		return strings.TrimSpace(h[7:]), true
+	}
+	return "", false
+}
+
+// verifyHMAC 校验时间戳与签名；读取的 body 会放回 r.Body 供后续 handler 使用
+func (g *Guard) verifyHMAC(r *http.Request) (string, error) {
+	ts := r.Header.Get(TimestampHeader)
+	sec, err := strconv.ParseInt(ts, 10, 64)
+	if err != nil {
+		return "", fmt.Errorf("missing or invalid %s header", TimestampHeader)
+	}
+	if skew := time.Since(time.Unix(sec, 0)); skew > g.opt.MaxSkew || skew < -g.opt.MaxSkew {
+		return "", fmt.Errorf("timestamp outside allowed skew of %v", g.opt.MaxSkew)
+	}
+	sig, err := hex.DecodeString(strings.TrimPrefix(r.Header.Get(SignatureHeader), "sha256="))
+	if err != nil {
+		return "", fmt.Errorf("malformed %s header", SignatureHeader)
+	}
+	body, err := io.ReadAll(io.LimitReader(r.Body, g.opt.MaxBody+1))
+	_ = r.Body.Close()
+	if err != nil {
+		return "", fmt.Errorf("read body: %v", err)
+	}
+	if int64(len(body)) > g.opt.MaxBody {
+		return "", fmt.Errorf("body too large for signature check")
+	}
+	r.Body = io.NopCloser(bytes.NewReader(body))
+
+	name, ok := g.secrets.match(func(secret string) bool {
+		mac := hmac.New(sha256.New, []byte(secret))
+		mac.Write([]byte(ts))
+		mac.Write([]byte("."))
+		mac.Write(body)
+		return hmac.Equal(mac.Sum(nil), sig)
+	})
+	if !ok {
+		return "", fmt.Errorf("signature mismatch")
+	}
+	return name, nil
+}
+
+// allow 按客户端取一个令牌；失败时返回需要等待的时间
+func (g *Guard) allow(client string) (time.Duration, bool) {
+	if g.opt.RatePerSec <= 0 {
+		return 0, true
+	}
+	now := time.Now()
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	b, ok := g.buckets[client]
+	if !ok {
+		// 顺带清理长时间未用（已回满）的桶，避免按 IP 区分时无限增长
+		if len(g.buckets) > 1024 {
+			full := time.Duration(float64(g.opt.Burst) / g.opt.RatePerSec * float64(time.Second))
+			for k, ob := range g.buckets {
+				if now.Sub(ob.last) > full {
+					delete(g.buckets, k)
+				}
+			}
+		}
+		b = &bucket{tokens: float64(g.opt.Burst), last: now}
+		g.buckets[client] = b
+	}
+	b.tokens += now.Sub(b.last).Seconds() * g.opt.RatePerSec
+	if max := float64(g.opt.Burst); b.tokens > max {
+		b.tokens = max
+	}
+	b.last = now
+	if b.tokens < 1 {
+		return time.Duration((1 - b.tokens) / g.opt.RatePerSec * float64(time.Second)), false
+	}
+	b.tokens--
+	return 0, true
+}
+
+type bucket struct {
+	tokens float64
+	last   time.Time
+}
+
+// keyFile 是 "<key> [client]" 格式的密钥文件，mtime 变化时重新读取
+type keyFile struct {
+	path string
+
+	mu      sync.Mutex
+	keys    []namedKey
+	modTime time.Time
+	checked time.Time
+}
+
+type namedKey struct {
+	key, name string
+}
+
+func (k *keyFile) load() error {
+	st, err := os.Stat(k.path)
+	if err != nil {
+		return err
+	}
+	f, err := os.Open(k.path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	var keys []namedKey
+	sc := bufio.NewScanner(f)
+	for n := 1; sc.Scan(); n++ {
+		line := strings.TrimSpace(sc.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		fields := strings.Fields(line)
+		name := fmt.Sprintf("%s#%d", filepath.Base(k.path), n)
+		if len(fields) > 1 {
+			name = fields[1]
+		}
+		keys = append(keys, namedKey{key: fields[0], name: name})
+	}
+	if err := sc.Err(); err != nil {
+		return err
+	}
+	if len(keys) == 0 {
+		return fmt.Errorf("%s: no keys", k.path)
+	}
+	k.keys, k.modTime = keys, st.ModTime()
+	return nil
+}
+
+// match 返回第一个满足 ok 的 key 对应的客户端名；每 5 秒检查一次文件是否变更
+func (k *keyFile) match(ok func(key string) bool) (string, bool) {
+	k.mu.Lock()
+	if time.Since(k.checked) > 5*time.Second {
+		k.checked = time.Now()
+		if st, err := os.Stat(k.path); err == nil && !st.ModTime().Equal(k.modTime) {
+			if err := k.load(); err != nil {
+				log.Printf("httpauth: reload %s failed, keeping previous keys: %v", k.path, err)
+			} else {
+				log.Printf("httpauth: reloaded %s (%d keys)", k.path, len(k.keys))
+			}
+		}
+	}
+	keys := k.keys
+	k.mu.Unlock()
+
+	for _, nk := range keys {
+		if ok(nk.key) {
+			return nk.name, true
+		}
+	}
+	return "", false
+}
+
+func remoteIP(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
@@ -0,0 +1,169 @@
+package httpauth
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+func writeKeys(t *testing.T, content string) string {
+	t.Helper()
+	p := filepath.Join(t.TempDir(), "keys")
+	if err := os.WriteFile(p, []byte(content), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	return p
+}
+
+func sign(secret, ts, body string) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(ts + "." + body))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// echo 返回识别出的客户端与 handler 读到的 body
+var echo = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+	b, _ := io.ReadAll(r.Body)
+	_, _ = io.WriteString(w, ClientFrom(r.Context())+"|"+string(b))
+})
+
+func TestWrapAuth(t *testing.T) {
+	tokens := writeKeys(t, "# comment\n\ntok-n8n n8n\ntok-anon\n")
+	secrets := writeKeys(t, "s3cret alertmanager\n")
+	g, err := New(Options{TokenFile: tokens, HMACSecretFile: secrets, Exempt: []string{"/healthz"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	h := g.Wrap(echo)
+	now := strconv.FormatInt(time.Now().Unix(), 10)
+	old := strconv.FormatInt(time.Now().Add(-10*time.Minute).Unix(), 10)
+	body := `{"prompt":"x"}`
+
+	tests := []struct {
+		name    string
+		path    string
+		headers map[string]string
+		status  int
+		want    string // 200 时的响应体，其余为错误信息片段
+	}{
+		{"exempt", "/healthz", nil, 200, "|" + body},
+		{"missing credentials", "/incident", nil, 401, "missing bearer token or X-QProxy-Signature header"},
+		{"bearer", "/incident", map[string]string{"Authorization": "Bearer tok-n8n"}, 200, "n8n|" + body},
+		{"bearer lower case", "/incident", map[string]string{"Authorization": "bearer tok-n8n"}, 200, "n8n|" + body},
+		{"unnamed token", "/incident", map[string]string{"Authorization": "Bearer tok-anon"}, 200, "keys#4|" + body},
+		{"bad token", "/incident", map[string]string{"Authorization": "Bearer nope"}, 401, "invalid bearer token"},
+		{"hmac", "/incident", map[string]string{TimestampHeader: now, SignatureHeader: sign("s3cret", now, body)}, 200, "alertmanager|" + body},
+		{"hmac prefixed", "/incident", map[string]string{TimestampHeader: now, SignatureHeader: "sha256=" + sign("s3cret", now, body)}, 200, "alertmanager|" + body},
+		{"hmac wrong secret", "/incident", map[string]string{TimestampHeader: now, SignatureHeader: sign("other", now, body)}, 401, "signature mismatch"},
+		{"hmac stale", "/incident", map[string]string{TimestampHeader: old, SignatureHeader: sign("s3cret", old, body)}, 401, "timestamp outside allowed skew"},
+		{"hmac no timestamp", "/incident", map[string]string{SignatureHeader: sign("s3cret", now, body)}, 401, "invalid X-QProxy-Timestamp"},
+		{"hmac not hex", "/incident", map[string]string{TimestampHeader: now, SignatureHeader: "zz"}, 401, "malformed X-QProxy-Signature"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest(http.MethodPost, tt.path, strings.NewReader(body))
+			for k, v := range tt.headers {
+				r.Header.Set(k, v)
+			}
+			rec := httptest.NewRecorder()
+			h.ServeHTTP(rec, r)
+			if rec.Code != tt.status {
+				t.Fatalf("status = %d, want %d (%s)", rec.Code, tt.status, rec.Body)
+			}
+			if tt.status == 200 {
+				if rec.Body.String() != tt.want {
+					t.Fatalf("body = %q, want %q", rec.Body, tt.want)
+				}
+				return
+			}
+			var e struct{ Error, Message string }
+			if err := json.Unmarshal(rec.Body.Bytes(), &e); err != nil {
+				t.Fatal(err)
+			}
+			if e.Error != "unauthorized" || !strings.Contains(e.Message, tt.want) {
+				t.Fatalf("error = %+v, want message containing %q", e, tt.want)
+			}
+			if rec.Header().Get("WWW-Authenticate") == "" {
+				t.Fatal("missing WWW-Authenticate")
+			}
+		})
+	}
+}
+
+func TestRateLimit(t *testing.T) {
+	g, err := New(Options{RatePerSec: 1, Burst: 2, Exempt: []string{"/healthz"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	h := g.Wrap(echo)
+	do := func(path, ip string) *httptest.ResponseRecorder {
+		r := httptest.NewRequest(http.MethodGet, path, nil)
+		r.RemoteAddr = ip + ":12345"
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, r)
+		return rec
+	}
+	tests := []struct {
+		path, ip string
+		status   int
+	}{
+		{"/incident", "10.0.0.1", 200},
+		{"/incident", "10.0.0.1", 200},
+		{"/incident", "10.0.0.1", 429}, // 桶容量 2
+		{"/incident", "10.0.0.2", 200}, // 未鉴权时按 IP 分桶
+		{"/healthz", "10.0.0.1", 200},  // 免限流
+	}
+	for i, tt := range tests {
+		rec := do(tt.path, tt.ip)
+		if rec.Code != tt.status {
+			t.Fatalf("request %d (%s from %s): status = %d, want %d", i, tt.path, tt.ip, rec.Code, tt.status)
+		}
+		if tt.status == 429 && rec.Header().Get("Retry-After") != "1" {
+			t.Fatalf("Retry-After = %q, want 1", rec.Header().Get("Retry-After"))
+		}
+		if tt.status == 200 && tt.path != "/healthz" && rec.Body.String() != tt.ip+"|" {
+			t.Fatalf("client = %q, want %s", rec.Body, tt.ip)
+		}
+	}
+}
+
+func TestNewErrors(t *testing.T) {
+	tests := []struct {
+		name string
+		opt  Options
+	}{
+		{"missing token file", Options{TokenFile: filepath.Join(t.TempDir(), "nope")}},
+		{"empty token file", Options{TokenFile: writeKeys(t, "# only comments\n")}},
+		{"missing secret file", Options{HMACSecretFile: filepath.Join(t.TempDir(), "nope")}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, err := New(tt.opt); err == nil {
+				t.Fatal("New succeeded")
+			}
+		})
+	}
+}
+
+func TestOptionsFromEnv(t *testing.T) {
+	t.Setenv("QPROXY_AUTH_TOKEN_FILE", " /etc/qproxy/tokens ")
+	t.Setenv("QPROXY_AUTH_HMAC_SECRET_FILE", "")
+	t.Setenv("QPROXY_AUTH_MAX_SKEW_SEC", "30")
+	t.Setenv("QPROXY_RATE_RPS", "0.5")
+	t.Setenv("QPROXY_RATE_BURST", "bad")
+	opt := OptionsFromEnv([]string{"/healthz"})
+	if opt.TokenFile != "/etc/qproxy/tokens" || opt.HMACSecretFile != "" || opt.MaxSkew != 30*time.Second ||
+		opt.RatePerSec != 0.5 || opt.Burst != 0 || len(opt.Exempt) != 1 {
+		t.Fatalf("OptionsFromEnv = %+v", opt)
+	}
+}
@@ -0,0 +1,172 @@
+package jobs
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"syscall"
+	"time"
+
+	"aiops-qproxy/internal/logx"
+	"aiops-qproxy/internal/qerr"
+)
+
+// 回调投递状态（Job.CallbackStatus）；失败时为 "failed: <原因>"
+const (
+	CallbackPending   = "pending" // 等待投递；关闭时未投递完的，重启后重新投递
+	CallbackDelivered = "delivered"
+)
+
+// ValidateCallbackURL 检查 callback_url：必须是 http/https 且带主机名。
+// 配置了 CallbackAllowHosts 时主机必须在白名单内；未配置时拒绝字面量的内部 IP
+// （域名在投递拨号时按解析结果检查，见 dialCallback）。返回 qerr.ErrBadInput
+func (m *Manager) ValidateCallbackURL(raw string) error {
+	u, err := url.Parse(raw)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Hostname() == "" {
+		return qerr.Errorf(qerr.ErrBadInput, "invalid callback_url")
+	}
+	host := strings.ToLower(u.Hostname())
+	if len(m.opt.CallbackAllowHosts) > 0 {
+		if !hostAllowed(host, m.opt.CallbackAllowHosts) {
+			return qerr.Errorf(qerr.ErrBadInput, "callback_url host %q is not in QPROXY_CALLBACK_ALLOW_HOSTS", host)
+		}
+		return nil
+	}
+	if ip := net.ParseIP(host); ip != nil && internalIP(ip) {
+		return qerr.Errorf(qerr.ErrBadInput, "callback_url must not point to an internal address")
+	}
+	return nil
+}
+
+// hostAllowed 白名单项为完整主机名，或 "*.example.com"（匹配其任意子域名）
+func hostAllowed(host string, allow []string) bool {
+	for _, a := range allow {
+		a = strings.ToLower(strings.TrimSpace(a))
+		switch {
+		case a == "":
+		case strings.HasPrefix(a, "*."):
+			if strings.HasSuffix(host, a[1:]) {
+				return true
+			}
+		case host == a:
+			return true
+		}
+	}
+	return false
+}
+
+// internalIP 回环、链路本地、私有（含 IPv6 ULA）、未指定与组播地址
+func internalIP(ip net.IP) bool {
+	return ip.IsLoopback() || ip.IsLinkLocalUnicast() || ip.IsLinkLocalMulticast() ||
+		ip.IsPrivate() || ip.IsUnspecified() || ip.IsMulticast()
+}
+
+// newCallbackClient 回调专用的 HTTP 客户端：不跟随重定向、不走环境变量代理；
+// 未配置白名单时在拨号阶段检查解析后的 IP，拒绝内部地址（防止 DNS 解析到内网）
+func newCallbackClient(opt Options) *http.Client {
+	d := &net.Dialer{Timeout: opt.CallbackTO}
+	if len(opt.CallbackAllowHosts) == 0 {
+		d.Control = dialCallback
+	}
+	tr := http.DefaultTransport.(*http.Transport).Clone()
+	tr.Proxy = nil
+	tr.DialContext = d.DialContext
+	return &http.Client{
+		Timeout:   opt.CallbackTO,
+		Transport: tr,
+		CheckRedirect: func(*http.Request, []*http.Request) error {
+			return http.ErrUseLastResponse
+		},
+	}
+}
+
+// errInternalAddr 回调地址解析到内部 IP，重试无意义
+var errInternalAddr = errors.New("callback to internal address refused")
+
+func dialCallback(network, address string, _ syscall.RawConn) error {
+	host, _, err := net.SplitHostPort(address)
+	if err != nil {
+		return err
+	}
+	if ip := net.ParseIP(host); ip == nil || internalIP(ip) {
+		return fmt.Errorf("%w: %s", errInternalAddr, host)
+	}
+	return nil
+}
+
+// callback 在独立 goroutine 中投递回调（不占用 job worker），结束后记录投递状态；
+// 关闭时中断的投递保持 pending，重启后重新投递
+func (m *Manager) callback(id string) {
+	defer m.cbwg.Done()
+	j := m.mustGet(id)
+	status := m.deliver(j)
+	if status == CallbackPending {
+		logx.Infof(j.logCtx(), "jobs: callback for %s interrupted by shutdown, will retry after restart", id)
+		return
+	}
+	if status != CallbackDelivered {
+		logx.Warnf(j.logCtx(), "jobs: callback for %s %s", id, status)
+	}
+	m.update(id, func(j *Job) { j.CallbackStatus = status })
+}
+
+// deliver 把结果 POST 到 callback_url，最多尝试 3 次，返回投递状态
+func (m *Manager) deliver(j Job) string {
+	j.CallbackStatus = "" // 推送内容不含投递状态（此时为 pending）
+	body, _ := json.Marshal(j.Redacted())
+	lctx := j.logCtx()
+	backoff := time.Second
+	var lastErr error
+	for attempt := 1; attempt <= 3; attempt++ {
+		req, err := http.NewRequestWithContext(m.ctx, http.MethodPost, j.CallbackURL, bytes.NewReader(body))
+		if err != nil {
+			lastErr = err
+			break
+		}
+		req.Header.Set("Content-Type", "application/json")
+		req.Header.Set("X-QProxy-Job-ID", j.ID)
+		resp, err := m.hc.Do(req)
+		if err == nil {
+			_ = resp.Body.Close()
+			if resp.StatusCode < 300 {
+				logx.Infof(lctx, "jobs: callback for %s delivered (status=%d)", j.ID, resp.StatusCode)
+				return CallbackDelivered
+			}
+			err = fmt.Errorf("status %d", resp.StatusCode)
+			if resp.StatusCode < 500 && resp.StatusCode != http.StatusTooManyRequests {
+				// 3xx（不跟随重定向）与 4xx 重试无意义
+				lastErr = err
+				break
+			}
+		}
+		if m.ctx.Err() != nil {
+			return CallbackPending
+		}
+		lastErr = err
+		if errors.Is(err, errInternalAddr) {
+			break
+		}
+		logx.Warnf(lctx, "jobs: callback for %s failed (attempt %d/3): %v", j.ID, attempt, err)
+		if attempt < 3 {
+			select {
+			case <-time.After(backoff):
+			case <-m.ctx.Done():
+				return CallbackPending
+			}
+			backoff *= 2
+		}
+	}
+	return "failed: " + lastErr.Error()
+}
+
+// startCallback 标记 pending 并异步投递
+func (m *Manager) startCallback(id string) {
+	m.update(id, func(j *Job) { j.CallbackStatus = CallbackPending })
+	m.cbwg.Add(1)
+	go m.callback(id)
+}
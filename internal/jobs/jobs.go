@@ -0,0 +1,457 @@
+package jobs
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"aiops-qproxy/internal/drain"
+	"aiops-qproxy/internal/logx"
+	"aiops-qproxy/internal/qerr"
+	"aiops-qproxy/internal/runner"
+	"aiops-qproxy/internal/tracing"
+)
+
+type Status string
+
+const (
+	StatusQueued    Status = "queued"
+	StatusRunning   Status = "running"
+	StatusSucceeded Status = "succeeded"
+	StatusFailed    Status = "failed"
+)
+
+// ErrQueueFull 表示待处理队列已满，调用方应稍后重试
+var ErrQueueFull = qerr.Errorf(qerr.ErrPoolExhausted, "job queue full")
+
+// ErrStopped 表示 Manager 已在关闭，不再接收新 job
+var ErrStopped = qerr.Errorf(qerr.ErrPoolExhausted, "job manager shutting down")
+
+// Job 是一次异步 incident 处理的持久化记录（每个 job 一个 JSON 文件）
+type Job struct {
+	ID               string           `json:"id"`
+	Status           Status           `json:"status"`
+	IncidentKey      string           `json:"incident_key"`
+	SopID            string           `json:"sop_id,omitempty"`
+	SopIDs           []string         `json:"sop_ids,omitempty"`
+	Service          string           `json:"service,omitempty"`
+	Prompt           string           `json:"prompt,omitempty"`
+	CallbackURL      string           `json:"callback_url,omitempty"`
+	Answer           string           `json:"answer,omitempty"`
+	Result           *runner.Analysis `json:"result,omitempty"` // 成功时的解析结果与校验信息（同 /incident 的响应，见 runner.Result）
+	Valid            *bool            `json:"valid,omitempty"`
+	ValidationErrors []string         `json:"validation_errors,omitempty"`
+	RepairAttempts   int              `json:"repair_attempts,omitempty"`
+	Error            string           `json:"error,omitempty"`
+	ErrorCode        string           `json:"error_code,omitempty"` // 失败时的错误码（见 qerr），供调用方决定是否重试
+	Retryable        bool             `json:"retryable,omitempty"`
+	CallbackStatus   string           `json:"callback_status,omitempty"`
+	Traceparent      string           `json:"traceparent,omitempty"` // 提交请求的 W3C traceparent
+	CreatedAt        time.Time        `json:"created_at"`
+	StartedAt        *time.Time       `json:"started_at,omitempty"`
+	FinishedAt       *time.Time       `json:"finished_at,omitempty"`
+}
+
+// Redacted 返回不含 prompt 的副本（对外展示/回调用，prompt 可能很大），回答与解析结果都保留
+func (j Job) Redacted() Job {
+	j.Prompt = ""
+	return j
+}
+
+// logCtx 返回带 job 关联字段的 context：job ID 作为 request_id，trace_id 取自提交请求的 traceparent
+func (j Job) logCtx() context.Context {
+	ctx := logx.With(context.Background(), logx.RequestID, j.ID, logx.IncidentKey, j.IncidentKey, logx.SopID, j.SopID)
+	if sc, err := tracing.ParseTraceparent(j.Traceparent); err == nil {
+		ctx = logx.With(ctx, logx.TraceID, sc.TraceID.String())
+	}
+	return ctx
+}
+
+func (j Job) done() bool {
+	return j.Status == StatusSucceeded || j.Status == StatusFailed
+}
+
+// ProcessFunc 执行一次 incident 处理，返回的 Result.Answer 应已清洗
+type ProcessFunc func(ctx context.Context, in runner.IncidentInput) (*runner.Result, error)
+
+type Options struct {
+	Dir        string        // 持久化目录（例如 $QPROXY_CONV_ROOT/_jobs）
+	Workers    int           // 并发 worker 数
+	QueueSize  int           // 待处理队列上限
+	Timeout    time.Duration // 单个 job 的处理超时
+	Retention  time.Duration // 已完成 job 的保留时长，<=0 表示不清理
+	CallbackTO time.Duration // 单次回调超时
+	// CallbackAllowHosts 非空时 callback_url 的主机必须在其中（"host" 或 "*.domain"）；
+	// 为空时允许任意主机，但拒绝解析到回环/链路本地/私有地址的回调
+	CallbackAllowHosts []string
+}
+
+type Manager struct {
+	opt     Options
+	process ProcessFunc
+	hc      *http.Client
+
+	mu    sync.Mutex
+	jobs  map[string]*Job
+	queue chan string
+
+	stop     chan struct{} // Shutdown 时关闭：worker 不再取新 job
+	stopOnce sync.Once
+	wg       sync.WaitGroup
+
+	ctx    context.Context // Shutdown 时取消：中断回调投递
+	cancel context.CancelFunc
+	cbwg   sync.WaitGroup // 投递中的回调
+}
+
+// NewManager 加载已持久化的 job，把重启前未完成的（queued/running）重新入队，并启动 worker。
+func NewManager(opt Options, fn ProcessFunc) (*Manager, error) {
+	if opt.Workers <= 0 {
+		opt.Workers = 1
+	}
+	if opt.QueueSize <= 0 {
+		opt.QueueSize = 1024
+	}
+	if opt.Timeout <= 0 {
+		opt.Timeout = 5 * time.Minute
+	}
+	if opt.CallbackTO <= 0 {
+		opt.CallbackTO = 10 * time.Second
+	}
+	if err := os.MkdirAll(opt.Dir, 0o755); err != nil {
+		return nil, err
+	}
+	m := &Manager{
+		opt:     opt,
+		process: fn,
+		hc:      newCallbackClient(opt),
+		jobs:    map[string]*Job{},
+		stop:    make(chan struct{}),
+	}
+	m.ctx, m.cancel = context.WithCancel(context.Background())
+
+	pending, callbacks, err := m.load()
+	if err != nil {
+		return nil, err
+	}
+	size := opt.QueueSize
+	if len(pending) > size {
+		size = len(pending)
+	}
+	m.queue = make(chan string, size)
+	for _, id := range pending {
+		m.queue <- id
+	}
+	if len(pending) > 0 {
+		logx.Infof(context.Background(), "jobs: requeued %d unfinished job(s) from %s", len(pending), opt.Dir)
+	}
+
+	for i := 0; i < opt.Workers; i++ {
+		m.wg.Add(1)
+		go m.worker()
+	}
+	for _, id := range callbacks {
+		m.startCallback(id)
+	}
+	if len(callbacks) > 0 {
+		logx.Infof(context.Background(), "jobs: redelivering %d pending callback(s)", len(callbacks))
+	}
+	if opt.Retention > 0 {
+		go m.pruneLoop()
+	}
+	return m, nil
+}
+
+// load 读取目录下所有 job 文件，返回需要重新执行的 job ID（按创建时间排序）与回调仍未投递的 job ID
+func (m *Manager) load() ([]string, []string, error) {
+	entries, err := os.ReadDir(m.opt.Dir)
+	if err != nil {
+		return nil, nil, err
+	}
+	var pending []*Job
+	var callbacks []string
+	for _, e := range entries {
+		if e.IsDir() || !strings.HasSuffix(e.Name(), ".json") {
+			continue
+		}
+		path := filepath.Join(m.opt.Dir, e.Name())
+		b, err := os.ReadFile(path)
+		if err != nil {
+			logx.Warnf(context.Background(), "jobs: skip %s: %v", path, err)
+			continue
+		}
+		var j Job
+		if err := json.Unmarshal(b, &j); err != nil || j.ID == "" {
+			logx.Warnf(context.Background(), "jobs: skip malformed %s: %v", path, err)
+			continue
+		}
+		if j.done() && m.expired(&j) {
+			_ = os.Remove(path)
+			continue
+		}
+		if !j.done() {
+			// 重启前正在运行的 job 视为中断，重新排队
+			j.Status = StatusQueued
+			j.StartedAt = nil
+			pending = append(pending, &j)
+		} else if j.CallbackURL != "" && j.CallbackStatus == CallbackPending {
+			callbacks = append(callbacks, j.ID)
+		}
+		m.jobs[j.ID] = &j
+	}
+	sort.Slice(pending, func(a, b int) bool { return pending[a].CreatedAt.Before(pending[b].CreatedAt) })
+	ids := make([]string, 0, len(pending))
+	for _, j := range pending {
+		ids = append(ids, j.ID)
+	}
+	return ids, callbacks, nil
+}
+
+// Submit 创建并持久化一个 queued job，随后入队
+func (m *Manager) Submit(in runner.IncidentInput, callbackURL string) (Job, error) {
+	return m.SubmitContext(context.Background(), in, callbackURL)
+}
+
+// SubmitContext 同 Submit，并记录 ctx 上的 trace，job 执行时的 span 挂在提交请求的 trace 下
+func (m *Manager) SubmitContext(ctx context.Context, in runner.IncidentInput, callbackURL string) (Job, error) {
+	select {
+	case <-m.stop:
+		return Job{}, ErrStopped
+	default:
+	}
+	if callbackURL != "" {
+		if err := m.ValidateCallbackURL(callbackURL); err != nil {
+			return Job{}, err
+		}
+	}
+	j := &Job{
+		ID:          newID(),
+		Status:      StatusQueued,
+		IncidentKey: in.IncidentKey,
+		SopID:       in.SopID,
+		SopIDs:      in.SopIDs,
+		Service:     in.Service,
+		Prompt:      in.Prompt,
+		CallbackURL: callbackURL,
+		Traceparent: tracing.Traceparent(ctx),
+		CreatedAt:   time.Now().UTC(),
+	}
+	m.mu.Lock()
+	if err := m.saveLocked(j); err != nil {
+		m.mu.Unlock()
+		return Job{}, err
+	}
+	m.jobs[j.ID] = j
+	m.mu.Unlock()
+
+	select {
+	case m.queue <- j.ID:
+	default:
+		m.update(j.ID, func(j *Job) {
+			j.Status = StatusFailed
+			j.Error = ErrQueueFull.Error()
+			j.ErrorCode = qerr.ErrPoolExhausted.Code
+			j.Retryable = true
+			now := time.Now().UTC()
+			j.FinishedAt = &now
+		})
+		return Job{}, ErrQueueFull
+	}
+	// 提交请求的 request_id 与 job ID（job 执行时的 request_id）记在同一行，便于关联
+	logx.Infof(logx.With(ctx, logx.IncidentKey, in.IncidentKey, logx.SopID, in.SopID), "jobs: submitted %s", j.ID)
+	return m.mustGet(j.ID), nil
+}
+
+// Get 返回 job 的快照
+func (m *Manager) Get(id string) (Job, bool) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	j, ok := m.jobs[id]
+	if !ok {
+		return Job{}, false
+	}
+	return *j, true
+}
+
+func (m *Manager) mustGet(id string) Job {
+	j, _ := m.Get(id)
+	return j
+}
+
+// Stats 返回各状态的 job 数量
+func (m *Manager) Stats() map[Status]int {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	out := map[Status]int{}
+	for _, j := range m.jobs {
+		out[j.Status]++
+	}
+	return out
+}
+
+// Shutdown 停止取新 job 并等待执行中的 job 结束；未开始的 job 留在磁盘上，重启后重新入队。
+// 投递中的回调被中断并保持 pending，重启后重新投递
+func (m *Manager) Shutdown(ctx context.Context) error {
+	m.stopOnce.Do(func() {
+		close(m.stop)
+		m.cancel()
+	})
+	done := make(chan struct{})
+	go func() {
+		m.wg.Wait()
+		m.cbwg.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+func (m *Manager) worker() {
+	defer m.wg.Done()
+	for {
+		select {
+		case <-m.stop:
+			return
+		case id := <-m.queue:
+			select {
+			case <-m.stop:
+				return
+			default:
+			}
+			m.run(id)
+		}
+	}
+}
+
+func (m *Manager) run(id string) {
+	var in runner.IncidentInput
+	var snap Job
+	ok := m.update(id, func(j *Job) {
+		now := time.Now().UTC()
+		j.Status = StatusRunning
+		j.StartedAt = &now
+		in = runner.IncidentInput{IncidentKey: j.IncidentKey, SopID: j.SopID, SopIDs: j.SopIDs, Service: j.Service, Prompt: j.Prompt}
+		snap = *j
+	})
+	if !ok {
+		return
+	}
+	lctx := snap.logCtx()
+	logx.Infof(lctx, "jobs: running %s", id)
+
+	if sc, err := tracing.ParseTraceparent(snap.Traceparent); err == nil {
+		lctx = tracing.WithRemote(lctx, sc)
+	}
+	lctx, sp := tracing.Start(lctx, "job.run", tracing.Attr{Key: "job_id", Value: id})
+	if sp != nil {
+		// 没有 traceparent 时 job.run 开启新的 trace
+		lctx = logx.With(lctx, logx.TraceID, sp.Context().TraceID.String())
+	}
+	ctx, cancel := context.WithTimeout(lctx, m.opt.Timeout)
+	res, err := m.process(ctx, in)
+	cancel()
+	sp.RecordError(err)
+	sp.End()
+
+	if errors.Is(err, drain.ErrDraining) {
+		// 关闭排空开始后才取到的 job：保持 queued 留在磁盘上，重启后重新入队
+		m.update(id, func(j *Job) {
+			j.Status = StatusQueued
+			j.StartedAt = nil
+		})
+		logx.Infof(lctx, "jobs: %s left queued, worker is shutting down", id)
+		return
+	}
+	m.update(id, func(j *Job) {
+		now := time.Now().UTC()
+		j.FinishedAt = &now
+		if err != nil {
+			j.Status = StatusFailed
+			e := qerr.BodyOf(err)
+			j.Error, j.ErrorCode, j.Retryable = e.Error, e.Code, e.Retryable
+			return
+		}
+		j.Status = StatusSucceeded
+		valid := res.Valid
+		j.Answer, j.Result, j.Valid = res.Answer, res.Parsed, &valid
+		j.ValidationErrors, j.RepairAttempts = res.ValidationErrors, res.RepairAttempts
+	})
+	if err != nil {
+		logx.Warnf(lctx, "jobs: %s failed: %v", id, err)
+	} else {
+		logx.Infof(lctx, "jobs: %s succeeded (answer_len=%d, valid=%v)", id, len(res.Answer), res.Valid)
+	}
+
+	if m.mustGet(id).CallbackURL != "" {
+		m.startCallback(id)
+	}
+}
+
+// update 在锁内修改 job 并落盘；job 不存在时返回 false
+func (m *Manager) update(id string, fn func(j *Job)) bool {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	j, ok := m.jobs[id]
+	if !ok {
+		return false
+	}
+	fn(j)
+	if err := m.saveLocked(j); err != nil {
+		logx.Errorf(j.logCtx(), "jobs: persist %s failed: %v", id, err)
+	}
+	return true
+}
+
+func (m *Manager) saveLocked(j *Job) error {
+	path := filepath.Join(m.opt.Dir, j.ID+".json")
+	tmp := path + ".tmp"
+	b, _ := json.MarshalIndent(j, "", "  ")
+	if err := os.WriteFile(tmp, b, 0o644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
+
+func (m *Manager) expired(j *Job) bool {
+	if m.opt.Retention <= 0 || j.FinishedAt == nil {
+		return false
+	}
+	return time.Since(*j.FinishedAt) > m.opt.Retention
+}
+
+func (m *Manager) pruneLoop() {
+	t := time.NewTicker(time.Hour)
+	defer t.Stop()
+	for range t.C {
+		m.mu.Lock()
+		for id, j := range m.jobs {
+			if j.done() && m.expired(j) {
+				delete(m.jobs, id)
+				_ = os.Remove(filepath.Join(m.opt.Dir, id+".json"))
+			}
+		}
+		m.mu.Unlock()
+	}
+}
+
+func newID() string {
+	var b [8]byte
+	if _, err := rand.Read(b[:]); err != nil {
+		return fmt.Sprintf("job_%d", time.Now().UnixNano())
+	}
+	return "job_" + hex.EncodeToString(b[:])
+}
@@ -0,0 +1,236 @@
+package logx
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// 贯穿一次请求的关联字段（经 context 传递，每行日志都会带上）
+const (
+	RequestID   = "request_id"
+	IncidentKey = "incident_key"
+	SopID       = "sop_id"
+	SessionID   = "session_id"
+	TraceID     = "trace_id"
+)
+
+type Level int
+
+const (
+	LevelDebug Level = iota
+	LevelInfo
+	LevelWarn
+	LevelError
+)
+
+func (l Level) String() string {
+	switch l {
+	case LevelDebug:
+		return "debug"
+	case LevelWarn:
+		return "warn"
+	case LevelError:
+		return "error"
+	}
+	return "info"
+}
+
+// ParseLevel 解析 debug/info/warn/error，无法识别时为 info
+func ParseLevel(s string) Level {
+	switch strings.ToLower(strings.TrimSpace(s)) {
+	case "debug":
+		return LevelDebug
+	case "warn", "warning":
+		return LevelWarn
+	case "error":
+		return LevelError
+	}
+	return LevelInfo
+}
+
+var (
+	mu    sync.Mutex
+	out   io.Writer = os.Stderr
+	level           = LevelInfo
+	text  bool
+)
+
+// Setup 设置输出格式（json/text）与最低级别，并把标准库 log 的输出也转成同样格式（级别 info）
+func Setup(format string, lv Level) {
+	mu.Lock()
+	text = strings.ToLower(strings.TrimSpace(format)) == "text"
+	level = lv
+	mu.Unlock()
+	log.SetFlags(0)
+	log.SetPrefix("")
+	log.SetOutput(stdBridge{})
+}
+
+// SetOutput 修改日志输出目标（默认 stderr）
+func SetOutput(w io.Writer) {
+	mu.Lock()
+	out = w
+	mu.Unlock()
+}
+
+// Enabled 该级别的日志是否会输出（用于跳过代价较高的日志参数计算）
+func Enabled(lv Level) bool {
+	mu.Lock()
+	defer mu.Unlock()
+	return lv >= level
+}
+
+type fieldsKey struct{}
+
+// With 在 ctx 上追加关联字段（kv 为 key, value 交替；同名字段后者覆盖前者）
+func With(ctx context.Context, kv ...string) context.Context {
+	if ctx == nil {
+		ctx = context.Background()
+	}
+	old := fieldsFrom(ctx)
+	fs := make([]string, len(old), len(old)+len(kv))
+	copy(fs, old)
+	for i := 0; i+1 < len(kv); i += 2 {
+		fs = setField(fs, kv[i], kv[i+1])
+	}
+	return context.WithValue(ctx, fieldsKey{}, fs)
+}
+
+// Field 读取 ctx 上的关联字段
+func Field(ctx context.Context, key string) string {
+	fs := fieldsFrom(ctx)
+	for i := 0; i+1 < len(fs); i += 2 {
+		if fs[i] == key {
+			return fs[i+1]
+		}
+	}
+	return ""
+}
+
+// Detach 返回保留 ctx 中所有值（关联字段、trace span 等）但不继承取消与超时的 context，
+// 用于请求结束后仍需完成的操作（/compact、/save、清理）
+func Detach(ctx context.Context) context.Context {
+	if ctx == nil {
+		return context.Background()
+	}
+	return detached{ctx}
+}
+
+type detached struct{ parent context.Context }
+
+func (detached) Deadline() (time.Time, bool)         { return time.Time{}, false }
+func (detached) Done() <-chan struct{}               { return nil }
+func (detached) Err() error                          { return nil }
+func (d detached) Value(key interface{}) interface{} { return d.parent.Value(key) }
+
+func fieldsFrom(ctx context.Context) []string {
+	if ctx == nil {
+		return nil
+	}
+	fs, _ := ctx.Value(fieldsKey{}).([]string)
+	return fs
+}
+
+func setField(fs []string, k, v string) []string {
+	for i := 0; i+1 < len(fs); i += 2 {
+		if fs[i] == k {
+			fs[i+1] = v
+			return fs
+		}
+	}
+	return append(fs, k, v)
+}
+
+// NewID 生成带前缀的随机 ID（如 req_1a2b3c4d5e6f7a8b）
+func NewID(prefix string) string {
+	b := make([]byte, 8)
+	if _, err := rand.Read(b); err != nil {
+		return fmt.Sprintf("%s_%x", prefix, time.Now().UnixNano())
+	}
+	return prefix + "_" + hex.EncodeToString(b)
+}
+
+func Debugf(ctx context.Context, format string, args ...interface{}) {
+	output(ctx, LevelDebug, format, args...)
+}
+
+func Infof(ctx context.Context, format string, args ...interface{}) {
+	output(ctx, LevelInfo, format, args...)
+}
+
+func Warnf(ctx context.Context, format string, args ...interface{}) {
+	output(ctx, LevelWarn, format, args...)
+}
+
+func Errorf(ctx context.Context, format string, args ...interface{}) {
+	output(ctx, LevelError, format, args...)
+}
+
+func output(ctx context.Context, lv Level, format string, args ...interface{}) {
+	if !Enabled(lv) {
+		return
+	}
+	write(lv, strings.TrimRight(fmt.Sprintf(format, args...), "\n"), fieldsFrom(ctx))
+}
+
+func write(lv Level, msg string, fs []string) {
+	now := time.Now().UTC().Format("2006-01-02T15:04:05.000Z07:00")
+	var b bytes.Buffer
+	mu.Lock()
+	defer mu.Unlock()
+	if text {
+		fmt.Fprintf(&b, "%s %-5s %s", now, strings.ToUpper(lv.String()), msg)
+		for i := 0; i+1 < len(fs); i += 2 {
+			if fs[i+1] != "" {
+				fmt.Fprintf(&b, " %s=%s", fs[i], fs[i+1])
+			}
+		}
+	} else {
+		// 手工拼接以固定字段顺序：ts、level、msg、关联字段
+		b.WriteString(`{"ts":`)
+		writeJSONString(&b, now)
+		b.WriteString(`,"level":`)
+		writeJSONString(&b, lv.String())
+		b.WriteString(`,"msg":`)
+		writeJSONString(&b, msg)
+		for i := 0; i+1 < len(fs); i += 2 {
+			if fs[i+1] == "" {
+				continue
+			}
+			b.WriteByte(',')
+			writeJSONString(&b, fs[i])
+			b.WriteByte(':')
+			writeJSONString(&b, fs[i+1])
+		}
+		b.WriteByte('}')
+	}
+	b.WriteByte('\n')
+	_, _ = out.Write(b.Bytes())
+}
+
+func writeJSONString(b *bytes.Buffer, s string) {
+	enc := json.NewEncoder(b)
+	enc.SetEscapeHTML(false)
+	_ = enc.Encode(s)
+	b.Truncate(b.Len() - 1) // 去掉 Encode 追加的换行
+}
+
+// stdBridge 接收标准库 log 的输出（尚未改用 logx 的代码），按 info 级别输出
+type stdBridge struct{}
+
+func (stdBridge) Write(p []byte) (int, error) {
+	if Enabled(LevelInfo) {
+		write(LevelInfo, strings.TrimRight(string(p), "\n"), nil)
+	}
+	return len(p), nil
+}
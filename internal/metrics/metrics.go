@@ -0,0 +1,369 @@
+// Package metrics 是一个只依赖标准库的最小 Prometheus 文本格式实现
+// （counter / gauge / histogram，支持标签），保证在 Go 1.18 模块下可编译。
+package metrics
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+type collector interface {
+	name() string
+	write(w *bufio.Writer)
+}
+
+// Registry 保存已注册的指标，按注册顺序输出
+type Registry struct {
+	mu         sync.Mutex
+	collectors []collector
+	names      map[string]bool
+}
+
+func NewRegistry() *Registry {
+	return &Registry{names: map[string]bool{}}
+}
+
+// Default 是进程级默认注册表，包级构造函数都注册到这里
+var Default = NewRegistry()
+
+func (r *Registry) register(c collector) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.names[c.name()] {
+		panic("metrics: duplicate metric " + c.name())
+	}
+	r.names[c.name()] = true
+	r.collectors = append(r.collectors, c)
+}
+
+// WriteText 以 Prometheus 文本格式（0.0.4）输出全部指标
+func (r *Registry) WriteText(w io.Writer) error {
+	r.mu.Lock()
+	cs := append([]collector(nil), r.collectors...)
+	r.mu.Unlock()
+	bw := bufio.NewWriter(w)
+	for _, c := range cs {
+		c.write(bw)
+	}
+	return bw.Flush()
+}
+
+// Handler 返回 /metrics 的 http.Handler
+func (r *Registry) Handler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+		_ = r.WriteText(w)
+	})
+}
+
+// Handler 返回默认注册表的 /metrics handler
+func Handler() http.Handler { return Default.Handler() }
+
+// ---- 原子 float64 ----
+
+type atomicFloat struct{ bits uint64 }
+
+func (f *atomicFloat) add(v float64) {
+	for {
+		old := atomic.LoadUint64(&f.bits)
+		nv := math.Float64bits(math.Float64frombits(old) + v)
+		if atomic.CompareAndSwapUint64(&f.bits, old, nv) {
+			return
+		}
+	}
+}
+
+func (f *atomicFloat) set(v float64) { atomic.StoreUint64(&f.bits, math.Float64bits(v)) }
+
+func (f *atomicFloat) load() float64 { return math.Float64frombits(atomic.LoadUint64(&f.bits)) }
+
+// ---- 带标签的子指标集合 ----
+
+type family struct {
+	fname  string
+	help   string
+	typ    string
+	labels []string
+
+	mu       sync.Mutex
+	children map[string]interface{}
+	values   map[string][]string
+	newChild func() interface{}
+}
+
+func (f *family) name() string { return f.fname }
+
+func (f *family) child(vals []string) interface{} {
+	if len(vals) != len(f.labels) {
+		panic(fmt.Sprintf("metrics: %s expects %d label values, got %d", f.fname, len(f.labels), len(vals)))
+	}
+	key := strings.Join(vals, "\xff")
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	c, ok := f.children[key]
+	if !ok {
+		c = f.newChild()
+		f.children[key] = c
+		f.values[key] = append([]string(nil), vals...)
+	}
+	return c
+}
+
+// each 按标签值排序遍历子指标，输出稳定
+func (f *family) each(fn func(labels string, c interface{})) {
+	f.mu.Lock()
+	keys := make([]string, 0, len(f.children))
+	for k := range f.children {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	type kv struct {
+		labels string
+		c      interface{}
+	}
+	items := make([]kv, 0, len(keys))
+	for _, k := range keys {
+		items = append(items, kv{formatLabels(f.labels, f.values[k]), f.children[k]})
+	}
+	f.mu.Unlock()
+	for _, it := range items {
+		fn(it.labels, it.c)
+	}
+}
+
+func (f *family) header(w *bufio.Writer) {
+	fmt.Fprintf(w, "# HELP %s %s\n", f.fname, escapeHelp(f.help))
+	fmt.Fprintf(w, "# TYPE %s %s\n", f.fname, f.typ)
+}
+
+func newFamily(name, help, typ string, labels []string, newChild func() interface{}) *family {
+	return &family{
+		fname:    name,
+		help:     help,
+		typ:      typ,
+		labels:   labels,
+		children: map[string]interface{}{},
+		values:   map[string][]string{},
+		newChild: newChild,
+	}
+}
+
+// ---- Counter ----
+
+type Counter struct{ v atomicFloat }
+
+func (c *Counter) Inc()          { c.v.add(1) }
+func (c *Counter) Add(v float64) { c.v.add(v) }
+
+type CounterVec struct{ f *family }
+
+// NewCounterVec 注册一个带标签的 counter；labels 为空时等价于无标签 counter
+func NewCounterVec(name, help string, labels ...string) *CounterVec {
+	cv := &CounterVec{f: newFamily(name, help, "counter", labels, func() interface{} { return &Counter{} })}
+	Default.register(cv)
+	return cv
+}
+
+// NewCounter 注册一个无标签 counter
+func NewCounter(name, help string) *Counter {
+	return NewCounterVec(name, help).With()
+}
+
+func (cv *CounterVec) With(vals ...string) *Counter { return cv.f.child(vals).(*Counter) }
+func (cv *CounterVec) name() string                 { return cv.f.fname }
+func (cv *CounterVec) write(w *bufio.Writer) {
+	cv.f.header(w)
+	cv.f.each(func(labels string, c interface{}) {
+		fmt.Fprintf(w, "%s%s %s\n", cv.f.fname, labels, formatFloat(c.(*Counter).v.load()))
+	})
+}
+
+// ---- Gauge ----
+
+type Gauge struct{ v atomicFloat }
+
+func (g *Gauge) Set(v float64) { g.v.set(v) }
+func (g *Gauge) Add(v float64) { g.v.add(v) }
+func (g *Gauge) Inc()          { g.v.add(1) }
+func (g *Gauge) Dec()          { g.v.add(-1) }
+
+type GaugeVec struct{ f *family }
+
+func NewGaugeVec(name, help string, labels ...string) *GaugeVec {
+	gv := &GaugeVec{f: newFamily(name, help, "gauge", labels, func() interface{} { return &Gauge{} })}
+	Default.register(gv)
+	return gv
+}
+
+func NewGauge(name, help string) *Gauge {
+	return NewGaugeVec(name, help).With()
+}
+
+func (gv *GaugeVec) With(vals ...string) *Gauge { return gv.f.child(vals).(*Gauge) }
+func (gv *GaugeVec) name() string               { return gv.f.fname }
+func (gv *GaugeVec) write(w *bufio.Writer) {
+	gv.f.header(w)
+	gv.f.each(func(labels string, c interface{}) {
+		fmt.Fprintf(w, "%s%s %s\n", gv.f.fname, labels, formatFloat(c.(*Gauge).v.load()))
+	})
+}
+
+// gaugeFunc 在抓取时调用函数取值（用于池状态等外部状态）
+type gaugeFunc struct {
+	fname, help string
+	fn          func() float64
+}
+
+// NewGaugeFunc 注册一个抓取时求值的 gauge
+func NewGaugeFunc(name, help string, fn func() float64) {
+	Default.register(&gaugeFunc{fname: name, help: help, fn: fn})
+}
+
+func (g *gaugeFunc) name() string { return g.fname }
+func (g *gaugeFunc) write(w *bufio.Writer) {
+	fmt.Fprintf(w, "# HELP %s %s\n", g.fname, escapeHelp(g.help))
+	fmt.Fprintf(w, "# TYPE %s gauge\n", g.fname)
+	fmt.Fprintf(w, "%s %s\n", g.fname, formatFloat(g.fn()))
+}
+
+// ---- Histogram ----
+
+// DefBuckets 覆盖 5ms ~ 10min，适配从管理命令到完整 Q 调用的耗时
+var DefBuckets = []float64{0.005, 0.01, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10, 30, 60, 120, 300, 600}
+
+// Histogram 的桶、count 与 sum 在同一把锁内更新与读取，抓取时看到的是一致的快照
+// （否则 +Inf 可能小于某个有限桶，histogram_quantile 会出错）
+type Histogram struct {
+	upper  []float64
+	mu     sync.Mutex
+	counts []uint64
+	count  uint64
+	sum    float64
+}
+
+func (h *Histogram) Observe(v float64) {
+	i := sort.SearchFloat64s(h.upper, v) // 第一个 >= v 的桶
+	h.mu.Lock()
+	if i < len(h.counts) {
+		h.counts[i]++
+	}
+	h.count++
+	h.sum += v
+	h.mu.Unlock()
+}
+
+// snapshot 在锁内复制各桶计数、count 与 sum
+func (h *Histogram) snapshot() (counts []uint64, count uint64, sum float64) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return append([]uint64(nil), h.counts...), h.count, h.sum
+}
+
+// ObserveDuration 以秒为单位记录耗时
+func (h *Histogram) ObserveDuration(d time.Duration) { h.Observe(d.Seconds()) }
+
+// Since 记录自 t0 起的耗时
+func (h *Histogram) Since(t0 time.Time) { h.ObserveDuration(time.Since(t0)) }
+
+type HistogramVec struct {
+	f       *family
+	buckets []float64
+}
+
+func NewHistogramVec(name, help string, buckets []float64, labels ...string) *HistogramVec {
+	if len(buckets) == 0 {
+		buckets = DefBuckets
+	}
+	b := append([]float64(nil), buckets...)
+	sort.Float64s(b)
+	hv := &HistogramVec{buckets: b}
+	hv.f = newFamily(name, help, "histogram", labels, func() interface{} {
+		return &Histogram{upper: b, counts: make([]uint64, len(b))}
+	})
+	Default.register(hv)
+	return hv
+}
+
+func NewHistogram(name, help string, buckets []float64) *Histogram {
+	return NewHistogramVec(name, help, buckets).With()
+}
+
+func (hv *HistogramVec) With(vals ...string) *Histogram { return hv.f.child(vals).(*Histogram) }
+func (hv *HistogramVec) name() string                   { return hv.f.fname }
+func (hv *HistogramVec) write(w *bufio.Writer) {
+	hv.f.header(w)
+	hv.f.each(func(labels string, c interface{}) {
+		h := c.(*Histogram)
+		counts, total, sum := h.snapshot()
+		var cum uint64
+		for i, ub := range h.upper {
+			cum += counts[i]
+			fmt.Fprintf(w, "%s_bucket%s %d\n", hv.f.fname, withLabel(labels, "le", formatFloat(ub)), cum)
+		}
+		fmt.Fprintf(w, "%s_bucket%s %d\n", hv.f.fname, withLabel(labels, "le", "+Inf"), total)
+		fmt.Fprintf(w, "%s_sum%s %s\n", hv.f.fname, labels, formatFloat(sum))
+		fmt.Fprintf(w, "%s_count%s %d\n", hv.f.fname, labels, total)
+	})
+}
+
+// ---- 格式化 ----
+
+func formatLabels(names, vals []string) string {
+	if len(names) == 0 {
+		return ""
+	}
+	var b strings.Builder
+	b.WriteByte('{')
+	for i, n := range names {
+		if i > 0 {
+			b.WriteByte(',')
+		}
+		b.WriteString(n)
+		b.WriteString(`="`)
+		b.WriteString(escapeLabel(vals[i]))
+		b.WriteByte('"')
+	}
+	b.WriteByte('}')
+	return b.String()
+}
+
+// withLabel 在已格式化的标签串后追加一个标签（用于 histogram 的 le）
+func withLabel(labels, name, val string) string {
+	extra := name + `="` + val + `"`
+	if labels == "" {
+		return "{" + extra + "}"
+	}
+	return labels[:len(labels)-1] + "," + extra + "}"
+}
+
+func escapeLabel(s string) string {
+	s = strings.ReplaceAll(s, `\`, `\\`)
+	s = strings.ReplaceAll(s, `"`, `\"`)
+	return strings.ReplaceAll(s, "\n", `\n`)
+}
+
+func escapeHelp(s string) string {
+	s = strings.ReplaceAll(s, `\`, `\\`)
+	return strings.ReplaceAll(s, "\n", `\n`)
+}
+
+func formatFloat(v float64) string {
+	switch {
+	case math.IsInf(v, 1):
+		return "+Inf"
+	case math.IsInf(v, -1):
+		return "-Inf"
+	case math.IsNaN(v):
+		return "NaN"
+	}
+	return strconv.FormatFloat(v, 'g', -1, 64)
+}
@@ -0,0 +1,48 @@
+package metrics
+
+// qproxy 各环节共享的指标定义（池状态 gauge 由 main 通过 NewGaugeFunc 注册）
+var (
+	// AcquireSeconds 租用会话的等待时间（含健康检查与必要时的重拨）
+	AcquireSeconds = NewHistogram("qproxy_pool_acquire_seconds",
+		"Time spent waiting in pool.Acquire.", nil)
+
+	// AskSeconds 一次 AskOnce（发送 prompt 到拿到完整回答）的耗时
+	AskSeconds = NewHistogram("qproxy_ask_seconds",
+		"Latency of AskOnce calls to q chat.", nil)
+
+	// CommandSeconds 斜杠命令耗时，cmd=load/compact/save/clear
+	CommandSeconds = NewHistogramVec("qproxy_command_seconds",
+		"Latency of q chat slash commands.", nil, "cmd")
+
+	// ConnErrors 连接类错误次数，stage=acquire/load/ask/compact/save/clear
+	ConnErrors = NewCounterVec("qproxy_conn_errors_total",
+		"Connection errors talking to the chat backend.", "stage")
+
+	// QuotaExhausted 仅返回提示符（疑似配额耗尽）的次数
+	QuotaExhausted = NewCounter("qproxy_quota_exhausted_total",
+		"Responses that contained only the prompt (likely quota exhausted).")
+
+	// Outputs 回答是否可用（决定是否 /compact + /save），usable=true/false
+	Outputs = NewCounterVec("qproxy_outputs_total",
+		"Answers classified by the usable-output heuristic.", "usable")
+
+	// SchemaValidations 输出 schema 校验结果，result=valid/repaired/invalid
+	SchemaValidations = NewCounterVec("qproxy_schema_validations_total",
+		"Answers checked against the output schema.", "result")
+
+	// SopLockWaitSeconds 等待同一 sop_id 会话文件锁的时间
+	SopLockWaitSeconds = NewHistogram("qproxy_sop_lock_wait_seconds",
+		"Time spent waiting for the per-SOP conversation lock.", nil)
+
+	// AffinityLeases 亲和租用结果，result=hit/miss/steal
+	AffinityLeases = NewCounterVec("qproxy_pool_affinity_leases_total",
+		"Session leases by affinity result.", "result")
+
+	// DedupHits 去重命中，source=inflight/cached
+	DedupHits = NewCounterVec("qproxy_dedup_hits_total",
+		"Requests answered by an in-flight or cached run of the same incident_key.", "source")
+
+	// SopMatches SOP 匹配结果，result=hit/miss
+	SopMatches = NewCounterVec("qproxy_sop_match_total",
+		"SOP lookups for incoming alerts.", "result")
+)
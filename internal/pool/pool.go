@@ -1,253 +1,632 @@
 package pool
 
 import (
+	"container/list"
 	"context"
-	"log"
-	"math"
+	"errors"
 	"math/rand"
+	"sync"
 	"sync/atomic"
 	"time"
 
+	"aiops-qproxy/internal/logx"
+	"aiops-qproxy/internal/qerr"
 	"aiops-qproxy/internal/qflow"
+	"aiops-qproxy/internal/tracing"
 )
 
+// ErrClosed 池已关闭
+var ErrClosed = errors.New("pool: closed")
+
+// Factory 创建一个新的聊天客户端（ttyd 会话、本地 q 进程等）
+type Factory func(ctx context.Context) (qflow.ChatClient, error)
+
+// SessionFactory 按 qflow.Opts 创建 *qflow.Session（支持斜杠命令、回显清理与断线重连）
+func SessionFactory(o qflow.Opts) Factory {
+	return func(ctx context.Context) (qflow.ChatClient, error) {
+		s, err := qflow.New(ctx, o)
+		if err != nil {
+			return nil, err
+		}
+		return s, nil
+	}
+}
+
+// Options 是池的配置
+type Options struct {
+	Size        int
+	Factory     Factory
+	DialTimeout time.Duration // 单次创建的超时，默认 45s
+	HealthTO    time.Duration // 租用前健康探测的超时，默认 1s
+	MaxBackoff  time.Duration // 后台补充失败时的最大退避，默认 30s
+}
+
+// Pool 是围绕 Factory 的通用客户端池：预热、租用前探活、坏连接替换、
+// 带抖动退避的后台补充、按 sop_id 的亲和租用，以及 Close 时的排空
 type Pool struct {
+	opt            Options
 	size           int
-	slots          chan *qflow.Session
-	opts           qflow.Opts
+	slots          chan qflow.ChatClient
 	fillingWorkers int32 // 正在后台填充的 goroutine 数量（原子操作）
-	failedAttempts int32 // 连续失败次数（原子操作），用于避免无限重试
-	healthy        int32 // 健康状态标记
+	failedAttempts int32 // 连续失败次数（原子操作）
+	healthy        int32 // 预热完成标记
+
+	ctx    context.Context // Close 时取消，终止预热与补充
+	cancel context.CancelFunc
+	wg     sync.WaitGroup
+	ready  chan struct{} // 第一个客户端就绪时关闭
+	once   sync.Once
+
+	// 亲和会话：空闲但仍在内存中保留某个 sop_id 对话的会话（LRU，front 为最近使用）
+	mu      sync.Mutex
+	closed  bool
+	maxWarm int
+	warm    map[string]*list.Element
+	warmLRU *list.List
 }
 
-func New(ctx context.Context, size int, o qflow.Opts) (*Pool, error) {
+type warmEntry struct {
+	sopID string
+	c     qflow.ChatClient
+}
+
+// New 创建池并在后台预热 Size 个客户端；ctx 仅用于取消预热
+func New(ctx context.Context, opt Options) (*Pool, error) {
+	if opt.Factory == nil {
+		return nil, errors.New("pool: nil factory")
+	}
+	if opt.Size <= 0 {
+		opt.Size = 1
+	}
+	if opt.DialTimeout <= 0 {
+		opt.DialTimeout = 45 * time.Second
+	}
+	if opt.HealthTO <= 0 {
+		opt.HealthTO = time.Second
+	}
+	if opt.MaxBackoff <= 0 {
+		opt.MaxBackoff = 30 * time.Second
+	}
+	pctx, cancel := context.WithCancel(context.Background())
 	p := &Pool{
-		size:  size,
-		slots: make(chan *qflow.Session, size),
-		opts:  o,
+		opt:     opt,
+		size:    opt.Size,
+		slots:   make(chan qflow.ChatClient, opt.Size),
+		ctx:     pctx,
+		cancel:  cancel,
+		ready:   make(chan struct{}),
+		warm:    make(map[string]*list.Element),
+		warmLRU: list.New(),
 	}
 
-	// 预创建：启动后尽快填满池，使用更合理的间隔和错误处理
+	// 预热：错开创建，避免同时打满后端；失败的由后台补充继续重试
+	p.wg.Add(1)
 	go func() {
-		for i := 0; i < size; i++ {
-			if i > 0 {
-				// 使用更长的间隔，避免同时创建太多连接
-				time.Sleep(time.Duration(i*500) * time.Millisecond)
+		defer p.wg.Done()
+		for i := 0; i < p.size; i++ {
+			if i > 0 && !p.sleep(time.Duration(i*500)*time.Millisecond) {
+				return
+			}
+			if ctx.Err() != nil {
+				logx.Infof(p.ctx, "pool: warmup canceled after %d/%d sessions", i, p.size)
+				return
 			}
-			
-			// 使用带超时的 context
-			fillCtx, cancel := context.WithTimeout(context.Background(), 60*time.Second)
-			success := p.fillOne(fillCtx)
-			cancel()
-			
-			if !success {
-				log.Printf("pool: failed to create initial session %d/%d", i+1, size)
-				// 如果是 exec 模式失败，可能是 Q CLI 问题，继续尝试其他连接
-				if p.opts.ExecMode {
-					continue
-				}
-				// WebSocket 模式失败可能是服务不可用，等待更长时间再试
-				time.Sleep(5 * time.Second)
+			if !p.fillOnce() {
+				logx.Warnf(p.ctx, "pool: failed to create initial session %d/%d, retrying in background", i+1, p.size)
+				p.refill()
 			}
 		}
-		
-		// 标记池为健康状态
 		atomic.StoreInt32(&p.healthy, 1)
-		log.Printf("pool: initialization completed, %d sessions ready", len(p.slots))
+		logx.Infof(p.ctx, "pool: initialization completed, %d sessions ready", len(p.slots))
 	}()
-
 	return p, nil
 }
 
+// SetAffinity 设置最多保留的亲和会话数；0 关闭亲和（归还时不保留对话）
+func (p *Pool) SetAffinity(maxWarm int) {
+	if maxWarm < 0 {
+		maxWarm = 0
+	}
+	if maxWarm > p.size {
+		maxWarm = p.size
+	}
+	p.mu.Lock()
+	p.maxWarm = maxWarm
+	evicted := p.trimWarmLocked()
+	p.mu.Unlock()
+	for _, c := range evicted {
+		go p.recycle(c)
+	}
+}
+
+// AffinityEnabled 是否启用了亲和租用
+func (p *Pool) AffinityEnabled() bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.maxWarm > 0
+}
+
 type Lease struct {
 	p  *Pool
-	s  *qflow.Session
+	c  qflow.ChatClient
 	t0 time.Time
 	// mark bad sessions so we don't put them back
 	broken bool
+	// warm: 会话内存中已是该 sop_id 的对话；dirty: 持有其他 sop_id 的对话，使用前需 /clear
+	warm   bool
+	dirty  bool
+	dialed bool // 没有空闲会话，租用时新建
+	keep   string
+}
+
+// AcquireFor 按 sop_id 亲和租用：优先取上次服务同一 sop_id 且仍保留对话的会话，
+// 否则退回 Acquire（空闲会话 → 抢占最久未用的亲和会话 → 直接创建）
+func (p *Pool) AcquireFor(ctx context.Context, sopID string) (*Lease, error) {
+	ctx, sp := tracing.Start(ctx, "pool.acquire", tracing.Attr{Key: "sop_id", Value: sopID})
+	l, err := p.acquireFor(ctx, sopID)
+	endAcquireSpan(sp, l, err)
+	return l, err
+}
+
+func (p *Pool) acquireFor(ctx context.Context, sopID string) (*Lease, error) {
+	if sopID != "" {
+		if c := p.takeWarm(sopID); c != nil {
+			if p.healthCheck(ctx, c) {
+				return &Lease{p: p, c: c, t0: time.Now(), warm: true}, nil
+			}
+			logx.Warnf(logx.With(ctx, logx.SessionID, sessionID(c)), "pool: unhealthy warm session for sop_id=%s, dropping", sopID)
+			p.discard(c)
+		}
+	}
+	return p.acquire(ctx)
 }
 
+// Acquire 租用一个健康的客户端；没有空闲客户端时同步创建
 func (p *Pool) Acquire(ctx context.Context) (*Lease, error) {
-	// 检查池是否健康
-	if atomic.LoadInt32(&p.healthy) == 0 {
-		log.Printf("pool: not yet healthy, attempting direct creation")
+	ctx, sp := tracing.Start(ctx, "pool.acquire")
+	l, err := p.acquire(ctx)
+	endAcquireSpan(sp, l, err)
+	return l, err
+}
+
+// endAcquireSpan 记录租用结果：会话来源（warm 亲和/dirty 抢占/空闲或新建）与 session_id
+func endAcquireSpan(sp *tracing.Span, l *Lease, err error) {
+	if err != nil {
+		sp.RecordError(err)
+	} else {
+		src := "idle"
+		switch {
+		case l.warm:
+			src = "warm"
+		case l.dirty:
+			src = "steal"
+		case l.dialed:
+			src = "dial"
+		}
+		sp.SetAttr("source", src)
+		sp.SetAttr("session_id", l.ID())
 	}
-	
-	// 最多尝试3次，避免拿到已被对端回收的旧连接
-	for attempt := 0; attempt < 3; attempt++ {
+	sp.End()
+}
+
+func (p *Pool) acquire(ctx context.Context) (*Lease, error) {
+	for {
+		if p.isClosed() {
+			return nil, qerr.New(qerr.ErrPoolExhausted, "acquire", ErrClosed)
+		}
 		select {
-		case s := <-p.slots:
-			// 轻量健康校验：使用更合理的超时时间
-			hcTO := 1 * time.Second
-			if dl, ok := ctx.Deadline(); ok {
-				if rem := time.Until(dl); rem > 0 && rem < hcTO {
-					hcTO = rem / 2 // 使用剩余时间的一半
-				}
-			}
-			hcCtx, cancel := context.WithTimeout(ctx, hcTO)
-			healthy := s.Healthy(hcCtx)
-			cancel()
-			
-			if healthy {
-				return &Lease{p: p, s: s, t0: time.Now()}, nil
+		case c := <-p.slots:
+			if p.healthCheck(ctx, c) {
+				return &Lease{p: p, c: c, t0: time.Now()}, nil
 			}
-			
-			// 不健康：关闭并同步创建一个替代
-			log.Printf("pool: unhealthy session detected, replacing")
-			_ = s.Close()
-			
-			// 尝试创建新会话
-			createCtx, cancel := context.WithTimeout(ctx, 30*time.Second)
-			ns, err := qflow.New(createCtx, p.opts)
-			cancel()
-			
-			if err == nil {
-				return &Lease{p: p, s: ns, t0: time.Now()}, nil
-			}
-			
-			log.Printf("pool: failed to create replacement session: %v", err)
-			// 创建失败则继续下一轮（或落入下面的拨号）
-			
+			logx.Warnf(logx.With(ctx, logx.SessionID, sessionID(c)), "pool: unhealthy session detected, replacing")
+			p.discard(c)
+			continue
 		case <-ctx.Done():
 			return nil, ctx.Err()
-			
 		default:
-			// 没有可用连接：同步拨号
-			log.Printf("pool: no available sessions, creating new one")
-			createCtx, cancel := context.WithTimeout(ctx, 45*time.Second)
-			ns, err := qflow.New(createCtx, p.opts)
-			cancel()
-			
-			if err != nil {
-				log.Printf("pool: direct session creation failed: %v", err)
-				return nil, err
+		}
+
+		// 没有空闲连接：先抢占最久未用的亲和会话（比创建便宜）
+		if c, from := p.stealWarm(); c != nil {
+			if p.healthCheck(ctx, c) {
+				logx.Infof(logx.With(ctx, logx.SessionID, sessionID(c)), "pool: no free sessions, reusing warm session of sop_id=%s", from)
+				return &Lease{p: p, c: c, t0: time.Now(), dirty: true}, nil
+			}
+			p.discard(c)
+			continue
+		}
+
+		logx.Infof(ctx, "pool: no available sessions, creating new one")
+		c, err := p.dial(ctx)
+		if err != nil {
+			logx.Warnf(ctx, "pool: direct session creation failed: %v", err)
+			if ctx.Err() != nil {
+				return nil, qerr.New(qerr.ErrTimeout, "acquire", ctx.Err())
 			}
-			return &Lease{p: p, s: ns, t0: time.Now()}, nil
+			return nil, qerr.New(qerr.ErrPoolExhausted, "acquire", err)
 		}
+		return &Lease{p: p, c: c, t0: time.Now(), dialed: true}, nil
 	}
-	
-	// 理论上不会到这里，但提供一个最后的回退
-	log.Printf("pool: all acquire attempts failed, trying one more direct creation")
-	createCtx, cancel := context.WithTimeout(ctx, 30*time.Second)
-	defer cancel()
-	ns, err := qflow.New(createCtx, p.opts)
-	if err != nil {
-		return nil, err
+}
+
+// WaitReady 等待至少一个客户端创建成功（预热或补充均可）
+func (p *Pool) WaitReady(ctx context.Context) error {
+	select {
+	case <-p.ready:
+		return nil
+	case <-p.ctx.Done():
+		return ErrClosed
+	case <-ctx.Done():
+		return ctx.Err()
 	}
-	return &Lease{p: p, s: ns, t0: time.Now()}, nil
 }
 
-func (l *Lease) Session() *qflow.Session { return l.s }
-func (l *Lease) MarkBroken()             { l.broken = true }
+// Close 停止预热与补充，关闭所有空闲与亲和客户端；租出的客户端在归还时关闭
+func (p *Pool) Close() error {
+	p.mu.Lock()
+	if p.closed {
+		p.mu.Unlock()
+		return nil
+	}
+	p.closed = true
+	var idle []qflow.ChatClient
+	for el := p.warmLRU.Front(); el != nil; el = el.Next() {
+		idle = append(idle, el.Value.(*warmEntry).c)
+	}
+	p.warm = make(map[string]*list.Element)
+	p.warmLRU.Init()
+	p.mu.Unlock()
 
-func (l *Lease) Release() {
-	if l.broken {
-		// Replace it in background
-		_ = l.s.Close()
-		
-		// 限制并发 fillOne goroutine 数量，避免泄漏
-		current := atomic.LoadInt32(&l.p.fillingWorkers)
-		if current < int32(l.p.size*2) { // 允许最多 size*2 个 goroutine 在填充
-			atomic.AddInt32(&l.p.fillingWorkers, 1)
-			go func() {
-				defer atomic.AddInt32(&l.p.fillingWorkers, -1)
-				fillCtx, cancel := context.WithTimeout(context.Background(), 60*time.Second)
-				defer cancel()
-				l.p.fillOne(fillCtx)
-			}()
-		} else {
-			log.Printf("pool: skipping fillOne, already %d workers running", current)
+	p.cancel()
+	p.wg.Wait()
+drain:
+	for {
+		select {
+		case c := <-p.slots:
+			idle = append(idle, c)
+		default:
+			break drain
 		}
-		return
 	}
-	
-	// 非阻塞归还，防止因通道已满导致调用方卡死
+	for _, c := range idle {
+		_ = c.Close()
+	}
+	logx.Infof(p.ctx, "pool: closed, %d idle sessions closed", len(idle))
+	return nil
+}
+
+func (p *Pool) isClosed() bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.closed
+}
+
+// put 把客户端放回空闲队列；池已关闭或空闲会话（含亲和会话）已达 Size 时关闭客户端
+func (p *Pool) put(c qflow.ChatClient) bool {
+	p.mu.Lock()
+	if p.closed {
+		p.mu.Unlock()
+		_ = c.Close()
+		return false
+	}
+	if p.idleLocked() >= p.size {
+		p.mu.Unlock()
+		_ = c.Close()
+		logx.Infof(p.ctx, "pool: %d idle sessions (including warm), dropping session", p.size)
+		return false
+	}
 	select {
-	case l.p.slots <- l.s:
-		// 成功归还
+	case p.slots <- c:
+		p.mu.Unlock()
+		p.once.Do(func() { close(p.ready) })
+		return true
 	default:
-		// 通道已满，关闭这个会话
-		_ = l.s.Close()
-		log.Printf("pool: slots full, dropping session on release")
+		p.mu.Unlock()
+		_ = c.Close()
+		logx.Infof(p.ctx, "pool: slots full, dropping session")
+		return false
 	}
 }
 
-func (p *Pool) fillOne(ctx context.Context) bool {
-	// 检查连续失败次数，避免无限重试
-	failed := atomic.LoadInt32(&p.failedAttempts)
-	if failed > 20 { // 增加最大失败次数，但添加更长的退避
-		log.Printf("pool: too many consecutive failures (%d), refusing to retry", failed)
-		return false
+// discard 关闭坏客户端并在后台补一个
+func (p *Pool) discard(c qflow.ChatClient) {
+	_ = c.Close()
+	p.refill()
+}
+
+// takeWarm 取出 sop_id 对应的亲和会话
+func (p *Pool) takeWarm(sopID string) qflow.ChatClient {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	el, ok := p.warm[sopID]
+	if !ok {
+		return nil
 	}
+	delete(p.warm, sopID)
+	return p.warmLRU.Remove(el).(*warmEntry).c
+}
 
-	backoff := 1 * time.Second // 使用更合理的初始退避时间
-	maxAttempts := 3 // 减少重试次数，但增加单次超时
-	
-	for attempt := 1; attempt <= maxAttempts; attempt++ {
-		log.Printf("pool: attempting to create session (attempt %d/%d, total_failures=%d)", attempt, maxAttempts, failed)
-		
-		// 为每次拨号设置合理的超时
-		dialTO := 45 * time.Second
-		if p.opts.ExecMode {
-			dialTO = 30 * time.Second // exec 模式可以更快
-		}
-		
-		attemptCtx, cancel := context.WithTimeout(ctx, dialTO)
-		s, err := qflow.New(attemptCtx, p.opts)
-		cancel()
-		
-		if err == nil {
-			log.Printf("pool: session created successfully")
-			// 重置失败计数
-			atomic.StoreInt32(&p.failedAttempts, 0)
-			
-			select {
-			case p.slots <- s:
-				log.Printf("pool: session added to pool")
-				return true
-			case <-ctx.Done():
-				_ = s.Close()
-				return false
-			}
+// stealWarm 取出最久未用的亲和会话（其对话属于其他 sop_id，调用方需先 /clear）
+func (p *Pool) stealWarm() (qflow.ChatClient, string) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	el := p.warmLRU.Back()
+	if el == nil {
+		return nil, ""
+	}
+	e := p.warmLRU.Remove(el).(*warmEntry)
+	delete(p.warm, e.sopID)
+	return e.c, e.sopID
+}
+
+// park 把会话作为 sop_id 的亲和会话放回；超出上限时按 LRU 淘汰
+func (p *Pool) park(sopID string, c qflow.ChatClient) {
+	p.mu.Lock()
+	if p.closed {
+		p.mu.Unlock()
+		_ = c.Close()
+		return
+	}
+	var evicted []qflow.ChatClient
+	if el, ok := p.warm[sopID]; ok {
+		// 同一 sop_id 已有亲和会话（并发请求），旧的淘汰
+		evicted = append(evicted, p.warmLRU.Remove(el).(*warmEntry).c)
+	}
+	p.warm[sopID] = p.warmLRU.PushFront(&warmEntry{sopID: sopID, c: c})
+	evicted = append(evicted, p.trimWarmLocked()...)
+	// 亲和会话计入 Size：租出期间补充或新建的会话可能已占满空闲队列，
+	// 超出时先关闭空闲会话，再关闭最久未用的亲和会话
+	var extra []qflow.ChatClient
+	for p.idleLocked() > p.size {
+		select {
+		case ic := <-p.slots:
+			extra = append(extra, ic)
+		default:
+			e := p.warmLRU.Remove(p.warmLRU.Back()).(*warmEntry)
+			delete(p.warm, e.sopID)
+			logx.Infof(p.ctx, "pool: evicting affinity for sop_id=%s (pool full)", e.sopID)
+			extra = append(extra, e.c)
 		}
+	}
+	p.mu.Unlock()
+	for _, ec := range extra {
+		_ = ec.Close()
+	}
+	for _, ec := range evicted {
+		go p.recycle(ec)
+	}
+}
 
-		// 增加失败计数
-		atomic.AddInt32(&p.failedAttempts, 1)
-		log.Printf("pool: dial failed (attempt %d/%d): %v", attempt, maxAttempts, err)
+// idleLocked 空闲会话数（含亲和会话），不超过 Size
+func (p *Pool) idleLocked() int {
+	return len(p.slots) + p.warmLRU.Len()
+}
+
+// full 空闲会话（含亲和会话）是否已达 Size
+func (p *Pool) full() bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.idleLocked() >= p.size
+}
+
+func (p *Pool) trimWarmLocked() []qflow.ChatClient {
+	var evicted []qflow.ChatClient
+	for p.warmLRU.Len() > p.maxWarm {
+		e := p.warmLRU.Remove(p.warmLRU.Back()).(*warmEntry)
+		delete(p.warm, e.sopID)
+		logx.Infof(p.ctx, "pool: evicting affinity for sop_id=%s (lru)", e.sopID)
+		evicted = append(evicted, e.c)
+	}
+	return evicted
+}
+
+// clearer 是支持清空对话的客户端（*qflow.Session）
+type clearer interface {
+	ClearWithContext(ctx context.Context) error
+}
 
-		if attempt == maxAttempts {
-			log.Printf("pool: max attempts reached, giving up (total_failures=%d)", atomic.LoadInt32(&p.failedAttempts))
-			return false
+// recycle 清空被淘汰会话的对话后放回空闲队列；空闲会话已满时直接关闭，省去 /clear
+func (p *Pool) recycle(c qflow.ChatClient) {
+	if p.full() {
+		_ = c.Close()
+		return
+	}
+	if cl, ok := c.(clearer); ok {
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		defer cancel()
+		if err := cl.ClearWithContext(ctx); err != nil {
+			logx.Warnf(logx.With(p.ctx, logx.SessionID, sessionID(c)), "pool: /clear on evicted session failed: %v", err)
+			p.discard(c)
+			return
 		}
+	}
+	p.put(c)
+}
 
-		// 使用指数退避，但有上限
-		sleep := withJitter(backoff)
-		if backoff < 10*time.Second {
-			backoff = time.Duration(math.Min(float64(backoff*2), float64(10*time.Second)))
+// healthCheck 租用前的轻量探活：不超过 HealthTO，也不超过 ctx 剩余时间的一半
+func (p *Pool) healthCheck(ctx context.Context, c qflow.ChatClient) bool {
+	hcTO := p.opt.HealthTO
+	if dl, ok := ctx.Deadline(); ok {
+		if rem := time.Until(dl); rem > 0 && rem < hcTO {
+			hcTO = rem / 2
 		}
-		
-		log.Printf("pool: retry in %v", sleep)
-		select {
-		case <-time.After(sleep):
-		case <-ctx.Done():
-			return false
+	}
+	hcCtx, cancel := context.WithTimeout(ctx, hcTO)
+	defer cancel()
+	hcCtx, sp := tracing.Start(hcCtx, "pool.health_check", tracing.Attr{Key: "session_id", Value: sessionID(c)})
+	err := c.Ping(hcCtx)
+	sp.RecordError(err)
+	sp.End()
+	return err == nil
+}
+
+// Client 租到的客户端
+func (l *Lease) Client() qflow.ChatClient { return l.c }
+
+// ID 租到的会话的 session_id（客户端不提供 ID 时为空）
+func (l *Lease) ID() string { return sessionID(l.c) }
+
+// sessionID 取客户端的 session_id（*qflow.Session 等实现了 ID() 的客户端）
+func sessionID(c qflow.ChatClient) string {
+	if v, ok := c.(interface{ ID() string }); ok {
+		return v.ID()
+	}
+	return ""
+}
+
+// Session 租到的会话；工厂返回的不是 *qflow.Session 时包装为无状态会话
+func (l *Lease) Session() *qflow.Session {
+	if s, ok := l.c.(*qflow.Session); ok {
+		return s
+	}
+	return qflow.Wrap(l.c)
+}
+
+// MarkBroken 归还时关闭客户端并在后台补一个
+func (l *Lease) MarkBroken() { l.broken = true }
+
+// Warm 会话内存中已是本次 sop_id 的对话，可跳过 /load
+func (l *Lease) Warm() bool { return l.warm }
+
+// Dirty 会话仍持有其他 sop_id 的对话，使用前需 /clear
+func (l *Lease) Dirty() bool { return l.dirty }
+
+// Keep 归还时保留会话中的对话，作为 sop_id 的亲和会话（代替 /clear）
+func (l *Lease) Keep(sopID string) { l.keep = sopID }
+
+func (l *Lease) Release() {
+	if l.broken {
+		l.p.discard(l.c)
+		return
+	}
+	if l.keep != "" && l.p.AffinityEnabled() {
+		l.p.park(l.keep, l.c)
+		return
+	}
+	l.p.put(l.c)
+}
+
+// dial 用 Factory 创建一个客户端（单次超时 DialTimeout）；session_id 在此分配，拨号日志即可关联
+func (p *Pool) dial(ctx context.Context) (qflow.ChatClient, error) {
+	id := logx.NewID("s")
+	ctx = logx.With(ctx, logx.SessionID, id)
+	dctx, cancel := context.WithTimeout(ctx, p.opt.DialTimeout)
+	defer cancel()
+	dctx, sp := tracing.Start(dctx, "pool.dial", tracing.Attr{Key: "session_id", Value: id})
+	c, err := p.opt.Factory(dctx)
+	sp.RecordError(err)
+	sp.End()
+	if err != nil {
+		atomic.AddInt32(&p.failedAttempts, 1)
+		return nil, err
+	}
+	atomic.StoreInt32(&p.failedAttempts, 0)
+	return c, nil
+}
+
+// fillOnce 创建一个客户端放入空闲队列；空闲会话（含亲和会话）已满时不再创建
+func (p *Pool) fillOnce() bool {
+	if p.full() {
+		return true
+	}
+	c, err := p.dial(p.ctx)
+	if err != nil {
+		logx.Warnf(p.ctx, "pool: dial failed (total_failures=%d): %v", atomic.LoadInt32(&p.failedAttempts), err)
+		return false
+	}
+	logx.Infof(logx.With(p.ctx, logx.SessionID, sessionID(c)), "pool: session created successfully")
+	return p.put(c)
+}
+
+// refill 在后台补一个客户端，失败时按带抖动的指数退避重试，直到成功或池关闭
+func (p *Pool) refill() {
+	// 最多 size 个补充 goroutine，避免后端不可用时堆积
+	if n := atomic.AddInt32(&p.fillingWorkers, 1); n > int32(p.size) {
+		atomic.AddInt32(&p.fillingWorkers, -1)
+		logx.Infof(p.ctx, "pool: skipping refill, already %d workers running", n-1)
+		return
+	}
+	p.mu.Lock()
+	if p.closed {
+		p.mu.Unlock()
+		atomic.AddInt32(&p.fillingWorkers, -1)
+		return
+	}
+	p.wg.Add(1)
+	p.mu.Unlock()
+	go func() {
+		defer p.wg.Done()
+		defer atomic.AddInt32(&p.fillingWorkers, -1)
+		backoff := time.Second
+		for !p.fillOnce() {
+			if p.isClosed() {
+				return
+			}
+			sleep := withJitter(backoff)
+			logx.Infof(p.ctx, "pool: refill retry in %v", sleep)
+			if !p.sleep(sleep) {
+				return
+			}
+			if backoff *= 2; backoff > p.opt.MaxBackoff {
+				backoff = p.opt.MaxBackoff
+			}
 		}
+	}()
+}
+
+// sleep 等待 d；池关闭时返回 false
+func (p *Pool) sleep(d time.Duration) bool {
+	t := time.NewTimer(d)
+	defer t.Stop()
+	select {
+	case <-t.C:
+		return true
+	case <-p.ctx.Done():
+		return false
 	}
-	
-	return false
 }
 
 func withJitter(d time.Duration) time.Duration {
-	delta := d / 4 // 减少抖动范围
+	if d < 4 {
+		return d // delta 为 0 时 rand.Int63n 会 panic
+	}
+	delta := d / 4 // ±25% 抖动
 	return d - delta + time.Duration(rand.Int63n(int64(2*delta)))
 }
 
-// Stats returns (ready,size).
+func (p *Pool) warmLen() int {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.warmLRU.Len()
+}
+
+// Stats returns (ready,size). ready 包含亲和会话
 func (p *Pool) Stats() (int, int) {
-	return len(p.slots), p.size
+	return len(p.slots) + p.warmLen(), p.size
+}
+
+// Snapshot 是池内部状态的快照，供 /metrics 使用
+type Snapshot struct {
+	Ready          int
+	Warm           int
+	Size           int
+	FillingWorkers int
+	FailedAttempts int
+}
+
+func (p *Pool) Snapshot() Snapshot {
+	warm := p.warmLen()
+	return Snapshot{
+		Ready:          len(p.slots) + warm,
+		Warm:           warm,
+		Size:           p.size,
+		FillingWorkers: int(atomic.LoadInt32(&p.fillingWorkers)),
+		FailedAttempts: int(atomic.LoadInt32(&p.failedAttempts)),
+	}
 }
 
-// IsHealthy returns whether the pool has been successfully initialized
+// IsHealthy returns whether the pool has finished warmup
 func (p *Pool) IsHealthy() bool {
 	return atomic.LoadInt32(&p.healthy) > 0
 }
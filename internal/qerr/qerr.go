@@ -0,0 +1,105 @@
+package qerr
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+)
+
+// Kind 是错误分类，同时作为哨兵错误：errors.Is(err, qerr.ErrTimeout)
+type Kind struct {
+	Code      string // 机器可读的错误码，写入 HTTP 错误体
+	Status    int    // 对应的 HTTP 状态码
+	Retryable bool   // 调用方（如 n8n）稍后重试是否可能成功
+}
+
+func (k *Kind) Error() string { return k.Code }
+
+var (
+	ErrConnLost       = &Kind{Code: "conn_lost", Status: http.StatusBadGateway, Retryable: true}              // 与 Q 的连接断开
+	ErrQuotaExhausted = &Kind{Code: "quota_exhausted", Status: http.StatusTooManyRequests}                    // Q 配额耗尽，短时间内重试无用
+	ErrTimeout        = &Kind{Code: "timeout", Status: http.StatusGatewayTimeout, Retryable: true}            // 等待回答或锁超时
+	ErrPromptOnly     = &Kind{Code: "prompt_only", Status: http.StatusBadGateway, Retryable: true}            // Q 只返回了提示符，没有回答
+	ErrPoolExhausted  = &Kind{Code: "pool_exhausted", Status: http.StatusServiceUnavailable, Retryable: true} // 无可用会话且无法新建
+	ErrBadInput       = &Kind{Code: "bad_input", Status: http.StatusBadRequest}                               // 请求内容不合法
+	ErrInternal       = &Kind{Code: "internal", Status: http.StatusInternalServerError}                       // 未归类的错误
+)
+
+// Error 是带分类的错误；Unwrap 保留原始错误，Is 匹配分类
+type Error struct {
+	Kind *Kind
+	Op   string // 出错的步骤，如 acquire/ask/load/save
+	Err  error
+}
+
+func (e *Error) Error() string {
+	msg := e.Kind.Code
+	if e.Err != nil {
+		msg = e.Err.Error()
+	}
+	if e.Op != "" {
+		return e.Op + ": " + msg
+	}
+	return msg
+}
+
+func (e *Error) Unwrap() error { return e.Err }
+
+func (e *Error) Is(target error) bool { return target == e.Kind }
+
+// New 创建分类错误；err 已是同一分类时原样返回
+func New(k *Kind, op string, err error) error {
+	var e *Error
+	if errors.As(err, &e) && e.Kind == k {
+		return err
+	}
+	return &Error{Kind: k, Op: op, Err: err}
+}
+
+// Errorf 以格式化消息创建分类错误
+func Errorf(k *Kind, format string, args ...interface{}) error {
+	return &Error{Kind: k, Err: fmt.Errorf(format, args...)}
+}
+
+// KindOf 返回 err 的分类；未分类的 context 超时视为 ErrTimeout，其余为 ErrInternal
+func KindOf(err error) *Kind {
+	var e *Error
+	if errors.As(err, &e) {
+		return e.Kind
+	}
+	var k *Kind
+	if errors.As(err, &k) {
+		return k
+	}
+	if errors.Is(err, context.DeadlineExceeded) {
+		return ErrTimeout
+	}
+	return ErrInternal
+}
+
+// Body 是 HTTP 错误响应体
+type Body struct {
+	Error     string `json:"error"`
+	Code      string `json:"code"`
+	Retryable bool   `json:"retryable"`
+}
+
+// BodyOf 生成 err 的错误体
+func BodyOf(err error) Body {
+	k := KindOf(err)
+	return Body{Error: err.Error(), Code: k.Code, Retryable: k.Retryable}
+}
+
+// WriteHTTP 按分类写出状态码与 JSON 错误体；可重试的错误附带 Retry-After
+func WriteHTTP(w http.ResponseWriter, err error) {
+	k := KindOf(err)
+	w.Header().Set("content-type", "application/json")
+	if k.Retryable {
+		w.Header().Set("Retry-After", strconv.Itoa(5))
+	}
+	w.WriteHeader(k.Status)
+	_ = json.NewEncoder(w).Encode(BodyOf(err))
+}
@@ -0,0 +1,100 @@
+package qerr
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestKindOf(t *testing.T) {
+	base := errors.New("boom")
+	tests := []struct {
+		name string
+		err  error
+		want *Kind
+		is   bool // errors.Is(err, want)：只有带分类的错误成立
+	}{
+		{"classified", New(ErrConnLost, "ask", base), ErrConnLost, true},
+		{"wrapped", fmt.Errorf("runner: %w", New(ErrQuotaExhausted, "ask", base)), ErrQuotaExhausted, true},
+		{"errorf", Errorf(ErrBadInput, "missing %s", "prompt"), ErrBadInput, true},
+		{"bare kind", ErrPromptOnly, ErrPromptOnly, true},
+		{"context deadline", fmt.Errorf("ask: %w", context.DeadlineExceeded), ErrTimeout, false},
+		{"context canceled", context.Canceled, ErrInternal, false},
+		{"plain", base, ErrInternal, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := KindOf(tt.err); got != tt.want {
+				t.Fatalf("KindOf = %s, want %s", got.Code, tt.want.Code)
+			}
+			if errors.Is(tt.err, tt.want) != tt.is {
+				t.Fatalf("errors.Is(%v, %s) = %v", tt.err, tt.want.Code, !tt.is)
+			}
+		})
+	}
+}
+
+func TestNew(t *testing.T) {
+	base := errors.New("read: connection reset")
+	tests := []struct {
+		name    string
+		err     error
+		wantMsg string
+	}{
+		{"with op", New(ErrConnLost, "ask", base), "ask: read: connection reset"},
+		{"without op", New(ErrConnLost, "", base), "read: connection reset"},
+		{"nil cause", New(ErrTimeout, "load", nil), "load: timeout"},
+		// 同一分类不重复包装，保留最内层的 op
+		{"same kind", New(ErrConnLost, "outer", New(ErrConnLost, "inner", base)), "inner: read: connection reset"},
+		{"other kind", New(ErrTimeout, "outer", New(ErrConnLost, "inner", base)), "outer: inner: read: connection reset"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := tt.err.Error(); got != tt.wantMsg {
+				t.Fatalf("Error() = %q, want %q", got, tt.wantMsg)
+			}
+		})
+	}
+	if !errors.Is(New(ErrConnLost, "ask", base), base) {
+		t.Fatal("New must keep the cause for errors.Is")
+	}
+}
+
+func TestWriteHTTP(t *testing.T) {
+	tests := []struct {
+		err        error
+		status     int
+		code       string
+		retryAfter string
+	}{
+		{New(ErrConnLost, "ask", errors.New("eof")), http.StatusBadGateway, "conn_lost", "5"},
+		{Errorf(ErrQuotaExhausted, "limit"), http.StatusTooManyRequests, "quota_exhausted", ""},
+		{Errorf(ErrPoolExhausted, "shutting down"), http.StatusServiceUnavailable, "pool_exhausted", "5"},
+		{Errorf(ErrBadInput, "no prompt"), http.StatusBadRequest, "bad_input", ""},
+		{context.DeadlineExceeded, http.StatusGatewayTimeout, "timeout", "5"},
+		{errors.New("boom"), http.StatusInternalServerError, "internal", ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.code, func(t *testing.T) {
+			rec := httptest.NewRecorder()
+			WriteHTTP(rec, tt.err)
+			if rec.Code != tt.status {
+				t.Fatalf("status = %d, want %d", rec.Code, tt.status)
+			}
+			if got := rec.Header().Get("Retry-After"); got != tt.retryAfter {
+				t.Fatalf("Retry-After = %q, want %q", got, tt.retryAfter)
+			}
+			var b Body
+			if err := json.Unmarshal(rec.Body.Bytes(), &b); err != nil {
+				t.Fatal(err)
+			}
+			if b.Code != tt.code || b.Error != tt.err.Error() || b.Retryable != (tt.retryAfter != "") {
+				t.Fatalf("body = %+v", b)
+			}
+		})
+	}
+}
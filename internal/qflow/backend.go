@@ -0,0 +1,166 @@
+package qflow
+
+import (
+	"context"
+	"fmt"
+	"os/exec"
+	"sort"
+	"strings"
+	"time"
+
+	execchat "aiops-qproxy/internal/execchat"
+	"aiops-qproxy/internal/ttyd"
+)
+
+// 聊天后端（Opts.Backend），均通过 ChatClient 接入同一套 Session/连接池/编排
+const (
+	BackendTTYD       = "ttyd"       // 经 ttyd WebSocket 连接 q chat（默认）
+	BackendPTY        = "pty"        // 本地 PTY 运行 q chat
+	BackendPersistent = "persistent" // 本地常驻 q chat 进程，经 stdin/stdout 交互
+	BackendOptimized  = "optimized"  // 同 persistent，但缩短 MCP 超时，MCP server 未全部加载也视为就绪
+	BackendOneShot    = "oneshot"    // 每次提问执行 q chat --no-interactive <prompt>
+	BackendSimple     = "simple"     // 每次提问启动 q chat --no-interactive，prompt 经 stdin 输入
+)
+
+var backends = map[string]bool{
+	BackendTTYD: true, BackendPTY: true, BackendPersistent: true, BackendOptimized: true, BackendOneShot: true, BackendSimple: true,
+}
+
+// 旧的 QPROXY_MODE 取值与原来各个 main_*.go 的叫法
+var backendAliases = map[string]string{
+	"":          BackendTTYD,
+	"ws":        BackendTTYD,
+	"exec-pool": BackendPTY,
+	"exec":      BackendPTY,
+	"pooled":    BackendOneShot,
+}
+
+// ParseBackend 规范化后端名（兼容旧名），未知名称返回错误
+func ParseBackend(s string) (string, error) {
+	b := strings.ToLower(strings.TrimSpace(s))
+	if a, ok := backendAliases[b]; ok {
+		b = a
+	}
+	if !backends[b] {
+		names := make([]string, 0, len(backends))
+		for n := range backends {
+			names = append(names, n)
+		}
+		sort.Strings(names)
+		return "", fmt.Errorf("unknown backend %q (want one of %s)", s, strings.Join(names, ", "))
+	}
+	return b, nil
+}
+
+// BackendName 返回生效的后端；Backend 为空时按 ExecMode 兼容旧配置
+func (o Opts) BackendName() string {
+	if o.Backend != "" {
+		if b, err := ParseBackend(o.Backend); err == nil {
+			return b
+		}
+	}
+	if o.ExecMode {
+		return BackendPTY
+	}
+	return BackendTTYD
+}
+
+// Stateful 后端是否保留多轮对话（支持 /load、/save、/compact、/clear）；
+// oneshot/simple 每次提问都是新进程，没有会话可言
+func Stateful(backend string) bool {
+	switch backend {
+	case BackendOneShot, BackendSimple:
+		return false
+	}
+	return true
+}
+
+// dial 按后端创建 ChatClient
+func dial(ctx context.Context, o Opts) (ChatClient, error) {
+	switch o.BackendName() {
+	case BackendPTY:
+		// 同 persistent：进程不能随拨号 ctx 一起被杀掉，Dial 内部自带等待提示符的超时
+		return execchat.Dial(context.Background(), execchat.DialOptions{QBin: o.QBin, WakeMode: o.WakeMode})
+	case BackendPersistent:
+		return startResident(ctx, execchat.NewPersistentClient(o.QBin))
+	case BackendOptimized:
+		return startResident(ctx, execchat.NewOptimizedClient(o.QBin))
+	case BackendOneShot:
+		c := execchat.NewSimpleExecClient(o.QBin)
+		if err := c.Ping(ctx); err != nil {
+			return nil, fmt.Errorf("q binary not found: %w", err)
+		}
+		return c, nil
+	case BackendSimple:
+		return newPerAsk(o.QBin, func(ctx context.Context) (ChatClient, error) {
+			return execchat.DialSimple(ctx, execchat.DialOptions{QBin: o.QBin})
+		})
+	}
+	return ttyd.Dial(ctx, ttyd.DialOptions{
+		Endpoint:       o.WSURL,
+		NoAuth:         o.NoAuth,
+		Username:       o.WSUser,
+		Password:       o.WSPass,
+		HandshakeTO:    o.Handshake,
+		ConnectTO:      o.ConnectTO,
+		ReadIdleTO:     o.IdleTO,
+		KeepAlive:      o.KeepAlive,
+		InsecureTLS:    o.InsecureTLS,
+		WakeMode:       o.WakeMode,
+		TokenURL:       o.TokenURL,
+		AuthHeaderName: o.AuthHeaderName,
+		AuthHeaderVal:  o.AuthHeaderVal,
+		RecordDir:      o.RecordDir,
+	})
+}
+
+// residentClient 是常驻 q chat 进程的客户端（execchat.PersistentClient/OptimizedClient）
+type residentClient interface {
+	ChatClient
+	Start(ctx context.Context) error
+	WaitReady(ctx context.Context) error
+}
+
+// startResident 启动常驻进程并等待就绪；进程生命周期不能跟随拨号 ctx（拨号完成即取消），只用 ctx 等待就绪
+func startResident(ctx context.Context, c residentClient) (ChatClient, error) {
+	if err := c.Start(context.Background()); err != nil {
+		return nil, err
+	}
+	if err := c.WaitReady(ctx); err != nil {
+		_ = c.Close()
+		return nil, err
+	}
+	return c, nil
+}
+
+// perAsk 为每次 Ask 新建一次性客户端（SimpleClient 回答一次后即关闭 stdin，不可复用）
+type perAsk struct {
+	qBin string
+	dial func(ctx context.Context) (ChatClient, error)
+}
+
+func newPerAsk(qBin string, d func(ctx context.Context) (ChatClient, error)) (*perAsk, error) {
+	if strings.TrimSpace(qBin) == "" {
+		qBin = "q"
+	}
+	if _, err := exec.LookPath(qBin); err != nil {
+		return nil, fmt.Errorf("q binary not found: %w", err)
+	}
+	return &perAsk{qBin: qBin, dial: d}, nil
+}
+
+func (p *perAsk) Ask(ctx context.Context, prompt string, idle time.Duration) (string, error) {
+	c, err := p.dial(ctx)
+	if err != nil {
+		return "", err
+	}
+	defer c.Close()
+	return c.Ask(ctx, prompt, idle)
+}
+
+func (p *perAsk) Close() error { return nil }
+
+func (p *perAsk) Ping(ctx context.Context) error {
+	_, err := exec.LookPath(p.qBin)
+	return err
+}
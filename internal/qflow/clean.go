@@ -0,0 +1,143 @@
+package qflow
+
+import (
+	"regexp"
+	"strings"
+	"unicode/utf8"
+)
+
+// 清洗 ANSI/控制字符，避免 spinner/颜色污染响应（incident-worker 与 qproxy replay 共用）
+var (
+	csiRE     = regexp.MustCompile(`\x1b\[[0-9;?]*[A-Za-z]`)
+	oscRE     = regexp.MustCompile(`\x1b\][^\a]*\x07`)
+	ctrlRE    = regexp.MustCompile(`[\x00-\x08\x0b\x0c\x0e-\x1f]`)  // 保留\t\n\r
+	spinnerRE = regexp.MustCompile(`[⠋⠙⠹⠸⠼⠴⠦⠧⠇⠏]\s*Thinking\.\.\.`) // 清除 spinner 动画
+	// 与旧 HTTP runner 对齐：去除 TUI 前缀（>、!>、\x1b[0m 等）
+	tuiPrefixRE = regexp.MustCompile(`(?m)^(>|!>|\s*\x1b\[0m)+\s*`)
+)
+
+// StripTerminal 仅去除 ANSI/控制字符/spinner，不做裁剪（流式输出的单帧也可使用）
+func StripTerminal(s string) string {
+	s = csiRE.ReplaceAllString(s, "")
+	s = oscRE.ReplaceAllString(s, "")
+	s = ctrlRE.ReplaceAllString(s, "")
+	return spinnerRE.ReplaceAllString(s, "") // 移除 spinner
+}
+
+// TermStream 逐帧清洗终端输出（SSE 流式推送用）：ttyd 的帧边界可能落在 ESC 序列或多字节 UTF-8 字符中间，
+// 帧尾不完整的部分留到下一帧拼接后再清洗，避免 "[" / "39m" 等残片或乱码漏到输出里。非并发安全
+type TermStream struct {
+	pending []byte
+}
+
+// maxPendingEscape 超过该长度仍未结束的 ESC 序列不再等待（按已有内容清洗）
+const maxPendingEscape = 256
+
+// Write 追加一帧，返回可以安全清洗的部分（已 StripTerminal）
+func (t *TermStream) Write(data []byte) string {
+	buf := make([]byte, 0, len(t.pending)+len(data))
+	buf = append(append(buf, t.pending...), data...)
+	n := completeLen(buf)
+	n = spinnerCut(buf[:n])
+	t.pending = append(t.pending[:0], buf[n:]...)
+	return StripTerminal(string(buf[:n]))
+}
+
+// completeLen 返回 b 中不以半个 ESC 序列或半个 UTF-8 字符结尾的最长前缀长度
+func completeLen(b []byte) int {
+	if i := bytesLastESC(b); i >= 0 && len(b)-i <= maxPendingEscape && !escapeComplete(b[i:]) {
+		return i
+	}
+	// 最后一个字符的起始字节：向前最多跳过 3 个 10xxxxxx 续字节
+	i := len(b)
+	for k := 0; k < utf8.UTFMax && i > 0; k++ {
+		i--
+		if utf8.RuneStart(b[i]) {
+			if !utf8.FullRune(b[i:]) {
+				return i
+			}
+			break
+		}
+	}
+	return len(b)
+}
+
+// spinnerCut 帧尾是半个 spinner（"⠋ Thinking..." 未到齐）时留到下一帧，否则 spinnerRE 匹配不到
+func spinnerCut(b []byte) int {
+	const label = "Thinking..."
+	tail := b
+	if len(tail) > 64 {
+		tail = tail[len(tail)-64:]
+	}
+	off := len(b) - len(tail)
+	last := -1
+	for i, r := range string(tail) {
+		if r >= '⠋' && r <= '⠿' {
+			last = i
+		}
+	}
+	if last < 0 || strings.Contains(string(tail[last:]), label) {
+		return len(b)
+	}
+	// spinner 之后只有 ESC 序列、空白与 label 的前缀时才等待
+	rest := strings.TrimLeft(csiRE.ReplaceAllString(string(tail[last+len("⠋"):]), ""), " ")
+	if strings.HasPrefix(label, rest) {
+		return off + last
+	}
+	return len(b)
+}
+
+func bytesLastESC(b []byte) int {
+	for i := len(b) - 1; i >= 0; i-- {
+		if b[i] == 0x1b {
+			return i
+		}
+	}
+	return -1
+}
+
+// escapeComplete 判断以 ESC 开头的 b 是否已包含完整序列：CSI 以 0x40–0x7E 结束，OSC 以 BEL 结束，其余为 ESC+1 字节
+func escapeComplete(b []byte) bool {
+	if len(b) < 2 {
+		return false
+	}
+	switch b[1] {
+	case '[':
+		for _, c := range b[2:] {
+			if c >= 0x40 && c <= 0x7e {
+				return true
+			}
+		}
+		return false
+	case ']':
+		for _, c := range b[2:] {
+			if c == 0x07 {
+				return true
+			}
+		}
+		return false
+	}
+	return true
+}
+
+// CleanText 清洗回答文本：去终端控制序列、解码常见 unicode 转义、去 TUI 前缀、归一化换行
+func CleanText(s string) string {
+	s = StripTerminal(s)
+	// 解码常见的 JSON unicode 转义（与旧 HTTP runner 对齐）
+	s = strings.ReplaceAll(s, "\\u003e", ">")
+	s = strings.ReplaceAll(s, "\\u003c", "<")
+	s = strings.ReplaceAll(s, "\\u0026", "&")
+	s = strings.ReplaceAll(s, "\\u0022", "\"")
+	s = strings.ReplaceAll(s, "\\u0027", "'")
+	// 去除每行开头的 TUI 前缀
+	s = tuiPrefixRE.ReplaceAllString(s, "")
+	// 归一化换行
+	s = strings.ReplaceAll(s, "\r\n", "\n")
+	s = strings.ReplaceAll(s, "\r", "\n")
+	// 压缩多个连续换行为最多2个
+	for strings.Contains(s, "\n\n\n") {
+		s = strings.ReplaceAll(s, "\n\n\n", "\n\n")
+	}
+	// 去除多余首尾空白
+	return strings.TrimSpace(s)
+}
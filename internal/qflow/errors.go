@@ -0,0 +1,74 @@
+package qflow
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net"
+	"strings"
+	"syscall"
+
+	"aiops-qproxy/internal/qerr"
+
+	"github.com/gorilla/websocket"
+)
+
+// classify 把后端返回的错误归入 qerr 分类（连接断开/超时）；已分类或无法归类的原样返回
+// ttyd 客户端的读错误在 readFrame 中已归类（读超时为 ErrTimeout，其余为 ErrConnLost）
+func classify(op string, err error) error {
+	if err == nil {
+		return nil
+	}
+	var e *qerr.Error
+	switch {
+	case errors.As(err, &e):
+		return err
+	case connLost(err):
+		return qerr.New(qerr.ErrConnLost, op, err)
+	case timedOut(err):
+		return qerr.New(qerr.ErrTimeout, op, err)
+	}
+	return err
+}
+
+// connLost 判断底层连接是否已断开：WebSocket 关闭帧、已关闭的连接/管道、对端重置
+func connLost(err error) bool {
+	var ce *websocket.CloseError
+	return errors.As(err, &ce) ||
+		errors.Is(err, websocket.ErrCloseSent) ||
+		errors.Is(err, net.ErrClosed) ||
+		errors.Is(err, io.ErrClosedPipe) ||
+		errors.Is(err, io.EOF) ||
+		errors.Is(err, io.ErrUnexpectedEOF) ||
+		errors.Is(err, syscall.EPIPE) ||
+		errors.Is(err, syscall.ECONNRESET)
+}
+
+func timedOut(err error) bool {
+	if errors.Is(err, context.DeadlineExceeded) {
+		return true
+	}
+	var ne net.Error
+	return errors.As(err, &ne) && ne.Timeout()
+}
+
+// IsConnError reports whether err is a lost connection (qerr.ErrConnLost or an unclassified transport error).
+func IsConnError(err error) bool {
+	return err != nil && (errors.Is(err, qerr.ErrConnLost) || connLost(err))
+}
+
+// quotaPhrases 是 Q 配额耗尽时的提示（只在很短的输出里检查，避免误伤分析内容）
+var quotaPhrases = []string{"monthly request limit", "monthly limit", "quota exceeded", "request limit reached"}
+
+func looksLikeQuota(s string) bool {
+	t := strings.ToLower(strings.TrimSpace(s))
+	if len(t) > 300 {
+		return false
+	}
+	for _, p := range quotaPhrases {
+		if strings.Contains(t, p) {
+			return true
+		}
+	}
+	return false
+}
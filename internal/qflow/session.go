@@ -2,12 +2,14 @@ package qflow
 
 import (
 	"context"
+	"errors"
 	"fmt"
-	"log"
 	"strings"
 	"time"
 
-	execchat "aiops-qproxy/internal/execchat"
+	"aiops-qproxy/internal/logx"
+	"aiops-qproxy/internal/qerr"
+	"aiops-qproxy/internal/tracing"
 	"aiops-qproxy/internal/ttyd"
 )
 
@@ -19,8 +21,10 @@ type ChatClient interface {
 }
 
 type Session struct {
-	cli  ChatClient
-	opts Opts
+	id       string // session_id，写入日志用于关联
+	cli      ChatClient
+	opts     Opts
+	stateful bool
 }
 
 type Opts struct {
@@ -34,96 +38,158 @@ type Opts struct {
 	KeepAlive   time.Duration // WebSocket ping 间隔，防止空闲连接被关闭
 	NoAuth      bool
 	WakeMode    string // 唤醒 Q CLI 的方式: ctrlc/newline/none
+	// 后端：ttyd/pty/persistent/optimized/oneshot/simple，见 backend.go；为空时按 ExecMode 兼容旧配置
+	Backend string
 	// Exec mode (exec-pool) options
-	ExecMode bool
+	ExecMode bool // 已废弃，等同 Backend=pty
 	QBin     string
 	// auth/hello extras
 	TokenURL       string // ignored when NoAuth
 	AuthHeaderName string // ignored when NoAuth
 	AuthHeaderVal  string // ignored when NoAuth
+	// RecordDir 非空时录制 ttyd 原始帧（仅 ttyd 后端），见 internal/transcript
+	RecordDir string
+	// CmdTO 是 /load、/save、/compact 的超时（/compact 需要模型总结对话）；<=0 时为 DefaultCmdTO
+	CmdTO time.Duration
 }
 
+// DefaultCmdTO 是 Opts.CmdTO 的默认值
+const DefaultCmdTO = 60 * time.Second
+
+// New 创建会话；ctx 上已有 session_id（由连接池分配）时沿用，否则新生成
 func New(ctx context.Context, o Opts) (*Session, error) {
-	if o.ExecMode {
-		cli2, err := execchat.Dial(ctx, execchat.DialOptions{
-			QBin:     o.QBin,
-			WakeMode: o.WakeMode,
-		})
-		if err != nil {
-			return nil, err
-		}
-		return &Session{cli: cli2, opts: o}, nil
-	}
-	cli, err := ttyd.Dial(ctx, ttyd.DialOptions{
-		Endpoint:       o.WSURL,
-		NoAuth:         o.NoAuth,
-		Username:       o.WSUser,
-		Password:       o.WSPass,
-		HandshakeTO:    o.Handshake,
-		ConnectTO:      o.ConnectTO,
-		ReadIdleTO:     o.IdleTO,
-		KeepAlive:      o.KeepAlive,
-		InsecureTLS:    o.InsecureTLS,
-		WakeMode:       o.WakeMode,
-		TokenURL:       o.TokenURL,
-		AuthHeaderName: o.AuthHeaderName,
-		AuthHeaderVal:  o.AuthHeaderVal,
-	})
+	id := logx.Field(ctx, logx.SessionID)
+	if id == "" {
+		id = logx.NewID("s")
+		ctx = logx.With(ctx, logx.SessionID, id)
+	}
+	cli, err := dial(ctx, o)
 	if err != nil {
 		return nil, err
 	}
-	return &Session{cli: cli, opts: o}, nil
+	return &Session{id: id, cli: cli, opts: o, stateful: Stateful(o.BackendName())}, nil
 }
 
+// Wrap 把任意 ChatClient 包装为无状态会话（不发送斜杠命令，不重连）
+func Wrap(cli ChatClient) *Session {
+	if s, ok := cli.(*Session); ok {
+		return s
+	}
+	return &Session{id: logx.NewID("s"), cli: cli, opts: Opts{Backend: BackendOneShot}}
+}
+
+// ID 返回 session_id
+func (s *Session) ID() string { return s.id }
+
+// mgmtCtx 用于斜杠命令：补上 session_id，并去掉流式输出回调（命令输出不推送给调用方）
+func (s *Session) mgmtCtx(ctx context.Context) context.Context {
+	return ttyd.WithOutputFunc(s.logCtx(ctx), nil)
+}
+
+// logCtx 给 ctx 补上本会话的 session_id，使底层客户端的日志可以关联到会话
+func (s *Session) logCtx(ctx context.Context) context.Context {
+	if logx.Field(ctx, logx.SessionID) == s.id {
+		return ctx
+	}
+	return logx.With(ctx, logx.SessionID, s.id)
+}
+
+// Ask 实现 ChatClient：直接转发给底层客户端（不做提示符检测与回显清理）
+func (s *Session) Ask(ctx context.Context, prompt string, idle time.Duration) (string, error) {
+	return s.cli.Ask(s.logCtx(ctx), prompt, idle)
+}
+
+// Ping 实现 ChatClient
+func (s *Session) Ping(ctx context.Context) error {
+	if s.cli == nil {
+		return fmt.Errorf("nil client")
+	}
+	return s.cli.Ping(ctx)
+}
+
+// cmdTO 返回 /load、/save、/compact 的超时
+func (s *Session) cmdTO() time.Duration {
+	if s.opts.CmdTO > 0 {
+		return s.opts.CmdTO
+	}
+	return DefaultCmdTO
+}
+
+// Stateful 会话是否保留多轮对话；无状态后端上的斜杠命令直接返回 nil
+func (s *Session) Stateful() bool { return s.stateful }
+
 // Slash commands
 func (s *Session) Load(path string) error {
-	// 管理类命令使用更短超时
-	const mgmtTO = time.Second
-	ctx, cancel := context.WithTimeout(context.Background(), mgmtTO)
+	return s.LoadWithContext(context.Background(), path)
+}
+func (s *Session) LoadWithContext(ctx context.Context, path string) error {
+	if !s.stateful {
+		return nil
+	}
+	// 对话较长时 /load 需要数秒，超时后连接不可复用（见 ttyd.Client.readFrame）
+	to := s.cmdTO()
+	cctx, cancel := context.WithTimeout(s.mgmtCtx(ctx), to)
 	defer cancel()
-	_, e := s.cli.Ask(ctx, "/load "+quotePath(path), mgmtTO)
-	return e
+	_, e := s.cli.Ask(cctx, "/load "+quotePath(path), to)
+	return classify("load", e)
 }
 func (s *Session) Save(path string, force bool) error {
+	return s.SaveWithContext(context.Background(), path, force)
+}
+func (s *Session) SaveWithContext(ctx context.Context, path string, force bool) error {
+	if !s.stateful {
+		return nil
+	}
 	cmd := "/save " + quotePath(path)
 	if force {
 		cmd += " -f"
 	}
-	// 使用更短的管理命令超时
-	const mgmtTO = time.Second
-	ctx, cancel := context.WithTimeout(context.Background(), mgmtTO)
+	to := s.cmdTO()
+	cctx, cancel := context.WithTimeout(s.mgmtCtx(ctx), to)
 	defer cancel()
-	_, err := s.cli.Ask(ctx, cmd, mgmtTO)
-	return err
+	_, err := s.cli.Ask(cctx, cmd, to)
+	return classify("save", err)
 }
 func (s *Session) Compact() error {
-	const mgmtTO = time.Second
-	ctx, cancel := context.WithTimeout(context.Background(), mgmtTO)
+	return s.CompactWithContext(context.Background())
+}
+func (s *Session) CompactWithContext(ctx context.Context) error {
+	if !s.stateful {
+		return nil
+	}
+	to := s.cmdTO()
+	cctx, cancel := context.WithTimeout(s.mgmtCtx(ctx), to)
 	defer cancel()
-	_, err := s.cli.Ask(ctx, "/compact", mgmtTO)
-	return err
+	_, err := s.cli.Ask(cctx, "/compact", to)
+	return classify("compact", err)
 }
 func (s *Session) Clear() error {
 	return s.ClearWithContext(context.Background())
 }
 func (s *Session) ClearWithContext(ctx context.Context) error {
+	if !s.stateful {
+		return nil
+	}
 	// 管理命令短超时（广泛应用）
 	const mgmtTO = time.Second
-	cctx, cancel := context.WithTimeout(ctx, mgmtTO)
+	cctx, cancel := context.WithTimeout(s.mgmtCtx(ctx), mgmtTO)
 	defer cancel()
 	// /clear 会要求 y/n 确认，这里直接一并发送 'y' 避免阻塞
 	_, err := s.cli.Ask(cctx, "/clear\ny", mgmtTO)
-	return err
+	return classify("clear", err)
 }
 func (s *Session) ContextClear() error {
 	return s.ContextClearWithContext(context.Background())
 }
 func (s *Session) ContextClearWithContext(ctx context.Context) error {
+	if !s.stateful {
+		return nil
+	}
 	const mgmtTO = time.Second
-	cctx, cancel := context.WithTimeout(ctx, mgmtTO)
+	cctx, cancel := context.WithTimeout(s.mgmtCtx(ctx), mgmtTO)
 	defer cancel()
 	_, err := s.cli.Ask(cctx, "/context clear", mgmtTO)
-	return err
+	return classify("context_clear", err)
 }
 func (s *Session) AskOnce(prompt string) (string, error) {
 	return s.AskOnceWithContext(context.Background(), prompt)
@@ -132,56 +198,60 @@ func (s *Session) AskOnce(prompt string) (string, error) {
 func (s *Session) AskOnceWithContext(ctx context.Context, prompt string) (string, error) {
 	p := strings.TrimSpace(prompt)
 	if p == "" {
-		return "", fmt.Errorf("empty prompt")
+		return "", qerr.Errorf(qerr.ErrBadInput, "empty prompt")
 	}
+	ctx = s.logCtx(ctx)
 	out, err := s.cli.Ask(ctx, p, s.opts.IdleTO)
-	if err == nil {
-		// 检测仅提示符（可能代表配额/权限问题）
-		if looksLikePromptOnly(out) {
-			log.Printf("qflow: prompt-only response detected (possible quota exhausted)")
-			return "", fmt.Errorf("quota_exhausted: prompt-only response from q chat")
+	if err != nil {
+		// 记录错误详情，辅助定位是否误判连接错误
+		logx.Warnf(ctx, "qflow: Ask failed: %v", err)
+		err = classify("ask", err)
+		// 只在断连时重连重发；超时时 q 可能仍在处理这条 prompt，重发会重复执行（连接已标记失效，由上层丢弃）
+		if !errors.Is(err, qerr.ErrConnLost) {
+			return "", err
 		}
-		// 去除回显的输入与提示符行（仅保留 q 的输出）
-		cleaned := stripPromptEcho(out, p)
-		return cleaned, nil
-	}
-	// 记录错误详情，辅助定位是否误判连接错误
-	log.Printf("qflow: Ask failed: %v", err)
-	if IsConnError(err) {
-		log.Printf("qflow: detected connection error, will close and redial once")
+		logx.Warnf(ctx, "qflow: detected connection error, will close and redial once")
 		// 记录并标记旧连接坏掉，主动关闭后重连一次再重试
 		_ = s.cli.Close()
-		cli, e2 := ttyd.Dial(ctx, ttyd.DialOptions{
-			Endpoint:       s.opts.WSURL,
-			NoAuth:         s.opts.NoAuth,
-			Username:       s.opts.WSUser,
-			Password:       s.opts.WSPass,
-			HandshakeTO:    s.opts.Handshake,
-			ConnectTO:      s.opts.ConnectTO,
-			ReadIdleTO:     s.opts.IdleTO,
-			KeepAlive:      s.opts.KeepAlive,
-			InsecureTLS:    s.opts.InsecureTLS,
-			WakeMode:       s.opts.WakeMode,
-			TokenURL:       s.opts.TokenURL,
-			AuthHeaderName: s.opts.AuthHeaderName,
-			AuthHeaderVal:  s.opts.AuthHeaderVal,
-		})
-		if e2 == nil {
-			s.cli = cli
-			out2, e3 := s.cli.Ask(ctx, p, s.opts.IdleTO)
-			if e3 != nil {
-				return "", e3
-			}
-			if looksLikePromptOnly(out2) {
-				log.Printf("qflow: prompt-only response detected after reconnect (possible quota exhausted)")
-				return "", fmt.Errorf("quota_exhausted: prompt-only response from q chat")
-			}
-			cleaned := stripPromptEcho(out2, p)
-			return cleaned, nil
+		rctx, sp := tracing.Start(ctx, "qflow.redial", tracing.Attr{Key: "backend", Value: s.opts.BackendName()})
+		cli, e2 := dial(rctx, s.opts)
+		sp.RecordError(e2)
+		sp.End()
+		if e2 != nil {
+			return "", err
+		}
+		s.cli = cli
+		if out, err = s.cli.Ask(ctx, p, s.opts.IdleTO); err != nil {
+			return "", classify("ask", err)
 		}
-		return "", err
 	}
-	return "", err
+	ans, err := ParseAnswer(out, p)
+	switch {
+	case errors.Is(err, qerr.ErrQuotaExhausted):
+		logx.Warnf(ctx, "qflow: quota exhausted message detected")
+	case errors.Is(err, qerr.ErrPromptOnly):
+		logx.Warnf(ctx, "qflow: prompt-only response detected (possible quota exhausted)")
+	}
+	return ans, err
+}
+
+// ParseAnswer 把客户端返回的原始输出转成回答：识别配额耗尽与仅提示符的输出，
+// 并去除回显的输入与提示符行（AskOnceWithContext 与 qproxy replay 共用）
+func ParseAnswer(out, prompt string) (string, error) {
+	if looksLikeQuota(out) {
+		return "", qerr.Errorf(qerr.ErrQuotaExhausted, "q chat: %s", strings.TrimSpace(out))
+	}
+	// 检测仅提示符（多半是配额/权限问题）
+	if looksLikePromptOnly(out) {
+		return "", qerr.Errorf(qerr.ErrPromptOnly, "prompt-only response from q chat")
+	}
+	// 去除回显的输入与提示符行（仅保留 q 的输出）
+	ans := stripPromptEcho(out, strings.TrimSpace(prompt))
+	// 终端里 q 总会回显输入，且提示符带颜色：去掉回显与 ANSI 后再判断一次
+	if looksLikePromptOnly(StripTerminal(ans)) {
+		return "", qerr.Errorf(qerr.ErrPromptOnly, "prompt-only response from q chat")
+	}
+	return ans, nil
 }
 
 // stripPromptEcho 移除回显的用户输入与提示符行，仅保留 q 的输出
@@ -260,6 +330,11 @@ func stripPromptEcho(out, prompt string) string {
 	return cleaned
 }
 
+// ExtractFirstJSON returns the first complete JSON object in s (used by output validation).
+func ExtractFirstJSON(s string) (string, bool) {
+	return extractFirstJSON(s)
+}
+
 // extractFirstJSON scans a string and returns the first complete JSON object.
 func extractFirstJSON(s string) (string, bool) {
 	type st struct {
@@ -351,20 +426,6 @@ func (s *Session) Healthy(ctx context.Context) bool {
 	return true
 }
 
-// IsConnError reports if err looks like a dropped/closed ws.
-func IsConnError(err error) bool {
-	if err == nil {
-		return false
-	}
-	msg := err.Error()
-	return strings.Contains(msg, "use of closed network connection") ||
-		strings.Contains(msg, "read/write on closed pipe") ||
-		strings.Contains(msg, "broken pipe") ||
-		strings.Contains(msg, "connection reset by peer") ||
-		strings.Contains(msg, "close 1006") ||
-		strings.Contains(msg, "going away")
-}
-
 func quotePath(p string) string {
 	q := strings.ReplaceAll(p, `\`, `\\`)
 	q = strings.ReplaceAll(q, `"`, `\"`)
@@ -2,34 +2,90 @@ package runner
 
 import (
 	"context"
-	"log"
+	"errors"
 	"os"
 	"strings"
 	"sync"
 	"time"
 
+	"aiops-qproxy/internal/logx"
+	"aiops-qproxy/internal/metrics"
 	"aiops-qproxy/internal/pool"
+	"aiops-qproxy/internal/qerr"
 	"aiops-qproxy/internal/qflow"
+	"aiops-qproxy/internal/schema"
 	"aiops-qproxy/internal/store"
+	"aiops-qproxy/internal/tracing"
 )
 
 type Orchestrator struct {
 	pool   *pool.Pool
 	sopmap *store.SOPMap
 	conv   *store.ConvStore
+	// 输出校验：schema 为 nil 时仅做结构化解析，不发起修复
+	schema     *schema.Schema
+	maxRepairs int
 }
 
 func NewOrchestrator(p *pool.Pool, m *store.SOPMap, cs *store.ConvStore) *Orchestrator {
 	return &Orchestrator{pool: p, sopmap: m, conv: cs}
 }
 
+// SetOutputSchema 配置输出 schema 与最大修复次数（校验失败时在同一会话内追问修复）
+func (o *Orchestrator) SetOutputSchema(s *schema.Schema, maxRepairs int) {
+	o.schema = s
+	if maxRepairs < 0 {
+		maxRepairs = 0
+	}
+	o.maxRepairs = maxRepairs
+}
+
 type IncidentInput struct {
-	IncidentKey string `json:"incident_key"` // 原始的 incident_key（用于 sopmap）
-	SopID       string `json:"sop_id"`       // 可选：如果已知 sop_id，直接使用
-	Prompt      string `json:"prompt"`
+	IncidentKey string   `json:"incident_key"`      // 原始的 incident_key（用于 sopmap）
+	SopID       string   `json:"sop_id"`            // 可选：如果已知 sop_id，直接使用
+	SopIDs      []string `json:"sop_ids,omitempty"` // 参与合并渲染的 SOP（仅记录，不影响会话）
+	Service     string   `json:"service,omitempty"` // 告警的服务名（仅记录到事件历史）
+	Prompt      string   `json:"prompt"`
 }
 
+// Process 处理一次 incident，仅返回回答文本
 func (o *Orchestrator) Process(ctx context.Context, in IncidentInput) (string, error) {
+	res, err := o.ProcessResult(ctx, in)
+	if err != nil {
+		return "", err
+	}
+	return res.Answer, nil
+}
+
+// ProcessResult 处理一次 incident，返回回答、解析后的结构化结果与校验信息
+func (o *Orchestrator) ProcessResult(ctx context.Context, in IncidentInput) (*Result, error) {
+	ctx, sp := tracing.Start(ctx, "runner.process", tracing.Attr{Key: "incident_key", Value: in.IncidentKey})
+	defer sp.End()
+	res, err := o.processResult(ctx, in)
+	sp.RecordError(err)
+	if res != nil {
+		sp.SetAttr("valid", res.Valid)
+		sp.SetAttr("repair_attempts", res.RepairAttempts)
+	}
+	return res, err
+}
+
+// traced 在名为 name 的子 span 内执行一条斜杠命令
+func traced(ctx context.Context, name string, fn func(ctx context.Context) error) error {
+	ctx, sp := tracing.Start(ctx, name)
+	err := fn(ctx)
+	sp.RecordError(err)
+	sp.End()
+	return err
+}
+
+// SopIDFor 返回 incident_key 已映射的 sop_id（未映射时为空）
+func (o *Orchestrator) SopIDFor(incidentKey string) string {
+	id, _ := o.sopmap.Get(incidentKey)
+	return id
+}
+
+func (o *Orchestrator) processResult(ctx context.Context, in IncidentInput) (*Result, error) {
 	// 1) 确定 sop_id
 	var sopID string
 	var err error
@@ -45,20 +101,45 @@ func (o *Orchestrator) Process(ctx context.Context, in IncidentInput) (string, e
 		// 否则，通过 incident_key 生成或获取 sop_id
 		sopID, err = o.sopmap.GetOrCreate(in.IncidentKey)
 		if err != nil {
-			return "", err
+			return nil, err
 		}
 	}
 
+	ctx = logx.With(ctx, logx.IncidentKey, in.IncidentKey, logx.SopID, sopID)
+	tracing.FromContext(ctx).SetAttr("sop_id", sopID)
 	convPath := o.conv.PathFor(sopID)
-	log.Printf("runner: processing incident_key=%s → sop_id=%s, conv_path=%s",
+	logx.Infof(ctx, "runner: processing incident_key=%s → sop_id=%s, conv_path=%s",
 		in.IncidentKey, sopID, convPath)
 
+	// 1.1) 同一 sop_id 串行处理：避免并发 /save -f 覆盖同一会话文件（先加锁再租会话，等待时不占连接）
+	t0 := time.Now()
+	lctx, lsp := tracing.Start(ctx, "runner.sop_lock")
+	unlock, err := o.conv.Lock(lctx, sopID)
+	lsp.RecordError(err)
+	lsp.End()
+	wait := time.Since(t0)
+	metrics.SopLockWaitSeconds.Observe(wait.Seconds())
+	if err != nil {
+		logx.Warnf(ctx, "runner: gave up waiting for sop_id=%s lock after %v: %v", sopID, wait, err)
+		return nil, qerr.New(qerr.ErrTimeout, "sop_lock", err)
+	}
+	defer unlock()
+	if wait > 10*time.Millisecond {
+		logx.Infof(ctx, "runner: waited %v for sop_id=%s lock", wait, sopID)
+	}
+
 	// 2) lease a session
-	lease, err := o.pool.Acquire(ctx)
+	t0 = time.Now()
+	lease, err := o.pool.AcquireFor(ctx, sopID)
+	metrics.AcquireSeconds.Since(t0)
 	if err != nil {
-		return "", err
+		if qflow.IsConnError(err) {
+			metrics.ConnErrors.With("acquire").Inc()
+		}
+		return nil, err
 	}
 	s := lease.Session()
+	ctx = logx.With(ctx, logx.SessionID, s.ID())
 
 	// 注意：不在这里 defer Release()，而是在函数最后手动 Release
 	// 原因：defer 会在函数返回前执行清理，但这时 AskOnce 可能还在等待响应
@@ -70,80 +151,205 @@ func (o *Orchestrator) Process(ctx context.Context, in IncidentInput) (string, e
 	}
 	defer doRelease() // 确保无论如何都会释放
 
+	// 2.1) 亲和：warm 会话已持有该 sop_id 的对话，跳过 /load；
+	// 抢占来的会话仍持有其他 sop_id 的对话，先 /clear
+	switch {
+	case lease.Warm():
+		metrics.AffinityLeases.With("hit").Inc()
+		logx.Infof(ctx, "runner: affinity hit for sop_id=%s, skip /load", sopID)
+	case lease.Dirty():
+		metrics.AffinityLeases.With("steal").Inc()
+		logx.Infof(ctx, "runner: executing /clear on reused session")
+		t0 := time.Now()
+		e := traced(ctx, "q.clear", s.ClearWithContext)
+		metrics.CommandSeconds.With("clear").Since(t0)
+		if e != nil {
+			if qflow.IsConnError(e) {
+				metrics.ConnErrors.With("clear").Inc()
+			}
+			// 无法确认对话已清空，不能继续使用
+			lease.MarkBroken()
+			logx.Warnf(ctx, "runner: /clear on reused session failed: %v", e)
+			return nil, e
+		}
+	default:
+		metrics.AffinityLeases.With("miss").Inc()
+	}
+
 	// 3) /load previous conversation if exists
-	if _, err := os.Stat(convPath); err == nil {
-		log.Printf("runner: executing /load %s", convPath)
-		if e := s.Load(convPath); e != nil {
+	if !s.Stateful() {
+		logx.Infof(ctx, "runner: stateless backend, conversation history is not loaded or saved")
+	} else if _, err := os.Stat(convPath); err == nil && !lease.Warm() {
+		logx.Infof(ctx, "runner: executing /load %s", convPath)
+		t0 := time.Now()
+		e := traced(logx.Detach(ctx), "q.load", func(ctx context.Context) error { return s.LoadWithContext(ctx, convPath) })
+		metrics.CommandSeconds.With("load").Since(t0)
+		if e != nil {
 			if qflow.IsConnError(e) {
+				metrics.ConnErrors.With("load").Inc()
+			}
+			if sessionBroken(e) {
 				lease.MarkBroken()
-				log.Printf("runner: /load failed (conn): %v", e)
-				return "", e
+				logx.Warnf(ctx, "runner: /load failed (session dropped): %v", e)
+				return nil, e
 			}
-			log.Printf("runner: /load failed: %v", e)
+			logx.Warnf(ctx, "runner: /load failed: %v", e)
 		} else {
-			log.Printf("runner: /load ok")
+			logx.Infof(ctx, "runner: /load ok")
 		}
 	}
 
-	// 4) ask with current prompt
-	out, err := s.AskOnce(strings.TrimSpace(in.Prompt))
+	// 4) ask with current prompt（透传 ctx：超时/取消与流式输出回调）
+	t0 = time.Now()
+	actx, asp := tracing.Start(ctx, "q.ask", tracing.Attr{Key: "prompt_len", Value: len(in.Prompt)})
+	out, err := s.AskOnceWithContext(actx, strings.TrimSpace(in.Prompt))
+	asp.RecordError(err)
+	asp.SetAttr("answer_len", len(out))
+	asp.End()
+	metrics.AskSeconds.Since(t0)
 	if err != nil {
+		// 仅提示符的回答多半也是配额耗尽，一并计数
+		if errors.Is(err, qerr.ErrQuotaExhausted) || errors.Is(err, qerr.ErrPromptOnly) {
+			metrics.QuotaExhausted.Inc()
+		}
 		if qflow.IsConnError(err) {
+			metrics.ConnErrors.With("ask").Inc()
+		}
+		if sessionBroken(err) {
 			lease.MarkBroken()
-			// 连接错误时，关闭底层连接，避免 defer 中的清理操作继续使用已失效的连接
+			// 连接错误或超时时，关闭底层连接，避免 defer 中的清理操作继续使用已失效的连接
 			_ = s.Close()
 		}
-		return "", err
+		return nil, err
+	}
+
+	// 4.1) 结构化解析 + schema 校验；不通过时在同一会话内追问修复（有上限）
+	res := &Result{Answer: out}
+	o.validate(res)
+	for o.schema != nil && !res.Valid && res.RepairAttempts < o.maxRepairs {
+		res.RepairAttempts++
+		logx.Warnf(ctx, "runner: output failed schema validation (%d errors), repair attempt %d/%d",
+			len(res.ValidationErrors), res.RepairAttempts, o.maxRepairs)
+		t0 = time.Now()
+		actx, asp := tracing.Start(ctx, "q.ask", tracing.Attr{Key: "repair_attempt", Value: res.RepairAttempts})
+		fixed, e := s.AskOnceWithContext(actx, repairPrompt(res.ValidationErrors))
+		asp.RecordError(e)
+		asp.End()
+		metrics.AskSeconds.Since(t0)
+		if e != nil {
+			logx.Warnf(ctx, "runner: repair attempt failed: %v", e)
+			if qflow.IsConnError(e) {
+				metrics.ConnErrors.With("ask").Inc()
+			}
+			if sessionBroken(e) {
+				// 连接已坏：保留原回答返回，跳过 compact/save/clear
+				lease.MarkBroken()
+				return res, nil
+			}
+			break
+		}
+		res.Answer = fixed
+		o.validate(res)
+	}
+	if o.schema != nil {
+		switch {
+		case res.Valid && res.RepairAttempts > 0:
+			metrics.SchemaValidations.With("repaired").Inc()
+		case res.Valid:
+			metrics.SchemaValidations.With("valid").Inc()
+		default:
+			metrics.SchemaValidations.With("invalid").Inc()
+			logx.Warnf(ctx, "runner: output still invalid after %d repair attempt(s): %s",
+				res.RepairAttempts, strings.Join(res.ValidationErrors, "; "))
+		}
 	}
+	out = res.Answer
 
 	// 5) 仅在输出“看起来可用”时才进行 compact+save
-	if isUsableOutput(out) {
-		log.Printf("runner: output looks usable, executing /compact + /save")
-		log.Printf("runner: executing /compact")
-		if e := s.Compact(); e != nil {
+	usable := isUsableOutput(out)
+	if usable && !s.Stateful() {
+		metrics.Outputs.With("true").Inc()
+		return res, nil
+	}
+	if usable {
+		metrics.Outputs.With("true").Inc()
+		logx.Infof(ctx, "runner: output looks usable, executing /compact + /save")
+		logx.Infof(ctx, "runner: executing /compact")
+		t0 := time.Now()
+		e := traced(logx.Detach(ctx), "q.compact", s.CompactWithContext)
+		metrics.CommandSeconds.With("compact").Since(t0)
+		if e != nil {
 			if qflow.IsConnError(e) {
+				metrics.ConnErrors.With("compact").Inc()
+			}
+			if sessionBroken(e) {
 				lease.MarkBroken()
-				log.Printf("runner: /compact failed (conn): %v", e)
-				return "", e
+				logx.Warnf(ctx, "runner: /compact failed (session dropped): %v", e)
+				return nil, e
 			}
-			log.Printf("runner: /compact failed: %v", e)
+			logx.Warnf(ctx, "runner: /compact failed: %v", e)
 		} else {
-			log.Printf("runner: /compact ok")
+			logx.Infof(ctx, "runner: /compact ok")
 		}
-		log.Printf("runner: executing /save %s (force)", convPath)
-		if e := s.Save(convPath, true); e != nil {
+		logx.Infof(ctx, "runner: executing /save %s (force)", convPath)
+		t0 = time.Now()
+		e = traced(logx.Detach(ctx), "q.save", func(ctx context.Context) error { return s.SaveWithContext(ctx, convPath, true) })
+		metrics.CommandSeconds.With("save").Since(t0)
+		if e != nil {
 			if qflow.IsConnError(e) {
+				metrics.ConnErrors.With("save").Inc()
+			}
+			if sessionBroken(e) {
 				lease.MarkBroken()
-				log.Printf("runner: /save failed (conn): %v", e)
-				return "", e
+				logx.Warnf(ctx, "runner: /save failed (session dropped): %v", e)
+				return nil, e
 			}
-			log.Printf("runner: /save failed: %v", e)
+			logx.Warnf(ctx, "runner: /save failed: %v", e)
 		} else {
-			log.Printf("runner: /save ok")
+			logx.Infof(ctx, "runner: /save ok")
 		}
 	} else {
-		log.Printf("runner: output not usable, skip /compact and /save")
+		metrics.Outputs.With("false").Inc()
+		logx.Warnf(ctx, "runner: output not usable, skip /compact and /save")
+	}
+
+	// 6) 亲和：输出可用时保留会话中的对话，下次同一 sop_id 可直接复用
+	if usable && o.pool.AffinityEnabled() {
+		logx.Infof(ctx, "runner: keeping session warm for sop_id=%s, skip /clear", sopID)
+		lease.Keep(sopID)
+		return res, nil
 	}
 
-	// 6) 清理 session context（成功完成后才清理）
+	// 6.1) 清理 session context（成功完成后才清理）
 	// 使用带超时的 context，避免清理操作阻塞
-	cleanupCtx, cleanupCancel := context.WithTimeout(context.Background(), 10*time.Second)
+	cleanupCtx, cleanupCancel := context.WithTimeout(logx.Detach(ctx), 10*time.Second)
 	defer cleanupCancel()
 
 	// 清理：仅保留 /clear
-	log.Printf("runner: executing /clear (cleanup)")
-	if e := s.ClearWithContext(cleanupCtx); e != nil {
+	logx.Infof(ctx, "runner: executing /clear (cleanup)")
+	t0 = time.Now()
+	e := traced(cleanupCtx, "q.clear", s.ClearWithContext)
+	metrics.CommandSeconds.With("clear").Since(t0)
+	if e != nil {
 		if qflow.IsConnError(e) {
+			metrics.ConnErrors.With("clear").Inc()
+		}
+		if sessionBroken(e) {
 			lease.MarkBroken()
-			log.Printf("runner: /clear failed (conn): %v", e)
+			logx.Warnf(ctx, "runner: /clear failed (session dropped): %v", e)
 		} else {
-			log.Printf("runner: /clear failed: %v", e)
+			logx.Warnf(ctx, "runner: /clear failed: %v", e)
 		}
 	} else {
-		log.Printf("runner: /clear ok")
+		logx.Infof(ctx, "runner: /clear ok")
 	}
 
-	return out, nil
+	return res, nil
+}
+
+// sessionBroken 命令失败后会话是否不能继续使用：断连，或超时（ttyd 连接已失效，q 可能仍在输出）
+func sessionBroken(err error) bool {
+	return qflow.IsConnError(err) || errors.Is(err, qerr.ErrTimeout)
 }
 
 // isUsableOutput 使用轻量启发式判断输出是否“足够有用”以保存会话
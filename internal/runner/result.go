@@ -0,0 +1,76 @@
+package runner
+
+import (
+	"encoding/json"
+	"regexp"
+	"strings"
+
+	"aiops-qproxy/internal/qflow"
+)
+
+// ToolCall 对应 task_instructions 中 tool_calls 数组的元素
+type ToolCall struct {
+	Tool   string          `json:"tool"`
+	Action string          `json:"action"`
+	Query  string          `json:"query,omitempty"`
+	Result json.RawMessage `json:"result,omitempty"`
+}
+
+// Analysis 是模型输出的结构化结果（见 ctx/task_instructions.md 的 REQUIRED JSON FORMAT）
+type Analysis struct {
+	ToolCalls        []ToolCall `json:"tool_calls"`
+	RootCause        string     `json:"root_cause"`
+	Evidence         []string   `json:"evidence"`
+	Confidence       float64    `json:"confidence"`
+	SuggestedActions []string   `json:"suggested_actions"`
+	AnalysisSummary  string     `json:"analysis_summary"`
+}
+
+// Result 是一次 incident 处理的结果：原始回答 + 解析结果 + 校验信息
+type Result struct {
+	Answer           string    `json:"answer"`
+	Parsed           *Analysis `json:"result,omitempty"`
+	Valid            bool      `json:"valid"`
+	ValidationErrors []string  `json:"validation_errors,omitempty"`
+	RepairAttempts   int       `json:"repair_attempts,omitempty"`
+}
+
+var ansiRE = regexp.MustCompile(`\x1b\[[0-9;?]*[A-Za-z]|\x1b\][^\a]*\x07`)
+
+// answerJSON 去掉 ANSI 后取出回答中的首个 JSON 对象
+func answerJSON(answer string) (string, bool) {
+	return qflow.ExtractFirstJSON(ansiRE.ReplaceAllString(answer, ""))
+}
+
+// validate 解析并（在配置了 schema 时）校验 r.Answer，填充 Parsed/Valid/ValidationErrors
+func (o *Orchestrator) validate(r *Result) {
+	r.Parsed = nil
+	r.ValidationErrors = nil
+	js, ok := answerJSON(r.Answer)
+	if !ok {
+		r.Valid = false
+		r.ValidationErrors = []string{"$: no JSON object found in answer"}
+		return
+	}
+	if o.schema != nil {
+		r.ValidationErrors = o.schema.ValidateJSON([]byte(js))
+	}
+	var a Analysis
+	if err := json.Unmarshal([]byte(js), &a); err == nil {
+		r.Parsed = &a
+	} else if len(r.ValidationErrors) == 0 {
+		r.ValidationErrors = []string{"$: cannot decode result: " + err.Error()}
+	}
+	r.Valid = r.Parsed != nil && len(r.ValidationErrors) == 0
+}
+
+// repairPrompt 构造单行修复提示（同一会话内追问，模型可看到上一轮回答）
+func repairPrompt(errs []string) string {
+	const maxErrs = 10
+	if len(errs) > maxErrs {
+		errs = append(errs[:maxErrs:maxErrs], "...")
+	}
+	return "Your previous answer does not match the REQUIRED JSON FORMAT. Problems: " +
+		strings.Join(errs, "; ") +
+		". Reply again with ONLY the corrected single JSON object (fields: tool_calls, root_cause, evidence, confidence, suggested_actions, analysis_summary), no markdown, no explanations."
+}
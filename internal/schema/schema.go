@@ -0,0 +1,205 @@
+// Package schema 实现 JSON Schema 的一个常用子集（type/required/properties/
+// additionalProperties/items/enum/minimum/maximum/minLength/minItems/maxItems），
+// 用于校验模型输出，只依赖标准库。
+package schema
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+)
+
+// Schema 是一个 JSON Schema 节点
+type Schema struct {
+	Type                 typeList           `json:"type,omitempty"`
+	Required             []string           `json:"required,omitempty"`
+	Properties           map[string]*Schema `json:"properties,omitempty"`
+	AdditionalProperties *bool              `json:"additionalProperties,omitempty"`
+	Items                *Schema            `json:"items,omitempty"`
+	Enum                 []interface{}      `json:"enum,omitempty"`
+	Minimum              *float64           `json:"minimum,omitempty"`
+	Maximum              *float64           `json:"maximum,omitempty"`
+	MinLength            *int               `json:"minLength,omitempty"`
+	MinItems             *int               `json:"minItems,omitempty"`
+	MaxItems             *int               `json:"maxItems,omitempty"`
+}
+
+// typeList 兼容 "type": "string" 与 "type": ["string","null"] 两种写法
+type typeList []string
+
+func (t *typeList) UnmarshalJSON(b []byte) error {
+	var one string
+	if err := json.Unmarshal(b, &one); err == nil {
+		*t = typeList{one}
+		return nil
+	}
+	var many []string
+	if err := json.Unmarshal(b, &many); err != nil {
+		return fmt.Errorf("schema: invalid type: %s", string(b))
+	}
+	*t = many
+	return nil
+}
+
+// Load 从文件加载 schema
+func Load(path string) (*Schema, error) {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	return Parse(b)
+}
+
+// Parse 解析 schema 文本
+func Parse(b []byte) (*Schema, error) {
+	var s Schema
+	if err := json.Unmarshal(b, &s); err != nil {
+		return nil, fmt.Errorf("schema: %w", err)
+	}
+	return &s, nil
+}
+
+// ValidateJSON 校验一段 JSON 文本，返回全部错误（为空表示通过）
+func (s *Schema) ValidateJSON(doc []byte) []string {
+	dec := json.NewDecoder(bytes.NewReader(doc))
+	dec.UseNumber()
+	var v interface{}
+	if err := dec.Decode(&v); err != nil {
+		return []string{"$: invalid JSON: " + err.Error()}
+	}
+	return s.Validate(v)
+}
+
+// Validate 校验已解码的值（数字需为 json.Number 或 float64）
+func (s *Schema) Validate(v interface{}) []string {
+	var errs []string
+	s.validate("$", v, &errs)
+	return errs
+}
+
+func (s *Schema) validate(path string, v interface{}, errs *[]string) {
+	if s == nil {
+		return
+	}
+	add := func(format string, args ...interface{}) {
+		*errs = append(*errs, path+": "+fmt.Sprintf(format, args...))
+	}
+
+	kind := kindOf(v)
+	if len(s.Type) > 0 && !s.typeAllows(kind, v) {
+		add("expected %s, got %s", strings.Join(s.Type, " or "), kind)
+		return
+	}
+	if len(s.Enum) > 0 && !inEnum(s.Enum, v) {
+		add("value not in enum")
+	}
+
+	switch t := v.(type) {
+	case map[string]interface{}:
+		for _, r := range s.Required {
+			if _, ok := t[r]; !ok {
+				*errs = append(*errs, fmt.Sprintf("%s: missing required property %q", path, r))
+			}
+		}
+		keys := make([]string, 0, len(t))
+		for k := range t {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+		for _, k := range keys {
+			if ps, ok := s.Properties[k]; ok {
+				ps.validate(path+"."+k, t[k], errs)
+			} else if s.AdditionalProperties != nil && !*s.AdditionalProperties {
+				*errs = append(*errs, fmt.Sprintf("%s: unexpected property %q", path, k))
+			}
+		}
+	case []interface{}:
+		if s.MinItems != nil && len(t) < *s.MinItems {
+			add("expected at least %d items, got %d", *s.MinItems, len(t))
+		}
+		if s.MaxItems != nil && len(t) > *s.MaxItems {
+			add("expected at most %d items, got %d", *s.MaxItems, len(t))
+		}
+		for i, item := range t {
+			s.Items.validate(fmt.Sprintf("%s[%d]", path, i), item, errs)
+		}
+	case string:
+		if s.MinLength != nil && len([]rune(t)) < *s.MinLength {
+			add("expected length >= %d", *s.MinLength)
+		}
+	}
+	if f, ok := toFloat(v); ok {
+		if s.Minimum != nil && f < *s.Minimum {
+			add("expected >= %v, got %v", *s.Minimum, f)
+		}
+		if s.Maximum != nil && f > *s.Maximum {
+			add("expected <= %v, got %v", *s.Maximum, f)
+		}
+	}
+}
+
+func (s *Schema) typeAllows(kind string, v interface{}) bool {
+	for _, t := range s.Type {
+		if t == kind {
+			return true
+		}
+		if t == "number" && kind == "integer" {
+			return true
+		}
+		if t == "integer" && kind == "number" {
+			if f, ok := toFloat(v); ok && f == float64(int64(f)) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func kindOf(v interface{}) string {
+	switch t := v.(type) {
+	case nil:
+		return "null"
+	case bool:
+		return "boolean"
+	case string:
+		return "string"
+	case []interface{}:
+		return "array"
+	case map[string]interface{}:
+		return "object"
+	case json.Number:
+		if _, err := t.Int64(); err == nil {
+			return "integer"
+		}
+		return "number"
+	case float64:
+		if t == float64(int64(t)) {
+			return "integer"
+		}
+		return "number"
+	}
+	return fmt.Sprintf("%T", v)
+}
+
+func toFloat(v interface{}) (float64, bool) {
+	switch t := v.(type) {
+	case json.Number:
+		f, err := t.Float64()
+		return f, err == nil
+	case float64:
+		return t, true
+	}
+	return 0, false
+}
+
+func inEnum(enum []interface{}, v interface{}) bool {
+	for _, e := range enum {
+		if fmt.Sprint(e) == fmt.Sprint(v) {
+			return true
+		}
+	}
+	return false
+}
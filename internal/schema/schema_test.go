@@ -0,0 +1,94 @@
+package schema
+
+import (
+	"reflect"
+	"testing"
+)
+
+const testSchema = `{
+  "type": "object",
+  "required": ["root_cause", "confidence"],
+  "additionalProperties": false,
+  "properties": {
+    "root_cause": {"type": "string", "minLength": 3},
+    "confidence": {"type": "number", "minimum": 0, "maximum": 1},
+    "severity": {"type": ["string", "null"], "enum": ["low", "high", null]},
+    "retries": {"type": "integer"},
+    "tool_calls": {
+      "type": "array", "minItems": 1, "maxItems": 2,
+      "items": {"type": "object", "required": ["tool"], "properties": {"tool": {"type": "string"}}}
+    }
+  }
+}`
+
+func TestValidateJSON(t *testing.T) {
+	s, err := Parse([]byte(testSchema))
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		name string
+		doc  string
+		want []string
+	}{
+		{"valid", `{"root_cause":"gc pause","confidence":0.8}`, nil},
+		{"valid full", `{"root_cause":"gc pause","confidence":1,"severity":null,"retries":2,"tool_calls":[{"tool":"vm"}]}`, nil},
+		{"integer as number", `{"root_cause":"gc pause","confidence":1,"retries":2.0}`, nil},
+		{"invalid json", `{"root_cause":`, []string{"$: invalid JSON: unexpected EOF"}},
+		{"not an object", `[1]`, []string{"$: expected object, got array"}},
+		{"missing required", `{"root_cause":"gc pause"}`, []string{`$: missing required property "confidence"`}},
+		{"unexpected property", `{"root_cause":"gc pause","confidence":0.5,"extra":1}`, []string{`$: unexpected property "extra"`}},
+		{"wrong type", `{"root_cause":42,"confidence":0.5}`, []string{"$.root_cause: expected string, got integer"}},
+		{"too short", `{"root_cause":"gc","confidence":0.5}`, []string{"$.root_cause: expected length >= 3"}},
+		{"multibyte length", `{"root_cause":"内存泄漏","confidence":0.5}`, nil},
+		{"above maximum", `{"root_cause":"gc pause","confidence":1.5}`, []string{"$.confidence: expected <= 1, got 1.5"}},
+		{"below minimum", `{"root_cause":"gc pause","confidence":-1}`, []string{"$.confidence: expected >= 0, got -1"}},
+		{"not integer", `{"root_cause":"gc pause","confidence":0.5,"retries":1.5}`, []string{"$.retries: expected integer, got number"}},
+		{"enum", `{"root_cause":"gc pause","confidence":0.5,"severity":"medium"}`, []string{"$.severity: value not in enum"}},
+		{"min items", `{"root_cause":"gc pause","confidence":0.5,"tool_calls":[]}`, []string{"$.tool_calls: expected at least 1 items, got 0"}},
+		{"max items", `{"root_cause":"gc pause","confidence":0.5,"tool_calls":[{"tool":"a"},{"tool":"b"},{"tool":"c"}]}`, []string{"$.tool_calls: expected at most 2 items, got 3"}},
+		{"item errors", `{"root_cause":"gc pause","confidence":0.5,"tool_calls":[{"tool":1},{}]}`, []string{
+			"$.tool_calls[0].tool: expected string, got integer",
+			`$.tool_calls[1]: missing required property "tool"`,
+		}},
+		{"all errors", `{"confidence":"high","extra":true}`, []string{
+			`$: missing required property "root_cause"`,
+			"$.confidence: expected number, got string",
+			`$: unexpected property "extra"`,
+		}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := s.ValidateJSON([]byte(tt.doc))
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Fatalf("ValidateJSON(%s)\n got: %q\nwant: %q", tt.doc, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestParse(t *testing.T) {
+	tests := []struct {
+		name    string
+		schema  string
+		want    []string
+		wantErr bool
+	}{
+		{"single type", `{"type":"string"}`, []string{"string"}, false},
+		{"type list", `{"type":["string","null"]}`, []string{"string", "null"}, false},
+		{"no type", `{}`, nil, false},
+		{"bad type", `{"type":3}`, nil, true},
+		{"bad json", `{`, nil, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s, err := Parse([]byte(tt.schema))
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("err = %v, wantErr %v", err, tt.wantErr)
+			}
+			if err == nil && !reflect.DeepEqual([]string(s.Type), tt.want) {
+				t.Fatalf("Type = %q, want %q", s.Type, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,120 @@
+package sop
+
+import (
+	"fmt"
+	"strings"
+)
+
+// ComposeOptions 控制多 SOP 合并渲染
+type ComposeOptions struct {
+	MaxSOPs int            // 最多合并的 SOP 数（主 SOP + 按排名的其余命中），<=0 视为 1
+	Budget  int            // 渲染文本的字节上限，<=0 不限
+	Limits  map[string]int // 各段条目上限（command/metric/log/parameter/fix_action），nil 用 DefaultLimits；0 不限
+}
+
+// DefaultLimits 是各段默认条目上限（合并后的总数）
+var DefaultLimits = map[string]int{"command": 5, "metric": 5, "log": 3, "parameter": 3, "fix_action": 3}
+
+// Composition 是合并渲染的结果
+type Composition struct {
+	Text    string   `json:"text"`
+	SopID   string   `json:"sop_id"`            // 主 SOP，用于会话关联
+	SopIDs  []string `json:"sop_ids"`           // 实际有条目写入文本的 SOP
+	Dropped int      `json:"dropped,omitempty"` // 因上限或预算被丢弃的条目数
+
+	Warnings []string `json:"warnings,omitempty"` // 模板占位符无法求值等警告
+}
+
+var sections = []struct {
+	name, prefix string
+	items        func(l *Line) []string
+}{
+	{"command", "Command", func(l *Line) []string { return l.Command }},
+	{"metric", "Metric", func(l *Line) []string { return l.Metric }},
+	{"log", "Log", func(l *Line) []string { return l.Log }},
+	{"parameter", "Parameter", func(l *Line) []string { return l.Parameter }},
+	{"fix_action", "FixAction", func(l *Line) []string { return l.FixAction }},
+}
+
+// Compose 合并主 SOP 与排名靠前的其余命中 SOP：逐段按 SOP 顺序取条目，去掉重复步骤，
+// 受各段上限与总字节预算约束；未匹配时返回空结果
+func (m *Match) Compose(a Alert, opt ComposeOptions) Composition {
+	if m.Selected == nil {
+		return Composition{}
+	}
+	if opt.MaxSOPs <= 0 {
+		opt.MaxSOPs = 1
+	}
+	if opt.Limits == nil {
+		opt.Limits = DefaultLimits
+	}
+
+	// 主 SOP 在前，其余按排名补足
+	picked := []*Line{m.Selected}
+	for _, l := range m.ranked {
+		if len(picked) >= opt.MaxSOPs {
+			break
+		}
+		if l != m.Selected {
+			picked = append(picked, l)
+		}
+	}
+	ids := make([]string, len(picked))
+	for i, l := range picked {
+		if ids[i] = l.SopID; ids[i] == "" {
+			ids[i] = "(unnamed)"
+		}
+	}
+	ids[0] = m.SopID
+
+	var b strings.Builder
+	b.WriteString("### [SOP] Preloaded knowledge (high priority)\n")
+	b.WriteString(fmt.Sprintf("Matched SOP ID: %s\n", m.SopID))
+	if len(picked) > 1 {
+		b.WriteString(fmt.Sprintf("Merged SOP IDs: %s\n", strings.Join(ids[1:], ", ")))
+	}
+	if m.Selected.IncidentKey != "" {
+		b.WriteString(fmt.Sprintf("Incident Key: %s\n", m.Selected.IncidentKey))
+	}
+	b.WriteString("\n")
+
+	c := Composition{SopID: m.SopID}
+	tc := NewTemplateContext(a)
+	contributed := make([]bool, len(picked))
+	seen := map[string]bool{}
+	for _, sec := range sections {
+		limit, cnt := opt.Limits[sec.name], 0
+		for i, l := range picked {
+			for _, x := range sec.items(l) {
+				x = strings.TrimSpace(x)
+				if x == "" {
+					continue
+				}
+				x, warns := tc.Render(x)
+				// 去重：同一段内忽略大小写与空白差异
+				key := sec.name + "::" + strings.Join(strings.Fields(strings.ToLower(x)), " ")
+				if seen[key] {
+					continue
+				}
+				seen[key] = true
+				c.Warnings = append(c.Warnings, warns...)
+				line := "- " + sec.prefix + ": " + x + "\n"
+				if (limit > 0 && cnt >= limit) || (opt.Budget > 0 && b.Len()+len(line) > opt.Budget) {
+					c.Dropped++
+					continue
+				}
+				b.WriteString(line)
+				cnt++
+				contributed[i] = true
+			}
+		}
+	}
+
+	for i, ok := range contributed {
+		if ok || i == 0 {
+			c.SopIDs = append(c.SopIDs, ids[i])
+		}
+	}
+	c.Text = b.String()
+	return c
+}
@@ -0,0 +1,96 @@
+package sop
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestCompose(t *testing.T) {
+	a := mustAlert(t, sopAlert)
+	m := MatchAlert(sopLines(), a, false)
+
+	tests := []struct {
+		name     string
+		opt      ComposeOptions
+		ids      []string
+		dropped  int
+		has      []string
+		hasNot   []string
+		maxBytes int
+	}{
+		{
+			name:    "primary only",
+			opt:     ComposeOptions{MaxSOPs: 1},
+			ids:     []string{"sop_cpu"},
+			dropped: 1, // command 默认上限 5
+			has:     []string{"Matched SOP ID: sop_cpu\n", "- Command: kubectl top pod api-1\n", "- Metric: cpu_usage\n"},
+			hasNot:  []string{"Merged SOP IDs", "c6", "pidstat"},
+		},
+		{
+			name:    "zero means one",
+			opt:     ComposeOptions{},
+			ids:     []string{"sop_cpu"},
+			dropped: 1,
+		},
+		{
+			name:   "merge two",
+			opt:    ComposeOptions{MaxSOPs: 2, Limits: map[string]int{"command": 0}},
+			ids:    []string{"sop_cpu", "sop_cpu_wild"},
+			has:    []string{"Merged SOP IDs: sop_cpu_wild\n", "- Command: c6\n", "- Command: pidstat 1 5\n", "- FixAction: scale out\n"},
+			hasNot: []string{"TOP  -b -n1"}, // 与 "top -b -n1" 仅大小写与空白不同，去重
+		},
+		{
+			name:    "merged sop without room is not reported",
+			opt:     ComposeOptions{MaxSOPs: 3, Limits: map[string]int{"command": 6}},
+			ids:     []string{"sop_cpu", "sop_cpu_wild"},
+			dropped: 2, // pidstat、uptime 超出 command 上限
+			hasNot:  []string{"uptime"},
+		},
+		{
+			name:     "budget",
+			opt:      ComposeOptions{MaxSOPs: 3, Budget: 150},
+			ids:      []string{"sop_cpu"},
+			has:      []string{"- Command: top -b -n1\n"},
+			hasNot:   []string{"Metric"},
+			maxBytes: 150,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := m.Compose(a, tt.opt)
+			if c.SopID != "sop_cpu" || !reflect.DeepEqual(c.SopIDs, tt.ids) {
+				t.Fatalf("sop_id=%s sop_ids=%v, want sop_cpu %v", c.SopID, c.SopIDs, tt.ids)
+			}
+			if tt.name != "budget" && c.Dropped != tt.dropped {
+				t.Fatalf("dropped = %d, want %d\n%s", c.Dropped, tt.dropped, c.Text)
+			}
+			for _, s := range tt.has {
+				if !strings.Contains(c.Text, s) {
+					t.Errorf("text missing %q:\n%s", s, c.Text)
+				}
+			}
+			for _, s := range tt.hasNot {
+				if strings.Contains(c.Text, s) {
+					t.Errorf("text contains %q:\n%s", s, c.Text)
+				}
+			}
+			if tt.maxBytes > 0 && (len(c.Text) > tt.maxBytes || c.Dropped == 0) {
+				t.Errorf("budget %d: %d bytes, dropped %d", tt.maxBytes, len(c.Text), c.Dropped)
+			}
+		})
+	}
+
+	if c := MatchAlert(nil, a, false).Compose(a, ComposeOptions{}); c.Text != "" || c.SopIDs != nil {
+		t.Fatalf("no match: %+v", c)
+	}
+}
+
+func TestComposeWarnings(t *testing.T) {
+	a := mustAlert(t, sopAlert)
+	lines := []Line{{SopID: "sop_x", Keys: []string{"cat:cpu"}, Command: []string{"echo {{.metadata.missing}}"}}}
+	c := MatchAlert(lines, a, false).Compose(a, ComposeOptions{})
+	if len(c.Warnings) != 1 || !strings.Contains(c.Text, "- Command: echo {{.metadata.missing}}\n") {
+		t.Fatalf("warnings=%q text=%q", c.Warnings, c.Text)
+	}
+}
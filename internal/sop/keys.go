@@ -0,0 +1,246 @@
+package sop
+
+import (
+	"encoding/json"
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// SOP key 语法：<field><op><value>
+//
+//	field: svc/service, cat/category, sev/severity, region, env, path, method, group_id, threshold,
+//	       metadata.<name>（可多级，如 metadata.labels.team）
+//	op:    ":" 或 "="  通配匹配（* 任意字符，不区分大小写）
+//	       "!="        通配不匹配
+//	       "=~" / "!~" 正则匹配 / 不匹配（整串匹配，区分大小写，可用 (?i)）
+//	       ">" ">=" "<" "<="  数值比较；value 为数字或另一个字段（如 metadata.current_value>threshold）
+//
+// 一条 SOP 的全部 key 都通过才算命中。
+type cond struct {
+	raw   string
+	field string
+	op    string
+	value string
+	re    *regexp.Regexp
+	wild  *regexp.Regexp // 含 * 的通配模式，解析时预编译
+	num   *float64       // 数值比较时 value 为数字
+}
+
+// compiledKey 是加载 SOP 时预先解析的 key；解析失败时记录错误，匹配时报告
+type compiledKey struct {
+	cond *cond
+	err  error
+}
+
+// compileKeys 解析全部 key，供 Line 缓存（见 Line.compile）
+func compileKeys(keys []string) []compiledKey {
+	out := make([]compiledKey, len(keys))
+	for i, k := range keys {
+		out[i].cond, out[i].err = parseKey(k)
+	}
+	return out
+}
+
+var (
+	keyRE    = regexp.MustCompile(`^\s*([A-Za-z_][A-Za-z0-9_.]*)\s*(!=|=~|!~|>=|<=|==|>|<|=|:)\s*(.*?)\s*$`)
+	aliasMap = map[string]string{"svc": "service", "cat": "category", "sev": "severity"}
+)
+
+// KeyFields 是 keys 中可用的字段名（另可用 metadata.<name>）
+var KeyFields = map[string]bool{
+	"svc": true, "service": true,
+	"cat": true, "category": true,
+	"sev": true, "severity": true,
+	"region": true, "env": true, "path": true, "method": true,
+	"group_id": true, "threshold": true,
+}
+
+func knownField(f string) bool {
+	f = strings.ToLower(f)
+	return KeyFields[f] || (strings.HasPrefix(f, "metadata.") && len(f) > len("metadata."))
+}
+
+// parseKey 解析一个 key
+func parseKey(k string) (*cond, error) {
+	m := keyRE.FindStringSubmatch(k)
+	if m == nil || m[3] == "" {
+		return nil, fmt.Errorf("key %q must look like field:pattern, field!=pattern, field=~regex or field>number", k)
+	}
+	c := &cond{raw: k, field: strings.ToLower(m[1]), op: m[2], value: m[3]}
+	if a, ok := aliasMap[c.field]; ok {
+		c.field = a
+	}
+	if c.op == "==" {
+		c.op = "="
+	}
+	if !knownField(c.field) {
+		return nil, fmt.Errorf("key %q: unknown field %q (want svc, cat, sev, region, env, path, method, group_id, threshold or metadata.<name>)", k, m[1])
+	}
+	switch c.op {
+	case ":", "=", "!=":
+		if strings.ContainsAny(c.value, " \t") {
+			return nil, fmt.Errorf("key %q: pattern must not contain spaces", k)
+		}
+		c.value = strings.ToLower(c.value)
+		if c.value != "*" && strings.Contains(c.value, "*") {
+			c.wild = regexp.MustCompile("^" + strings.ReplaceAll(regexp.QuoteMeta(c.value), "\\*", ".*") + "$")
+		}
+	case "=~", "!~":
+		re, err := regexp.Compile("^(?:" + c.value + ")$")
+		if err != nil {
+			return nil, fmt.Errorf("key %q: invalid regex: %v", k, err)
+		}
+		c.re = re
+	default: // 数值比较
+		if f, err := strconv.ParseFloat(c.value, 64); err == nil {
+			c.num = &f
+		} else if !knownField(c.value) {
+			return nil, fmt.Errorf("key %q: %s needs a number or a field on the right side", k, c.op)
+		} else {
+			c.value = strings.ToLower(c.value)
+			if a, ok := aliasMap[c.value]; ok {
+				c.value = a
+			}
+		}
+	}
+	return c, nil
+}
+
+// specificity 是 key 的具体程度：精确值 > 通配/正则/数值 > 否定；纯 "*" 为 0
+func (c *cond) specificity() int {
+	switch c.op {
+	case ":", "=":
+		switch {
+		case c.value == "*":
+			return 0
+		case strings.Contains(c.value, "*"):
+			return 2
+		default:
+			return 3
+		}
+	case "=~":
+		return 2
+	case "!=", "!~":
+		return 1
+	default:
+		return 2
+	}
+}
+
+// eval 评估 key，返回告警中的实际值与是否通过
+func (c *cond) eval(a Alert, meta map[string]interface{}) (string, bool) {
+	val, ok := fieldValue(a, meta, c.field)
+	switch c.op {
+	case ":", "=":
+		return val, c.wildcardMatch(strings.ToLower(val))
+	case "!=":
+		return val, !c.wildcardMatch(strings.ToLower(val))
+	case "=~":
+		return val, c.re.MatchString(val)
+	case "!~":
+		return val, !c.re.MatchString(val)
+	}
+	// 数值比较：两侧都必须是数字
+	lhs, err := strconv.ParseFloat(strings.TrimSpace(val), 64)
+	if !ok || err != nil {
+		return val, false
+	}
+	var rhs float64
+	if c.num != nil {
+		rhs = *c.num
+	} else {
+		rv, ok := fieldValue(a, meta, c.value)
+		if rhs, err = strconv.ParseFloat(strings.TrimSpace(rv), 64); !ok || err != nil {
+			return fmt.Sprintf("%s (%s=%q)", val, c.value, rv), false
+		}
+		val = fmt.Sprintf("%s (%s=%s)", val, c.value, rv)
+	}
+	switch c.op {
+	case ">":
+		return val, lhs > rhs
+	case ">=":
+		return val, lhs >= rhs
+	case "<":
+		return val, lhs < rhs
+	default:
+		return val, lhs <= rhs
+	}
+}
+
+// wildcardMatch 按通配模式匹配（val 已转小写）
+func (c *cond) wildcardMatch(val string) bool {
+	switch {
+	case c.value == "*":
+		return true
+	case c.wild != nil:
+		return c.wild.MatchString(val)
+	default:
+		return c.value == val
+	}
+}
+
+// fieldValue 取告警字段的字符串值；metadata.<a.b> 按层级查找，数字/布尔按 JSON 字面量输出
+func fieldValue(a Alert, meta map[string]interface{}, field string) (string, bool) {
+	switch field {
+	case "service":
+		return a.Service, a.Service != ""
+	case "category":
+		return a.Category, a.Category != ""
+	case "severity":
+		return a.Severity, a.Severity != ""
+	case "region":
+		return a.Region, a.Region != ""
+	case "env":
+		return a.Env, a.Env != ""
+	case "path":
+		return a.Path, a.Path != ""
+	case "method":
+		return a.Method, a.Method != ""
+	case "group_id":
+		return a.GroupID, a.GroupID != ""
+	case "threshold":
+		s := rawString(a.Threshold)
+		return s, s != ""
+	}
+	var cur interface{} = meta
+	for _, p := range strings.Split(strings.TrimPrefix(field, "metadata."), ".") {
+		m, ok := cur.(map[string]interface{})
+		if !ok {
+			return "", false
+		}
+		if cur, ok = m[p]; !ok {
+			// metadata 的键可能带大小写，退化为不区分大小写查找
+			for k, v := range m {
+				if strings.EqualFold(k, p) {
+					cur, ok = v, true
+					break
+				}
+			}
+			if !ok {
+				return "", false
+			}
+		}
+	}
+	switch v := cur.(type) {
+	case nil:
+		return "", false
+	case string:
+		return v, true
+	default:
+		b, _ := json.Marshal(v)
+		return string(b), true
+	}
+}
+
+func rawString(raw json.RawMessage) string {
+	if len(raw) == 0 {
+		return ""
+	}
+	var s string
+	if json.Unmarshal(raw, &s) == nil {
+		return s
+	}
+	return strings.TrimSpace(string(raw))
+}
@@ -0,0 +1,141 @@
+package sop
+
+import (
+	"encoding/json"
+	"testing"
+)
+
+const keysAlert = `{"service":"Omada-API","category":"cpu","severity":"critical","region":"us-east-1","env":"prod",
+	"path":"/api/v1/devices","method":"GET","group_id":"g-1","threshold":"80",
+	"metadata":{"current_value":95.5,"labels":{"Team":"sre"},"alert_name":"HighCPU","flag":true}}`
+
+func TestKeyEval(t *testing.T) {
+	a := mustAlert(t, keysAlert)
+	tests := []struct {
+		key    string
+		passed bool
+		value  string
+	}{
+		{"svc:omada-api", true, "Omada-API"},
+		{"service:OMADA-*", true, "Omada-API"},
+		{"svc:*api", true, "Omada-API"},
+		{"svc:om*da*", true, "Omada-API"},
+		{"svc:omada", false, "Omada-API"},
+		{"svc:*", true, "Omada-API"},
+		{"svc==omada-api", true, "Omada-API"},
+		{"cat!=mem*", true, "cpu"},
+		{"cat!=c*", false, "cpu"},
+		{"sev=~crit.*", true, "critical"},
+		{"sev=~CRIT.*", false, "critical"},
+		{"sev=~(?i)CRIT.*", true, "critical"},
+		{"sev=~crit", false, "critical"}, // 正则整串匹配
+		{"region!~eu-.*", true, "us-east-1"},
+		{"path:/api/*", true, "/api/v1/devices"},
+		{"path:/api/v1/devices.", false, "/api/v1/devices"}, // 通配模式中的 . 不是正则
+		{"method:get", true, "GET"},
+		{"group_id:g-1", true, "g-1"},
+		{"env:staging", false, "prod"},
+		{"threshold>=80", true, "80"},
+		{"metadata.current_value>90", true, "95.5"},
+		{"metadata.current_value<=95", false, "95.5"},
+		{"metadata.current_value>threshold", true, "95.5 (threshold=80)"},
+		{"metadata.current_value<threshold", false, "95.5 (threshold=80)"},
+		{"metadata.labels.team:sre", true, "sre"},
+		{"metadata.alert_name:highcpu", true, "HighCPU"},
+		{"metadata.flag:true", true, "true"},
+		{"metadata.missing:*", true, ""},
+		{"metadata.missing>1", false, ""},
+		{"svc>1", false, "Omada-API"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.key, func(t *testing.T) {
+			l := &Line{Keys: []string{tt.key}}
+			for _, compiled := range []bool{false, true} {
+				if compiled {
+					l.compile()
+				}
+				checks, ok, _ := checkKeys(l, a, metaOf(a))
+				c := checks[0]
+				if c.Error != "" {
+					t.Fatalf("compiled=%v: unexpected error %s", compiled, c.Error)
+				}
+				if ok != tt.passed || c.Passed != tt.passed || c.Value != tt.value {
+					t.Fatalf("compiled=%v: got passed=%v value=%q, want passed=%v value=%q", compiled, c.Passed, c.Value, tt.passed, tt.value)
+				}
+			}
+		})
+	}
+}
+
+func TestParseKeyErrors(t *testing.T) {
+	for _, k := range []string{
+		"",
+		"svc",
+		"svc:",
+		"owner:bob",
+		"svc:a b",
+		"sev=~(",
+		"metadata.:x",
+		"metadata.x>abc",
+		"1svc:x",
+	} {
+		if _, err := parseKey(k); err == nil {
+			t.Errorf("parseKey(%q) = nil error", k)
+		}
+	}
+}
+
+func TestSpecificity(t *testing.T) {
+	tests := []struct {
+		key  string
+		want int
+	}{
+		{"svc:omada", 3},
+		{"svc:om*", 2},
+		{"svc:*", 0},
+		{"svc=~om.*", 2},
+		{"svc!=omada", 1},
+		{"svc!~om.*", 1},
+		{"threshold>80", 2},
+	}
+	for _, tt := range tests {
+		c, err := parseKey(tt.key)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := c.specificity(); got != tt.want {
+			t.Errorf("specificity(%q) = %d, want %d", tt.key, got, tt.want)
+		}
+	}
+}
+
+func TestCheckKeysAll(t *testing.T) {
+	a := mustAlert(t, keysAlert)
+	tests := []struct {
+		name  string
+		keys  []string
+		ok    bool
+		score int
+	}{
+		{"no keys", nil, false, 0},
+		{"all pass", []string{"svc:omada-api", "cat:cpu"}, true, 6},
+		{"one fails", []string{"svc:omada-api", "cat:mem"}, false, 6},
+		{"invalid key", []string{"svc:omada-api", "owner:bob"}, false, 3},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			l := &Line{Keys: tt.keys}
+			l.compile()
+			checks, ok, score := checkKeys(l, a, metaOf(a))
+			if ok != tt.ok || score != tt.score || len(checks) != len(tt.keys) {
+				t.Fatalf("got ok=%v score=%d checks=%d, want ok=%v score=%d", ok, score, len(checks), tt.ok, tt.score)
+			}
+		})
+	}
+}
+
+func metaOf(a Alert) map[string]interface{} {
+	var meta map[string]interface{}
+	_ = json.Unmarshal(a.Metadata, &meta)
+	return meta
+}
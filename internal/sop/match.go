@@ -0,0 +1,191 @@
+package sop
+
+import (
+	"encoding/json"
+	"sort"
+	"strings"
+)
+
+// Alert 是参与 SOP 匹配的告警字段
+type Alert struct {
+	Service   string          `json:"service"`
+	Category  string          `json:"category"`
+	Severity  string          `json:"severity"`
+	Region    string          `json:"region"`
+	Env       string          `json:"env"`
+	GroupID   string          `json:"group_id"`
+	Path      string          `json:"path"`
+	Method    string          `json:"method"`
+	Metadata  json.RawMessage `json:"metadata"`
+	Threshold json.RawMessage `json:"threshold"`
+
+	raw map[string]interface{} // 完整告警 JSON，供模板按路径取值
+}
+
+// UnmarshalJSON 解析字段的同时保留完整告警，模板可引用未列出的字段
+func (a *Alert) UnmarshalJSON(b []byte) error {
+	type plain Alert
+	var p plain
+	if err := json.Unmarshal(b, &p); err != nil {
+		return err
+	}
+	*a = Alert(p)
+	_ = json.Unmarshal(b, &a.raw)
+	return nil
+}
+
+// IncidentKey 生成规范化的 incident_key: service_category_severity_region_alertname_groupid
+func IncidentKey(a Alert) string {
+	// 从 metadata 提取 alert_name
+	var metadata map[string]interface{}
+	alertName := ""
+	if len(a.Metadata) > 0 {
+		if err := json.Unmarshal(a.Metadata, &metadata); err == nil {
+			if name, ok := metadata["alert_name"].(string); ok && name != "" {
+				alertName = name
+			} else if name, ok := metadata["alertname"].(string); ok && name != "" {
+				alertName = name
+			}
+		}
+	}
+
+	// 规范化函数：替换空格和特殊字符为下划线
+	normalize := func(s string) string {
+		s = strings.ReplaceAll(s, " ", "_")
+		s = strings.ReplaceAll(s, "-", "_")
+		s = strings.ToLower(s)
+		return s
+	}
+
+	// 格式：service_category_severity_region_alertname_groupid
+	parts := []string{normalize(a.Service), normalize(a.Category), normalize(a.Severity), normalize(a.Region)}
+	if alertName = normalize(alertName); alertName != "" {
+		parts = append(parts, alertName)
+	}
+	if groupID := normalize(a.GroupID); groupID != "" {
+		parts = append(parts, groupID)
+	}
+	return strings.Join(parts, "_")
+}
+
+// KeyCheck 是单个 key 的匹配结果
+type KeyCheck struct {
+	Key    string `json:"key"`
+	Value  string `json:"value"` // 告警中对应字段的值
+	Passed bool   `json:"passed"`
+	Error  string `json:"error,omitempty"` // key 无法解析
+}
+
+// checkKeys 逐个评估 keys；全部 key 都通过（且至少一个）才算命中，同时返回具体程度得分。
+// 使用加载时预编译的 key；未经仓库加载的 Line（如单元测试直接构造）在此临时解析
+func checkKeys(l *Line, a Alert, meta map[string]interface{}) ([]KeyCheck, bool, int) {
+	keys := l.keys
+	if len(keys) != len(l.Keys) {
+		keys = compileKeys(l.Keys)
+	}
+	checks := make([]KeyCheck, 0, len(keys))
+	ok, score := len(keys) > 0, 0
+	for i, k := range keys {
+		c := KeyCheck{Key: l.Keys[i]}
+		cd, err := k.cond, k.err
+		if err != nil {
+			c.Error = err.Error()
+		} else {
+			c.Value, c.Passed = cd.eval(a, meta)
+			score += cd.specificity()
+		}
+		ok = ok && c.Passed
+		checks = append(checks, c)
+	}
+	return checks, ok, score
+}
+
+// Candidate 是一条 SOP 的匹配评估
+type Candidate struct {
+	Index    int        `json:"index"` // 在快照中的下标（无 sop_id 的 SOP 以此区分）
+	SopID    string     `json:"sop_id,omitempty"`
+	Priority string     `json:"priority,omitempty"`
+	Score    int        `json:"specificity"` // key 具体程度得分，同优先级时高者优先
+	Keys     []KeyCheck `json:"keys"`
+	Matched  bool       `json:"matched"`
+	Rank     int        `json:"rank,omitempty"` // 命中后按优先级排序的名次（从 1 开始）
+}
+
+// Match 是一次匹配的完整过程：先按 incident_key 推导的 sop_id 精确匹配，否则按 keys + 优先级选择
+type Match struct {
+	IncidentKey   string      `json:"incident_key"`
+	ExpectedSopID string      `json:"expected_sop_id"`
+	Method        string      `json:"method"` // exact/keys/none
+	Candidates    []Candidate `json:"candidates,omitempty"`
+	Ranking       []int       `json:"ranking,omitempty"` // 命中 SOP 的下标，按优先级、具体程度排序
+	SopID         string      `json:"sop_id,omitempty"`  // 最终 sop_id（SOP 未声明时使用 expected_sop_id）
+	Selected      *Line       `json:"selected,omitempty"`
+
+	ranked []*Line // 按 keys 命中的 SOP，顺序同 Ranking（供 Compose 合并）
+}
+
+var priorityOrder = map[string]int{"HIGH": 0, "MIDDLE": 1, "LOW": 2}
+
+// MatchAlert 为告警选择 SOP；explain 为 true 时记录每一条 SOP 的评估过程
+func MatchAlert(lines []Line, a Alert, explain bool) *Match {
+	m := &Match{IncidentKey: IncidentKey(a), Method: "none"}
+	m.ExpectedSopID = IDFor(m.IncidentKey)
+
+	// 优先通过 sop_id 精确匹配
+	for i := range lines {
+		if lines[i].SopID == m.ExpectedSopID {
+			m.Method, m.Selected = "exact", &lines[i]
+			break
+		}
+	}
+
+	{
+		// 通过 keys 匹配（精确匹配时也评估，供多 SOP 合并），按优先级、再按具体程度排序（稳定排序，都相同时保持文件顺序）
+		var meta map[string]interface{}
+		if len(a.Metadata) > 0 {
+			_ = json.Unmarshal(a.Metadata, &meta)
+		}
+		var hit []int
+		scores := make([]int, len(lines))
+		for i := range lines {
+			l := &lines[i]
+			checks, ok, score := checkKeys(l, a, meta)
+			scores[i] = score
+			if ok {
+				hit = append(hit, i)
+			}
+			if explain {
+				m.Candidates = append(m.Candidates, Candidate{
+					Index: i, SopID: l.SopID, Priority: l.Priority, Score: score, Keys: checks, Matched: ok,
+				})
+			}
+		}
+		sort.SliceStable(hit, func(i, j int) bool {
+			pi := priorityOrder[strings.ToUpper(lines[hit[i]].Priority)]
+			pj := priorityOrder[strings.ToUpper(lines[hit[j]].Priority)]
+			if pi != pj {
+				return pi < pj
+			}
+			return scores[hit[i]] > scores[hit[j]]
+		})
+		m.Ranking = hit
+		for r, i := range hit {
+			m.ranked = append(m.ranked, &lines[i])
+			if explain {
+				m.Candidates[i].Rank = r + 1
+			}
+		}
+		if m.Selected == nil && len(hit) > 0 {
+			m.Method, m.Selected = "keys", &lines[hit[0]]
+		}
+	}
+
+	if m.Selected != nil {
+		// 使用匹配到的 SOP 的 sop_id；SOP 没有 sop_id 时使用生成的
+		m.SopID = m.Selected.SopID
+		if m.SopID == "" {
+			m.SopID = m.ExpectedSopID
+		}
+	}
+	return m
+}
@@ -0,0 +1,67 @@
+package sop
+
+import (
+	"encoding/json"
+	"reflect"
+	"testing"
+)
+
+func mustAlert(t *testing.T, s string) Alert {
+	t.Helper()
+	var a Alert
+	if err := json.Unmarshal([]byte(s), &a); err != nil {
+		t.Fatal(err)
+	}
+	return a
+}
+
+const sopAlert = `{"service":"omada","category":"cpu","severity":"critical","region":"us","metadata":{"pod":"api-1"}}`
+
+func sopLines() []Line {
+	lines := []Line{
+		{SopID: "sop_generic", Keys: []string{"svc:*"}, Priority: "LOW", Command: []string{"uptime"}},
+		{SopID: "sop_cpu", Keys: []string{"svc:omada", "cat:cpu"}, Priority: "HIGH",
+			Command: []string{"top -b -n1", "kubectl top pod {{.metadata.pod}}", "c3", "c4", "c5", "c6"},
+			Metric:  []string{"cpu_usage"}},
+		{SopID: "sop_cpu_wild", Keys: []string{"svc:om*", "cat:cpu"}, Priority: "HIGH",
+			Command: []string{"TOP  -b -n1", "pidstat 1 5"}, FixAction: []string{"scale out"}},
+		{SopID: "sop_mem", Keys: []string{"cat:mem"}, Priority: "HIGH", Command: []string{"free -m"}},
+	}
+	for i := range lines {
+		lines[i].compile()
+	}
+	return lines
+}
+
+func TestMatchAlert(t *testing.T) {
+	a := mustAlert(t, sopAlert)
+	lines := sopLines()
+
+	m := MatchAlert(lines, a, true)
+	if m.Method != "keys" || m.SopID != "sop_cpu" {
+		t.Fatalf("method=%s sop_id=%s, want keys/sop_cpu", m.Method, m.SopID)
+	}
+	// HIGH 优先，同优先级按具体程度（精确 3+3 > 通配 2+3）
+	if want := []int{1, 2, 0}; !reflect.DeepEqual(m.Ranking, want) {
+		t.Fatalf("ranking = %v, want %v", m.Ranking, want)
+	}
+	if len(m.Candidates) != len(lines) || m.Candidates[3].Matched || m.Candidates[2].Rank != 2 {
+		t.Fatalf("candidates = %+v", m.Candidates)
+	}
+
+	// 按 incident_key 生成的 sop_id 精确命中时优先于 keys
+	exact := append(lines, Line{SopID: IDFor(IncidentKey(a)), Priority: "LOW", Command: []string{"exact"}})
+	if m := MatchAlert(exact, a, false); m.Method != "exact" || m.SopID != exact[4].SopID || m.Candidates != nil {
+		t.Fatalf("exact: method=%s sop_id=%s", m.Method, m.SopID)
+	}
+
+	// 无 sop_id 的 SOP 使用生成的 sop_id
+	anon := []Line{{Keys: []string{"cat:cpu"}, Command: []string{"x"}}}
+	if m := MatchAlert(anon, a, false); m.SopID != m.ExpectedSopID {
+		t.Fatalf("anonymous: sop_id=%s, want %s", m.SopID, m.ExpectedSopID)
+	}
+
+	if m := MatchAlert(lines[3:], a, false); m.Method != "none" || m.Selected != nil || m.SopID != "" {
+		t.Fatalf("no match: %+v", m)
+	}
+}
@@ -0,0 +1,380 @@
+package sop
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha1"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Repository 提供 SOP 的当前快照；实现需保证 Snapshot 返回的内容只读且整体替换（不会读到加载一半的数据）
+type Repository interface {
+	Snapshot() *Snapshot
+	Close()
+}
+
+// Editor 是可写的 SOP 仓库（供 /sops/{id} 管理接口使用）
+type Editor interface {
+	Repository
+	Create(file string, l Line) (Line, error)
+	Update(id string, l Line) (Line, error)
+	Delete(id string) error
+}
+
+var (
+	ErrNotFound  = errors.New("sop not found")
+	ErrDuplicate = errors.New("duplicate sop_id")
+)
+
+// Snapshot 是一次完整加载的结果
+type Snapshot struct {
+	Lines    []Line       `json:"-"`
+	Count    int          `json:"count"`
+	Files    []string     `json:"files"`
+	LoadedAt time.Time    `json:"loaded_at"`
+	Errors   []Diagnostic `json:"errors"`
+
+	index map[string]int // sop_id → Lines 下标
+}
+
+// Get 按 sop_id 查找
+func (s *Snapshot) Get(id string) (Line, bool) {
+	i, ok := s.index[id]
+	if !ok {
+		return Line{}, false
+	}
+	return s.Lines[i], true
+}
+
+// DirRepository 从目录下的 *.jsonl 加载 SOP，轮询检测变更后整体重载
+type DirRepository struct {
+	dir string
+
+	mu        sync.RWMutex
+	snap      *Snapshot
+	sig       string
+	lastError string
+
+	wmu sync.Mutex // 串行化写操作
+
+	stop chan struct{}
+	once sync.Once
+}
+
+// NewDirRepository 立即加载一次 dir；interval>0 时后台轮询，文件增删改后自动重载
+func NewDirRepository(dir string, interval time.Duration) *DirRepository {
+	r := &DirRepository{dir: dir, snap: &Snapshot{index: map[string]int{}}, stop: make(chan struct{})}
+	r.Reload()
+	if interval > 0 {
+		go r.watch(interval)
+	}
+	return r
+}
+
+func (r *DirRepository) Dir() string { return r.dir }
+
+func (r *DirRepository) Snapshot() *Snapshot {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	return r.snap
+}
+
+// LastError 返回最近一次扫描目录失败的原因（成功后清空）
+func (r *DirRepository) LastError() string {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	return r.lastError
+}
+
+func (r *DirRepository) Close() {
+	r.once.Do(func() { close(r.stop) })
+}
+
+func (r *DirRepository) watch(interval time.Duration) {
+	t := time.NewTicker(interval)
+	defer t.Stop()
+	for {
+		select {
+		case <-r.stop:
+			return
+		case <-t.C:
+			sig, _, err := r.scan()
+			r.mu.RLock()
+			changed := err == nil && sig != r.sig
+			r.mu.RUnlock()
+			if changed {
+				r.Reload()
+			}
+		}
+	}
+}
+
+// scan 列出目录下的 jsonl 文件，并以路径+大小+mtime 生成变更签名
+func (r *DirRepository) scan() (string, []string, error) {
+	var files []string
+	h := sha1.New()
+	err := filepath.WalkDir(r.dir, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if d.IsDir() || !strings.HasSuffix(path, ".jsonl") {
+			return nil
+		}
+		info, err := d.Info()
+		if err != nil {
+			return err
+		}
+		files = append(files, path)
+		fmt.Fprintf(h, "%s|%d|%d\n", path, info.Size(), info.ModTime().UnixNano())
+		return nil
+	})
+	if err != nil {
+		return "", nil, err
+	}
+	sort.Strings(files)
+	return fmt.Sprintf("%x", h.Sum(nil)), files, nil
+}
+
+// Reload 重新加载整个目录；目录不可读时保留旧快照并记录错误
+func (r *DirRepository) Reload() error {
+	sig, files, err := r.scan()
+	if err != nil {
+		r.mu.Lock()
+		r.lastError = err.Error()
+		r.mu.Unlock()
+		log.Printf("sop: scan %s failed, keeping %d loaded SOPs: %v", r.dir, r.Snapshot().Count, err)
+		return err
+	}
+	snap := &Snapshot{Files: files, LoadedAt: time.Now(), index: map[string]int{}}
+	seen := map[string]string{}
+	for _, f := range files {
+		lines, diags, err := parseFile(f)
+		if err != nil {
+			diags = append(diags, Diagnostic{File: f, Error: err.Error()})
+		}
+		for _, d := range diags {
+			log.Printf("sop: rejected %s", d)
+		}
+		snap.Errors = append(snap.Errors, diags...)
+		for _, pl := range lines {
+			if prev, dup := seen[pl.SopID]; dup && pl.SopID != "" {
+				d := Diagnostic{File: f, Line: pl.n, Error: fmt.Sprintf("duplicate sop_id %s (first defined in %s)", pl.SopID, prev)}
+				log.Printf("sop: rejected %s", d)
+				snap.Errors = append(snap.Errors, d)
+				continue
+			}
+			seen[pl.SopID] = fmt.Sprintf("%s:%d", f, pl.n)
+			if pl.SopID != "" {
+				snap.index[pl.SopID] = len(snap.Lines)
+			}
+			pl.Line.compile()
+			snap.Lines = append(snap.Lines, pl.Line)
+		}
+	}
+	snap.Count = len(snap.Lines)
+
+	r.mu.Lock()
+	r.snap, r.sig, r.lastError = snap, sig, ""
+	r.mu.Unlock()
+	log.Printf("sop: loaded %d SOPs from %d files in %s (%d rejected)", snap.Count, len(files), r.dir, len(snap.Errors))
+	return nil
+}
+
+type parsedLine struct {
+	Line
+	n int
+}
+
+func parseFile(path string) ([]parsedLine, []Diagnostic, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer f.Close()
+
+	var out []parsedLine
+	var diags []Diagnostic
+	sc := bufio.NewScanner(f)
+	sc.Buffer(make([]byte, 64*1024), 4*1024*1024)
+	for n := 1; sc.Scan(); n++ {
+		line := strings.TrimSpace(sc.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		one, err := ParseLine([]byte(line))
+		if err != nil {
+			diags = append(diags, Diagnostic{File: path, Line: n, Error: err.Error()})
+			continue
+		}
+		out = append(out, parsedLine{Line: one, n: n})
+	}
+	return out, diags, sc.Err()
+}
+
+// Create 把新 SOP 追加到 dir 下的 file（仅文件名，默认 custom.jsonl）；
+// 未给 sop_id 时按 incident_key 生成
+func (r *DirRepository) Create(file string, l Line) (Line, error) {
+	if l.SopID == "" && l.IncidentKey != "" {
+		l.SopID = IDFor(l.IncidentKey)
+	}
+	if l.SopID == "" {
+		return l, &ValidationError{Problems: []string{"sop_id or incident_key required"}}
+	}
+	if err := l.Validate(); err != nil {
+		return l, err
+	}
+	if file == "" {
+		file = "custom.jsonl"
+	}
+	if file != filepath.Base(file) || !strings.HasSuffix(file, ".jsonl") {
+		return l, &ValidationError{Problems: []string{fmt.Sprintf("file %q must be a plain *.jsonl name", file)}}
+	}
+	b, err := l.Encode()
+	if err != nil {
+		return l, err
+	}
+
+	r.wmu.Lock()
+	defer r.wmu.Unlock()
+	if path, _, err := r.locate(l.SopID); err != nil {
+		return l, err
+	} else if path != "" {
+		return l, fmt.Errorf("%w: %s already defined in %s", ErrDuplicate, l.SopID, path)
+	}
+	path := filepath.Join(r.dir, file)
+	lines, err := readRawLines(path)
+	if err != nil && !os.IsNotExist(err) {
+		return l, err
+	}
+	if err := writeLinesAtomic(path, append(lines, string(b))); err != nil {
+		return l, err
+	}
+	log.Printf("sop: created %s in %s", l.SopID, path)
+	return l, r.Reload()
+}
+
+// Update 替换 sop_id 为 id 的那一行（原文件、原位置）
+func (r *DirRepository) Update(id string, l Line) (Line, error) {
+	if l.SopID == "" {
+		l.SopID = id
+	}
+	if l.SopID != id {
+		return l, &ValidationError{Problems: []string{fmt.Sprintf("sop_id %q does not match path id %q", l.SopID, id)}}
+	}
+	if err := l.Validate(); err != nil {
+		return l, err
+	}
+	b, err := l.Encode()
+	if err != nil {
+		return l, err
+	}
+	return l, r.rewrite(id, func(lines []string, i int) []string {
+		lines[i] = string(b)
+		return lines
+	})
+}
+
+// Delete 删除 sop_id 为 id 的那一行
+func (r *DirRepository) Delete(id string) error {
+	return r.rewrite(id, func(lines []string, i int) []string {
+		return append(lines[:i], lines[i+1:]...)
+	})
+}
+
+func (r *DirRepository) rewrite(id string, edit func(lines []string, i int) []string) error {
+	r.wmu.Lock()
+	defer r.wmu.Unlock()
+	path, i, err := r.locate(id)
+	if err != nil {
+		return err
+	}
+	if path == "" {
+		return fmt.Errorf("%w: %s", ErrNotFound, id)
+	}
+	lines, err := readRawLines(path)
+	if err != nil {
+		return err
+	}
+	if err := writeLinesAtomic(path, edit(lines, i)); err != nil {
+		return err
+	}
+	log.Printf("sop: updated %s in %s", id, path)
+	return r.Reload()
+}
+
+// locate 在原始文件中查找 sop_id 所在的文件与行下标（包括被拒绝的行，避免写出重复 ID）
+func (r *DirRepository) locate(id string) (string, int, error) {
+	_, files, err := r.scan()
+	if err != nil {
+		return "", 0, err
+	}
+	for _, f := range files {
+		lines, err := readRawLines(f)
+		if err != nil {
+			return "", 0, err
+		}
+		for i, raw := range lines {
+			var probe struct {
+				SopID string `json:"sop_id"`
+			}
+			if json.Unmarshal([]byte(raw), &probe) == nil && probe.SopID == id {
+				return f, i, nil
+			}
+		}
+	}
+	return "", 0, nil
+}
+
+// readRawLines 按行读取文件原文（保留注释与无法解析的行）
+func readRawLines(path string) ([]string, error) {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	b = bytes.TrimRight(b, "\n")
+	if len(b) == 0 {
+		return nil, nil
+	}
+	return strings.Split(string(b), "\n"), nil
+}
+
+// writeLinesAtomic 写临时文件后 rename，读者不会看到写了一半的文件
+func writeLinesAtomic(path string, lines []string) error {
+	tmp, err := os.CreateTemp(filepath.Dir(path), "."+filepath.Base(path)+".tmp-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	w := bufio.NewWriter(tmp)
+	for _, l := range lines {
+		w.WriteString(l)
+		w.WriteByte('\n')
+	}
+	if err := w.Flush(); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	if st, err := os.Stat(path); err == nil {
+		_ = os.Chmod(tmp.Name(), st.Mode().Perm())
+	} else {
+		_ = os.Chmod(tmp.Name(), 0o644)
+	}
+	return os.Rename(tmp.Name(), path)
+}
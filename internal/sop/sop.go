@@ -0,0 +1,127 @@
+package sop
+
+import (
+	"crypto/sha1"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// Line 是 ctx/sop/*.jsonl 中的一条 SOP
+type Line struct {
+	SopID       string   `json:"sop_id"`                 // SOP 唯一标识（用于会话关联）
+	IncidentKey string   `json:"incident_key,omitempty"` // 规范化的 incident_key
+	Keys        []string `json:"keys"`                   // 匹配条件: svc:omada cat:cpu
+	Priority    string   `json:"priority,omitempty"`     // HIGH/MIDDLE/LOW
+	Command     []string `json:"command,omitempty"`      // 诊断命令列表
+	Metric      []string `json:"metric,omitempty"`       // 需要检查的指标
+	Log         []string `json:"log,omitempty"`          // 需要检查的日志
+	Parameter   []string `json:"parameter,omitempty"`    // 需要检查的参数
+	FixAction   []string `json:"fix_action,omitempty"`   // 修复操作
+
+	keys []compiledKey // 加载时预编译的 Keys（与 Keys 一一对应），避免每条告警重复解析
+}
+
+// compile 预编译 keys；仓库加载/重载时对每条 SOP 调用一次
+func (l *Line) compile() {
+	l.keys = compileKeys(l.Keys)
+}
+
+// Diagnostic 描述一条被拒绝的 SOP（文件 + 行号 + 原因）
+type Diagnostic struct {
+	File  string `json:"file"`
+	Line  int    `json:"line"`
+	Error string `json:"error"`
+}
+
+func (d Diagnostic) String() string {
+	return fmt.Sprintf("%s:%d: %s", d.File, d.Line, d.Error)
+}
+
+// ValidationError 汇总一条 SOP 的全部问题
+type ValidationError struct {
+	Problems []string
+}
+
+func (e *ValidationError) Error() string {
+	return strings.Join(e.Problems, "; ")
+}
+
+var priorities = map[string]bool{"": true, "HIGH": true, "MIDDLE": true, "LOW": true}
+
+// reservedIDs 与 /sops/ 下的固定路由同名，用作 sop_id 会被路由遮蔽而无法按 id 访问
+var reservedIDs = map[string]bool{"match": true}
+
+// IDFor 按 incident_key 生成 sop_id（与 worker 匹配时的生成规则一致）
+func IDFor(incidentKey string) string {
+	h := sha1.Sum([]byte(incidentKey))
+	return "sop_" + hex.EncodeToString(h[:])[:12]
+}
+
+// ParseLine 解析并校验一行 JSONL；未知字段视为错误，便于发现拼写错误
+func ParseLine(raw []byte) (Line, error) {
+	var l Line
+	dec := json.NewDecoder(strings.NewReader(string(raw)))
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(&l); err != nil {
+		return l, fmt.Errorf("invalid JSON: %v", err)
+	}
+	if dec.More() {
+		return l, fmt.Errorf("invalid JSON: trailing data after object")
+	}
+	return l, l.Validate()
+}
+
+// Validate 检查 SOP 是否可用于匹配：sop_id、keys 语法、priority、模板占位符
+func (l Line) Validate() error {
+	var probs []string
+	if strings.TrimSpace(l.SopID) == "" && len(l.Keys) == 0 {
+		probs = append(probs, "need sop_id or keys")
+	}
+	if reservedIDs[l.SopID] {
+		probs = append(probs, fmt.Sprintf("sop_id %q is reserved (conflicts with /sops/%s)", l.SopID, l.SopID))
+	} else if l.SopID != "" && !strings.HasPrefix(l.SopID, "sop_") {
+		probs = append(probs, fmt.Sprintf("sop_id %q must start with \"sop_\"", l.SopID))
+	}
+	for _, k := range l.Keys {
+		if err := validateKey(k); err != nil {
+			probs = append(probs, err.Error())
+		}
+	}
+	if !priorities[strings.ToUpper(l.Priority)] {
+		probs = append(probs, fmt.Sprintf("priority %q must be HIGH, MIDDLE or LOW", l.Priority))
+	}
+	for field, arr := range map[string][]string{
+		"command": l.Command, "metric": l.Metric, "log": l.Log,
+		"parameter": l.Parameter, "fix_action": l.FixAction,
+	} {
+		for i, s := range arr {
+			for _, p := range CheckTemplate(s) {
+				probs = append(probs, fmt.Sprintf("%s[%d]: %s", field, i, p))
+			}
+		}
+	}
+	if len(probs) == 0 {
+		return nil
+	}
+	sort.Strings(probs)
+	return &ValidationError{Problems: probs}
+}
+
+func validateKey(k string) error {
+	_, err := parseKey(k)
+	return err
+}
+
+// Encode 以紧凑的单行 JSON 输出（不转义 <>&，便于人工阅读）
+func (l Line) Encode() ([]byte, error) {
+	var b strings.Builder
+	enc := json.NewEncoder(&b)
+	enc.SetEscapeHTML(false)
+	if err := enc.Encode(l); err != nil {
+		return nil, err
+	}
+	return []byte(strings.TrimRight(b.String(), "\n")), nil
+}
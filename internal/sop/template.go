@@ -0,0 +1,425 @@
+package sop
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// SOP 模板语法：{{ <值> [| <过滤器> [参数]]... }}
+//
+//	值:     .service、.metadata.pod 等告警字段路径（可多级）
+//	        start / end / now / alert_time：告警时间，可做加减，如 start - 15m、end + 1h、now - 1d
+//	        兼容旧占位符：expression、alert_path、service_name、service名、alert_start_time、alert_end_time
+//	过滤器: default "x"         值为空时使用 x
+//	        rfc3339 / epoch / epoch_ms / format "2006.01.02"   时间格式化（ES/VictoriaMetrics 查询用）
+//	        promql / promql_re  转义为 PromQL 字符串字面量 / 正则字面量
+//	        lucene              转义 Lucene 查询特殊字符
+//	        lower / upper
+//
+// 无法求值的占位符保持原样并产生警告。
+var placeholderRE = regexp.MustCompile(`{{\s*(.*?)\s*}}`)
+
+// 旧占位符 → 新表达式（时间类旧占位符保持原有的原样输出行为，见 legacyTime）
+var legacyNames = map[string]string{
+	"expression":   ".metadata.expression",
+	"alert_path":   ".path",
+	"service_name": ".service",
+	"service名":     ".service",
+}
+
+var timeNames = map[string]bool{"start": true, "end": true, "now": true, "alert_time": true}
+
+var filterArgs = map[string]int{
+	"default": 1, "format": 1,
+	"rfc3339": 0, "epoch": 0, "epoch_ms": 0,
+	"promql": 0, "promql_re": 0, "lucene": 0,
+	"lower": 0, "upper": 0,
+}
+
+var timeExprRE = regexp.MustCompile(`^(start|end|now|alert_time)\s*(?:([+-])\s*(\d+(?:\.\d+)?)(ms|s|m|h|d|w))?$`)
+
+// TemplateContext 是一次渲染使用的告警数据（同一告警的多条文本共享）
+type TemplateContext struct {
+	root map[string]interface{}
+	meta map[string]interface{}
+	now  time.Time
+}
+
+// NewTemplateContext 以整个告警 JSON 为数据源
+func NewTemplateContext(a Alert) *TemplateContext {
+	root := a.raw
+	if root == nil {
+		b, _ := json.Marshal(a)
+		_ = json.Unmarshal(b, &root)
+	}
+	c := &TemplateContext{root: root, now: time.Now().UTC()}
+	c.meta, _ = root["metadata"].(map[string]interface{})
+	if c.meta == nil && len(a.Metadata) > 0 {
+		_ = json.Unmarshal(a.Metadata, &c.meta)
+	}
+	return c
+}
+
+// RenderTemplate 渲染一段 SOP 文本，返回结果与警告
+func RenderTemplate(text string, a Alert) (string, []string) {
+	return NewTemplateContext(a).Render(text)
+}
+
+// Render 替换 text 中的全部占位符；无法求值的保持原样并记录警告
+func (c *TemplateContext) Render(text string) (string, []string) {
+	var warns []string
+	out := placeholderRE.ReplaceAllStringFunc(text, func(ph string) string {
+		expr := placeholderRE.FindStringSubmatch(ph)[1]
+		v, err := c.eval(expr)
+		if err != nil {
+			warns = append(warns, fmt.Sprintf("%s: %v", ph, err))
+			return ph
+		}
+		return v
+	})
+	return out, warns
+}
+
+// CheckTemplate 静态检查 text 中的占位符语法（不依赖告警数据），返回问题列表
+func CheckTemplate(text string) []string {
+	var probs []string
+	for _, m := range placeholderRE.FindAllStringSubmatch(text, -1) {
+		value, filters, err := splitPipeline(m[1])
+		if err == nil {
+			err = checkValue(value)
+		}
+		for _, f := range filters {
+			if err != nil {
+				break
+			}
+			err = checkFilter(f)
+		}
+		if err != nil {
+			probs = append(probs, fmt.Sprintf("%s: %v", m[0], err))
+		}
+	}
+	return probs
+}
+
+func checkValue(v string) error {
+	switch {
+	case strings.HasPrefix(v, "."):
+		if len(v) == 1 || strings.Contains(v, "..") || strings.HasSuffix(v, ".") {
+			return fmt.Errorf("invalid field path %q", v)
+		}
+		return nil
+	case legacyNames[v] != "", v == "alert_start_time", v == "alert_end_time":
+		return nil
+	case timeExprRE.MatchString(v):
+		return nil
+	}
+	return fmt.Errorf("unknown placeholder %q", v)
+}
+
+func checkFilter(f []string) error {
+	n, ok := filterArgs[f[0]]
+	if !ok {
+		return fmt.Errorf("unknown filter %q", f[0])
+	}
+	if len(f)-1 != n {
+		return fmt.Errorf("filter %q takes %d argument(s)", f[0], n)
+	}
+	return nil
+}
+
+// splitPipeline 把 "value | f1 arg | f2" 拆成值与过滤器（参数可用双引号包裹，支持 \" 转义）
+func splitPipeline(expr string) (string, [][]string, error) {
+	var parts [][]string
+	var cur []string
+	var tok strings.Builder
+	inQuote, quoted := false, false
+	flush := func() {
+		if tok.Len() > 0 || quoted {
+			cur = append(cur, tok.String())
+		}
+		tok.Reset()
+		quoted = false
+	}
+	for i := 0; i < len(expr); i++ {
+		ch := expr[i]
+		switch {
+		case inQuote && ch == '\\' && i+1 < len(expr):
+			i++
+			tok.WriteByte(expr[i])
+		case ch == '"':
+			inQuote, quoted = !inQuote, true
+		case inQuote:
+			tok.WriteByte(ch)
+		case ch == '|':
+			flush()
+			parts = append(parts, cur)
+			cur = nil
+		case ch == ' ' || ch == '\t':
+			flush()
+		default:
+			tok.WriteByte(ch)
+		}
+	}
+	if inQuote {
+		return "", nil, fmt.Errorf("unterminated quote")
+	}
+	flush()
+	parts = append(parts, cur)
+	if len(parts[0]) == 0 {
+		return "", nil, fmt.Errorf("empty placeholder")
+	}
+	for _, p := range parts[1:] {
+		if len(p) == 0 {
+			return "", nil, fmt.Errorf("empty filter")
+		}
+	}
+	// 值部分允许带空格（如 "start - 15m"），重新拼接
+	return strings.Join(parts[0], " "), parts[1:], nil
+}
+
+func (c *TemplateContext) eval(expr string) (string, error) {
+	value, filters, err := splitPipeline(expr)
+	if err != nil {
+		return "", err
+	}
+	if err := checkValue(value); err != nil {
+		return "", err
+	}
+	for _, f := range filters {
+		if err := checkFilter(f); err != nil {
+			return "", err
+		}
+	}
+
+	v, ok := c.value(value)
+	for _, f := range filters {
+		switch f[0] {
+		case "default":
+			if !ok || v == "" {
+				v, ok = f[1], true
+			}
+			continue
+		}
+		if !ok {
+			break
+		}
+		if v, err = applyFilter(f, v); err != nil {
+			return "", err
+		}
+	}
+	if !ok {
+		return "", fmt.Errorf("no value for %q", value)
+	}
+	s, _ := v.(string)
+	if t, isTime := v.(time.Time); isTime {
+		s = t.Format(time.RFC3339)
+	}
+	return s, nil
+}
+
+// value 求值；时间类返回 time.Time，其余返回 string
+func (c *TemplateContext) value(v string) (interface{}, bool) {
+	if p, ok := legacyNames[v]; ok {
+		v = p
+	}
+	switch v {
+	case "alert_start_time":
+		// 旧行为：原样输出告警中的值，缺省为 Grafana/ES 相对时间 now-10m
+		if s := c.metaStr("alert_start_time", "start_time", "start", "startsAt"); s != "" {
+			return s, true
+		}
+		return "now-10m", true
+	case "alert_end_time":
+		if s := c.metaStr("alert_end_time", "end_time", "end", "endsAt"); s != "" {
+			return s, true
+		}
+		return "now", true
+	}
+	if strings.HasPrefix(v, ".") {
+		return lookup(c.root, strings.Split(v[1:], "."))
+	}
+	m := timeExprRE.FindStringSubmatch(v)
+	if m == nil {
+		return nil, false
+	}
+	t := c.timeOf(m[1])
+	if m[2] != "" {
+		n, _ := strconv.ParseFloat(m[3], 64)
+		d := time.Duration(n * float64(unitOf(m[4])))
+		if m[2] == "-" {
+			d = -d
+		}
+		t = t.Add(d)
+	}
+	return t, true
+}
+
+func unitOf(u string) time.Duration {
+	switch u {
+	case "ms":
+		return time.Millisecond
+	case "s":
+		return time.Second
+	case "m":
+		return time.Minute
+	case "h":
+		return time.Hour
+	case "d":
+		return 24 * time.Hour
+	default:
+		return 7 * 24 * time.Hour
+	}
+}
+
+// timeOf 取告警时间；缺失或无法解析时 start=now-10m、end=now、alert_time=now-10m（与旧默认一致）
+func (c *TemplateContext) timeOf(name string) time.Time {
+	var s string
+	def := c.now.Add(-10 * time.Minute)
+	switch name {
+	case "now":
+		return c.now
+	case "start":
+		s = c.metaStr("alert_start_time", "start_time", "start", "startsAt")
+	case "end":
+		s, def = c.metaStr("alert_end_time", "end_time", "end", "endsAt"), c.now
+	case "alert_time":
+		s = c.metaStr("alert_time", "timestamp", "ts")
+	}
+	if t, ok := parseTime(s); ok {
+		return t
+	}
+	return def
+}
+
+func (c *TemplateContext) metaStr(keys ...string) string {
+	for _, k := range keys {
+		switch v := c.meta[k].(type) {
+		case string:
+			if strings.TrimSpace(v) != "" {
+				return v
+			}
+		case float64:
+			return strconv.FormatFloat(v, 'f', -1, 64)
+		}
+	}
+	return ""
+}
+
+var timeLayouts = []string{time.RFC3339Nano, "2006-01-02 15:04:05", "2006-01-02T15:04:05", "2006-01-02 15:04:05Z07:00"}
+
+// parseTime 支持 RFC3339、常见日期格式、epoch 秒/毫秒
+func parseTime(s string) (time.Time, bool) {
+	s = strings.TrimSpace(s)
+	if s == "" {
+		return time.Time{}, false
+	}
+	for _, l := range timeLayouts {
+		if t, err := time.Parse(l, s); err == nil {
+			return t.UTC(), true
+		}
+	}
+	if n, err := strconv.ParseFloat(s, 64); err == nil && n > 0 {
+		if n > 1e12 {
+			n /= 1000
+		}
+		sec, frac := math.Modf(n)
+		return time.Unix(int64(sec), int64(frac*1e9)).UTC(), true
+	}
+	return time.Time{}, false
+}
+
+// lookup 按路径取值；键名大小写不敏感（精确匹配优先），数字按原样输出
+func lookup(root map[string]interface{}, path []string) (interface{}, bool) {
+	var cur interface{} = root
+	for _, p := range path {
+		m, ok := cur.(map[string]interface{})
+		if !ok {
+			return nil, false
+		}
+		v, ok := m[p]
+		if !ok {
+			for k, mv := range m {
+				if strings.EqualFold(k, p) {
+					v, ok = mv, true
+					break
+				}
+			}
+		}
+		if !ok {
+			return nil, false
+		}
+		cur = v
+	}
+	switch v := cur.(type) {
+	case nil:
+		return nil, false
+	case string:
+		return v, true
+	case float64:
+		return strconv.FormatFloat(v, 'f', -1, 64), true
+	default:
+		b, _ := json.Marshal(v)
+		return string(b), true
+	}
+}
+
+func applyFilter(f []string, v interface{}) (interface{}, error) {
+	switch f[0] {
+	case "rfc3339", "epoch", "epoch_ms", "format":
+		t, ok := v.(time.Time)
+		if !ok {
+			if t, ok = parseTime(fmt.Sprint(v)); !ok {
+				return nil, fmt.Errorf("%s: %q is not a time", f[0], v)
+			}
+		}
+		switch f[0] {
+		case "rfc3339":
+			return t.Format(time.RFC3339), nil
+		case "epoch":
+			return strconv.FormatInt(t.Unix(), 10), nil
+		case "epoch_ms":
+			return strconv.FormatInt(t.UnixNano()/int64(time.Millisecond), 10), nil
+		default:
+			return t.Format(f[1]), nil
+		}
+	}
+	s := fmt.Sprint(v)
+	if t, ok := v.(time.Time); ok {
+		s = t.Format(time.RFC3339)
+	}
+	switch f[0] {
+	case "promql":
+		return promqlEscape(s), nil
+	case "promql_re":
+		return promqlEscape(regexp.QuoteMeta(s)), nil
+	case "lucene":
+		return luceneEscape(s), nil
+	case "lower":
+		return strings.ToLower(s), nil
+	default:
+		return strings.ToUpper(s), nil
+	}
+}
+
+// promqlEscape 转义为可放入 PromQL 双引号字符串的内容
+func promqlEscape(s string) string {
+	r := strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+	return r.Replace(s)
+}
+
+// luceneEscape 转义 Lucene 查询语法的特殊字符（同 QueryParser.escape）
+func luceneEscape(s string) string {
+	var b strings.Builder
+	for _, r := range s {
+		if strings.ContainsRune(`\+-!():^[]"{}~*?|&/`, r) {
+			b.WriteByte('\\')
+		}
+		b.WriteRune(r)
+	}
+	return b.String()
+}
@@ -0,0 +1,104 @@
+package sop
+
+import (
+	"reflect"
+	"testing"
+	"time"
+)
+
+const templateAlert = `{"service":"omada.api","path":"/api/v1/devices","threshold":80,
+	"metadata":{"expression":"rate(http_requests_total{code=\"500\"}[5m])","alert_start_time":"2024-05-01T10:00:00Z",
+	"labels":{"team":"sre"},"pod":"api-7f9c","count":3}}`
+
+func TestRender(t *testing.T) {
+	tc := NewTemplateContext(mustAlert(t, templateAlert))
+	tc.now = time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)
+	tests := []struct {
+		in    string
+		want  string
+		warns int
+	}{
+		{"kubectl logs {{.metadata.pod}}", "kubectl logs api-7f9c", 0},
+		{"{{ .service }}", "omada.api", 0},
+		{"{{.METADATA.Pod}}", "api-7f9c", 0},
+		{"{{.metadata.labels.team | upper}}", "SRE", 0},
+		{"{{.metadata.labels}}", `{"team":"sre"}`, 0},
+		{"{{.threshold}} / {{.metadata.count}}", "80 / 3", 0},
+		{"{{service_name}} {{service名}} {{alert_path}}", "omada.api omada.api /api/v1/devices", 0},
+		{"{{expression}}", `rate(http_requests_total{code="500"}[5m])`, 0},
+		{"{{alert_start_time}}", "2024-05-01T10:00:00Z", 0},
+		{"{{alert_end_time}}", "now", 0},
+		{"{{start}}", "2024-05-01T10:00:00Z", 0},
+		{"{{start - 15m | rfc3339}}", "2024-05-01T09:45:00Z", 0},
+		{"{{end}}", "2024-05-01T12:00:00Z", 0},
+		{"{{now - 1d | format \"2006.01.02\"}}", "2024.04.30", 0},
+		{"{{start | epoch}}", "1714557600", 0},
+		{"{{start + 1.5s | epoch_ms}}", "1714557601500", 0},
+		{"{{alert_time}}", "2024-05-01T11:50:00Z", 0}, // 缺失时为 now-10m
+		{`{{expression | promql}}`, `rate(http_requests_total{code=\"500\"}[5m])`, 0},
+		{"{{.service | promql_re}}", `omada\\.api`, 0},
+		{"{{.path | lucene}}", `\/api\/v1\/devices`, 0},
+		{`{{.metadata.missing | default "n/a"}}`, "n/a", 0},
+		{`{{.metadata.missing | default "X" | lower}}`, "x", 0},
+		{"{{.metadata.missing}}", "{{.metadata.missing}}", 1},
+		{"{{.service | bogus}}", "{{.service | bogus}}", 1},
+		{"{{.service | epoch}}", "{{.service | epoch}}", 1},
+		{"{{unknown}} {{.service}}", "{{unknown}} omada.api", 1},
+		{"no placeholders", "no placeholders", 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.in, func(t *testing.T) {
+			got, warns := tc.Render(tt.in)
+			if got != tt.want || len(warns) != tt.warns {
+				t.Fatalf("Render(%q) = %q (warnings %q), want %q with %d warning(s)", tt.in, got, warns, tt.want, tt.warns)
+			}
+		})
+	}
+}
+
+func TestCheckTemplate(t *testing.T) {
+	tests := []struct {
+		in   string
+		want []string
+	}{
+		{"{{.metadata.pod}} {{start - 15m | rfc3339}} {{expression | promql}}", nil},
+		{`{{.x | default "a \"b\""}} {{now | format "2006-01-02"}}`, nil},
+		{"{{.}}", []string{`{{.}}: invalid field path "."`}},
+		{"{{.a..b}}", []string{`{{.a..b}}: invalid field path ".a..b"`}},
+		{"{{start - 15x}}", []string{`{{start - 15x}}: unknown placeholder "start - 15x"`}},
+		{"{{.a | nope}}", []string{`{{.a | nope}}: unknown filter "nope"`}},
+		{"{{.a | default}}", []string{`{{.a | default}}: filter "default" takes 1 argument(s)`}},
+		{"{{.a | upper x}}", []string{`{{.a | upper x}}: filter "upper" takes 0 argument(s)`}},
+		{"{{.a | }}", []string{"{{.a | }}: empty filter"}},
+		{`{{.a | default "x}}`, []string{`{{.a | default "x}}: unterminated quote`}},
+		{"{{ }} {{.ok}}", []string{"{{ }}: empty placeholder"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.in, func(t *testing.T) {
+			if got := CheckTemplate(tt.in); !reflect.DeepEqual(got, tt.want) {
+				t.Fatalf("CheckTemplate(%q) = %q, want %q", tt.in, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestParseTime(t *testing.T) {
+	want := time.Date(2024, 5, 1, 10, 0, 0, 0, time.UTC)
+	for _, s := range []string{
+		"2024-05-01T10:00:00Z",
+		"2024-05-01T12:00:00+02:00",
+		"2024-05-01 10:00:00",
+		"2024-05-01T10:00:00",
+		"1714557600",
+		"1714557600000",
+	} {
+		if got, ok := parseTime(s); !ok || !got.Equal(want) {
+			t.Errorf("parseTime(%q) = %v, %v", s, got, ok)
+		}
+	}
+	for _, s := range []string{"", "yesterday", "-5"} {
+		if _, ok := parseTime(s); ok {
+			t.Errorf("parseTime(%q) ok", s)
+		}
+	}
+}
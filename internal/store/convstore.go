@@ -1,21 +1,68 @@
 package store
 
 import (
+	"context"
 	"os"
 	"path/filepath"
+	"sync"
 )
 
 type ConvStore struct {
 	root string
+
+	// 按 sop_id 加锁：同一会话文件的 /load → /save 串行执行
+	mu    sync.Mutex
+	locks map[string]*convLock
+}
+
+type convLock struct {
+	ch   chan struct{}
+	refs int // 持有 + 等待者数量，归零时删除
 }
 
 func NewConvStore(root string) (*ConvStore, error) {
 	if err := os.MkdirAll(root, 0o755); err != nil {
 		return nil, err
 	}
-	return &ConvStore{root: root}, nil
+	return &ConvStore{root: root, locks: make(map[string]*convLock)}, nil
 }
 
 func (cs *ConvStore) PathFor(sopID string) string {
 	return filepath.Join(cs.root, sopID+".json")
 }
+
+// Lock 获取 sop_id 的会话文件锁，返回解锁函数（可重复调用）；
+// 不同 sop_id 互不影响，ctx 取消时放弃等待
+func (cs *ConvStore) Lock(ctx context.Context, sopID string) (func(), error) {
+	cs.mu.Lock()
+	l, ok := cs.locks[sopID]
+	if !ok {
+		l = &convLock{ch: make(chan struct{}, 1)}
+		cs.locks[sopID] = l
+	}
+	l.refs++
+	cs.mu.Unlock()
+
+	select {
+	case l.ch <- struct{}{}:
+	case <-ctx.Done():
+		cs.unref(sopID, l)
+		return nil, ctx.Err()
+	}
+	var once sync.Once
+	return func() {
+		once.Do(func() {
+			<-l.ch
+			cs.unref(sopID, l)
+		})
+	}, nil
+}
+
+func (cs *ConvStore) unref(sopID string, l *convLock) {
+	cs.mu.Lock()
+	defer cs.mu.Unlock()
+	l.refs--
+	if l.refs == 0 {
+		delete(cs.locks, sopID)
+	}
+}
@@ -0,0 +1,269 @@
+package tracing
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ---- OTLP/HTTP（JSON 编码）----
+
+// OTLPExporter 以 OTLP/HTTP JSON 把 span POST 到 collector 的 /v1/traces
+type OTLPExporter struct {
+	url     string
+	service string
+	headers map[string]string
+	hc      *http.Client
+}
+
+// NewOTLPExporter endpoint 为 collector 地址（如 http://otel-collector:4318），未以 /v1/traces 结尾时自动补上
+func NewOTLPExporter(endpoint, service string, headers map[string]string) *OTLPExporter {
+	u := strings.TrimRight(strings.TrimSpace(endpoint), "/")
+	if !strings.HasSuffix(u, "/v1/traces") {
+		u += "/v1/traces"
+	}
+	return &OTLPExporter{url: u, service: service, headers: headers, hc: &http.Client{Timeout: 10 * time.Second}}
+}
+
+// ParseHeaders 解析 k1=v1,k2=v2 形式的请求头（同 OTEL_EXPORTER_OTLP_HEADERS）
+func ParseHeaders(s string) map[string]string {
+	h := map[string]string{}
+	for _, kv := range strings.Split(s, ",") {
+		if k, v, ok := strings.Cut(kv, "="); ok && strings.TrimSpace(k) != "" {
+			h[strings.TrimSpace(k)] = strings.TrimSpace(v)
+		}
+	}
+	return h
+}
+
+type otlpValue struct {
+	StringValue *string  `json:"stringValue,omitempty"`
+	BoolValue   *bool    `json:"boolValue,omitempty"`
+	IntValue    *string  `json:"intValue,omitempty"` // OTLP JSON 中 int64 编码为字符串
+	DoubleValue *float64 `json:"doubleValue,omitempty"`
+}
+
+type otlpKV struct {
+	Key   string    `json:"key"`
+	Value otlpValue `json:"value"`
+}
+
+type otlpStatus struct {
+	Code    int    `json:"code"` // 0 unset, 1 ok, 2 error
+	Message string `json:"message,omitempty"`
+}
+
+type otlpSpan struct {
+	TraceID           string     `json:"traceId"`
+	SpanID            string     `json:"spanId"`
+	ParentSpanID      string     `json:"parentSpanId,omitempty"`
+	Name              string     `json:"name"`
+	Kind              int        `json:"kind"`
+	StartTimeUnixNano string     `json:"startTimeUnixNano"`
+	EndTimeUnixNano   string     `json:"endTimeUnixNano"`
+	Attributes        []otlpKV   `json:"attributes,omitempty"`
+	Status            otlpStatus `json:"status"`
+}
+
+func otlpAttr(a Attr) otlpKV {
+	var v otlpValue
+	switch x := a.Value.(type) {
+	case string:
+		v.StringValue = &x
+	case bool:
+		v.BoolValue = &x
+	case int:
+		s := strconv.Itoa(x)
+		v.IntValue = &s
+	case int64:
+		s := strconv.FormatInt(x, 10)
+		v.IntValue = &s
+	case float64:
+		v.DoubleValue = &x
+	default:
+		s := fmt.Sprint(x)
+		v.StringValue = &s
+	}
+	return otlpKV{Key: a.Key, Value: v}
+}
+
+func (e *OTLPExporter) Export(ctx context.Context, spans []SpanData) error {
+	out := make([]otlpSpan, 0, len(spans))
+	for _, d := range spans {
+		s := otlpSpan{
+			TraceID:           d.Context.TraceID.String(),
+			SpanID:            d.Context.SpanID.String(),
+			Name:              d.Name,
+			Kind:              int(d.Kind),
+			StartTimeUnixNano: strconv.FormatInt(d.Start.UnixNano(), 10),
+			EndTimeUnixNano:   strconv.FormatInt(d.End.UnixNano(), 10),
+		}
+		if d.Parent.IsValid() {
+			s.ParentSpanID = d.Parent.String()
+		}
+		for _, a := range d.Attrs {
+			s.Attributes = append(s.Attributes, otlpAttr(a))
+		}
+		if d.Error {
+			s.Status = otlpStatus{Code: 2, Message: d.ErrorMsg}
+		}
+		out = append(out, s)
+	}
+	body := map[string]interface{}{
+		"resourceSpans": []interface{}{map[string]interface{}{
+			"resource": map[string]interface{}{
+				"attributes": []otlpKV{otlpAttr(Attr{Key: "service.name", Value: e.service})},
+			},
+			"scopeSpans": []interface{}{map[string]interface{}{
+				"scope": map[string]string{"name": "aiops-qproxy"},
+				"spans": out,
+			}},
+		}},
+	}
+	b, err := json.Marshal(body)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, e.url, bytes.NewReader(b))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	for k, v := range e.headers {
+		req.Header.Set(k, v)
+	}
+	resp, err := e.hc.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	_, _ = io.Copy(io.Discard, io.LimitReader(resp.Body, 4096))
+	if resp.StatusCode/100 != 2 {
+		return fmt.Errorf("POST %s: status %d", e.url, resp.StatusCode)
+	}
+	return nil
+}
+
+func (e *OTLPExporter) Close() error { return nil }
+
+// ---- 本地 JSONL 文件 ----
+
+// FileExporter 每个 span 写一行 JSON；文件超过 MaxBytes 时轮转为 <path>.1
+type FileExporter struct {
+	mu       sync.Mutex
+	path     string
+	maxBytes int64
+	f        *os.File
+	size     int64
+}
+
+type fileSpan struct {
+	TraceID    string                 `json:"trace_id"`
+	SpanID     string                 `json:"span_id"`
+	ParentID   string                 `json:"parent_span_id,omitempty"`
+	Name       string                 `json:"name"`
+	Start      time.Time              `json:"start"`
+	End        time.Time              `json:"end"`
+	DurationMS float64                `json:"duration_ms"`
+	Attributes map[string]interface{} `json:"attributes,omitempty"`
+	Error      string                 `json:"error,omitempty"`
+}
+
+// NewFileExporter 打开（追加）path；maxBytes<=0 时不轮转
+func NewFileExporter(path string, maxBytes int64) (*FileExporter, error) {
+	if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+		return nil, err
+	}
+	e := &FileExporter{path: path, maxBytes: maxBytes}
+	if err := e.open(); err != nil {
+		return nil, err
+	}
+	return e, nil
+}
+
+func (e *FileExporter) open() error {
+	f, err := os.OpenFile(e.path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0o644)
+	if err != nil {
+		return err
+	}
+	st, err := f.Stat()
+	if err != nil {
+		_ = f.Close()
+		return err
+	}
+	e.f, e.size = f, st.Size()
+	return nil
+}
+
+func (e *FileExporter) Export(ctx context.Context, spans []SpanData) error {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	if e.maxBytes > 0 && e.size >= e.maxBytes {
+		_ = e.f.Close()
+		if err := os.Rename(e.path, e.path+".1"); err != nil {
+			return err
+		}
+		if err := e.open(); err != nil {
+			return err
+		}
+	}
+	w := bufio.NewWriter(e.f)
+	n := 0
+	for _, d := range spans {
+		fs := fileSpan{
+			TraceID:    d.Context.TraceID.String(),
+			SpanID:     d.Context.SpanID.String(),
+			Name:       d.Name,
+			Start:      d.Start.UTC(),
+			End:        d.End.UTC(),
+			DurationMS: float64(d.End.Sub(d.Start).Microseconds()) / 1000,
+		}
+		if d.Parent.IsValid() {
+			fs.ParentID = d.Parent.String()
+		}
+		if len(d.Attrs) > 0 {
+			fs.Attributes = make(map[string]interface{}, len(d.Attrs))
+			for _, a := range d.Attrs {
+				fs.Attributes[a.Key] = a.Value
+			}
+		}
+		if d.Error {
+			fs.Error = d.ErrorMsg
+		}
+		b, err := json.Marshal(fs)
+		if err != nil {
+			continue
+		}
+		b = append(b, '\n')
+		m, _ := w.Write(b)
+		n += m
+	}
+	err := w.Flush()
+	e.size += int64(n)
+	return err
+}
+
+func (e *FileExporter) Close() error {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	return e.f.Close()
+}
+
+// ---- 不导出 ----
+
+// NopExporter 丢弃所有 span：没有配置导出目标时仍生成 trace_id 并传播 traceparent，供日志关联
+type NopExporter struct{}
+
+func (NopExporter) Export(ctx context.Context, spans []SpanData) error { return nil }
+
+func (NopExporter) Close() error { return nil }
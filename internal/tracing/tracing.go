@@ -0,0 +1,329 @@
+package tracing
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"log"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// 轻量的 OpenTelemetry 风格追踪：W3C traceparent 传播、span 批量导出（OTLP/HTTP 或本地 JSONL）。
+// 未调用 Setup 时 Start 返回 nil span，所有方法都是空操作，调用方无需判空。
+
+type TraceID [16]byte
+type SpanID [8]byte
+
+func (t TraceID) String() string { return hex.EncodeToString(t[:]) }
+func (s SpanID) String() string  { return hex.EncodeToString(s[:]) }
+
+func (t TraceID) IsValid() bool { return t != TraceID{} }
+func (s SpanID) IsValid() bool  { return s != SpanID{} }
+
+// SpanContext 是跨进程传播的部分（traceparent）
+type SpanContext struct {
+	TraceID TraceID
+	SpanID  SpanID
+	Sampled bool
+}
+
+func (sc SpanContext) IsValid() bool { return sc.TraceID.IsValid() && sc.SpanID.IsValid() }
+
+// Traceparent 格式化为 W3C traceparent：00-<trace-id>-<span-id>-<flags>
+func (sc SpanContext) Traceparent() string {
+	flags := "00"
+	if sc.Sampled {
+		flags = "01"
+	}
+	return "00-" + sc.TraceID.String() + "-" + sc.SpanID.String() + "-" + flags
+}
+
+// ParseTraceparent 解析 W3C traceparent；格式不对或 ID 全零时返回错误
+func ParseTraceparent(h string) (SpanContext, error) {
+	var sc SpanContext
+	parts := strings.Split(strings.TrimSpace(h), "-")
+	if len(parts) < 4 || len(parts[0]) != 2 || len(parts[1]) != 32 || len(parts[2]) != 16 || len(parts[3]) != 2 {
+		return sc, fmt.Errorf("invalid traceparent %q", h)
+	}
+	if parts[0] == "ff" || (parts[0] == "00" && len(parts) != 4) {
+		return sc, fmt.Errorf("invalid traceparent version in %q", h)
+	}
+	if _, err := hex.Decode(sc.TraceID[:], []byte(parts[1])); err != nil {
+		return sc, fmt.Errorf("invalid trace-id in %q", h)
+	}
+	if _, err := hex.Decode(sc.SpanID[:], []byte(parts[2])); err != nil {
+		return sc, fmt.Errorf("invalid parent-id in %q", h)
+	}
+	flags, err := hex.DecodeString(parts[3])
+	if err != nil {
+		return sc, fmt.Errorf("invalid trace-flags in %q", h)
+	}
+	if !sc.IsValid() {
+		return sc, fmt.Errorf("all-zero id in traceparent %q", h)
+	}
+	sc.Sampled = flags[0]&1 == 1
+	return sc, nil
+}
+
+type Kind int
+
+// 取值与 OTLP SpanKind 一致
+const (
+	KindInternal Kind = 1
+	KindServer   Kind = 2
+	KindClient   Kind = 3
+)
+
+// Attr 是 span 属性；Value 为 string/bool/int/int64/float64，其他类型按 %v 转为字符串
+type Attr struct {
+	Key   string
+	Value interface{}
+}
+
+// SpanData 是已结束的 span，交给 Exporter
+type SpanData struct {
+	Name     string
+	Kind     Kind
+	Context  SpanContext
+	Parent   SpanID
+	Start    time.Time
+	End      time.Time
+	Attrs    []Attr
+	Error    bool
+	ErrorMsg string
+}
+
+// Exporter 批量导出已结束的 span
+type Exporter interface {
+	Export(ctx context.Context, spans []SpanData) error
+	Close() error
+}
+
+// Span 是进行中的 span；nil 表示未启用追踪
+type Span struct {
+	t    *tracer
+	mu   sync.Mutex
+	d    SpanData
+	done bool
+}
+
+// SetAttr 设置属性
+func (s *Span) SetAttr(key string, value interface{}) {
+	if s == nil {
+		return
+	}
+	s.mu.Lock()
+	s.d.Attrs = append(s.d.Attrs, Attr{Key: key, Value: value})
+	s.mu.Unlock()
+}
+
+// RecordError 记录错误并把 span 状态置为 error；err 为 nil 时忽略
+func (s *Span) RecordError(err error) {
+	if s == nil || err == nil {
+		return
+	}
+	s.mu.Lock()
+	s.d.Error = true
+	s.d.ErrorMsg = err.Error()
+	s.mu.Unlock()
+}
+
+// End 结束 span 并排队导出；重复调用无效
+func (s *Span) End() {
+	if s == nil {
+		return
+	}
+	s.mu.Lock()
+	if s.done {
+		s.mu.Unlock()
+		return
+	}
+	s.done = true
+	s.d.End = time.Now()
+	d := s.d
+	s.mu.Unlock()
+	if d.Context.Sampled {
+		s.t.enqueue(d)
+	}
+}
+
+// Context 返回 span 的 SpanContext
+func (s *Span) Context() SpanContext {
+	if s == nil {
+		return SpanContext{}
+	}
+	return s.d.Context
+}
+
+type spanKey struct{}
+type remoteKey struct{}
+
+// FromContext 返回 ctx 上当前的 span（可能为 nil）
+func FromContext(ctx context.Context) *Span {
+	s, _ := ctx.Value(spanKey{}).(*Span)
+	return s
+}
+
+// WithRemote 把入站请求的 traceparent 放入 ctx，下一个 Start 以它为父
+func WithRemote(ctx context.Context, sc SpanContext) context.Context {
+	return context.WithValue(ctx, remoteKey{}, sc)
+}
+
+// Traceparent 返回 ctx 上当前 span 的 traceparent（用于向下游传播），没有时为空
+func Traceparent(ctx context.Context) string {
+	if s := FromContext(ctx); s != nil {
+		return s.d.Context.Traceparent()
+	}
+	return ""
+}
+
+// Start 以 ctx 上的 span（或远端父 span）为父创建子 span；未启用追踪时返回原 ctx 与 nil
+func Start(ctx context.Context, name string, attrs ...Attr) (context.Context, *Span) {
+	return StartKind(ctx, name, KindInternal, attrs...)
+}
+
+// StartKind 同 Start，可指定 span 类型（入站 HTTP 为 KindServer）
+func StartKind(ctx context.Context, name string, kind Kind, attrs ...Attr) (context.Context, *Span) {
+	t := current()
+	if t == nil {
+		return ctx, nil
+	}
+	d := SpanData{Name: name, Kind: kind, Start: time.Now(), Attrs: attrs}
+	if p := FromContext(ctx); p != nil {
+		d.Context.TraceID, d.Parent, d.Context.Sampled = p.d.Context.TraceID, p.d.Context.SpanID, p.d.Context.Sampled
+	} else if rc, ok := ctx.Value(remoteKey{}).(SpanContext); ok && rc.IsValid() {
+		d.Context.TraceID, d.Parent, d.Context.Sampled = rc.TraceID, rc.SpanID, rc.Sampled
+	} else {
+		_, _ = rand.Read(d.Context.TraceID[:])
+		d.Context.Sampled = true
+	}
+	_, _ = rand.Read(d.Context.SpanID[:])
+	s := &Span{t: t, d: d}
+	return context.WithValue(ctx, spanKey{}, s), s
+}
+
+// ---- 全局 tracer：批量导出 ----
+
+type Options struct {
+	Exporter  Exporter
+	BatchSize int           // 单次导出的最大 span 数，默认 256
+	Interval  time.Duration // 最长导出间隔，默认 5s
+	QueueSize int           // 待导出队列长度，满了丢弃，默认 4096
+}
+
+type tracer struct {
+	dropped  int64 // 首字段，保证 32 位平台上 atomic 操作对齐
+	opt      Options
+	queue    chan SpanData
+	stop     chan struct{}
+	stopOnce sync.Once
+	done     chan struct{}
+}
+
+var global atomic.Value // *tracer
+
+func current() *tracer {
+	t, _ := global.Load().(*tracer)
+	return t
+}
+
+// Enabled 是否已启用追踪
+func Enabled() bool { return current() != nil }
+
+// Setup 启用追踪并启动后台导出
+func Setup(opt Options) {
+	if opt.BatchSize <= 0 {
+		opt.BatchSize = 256
+	}
+	if opt.Interval <= 0 {
+		opt.Interval = 5 * time.Second
+	}
+	if opt.QueueSize <= 0 {
+		opt.QueueSize = 4096
+	}
+	t := &tracer{
+		opt:   opt,
+		queue: make(chan SpanData, opt.QueueSize),
+		stop:  make(chan struct{}),
+		done:  make(chan struct{}),
+	}
+	go t.loop()
+	global.Store(t)
+}
+
+// Shutdown 导出剩余 span 并关闭 exporter；之后的 span 不再导出
+func Shutdown(ctx context.Context) error {
+	t := current()
+	if t == nil {
+		return nil
+	}
+	t.stopOnce.Do(func() { close(t.stop) })
+	select {
+	case <-t.done:
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+	if n := atomic.LoadInt64(&t.dropped); n > 0 {
+		log.Printf("tracing: %d span(s) dropped because the export queue was full", n)
+	}
+	return t.opt.Exporter.Close()
+}
+
+func (t *tracer) enqueue(d SpanData) {
+	select {
+	case <-t.stop:
+		return
+	default:
+	}
+	select {
+	case t.queue <- d:
+	default:
+		atomic.AddInt64(&t.dropped, 1)
+	}
+}
+
+func (t *tracer) loop() {
+	defer close(t.done)
+	tk := time.NewTicker(t.opt.Interval)
+	defer tk.Stop()
+	batch := make([]SpanData, 0, t.opt.BatchSize)
+	export := func() {
+		if len(batch) == 0 {
+			return
+		}
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		if err := t.opt.Exporter.Export(ctx, batch); err != nil {
+			log.Printf("tracing: export %d span(s) failed: %v", len(batch), err)
+		}
+		cancel()
+		batch = batch[:0]
+	}
+	for {
+		select {
+		case d := <-t.queue:
+			batch = append(batch, d)
+			if len(batch) >= t.opt.BatchSize {
+				export()
+			}
+		case <-tk.C:
+			export()
+		case <-t.stop:
+			for {
+				select {
+				case d := <-t.queue:
+					batch = append(batch, d)
+					if len(batch) >= t.opt.BatchSize {
+						export()
+					}
+				default:
+					export()
+					return
+				}
+			}
+		}
+	}
+}
@@ -0,0 +1,65 @@
+package tracing
+
+import (
+	"crypto/rand"
+	"testing"
+)
+
+func TestParseTraceparent(t *testing.T) {
+	const (
+		traceID = "4bf92f3577b34da6a3ce929d0e0e4736"
+		spanID  = "00f067aa0ba902b7"
+	)
+	tests := []struct {
+		name    string
+		in      string
+		sampled bool
+		wantErr bool
+	}{
+		{"sampled", "00-" + traceID + "-" + spanID + "-01", true, false},
+		{"not sampled", "00-" + traceID + "-" + spanID + "-00", false, false},
+		{"other flag bits", "00-" + traceID + "-" + spanID + "-03", true, false},
+		{"surrounding space", "  00-" + traceID + "-" + spanID + "-01 ", true, false},
+		{"future version with extra field", "01-" + traceID + "-" + spanID + "-01-extra", true, false},
+		{"version 00 with extra field", "00-" + traceID + "-" + spanID + "-01-extra", false, true},
+		{"version ff", "ff-" + traceID + "-" + spanID + "-01", false, true},
+		{"empty", "", false, true},
+		{"too few parts", "00-" + traceID + "-" + spanID, false, true},
+		{"short trace id", "00-4bf92f35-" + spanID + "-01", false, true},
+		{"short span id", "00-" + traceID + "-00f067aa-01", false, true},
+		{"non-hex trace id", "00-" + "zzf92f3577b34da6a3ce929d0e0e4736" + "-" + spanID + "-01", false, true},
+		{"non-hex span id", "00-" + traceID + "-" + "zzf067aa0ba902b7" + "-01", false, true},
+		{"non-hex flags", "00-" + traceID + "-" + spanID + "-zz", false, true},
+		{"zero trace id", "00-00000000000000000000000000000000-" + spanID + "-01", false, true},
+		{"zero span id", "00-" + traceID + "-0000000000000000-01", false, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			sc, err := ParseTraceparent(tt.in)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("ParseTraceparent(%q) err = %v, wantErr %v", tt.in, err, tt.wantErr)
+			}
+			if err != nil {
+				return
+			}
+			if sc.TraceID.String() != traceID || sc.SpanID.String() != spanID || sc.Sampled != tt.sampled {
+				t.Fatalf("ParseTraceparent(%q) = %s/%s sampled=%v", tt.in, sc.TraceID, sc.SpanID, sc.Sampled)
+			}
+		})
+	}
+}
+
+func TestTraceparentRoundTrip(t *testing.T) {
+	for _, sampled := range []bool{true, false} {
+		sc := SpanContext{Sampled: sampled}
+		_, _ = rand.Read(sc.TraceID[:])
+		_, _ = rand.Read(sc.SpanID[:])
+		got, err := ParseTraceparent(sc.Traceparent())
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got != sc {
+			t.Fatalf("round trip: got %+v, want %+v", got, sc)
+		}
+	}
+}
@@ -0,0 +1,100 @@
+package transcript
+
+import (
+	"bytes"
+	"log"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// ServeOptions 控制回放
+type ServeOptions struct {
+	// Speed 为 0 时不等待，直接按顺序发送；1 按录制时的帧间隔发送，2 为两倍速，以此类推
+	Speed float64
+	// Once 只回放给第一条连接，之后的连接返回 503（一个录制文件对应一条连接，重连不会重放）
+	Once bool
+	// OnMismatch 客户端输入与录制不一致时调用（hello 帧不比较）；可为 nil
+	OnMismatch func(index int, want, got []byte)
+}
+
+// Handler 返回一个 ttyd WebSocket 端点（子协议 tty），逐帧回放录制内容：
+// 遇到 send 事件读取一帧客户端输入，遇到 recv 事件原样发送（保留 ANSI、spinner 与帧拆分），
+// 遇到带 close_code 的 err 事件以该关闭码断开（1006 不发关闭帧，直接断开 TCP）。录制结束后保持连接，直到客户端断开。
+func Handler(t *Transcript, opt ServeOptions) http.Handler {
+	up := websocket.Upgrader{
+		Subprotocols: []string{"tty"},
+		CheckOrigin:  func(r *http.Request) bool { return true },
+	}
+	var mu sync.Mutex
+	served := false
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if opt.Once {
+			mu.Lock()
+			busy := served
+			served = true
+			mu.Unlock()
+			if busy {
+				http.Error(w, "transcript already replayed", http.StatusServiceUnavailable)
+				return
+			}
+		}
+		conn, err := up.Upgrade(w, r, nil)
+		if err != nil {
+			log.Printf("transcript: upgrade: %v", err)
+			return
+		}
+		defer conn.Close()
+		conn.SetReadLimit(16 << 20)
+		replay(conn, t, opt)
+		for {
+			if _, _, err := conn.ReadMessage(); err != nil {
+				return
+			}
+		}
+	})
+}
+
+func replay(conn *websocket.Conn, t *Transcript, opt ServeOptions) {
+	var prev int64
+	for i, e := range t.Events {
+		switch e.Dir {
+		case Send:
+			_, got, err := conn.ReadMessage()
+			if err != nil {
+				return
+			}
+			want := e.Bytes()
+			// hello 帧（JSON，鉴权模式下含 AuthToken）不比较
+			if len(want) > 0 && want[0] != '{' && !bytes.Equal(want, got) && opt.OnMismatch != nil {
+				opt.OnMismatch(i, want, got)
+			}
+		case Recv:
+			if opt.Speed > 0 && e.T > prev {
+				time.Sleep(time.Duration(float64(time.Duration(e.T-prev)*time.Millisecond) / opt.Speed))
+			}
+			typ := websocket.TextMessage
+			if e.Binary {
+				typ = websocket.BinaryMessage
+			}
+			if err := conn.WriteMessage(typ, e.Bytes()); err != nil {
+				return
+			}
+		case Err:
+			switch e.CloseCode {
+			case 0:
+			case websocket.CloseAbnormalClosure:
+				// 1006 只是本地对“未收到关闭帧就断开”的记录，不能出现在线上：直接断开 TCP 复现
+				_ = conn.UnderlyingConn().Close()
+				return
+			default:
+				msg := websocket.FormatCloseMessage(e.CloseCode, "")
+				_ = conn.WriteControl(websocket.CloseMessage, msg, time.Now().Add(time.Second))
+				return
+			}
+		}
+		prev = e.T
+	}
+}
@@ -0,0 +1,234 @@
+package transcript
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+	"unicode/utf8"
+)
+
+// 录制格式：每条 ttyd 连接一个 JSONL 文件，首行为 Header，之后每行一个 Event（原始 WebSocket 帧，含类型前缀）。
+// 帧内容按原样保存：合法 UTF-8 写在 data，否则（如被拆开的多字节字符）base64 写在 b64，回放时逐字节还原。
+
+const Version = 1
+
+// 事件方向
+const (
+	Send = "send" // 客户端 → ttyd（hello、输入）
+	Recv = "recv" // ttyd → 客户端（输出、标题、偏好设置）
+	Err  = "err"  // 客户端读取出错（对端关闭等），回放时按 close_code 关闭连接
+)
+
+// Header 是录制文件的首行
+type Header struct {
+	Version   int       `json:"version"`
+	SessionID string    `json:"session_id"`
+	Endpoint  string    `json:"endpoint,omitempty"`
+	WakeMode  string    `json:"wake_mode,omitempty"`
+	Started   time.Time `json:"started"`
+}
+
+// Event 是一帧或一次读取错误
+type Event struct {
+	T         int64  `json:"t_ms"` // 距 Header.Started 的毫秒数
+	Dir       string `json:"dir"`
+	RequestID string `json:"request_id,omitempty"`
+	Binary    bool   `json:"binary,omitempty"` // WebSocket 二进制帧（ttyd 输出通常为二进制帧）
+	Data      string `json:"data,omitempty"`
+	B64       []byte `json:"b64,omitempty"`
+	CloseCode int    `json:"close_code,omitempty"`
+	Error     string `json:"error,omitempty"`
+}
+
+// Bytes 返回帧的原始字节
+func (e Event) Bytes() []byte {
+	if e.B64 != nil {
+		return e.B64
+	}
+	return []byte(e.Data)
+}
+
+// Input 对 ttyd INPUT 帧（'0' + 内容）返回去掉类型前缀与结尾回车的输入行
+func (e Event) Input() (string, bool) {
+	b := e.Bytes()
+	if e.Dir != Send || len(b) == 0 || b[0] != '0' {
+		return "", false
+	}
+	return strings.TrimSuffix(string(b[1:]), "\r"), true
+}
+
+// Transcript 是读入内存的录制文件
+type Transcript struct {
+	Path   string
+	Header Header
+	Events []Event
+}
+
+// Exchange 是一次输入（prompt 或斜杠命令）及其后到下一次输入前收到的帧
+type Exchange struct {
+	Seq       int
+	RequestID string
+	Input     string
+	Frames    []Event
+}
+
+// Exchanges 按输入切分事件；Dial 阶段的唤醒输入（空行、Ctrl-C）不算作一次交互
+func (t *Transcript) Exchanges() []Exchange {
+	var out []Exchange
+	for _, e := range t.Events {
+		if in, ok := e.Input(); ok && strings.Trim(in, "\x03\x04") != "" {
+			out = append(out, Exchange{Seq: len(out) + 1, RequestID: e.RequestID, Input: in})
+			continue
+		}
+		if e.Dir == Recv && len(out) > 0 {
+			x := &out[len(out)-1]
+			x.Frames = append(x.Frames, e)
+		}
+	}
+	return out
+}
+
+// Load 读取录制文件
+func Load(path string) (*Transcript, error) {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	sc := bufio.NewScanner(bytes.NewReader(b))
+	sc.Buffer(make([]byte, 64*1024), 32<<20)
+	t := &Transcript{Path: path}
+	line := 0
+	for sc.Scan() {
+		line++
+		raw := bytes.TrimSpace(sc.Bytes())
+		if len(raw) == 0 {
+			continue
+		}
+		if line == 1 {
+			if err := json.Unmarshal(raw, &t.Header); err != nil {
+				return nil, fmt.Errorf("%s: header: %w", path, err)
+			}
+			if t.Header.Version != Version {
+				return nil, fmt.Errorf("%s: unsupported transcript version %d", path, t.Header.Version)
+			}
+			continue
+		}
+		var e Event
+		if err := json.Unmarshal(raw, &e); err != nil {
+			return nil, fmt.Errorf("%s:%d: %w", path, line, err)
+		}
+		t.Events = append(t.Events, e)
+	}
+	if err := sc.Err(); err != nil {
+		return nil, err
+	}
+	if line == 0 {
+		return nil, fmt.Errorf("%s: empty transcript", path)
+	}
+	return t, nil
+}
+
+// Recorder 把一条连接的帧追加写入录制文件；方法可并发调用，nil Recorder 上的调用为空操作
+type Recorder struct {
+	mu      sync.Mutex
+	f       *os.File
+	w       *bufio.Writer
+	started time.Time
+}
+
+// NewRecorder 在 dir 下创建 <时间>_<session_id>.jsonl 并写入 Header
+func NewRecorder(dir string, h Header) (*Recorder, error) {
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return nil, err
+	}
+	if h.Started.IsZero() {
+		h.Started = time.Now()
+	}
+	h.Started = h.Started.UTC()
+	h.Version = Version
+	id := h.SessionID
+	if id == "" {
+		id = "nosession"
+	}
+	name := h.Started.Format("20060102T150405.000000000Z") + "_" + id + ".jsonl"
+	f, err := os.OpenFile(filepath.Join(dir, name), os.O_CREATE|os.O_WRONLY|os.O_EXCL, 0o600)
+	if err != nil {
+		return nil, err
+	}
+	r := &Recorder{f: f, w: bufio.NewWriter(f), started: h.Started}
+	if err := r.writeLine(h); err != nil {
+		_ = f.Close()
+		return nil, err
+	}
+	return r, nil
+}
+
+// Path 返回录制文件路径
+func (r *Recorder) Path() string {
+	if r == nil {
+		return ""
+	}
+	return r.f.Name()
+}
+
+// Frame 记录一帧（dir 为 Send 或 Recv）
+func (r *Recorder) Frame(dir, requestID string, binary bool, data []byte) {
+	if r == nil {
+		return
+	}
+	e := Event{Dir: dir, RequestID: requestID, Binary: binary}
+	if utf8.Valid(data) {
+		e.Data = string(data)
+	} else {
+		e.B64 = append([]byte(nil), data...)
+	}
+	r.event(e)
+}
+
+// ReadError 记录读取错误；closeCode 为对端关闭码（非关闭错误为 0）
+func (r *Recorder) ReadError(requestID string, closeCode int, err error) {
+	if r == nil || err == nil {
+		return
+	}
+	r.event(Event{Dir: Err, RequestID: requestID, CloseCode: closeCode, Error: err.Error()})
+}
+
+func (r *Recorder) event(e Event) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.w == nil {
+		return
+	}
+	e.T = time.Since(r.started).Milliseconds()
+	_ = r.writeLine(e)
+}
+
+// writeLine 写一行并立即 flush，进程异常退出时也不丢已收到的帧
+func (r *Recorder) writeLine(v interface{}) error {
+	enc := json.NewEncoder(r.w) // Encode 自带换行
+	enc.SetEscapeHTML(false)    // 保持提示符 '>' 等字符可读
+	if err := enc.Encode(v); err != nil {
+		return err
+	}
+	return r.w.Flush()
+}
+
+// Close 关闭录制文件
+func (r *Recorder) Close() error {
+	if r == nil {
+		return nil
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.w == nil {
+		return nil
+	}
+	r.w = nil
+	return r.f.Close()
+}
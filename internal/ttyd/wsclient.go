@@ -4,19 +4,24 @@ import (
 	"bytes"
 	"context"
 	"crypto/tls"
+	"encoding/base64"
 	"encoding/json"
 	"errors"
 	"fmt"
-	"log"
+	"io"
 	"net"
 	"net/http"
 	"net/url"
-	"os"
 	"regexp"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
+	"aiops-qproxy/internal/logx"
+	"aiops-qproxy/internal/qerr"
+	"aiops-qproxy/internal/transcript"
+
 	"github.com/gorilla/websocket"
 )
 
@@ -26,7 +31,10 @@ type DialOptions struct {
 	// and send hello JSON without AuthToken.
 	NoAuth bool
 
-	// optional (kept for backward-compat; ignored when NoAuth==true)
+	// 鉴权选项（NoAuth==true 时全部忽略）：
+	//   - Username/Password：Basic 认证（对应 ttyd -c user:pass）
+	//   - AuthHeaderName/AuthHeaderVal：代理注入的自定义头
+	//   - TokenURL：显式 token 地址；为空时由 Endpoint 推导 /token
 	Username       string
 	Password       string
 	AuthHeaderName string
@@ -41,6 +49,8 @@ type DialOptions struct {
 	InsecureTLS bool
 	// 唤醒 Q 的方式：ctrlc（默认）/ newline / none
 	WakeMode string
+	// RecordDir 非空时把每条连接收发的原始帧写入 <RecordDir>/<时间>_<session_id>.jsonl（供 qproxy replay 回放）
+	RecordDir string
 }
 
 type Client struct {
@@ -51,17 +61,20 @@ type Client struct {
 	opt      DialOptions
 	done     chan struct{}
 	readIdle time.Duration
-}
-
-// 调试日志开关：设置 QPROXY_TTYD_DEBUG=1 时开启详细日志
-func ttydDebugEnabled() bool {
-	return strings.ToLower(os.Getenv("QPROXY_TTYD_DEBUG")) == "1"
+	// 只带 session_id 的 ctx，用于不在请求内的日志（关闭、对端断开）
+	lctx context.Context
+	// 录制（未开启时为 nil）；recErr 表示已记录过读错误（失败后的重复读取不再记录）
+	rec    *transcript.Recorder
+	recErr bool
+	// dead 非 0 表示连接已不可复用：gorilla/websocket 的读错误（含超时）是永久的，
+	// 放弃中的回答也会继续输出；之后 Ping 返回错误，池在租用前探活时丢弃
+	dead int32
 }
 
 // 限制读取缓冲区的最大字节数，避免单次响应异常膨胀导致内存和 CPU 飙升
 const maxReadBufferBytes = 256 * 1024 // 256KB
 
-func capBuffer(buf *bytes.Buffer) {
+func capBuffer(ctx context.Context, buf *bytes.Buffer) {
 	if buf.Len() <= maxReadBufferBytes {
 		return
 	}
@@ -72,9 +85,7 @@ func capBuffer(buf *bytes.Buffer) {
 	copy(tail, b[start:])
 	buf.Reset()
 	_, _ = buf.Write(tail)
-	if ttydDebugEnabled() {
-		log.Printf("ttyd: buffer capped to %d bytes (trimmed older output)", maxReadBufferBytes)
-	}
+	logx.Debugf(ctx, "ttyd: buffer capped to %d bytes (trimmed older output)", maxReadBufferBytes)
 }
 
 type helloFrame struct {
@@ -96,7 +107,7 @@ func Dial(ctx context.Context, opt DialOptions) (*Client, error) {
 		u.Path = "/ws"
 	}
 
-	h := http.Header{} // 留空：NoAuth 下不携带任何鉴权头
+	h := authHeader(opt) // NoAuth 下为空，不携带任何鉴权头
 
 	d := websocket.Dialer{
 		HandshakeTimeout: opt.HandshakeTO,
@@ -111,78 +122,104 @@ func Dial(ctx context.Context, opt DialOptions) (*Client, error) {
 		KeepAlive: 30 * time.Second,
 	}).DialContext
 
-	if ttydDebugEnabled() {
-		log.Printf("ttyd: attempting to connect to %s (NoAuth=%v)", u.String(), opt.NoAuth)
+	// 鉴权模式下，先取 token（ttyd 在 hello 帧里校验 AuthToken）
+	token := ""
+	if !opt.NoAuth {
+		token, err = fetchToken(ctx, opt, u, h)
+		if err != nil {
+			logx.Warnf(ctx, "ttyd: token fetch failed: %v", err)
+			return nil, fmt.Errorf("ttyd token fetch failed: %w", err)
+		}
 	}
-	conn, _, err := d.DialContext(ctx, u.String(), h)
+
+	logx.Debugf(ctx, "ttyd: attempting to connect to %s (NoAuth=%v)", u.String(), opt.NoAuth)
+	conn, resp, err := d.DialContext(ctx, u.String(), h)
 	if err != nil {
-		log.Printf("ttyd: connection failed: %v", err)
+		if resp != nil && resp.StatusCode == http.StatusUnauthorized {
+			logx.Errorf(ctx, "ttyd: connection rejected (401), check QPROXY_WS_USER/QPROXY_WS_PASS")
+		}
+		logx.Warnf(ctx, "ttyd: connection failed: %v", err)
 		return nil, err
 	}
-	if ttydDebugEnabled() {
-		log.Printf("ttyd: WebSocket connection established")
-	}
-	// 记录对端关闭事件，便于定位是谁主动断开
-	conn.SetCloseHandler(func(code int, text string) error {
-		if ttydDebugEnabled() {
-			log.Printf("ttyd: close from peer (code=%d, text=%q)", code, text)
-		}
-		return nil
-	})
+	logx.Debugf(ctx, "ttyd: WebSocket connection established")
 	c := &Client{
 		conn:     conn,
 		url:      u.String(),
 		opt:      opt,
 		done:     make(chan struct{}),
 		readIdle: opt.ReadIdleTO,
+		lctx:     logx.With(context.Background(), logx.SessionID, logx.Field(ctx, logx.SessionID)),
+	}
+	// ---- 唤醒方式（录制头部也需要）----
+	mode := opt.WakeMode
+	if mode == "" {
+		mode = "newline" // 默认使用 newline，避免 Ctrl-C 导致 Q CLI 退出
+	}
+	if opt.RecordDir != "" {
+		rec, err := transcript.NewRecorder(opt.RecordDir, transcript.Header{
+			SessionID: logx.Field(ctx, logx.SessionID),
+			Endpoint:  u.String(),
+			WakeMode:  mode,
+		})
+		if err != nil {
+			logx.Warnf(ctx, "ttyd: recording disabled for this connection: %v", err)
+		} else {
+			c.rec = rec
+			logx.Debugf(ctx, "ttyd: recording frames to %s", rec.Path())
+		}
 	}
-	// 读限制，但不设置初始 ReadDeadline（会在 readUntilPrompt 后设置为 24h）
+	dialed := false
+	defer func() {
+		if !dialed {
+			_ = c.rec.Close()
+		}
+	}()
+	// 记录对端关闭事件，便于定位是谁主动断开
+	conn.SetCloseHandler(func(code int, text string) error {
+		logx.Debugf(c.lctx, "ttyd: close from peer (code=%d, text=%q)", code, text)
+		return nil
+	})
+	// 读限制；读超时由每次读取时的 ctx 决定（见 readFrame）
 	c.conn.SetReadLimit(16 << 20)
-	// 移除 PongHandler 和初始 ReadDeadline，避免与后续的 24h 设置冲突
 
-	// ---- 首帧：只发 columns/rows；NoAuth 下不带 AuthToken ----
-	hello := helloFrame{Columns: 120, Rows: 30}
-	// （如果以后需要支持鉴权模式，这里可以根据 opt.NoAuth=false 去附加 AuthToken）
+	// ---- 首帧：columns/rows；鉴权模式下附带 AuthToken ----
+	hello := helloFrame{AuthToken: token, Columns: 120, Rows: 30}
 	b, _ := json.Marshal(&hello)
-	if ttydDebugEnabled() {
-		log.Printf("ttyd: sending hello message: %s", string(b))
+	// 不打印 token 明文
+	logx.Debugf(ctx, "ttyd: sending hello message (columns=%d rows=%d auth_token=%v)", hello.Columns, hello.Rows, token != "")
+	if c.rec != nil {
+		// 录制时同样不保存 token
+		redacted, _ := json.Marshal(&helloFrame{Columns: hello.Columns, Rows: hello.Rows})
+		c.rec.Frame(transcript.Send, logx.Field(ctx, logx.RequestID), false, redacted)
 	}
 	if err := conn.WriteMessage(websocket.TextMessage, b); err != nil {
-		log.Printf("ttyd: hello message failed: %v", err)
+		logx.Warnf(ctx, "ttyd: hello message failed: %v", err)
 		_ = conn.Close()
 		return nil, fmt.Errorf("ttyd hello failed: %w", err)
 	}
-	if ttydDebugEnabled() {
-		log.Printf("ttyd: hello message sent successfully")
-	}
+	logx.Debugf(ctx, "ttyd: hello message sent successfully")
 
 	// ---- 关键：先"唤醒" Q CLI，再等提示符（避免卡在 MCP 初始化）----
 	// Q CLI 初启会加载多个 MCP 工具，默认要等它们 ready；
 	// 只有收到一次用户输入（哪怕空行或 Ctrl-C）才给提示符。
-	mode := opt.WakeMode
-	if mode == "" {
-		mode = "newline" // 默认使用 newline，避免 Ctrl-C 导致 Q CLI 退出
-	}
-	if ttydDebugEnabled() {
-		log.Printf("ttyd: waking Q CLI with mode: %s", mode)
-	}
+	logx.Debugf(ctx, "ttyd: waking Q CLI with mode: %s", mode)
 	switch mode {
 	case "ctrlc":
 		// 发送 Ctrl-C + 回车，立刻进入可交互状态
 		// ttyd 1.7.4 协议：需要加 '0' (INPUT) 类型前缀
-		if err := c.conn.WriteMessage(websocket.TextMessage, []byte{'0', 0x03}); err != nil {
-			log.Printf("ttyd: wake Ctrl-C failed: %v", err)
+		if err := c.writeFrame(ctx, []byte{'0', 0x03}); err != nil {
+			logx.Warnf(ctx, "ttyd: wake Ctrl-C failed: %v", err)
 			_ = conn.Close()
 			return nil, fmt.Errorf("ttyd wake failed: %w", err)
 		}
-		if err := c.conn.WriteMessage(websocket.TextMessage, []byte("0\r")); err != nil {
-			log.Printf("ttyd: wake newline failed: %v", err)
+		if err := c.writeFrame(ctx, []byte("0\r")); err != nil {
+			logx.Warnf(ctx, "ttyd: wake newline failed: %v", err)
 			_ = conn.Close()
 			return nil, fmt.Errorf("ttyd wake failed: %w", err)
 		}
 	case "newline":
-		if err := c.conn.WriteMessage(websocket.TextMessage, []byte("0\r")); err != nil {
-			log.Printf("ttyd: wake newline failed: %v", err)
+		if err := c.writeFrame(ctx, []byte("0\r")); err != nil {
+			logx.Warnf(ctx, "ttyd: wake newline failed: %v", err)
 			_ = conn.Close()
 			return nil, fmt.Errorf("ttyd wake failed: %w", err)
 		}
@@ -190,33 +227,137 @@ func Dial(ctx context.Context, opt DialOptions) (*Client, error) {
 		// 不发送任何唤醒字符
 	}
 
-	if ttydDebugEnabled() {
-		log.Printf("ttyd: waiting for initial prompt...")
-	}
+	logx.Debugf(ctx, "ttyd: waiting for initial prompt...")
 	if _, err = c.readUntilPrompt(ctx, opt.ReadIdleTO); err != nil {
 		_ = conn.Close()
 		return nil, fmt.Errorf("ttyd init read failed: %w", err)
 	}
 
-	// 不设置 ReadDeadline！让连接永远不会因为超时而断开
-	if ttydDebugEnabled() {
-		log.Printf("ttyd: connection established, NO ReadDeadline set (永不超时)")
-	}
+	logx.Debugf(ctx, "ttyd: connection established")
 
 	// 不启动 keepalive（本地 ttyd 稳定，无需心跳）
-	if ttydDebugEnabled() {
-		log.Printf("ttyd: keepalive disabled by design")
-	}
+	logx.Debugf(ctx, "ttyd: keepalive disabled by design")
+	dialed = true
 	return c, nil
 }
 
+// authHeader 构造握手请求头：Basic 认证 + 自定义头。NoAuth 下返回空头。
+func authHeader(opt DialOptions) http.Header {
+	h := http.Header{}
+	if opt.NoAuth {
+		return h
+	}
+	if opt.Username != "" {
+		h.Set("Authorization", "Basic "+basicCredential(opt.Username, opt.Password))
+	}
+	if name := strings.TrimSpace(opt.AuthHeaderName); name != "" {
+		h.Set(name, opt.AuthHeaderVal)
+	}
+	return h
+}
+
+func basicCredential(user, pass string) string {
+	return base64.StdEncoding.EncodeToString([]byte(user + ":" + pass))
+}
+
+// tokenURLFor 返回 token 地址：优先使用显式 TokenURL，否则把 ws 端点的 /ws 换成 /token。
+func tokenURLFor(opt DialOptions, wsURL *url.URL) string {
+	if strings.TrimSpace(opt.TokenURL) != "" {
+		return opt.TokenURL
+	}
+	tu := *wsURL
+	switch tu.Scheme {
+	case "ws":
+		tu.Scheme = "http"
+	case "wss":
+		tu.Scheme = "https"
+	}
+	p := strings.TrimSuffix(tu.Path, "/")
+	p = strings.TrimSuffix(p, "/ws")
+	tu.Path = p + "/token"
+	tu.RawQuery = ""
+	return tu.String()
+}
+
+// fetchToken 从 ttyd 的 /token 取 AuthToken（响应格式 {"token":"..."}）。
+// 显式配置 TokenURL 时失败即报错；推导地址失败时回退为 Basic 凭证
+// （ttyd -c 模式下 token 即 base64(user:pass)）。
+func fetchToken(ctx context.Context, opt DialOptions, wsURL *url.URL, h http.Header) (string, error) {
+	explicit := strings.TrimSpace(opt.TokenURL) != ""
+	fallback := ""
+	if opt.Username != "" {
+		fallback = basicCredential(opt.Username, opt.Password)
+	}
+
+	to := opt.ConnectTO + opt.HandshakeTO
+	if to <= 0 {
+		to = 10 * time.Second
+	}
+	tctx, cancel := context.WithTimeout(ctx, to)
+	defer cancel()
+
+	tokenURL := tokenURLFor(opt, wsURL)
+	req, err := http.NewRequestWithContext(tctx, http.MethodGet, tokenURL, nil)
+	if err != nil {
+		if explicit {
+			return "", err
+		}
+		return fallback, nil
+	}
+	for k, vs := range h {
+		for _, v := range vs {
+			req.Header.Add(k, v)
+		}
+	}
+	hc := &http.Client{
+		Transport: &http.Transport{
+			Proxy:           http.ProxyFromEnvironment,
+			TLSClientConfig: &tls.Config{InsecureSkipVerify: opt.InsecureTLS},
+		},
+	}
+	resp, err := hc.Do(req)
+	if err != nil {
+		if explicit {
+			return "", err
+		}
+		logx.Debugf(ctx, "ttyd: GET %s failed, falling back to basic credential: %v", tokenURL, err)
+		return fallback, nil
+	}
+	defer resp.Body.Close()
+	body, _ := io.ReadAll(io.LimitReader(resp.Body, 64*1024))
+	if resp.StatusCode != http.StatusOK {
+		if explicit {
+			return "", fmt.Errorf("GET %s: status %d", tokenURL, resp.StatusCode)
+		}
+		logx.Debugf(ctx, "ttyd: GET %s returned %d, falling back to basic credential", tokenURL, resp.StatusCode)
+		return fallback, nil
+	}
+	var tr struct {
+		Token string `json:"token"`
+	}
+	if err := json.Unmarshal(body, &tr); err != nil {
+		if explicit {
+			return "", fmt.Errorf("GET %s: invalid token response: %w", tokenURL, err)
+		}
+		return fallback, nil
+	}
+	if tr.Token == "" {
+		return fallback, nil
+	}
+	return tr.Token, nil
+}
+
 func (c *Client) SendLine(line string) error {
+	return c.sendLine(c.lctx, line)
+}
+
+func (c *Client) sendLine(ctx context.Context, line string) error {
 	c.mu.Lock()
 	defer c.mu.Unlock()
 	// ttyd 1.7.4 协议：客户端输入需要以 "0" (INPUT 类型) 开头
 	// 格式: "0" + 实际输入内容 + "\r" (回车符，触发 Q CLI 执行)
 	msg := "0" + line + "\r"
-	return c.conn.WriteMessage(websocket.TextMessage, []byte(msg))
+	return c.writeFrame(ctx, []byte(msg))
 }
 
 // 发送 Ctrl-C
@@ -225,7 +366,7 @@ func (c *Client) sendCtrlC() error {
 	defer c.mu.Unlock()
 	// ttyd 1.7.4 协议：Ctrl-C 也需要 INPUT 类型前缀
 	// 格式: "0" + 0x03
-	return c.conn.WriteMessage(websocket.TextMessage, []byte{'0', 0x03})
+	return c.writeFrame(c.lctx, []byte{'0', 0x03})
 }
 
 // 发送 Ctrl-D (EOF) - 告诉 Q CLI 输入结束
@@ -234,7 +375,90 @@ func (c *Client) sendCtrlD() error {
 	defer c.mu.Unlock()
 	// ttyd 1.7.4 协议：Ctrl-D 也需要 INPUT 类型前缀
 	// 格式: "0" + 0x04
-	return c.conn.WriteMessage(websocket.TextMessage, []byte{'0', 0x04})
+	return c.writeFrame(c.lctx, []byte{'0', 0x04})
+}
+
+// writeFrame 发送一帧文本消息；开启录制时同时记录
+func (c *Client) writeFrame(ctx context.Context, data []byte) error {
+	c.rec.Frame(transcript.Send, logx.Field(ctx, logx.RequestID), false, data)
+	return c.conn.WriteMessage(websocket.TextMessage, data)
+}
+
+// readFrame 读取一帧，读超时跟随 ctx 的截止时间（无截止时间时不超时）。
+// 任何读错误都使连接失效：超时返回 qerr.ErrTimeout（ctx 被取消时返回 ctx.Err()），其余返回 qerr.ErrConnLost；
+// 开启录制时记录收到的数据帧与首个读错误
+func (c *Client) readFrame(ctx context.Context) (int, []byte, error) {
+	dl, _ := ctx.Deadline()
+	_ = c.conn.SetReadDeadline(dl)
+	if err := ctx.Err(); err != nil {
+		// interruptOn 可能已先一步把读超时设为当前时间，上面又被覆盖；此处兜底
+		c.markDead()
+		return 0, nil, err
+	}
+	typ, data, err := c.conn.ReadMessage()
+	rid := logx.Field(ctx, logx.RequestID)
+	if err != nil {
+		c.markDead()
+		if c.rec != nil && !c.recErr {
+			c.recErr = true
+			code := 0
+			var ce *websocket.CloseError
+			if errors.As(err, &ce) {
+				code = ce.Code
+			}
+			c.rec.ReadError(rid, code, err)
+		}
+		return typ, data, readErr(ctx, err)
+	}
+	if c.rec != nil && (typ == websocket.TextMessage || typ == websocket.BinaryMessage) {
+		c.rec.Frame(transcript.Recv, rid, typ == websocket.BinaryMessage, data)
+	}
+	return typ, data, err
+}
+
+func (c *Client) markDead() { atomic.StoreInt32(&c.dead, 1) }
+
+// readErr 归类读错误：读超时（截止时间到期或 interruptOn 打断）不是断连，上层不应重连重发
+func readErr(ctx context.Context, err error) error {
+	var ne net.Error
+	if (errors.As(err, &ne) && ne.Timeout()) || ctx.Err() != nil {
+		if errors.Is(ctx.Err(), context.Canceled) {
+			return ctx.Err()
+		}
+		return qerr.New(qerr.ErrTimeout, "read", err)
+	}
+	return qerr.New(qerr.ErrConnLost, "read", err)
+}
+
+// interruptOn 在 ctx 取消时把读超时设为当前时间，打断阻塞中的 ReadMessage（仅截止时间到期时 readFrame 自己会超时）；
+// 返回的函数停止监听并等待监听 goroutine 退出，之后不会再改动读超时（下一次读取不受影响）
+func (c *Client) interruptOn(ctx context.Context) func() {
+	if ctx.Done() == nil {
+		return func() {}
+	}
+	stop := make(chan struct{})
+	exited := make(chan struct{})
+	go func() {
+		defer close(exited)
+		select {
+		case <-ctx.Done():
+			_ = c.conn.SetReadDeadline(time.Now())
+		case <-stop:
+		}
+	}()
+	return func() {
+		close(stop)
+		<-exited
+	}
+}
+
+// peerClosed 对端发送了关闭帧（Close 1000/1001）或异常断开（1006）
+func peerClosed(err error) bool {
+	var ce *websocket.CloseError
+	if !errors.As(err, &ce) {
+		return false
+	}
+	return ce.Code == websocket.CloseNormalClosure || ce.Code == websocket.CloseGoingAway || ce.Code == websocket.CloseAbnormalClosure
 }
 
 // 全局编译正则表达式，避免重复编译
@@ -257,16 +481,24 @@ func hasPromptFast(buf *bytes.Buffer) bool {
 	// 过滤 ANSI ESC 序列: \x1b '[' ... [A-Za-z]
 	filtered := make([]byte, 0, len(tail))
 	for i := 0; i < len(tail); i++ {
-		if tail[i] == 0x1b && i+1 < len(tail) && tail[i+1] == '[' {
-			// 跳过直到尾部的字母结束符
+		if tail[i] == 0x1b && i+1 >= len(tail) {
+			// 帧边界落在 ESC 之后：序列未到齐，等下一帧（否则 "> " 后的颜色复位残片会留给下一次回答）
+			return false
+		}
+		if tail[i] == 0x1b && tail[i+1] == '[' {
+			// 跳过直到尾部的字母结束符；没有结束符说明序列被帧边界截断，同样等下一帧
 			j := i + 2
+			complete := false
 			for j < len(tail) {
 				c := tail[j]
+				j++
 				if (c >= 'A' && c <= 'Z') || (c >= 'a' && c <= 'z') {
-					j++
+					complete = true
 					break
 				}
-				j++
+			}
+			if !complete {
+				return false
 			}
 			i = j - 1
 			continue
@@ -300,49 +532,27 @@ func hasPromptFast(buf *bytes.Buffer) bool {
 
 func (c *Client) readUntilPrompt(ctx context.Context, idle time.Duration) (string, error) {
 	var buf bytes.Buffer
-	// 不设置 ReadDeadline！让连接永远不超时
-	// 依赖 context 来控制超时
-	if ttydDebugEnabled() {
-		log.Printf("ttyd: starting to read until prompt (NO ReadDeadline)")
-	}
+	// 依赖 context 来控制超时（读超时跟随 ctx 截止时间）
+	logx.Debugf(ctx, "ttyd: starting to read until prompt")
+	defer c.interruptOn(ctx)()
 	msgCount := 0
 
 	for {
 		// 检查 context 是否被取消
 		select {
 		case <-ctx.Done():
-			log.Printf("ttyd: context cancelled after %d messages", msgCount)
+			logx.Infof(ctx, "ttyd: context cancelled after %d messages", msgCount)
 			return "", ctx.Err()
 		default:
 		}
 
-		typ, data, err := c.conn.ReadMessage()
+		typ, data, err := c.readFrame(ctx)
 		if err != nil {
-			// 如果是超时，但 buf 里已有提示符，说明已到齐，返回成功
-			if netErr, ok := err.(net.Error); ok && netErr.Timeout() {
-				// 只检查末尾 500 字节，避免对超大 buf 做全量正则替换
-				tail := buf.Bytes()
-				if len(tail) > 500 {
-					tail = tail[len(tail)-500:]
-				}
-				cleaned := ansiRegex.ReplaceAllString(string(tail), "")
-				cleaned = strings.TrimRight(cleaned, " \r\n\t")
-				// 宽松判定：trim 后以 > 结尾，且不是字母数字紧接着（避免误判单词）
-				if strings.HasSuffix(cleaned, ">") && len(cleaned) > 0 {
-					// 检查 > 前一个字符（如果有）不是字母数字
-					if len(cleaned) == 1 || !isAlnum(cleaned[len(cleaned)-2]) {
-						if ttydDebugEnabled() {
-							log.Printf("ttyd: prompt detected on timeout after %d messages, buf size: %d", msgCount, buf.Len())
-						}
-						return buf.String(), nil
-					}
-				}
-			}
-			// 判断是否是对端关闭
-			if websocket.IsCloseError(err, websocket.CloseNormalClosure, websocket.CloseGoingAway, websocket.CloseAbnormalClosure) {
-				log.Printf("ttyd: peer closed connection while waiting initial prompt: %v", err)
-			} else if ttydDebugEnabled() {
-				log.Printf("ttyd: read message error after %d messages: %v", msgCount, err)
+			// 判断是否是对端关闭（每帧读完都检测过提示符，读错误时不会已有完整输出）
+			if peerClosed(err) {
+				logx.Warnf(ctx, "ttyd: peer closed connection while waiting initial prompt: %v", err)
+			} else {
+				logx.Debugf(ctx, "ttyd: read message error after %d messages: %v", msgCount, err)
 			}
 			return "", err
 		}
@@ -361,70 +571,67 @@ func (c *Client) readUntilPrompt(ctx context.Context, idle time.Duration) (strin
 				if len(data) > 1 {
 					actualData = data[1:]
 					buf.Write(actualData)
-					capBuffer(&buf)
+					capBuffer(ctx, &buf)
 				}
 				msgCount++
 			} else {
 				// 其他类型（SET_WINDOW_TITLE 等），忽略
-				if ttydDebugEnabled() {
-					log.Printf("ttyd: ignoring message type '%c'", msgType)
-				}
+				logx.Debugf(ctx, "ttyd: ignoring message type '%c'", msgType)
 				continue // 跳过这个消息，继续读下一个
 			}
 		}
 
 		// 快速检测提示符（低开销）
 		if hasPromptFast(&buf) {
-			if ttydDebugEnabled() {
-				log.Printf("ttyd: prompt detected after %d messages, buf size: %d", msgCount, buf.Len())
-			}
+			logx.Debugf(ctx, "ttyd: prompt detected after %d messages, buf size: %d", msgCount, buf.Len())
 			return buf.String(), nil
 		}
-
-		// 不再在循环中动态设置 ReadDeadline，只依赖初始的 hardDeadline
-		// 这样避免短超时累积导致连接在返回前被关闭
 	}
 }
 
+// OutputFunc 接收 readResponse 收到的每个 OUTPUT 帧内容（已去掉 '0' 类型前缀，保留 ANSI）。
+// 回调在读取 goroutine 中同步执行，不应阻塞；data 仅在回调期间有效。
+type OutputFunc func(data []byte)
+
+type outputFuncKey struct{}
+
+// WithOutputFunc 返回携带输出回调的 context，用于流式转发 Ask 期间的终端输出。
+func WithOutputFunc(ctx context.Context, fn OutputFunc) context.Context {
+	return context.WithValue(ctx, outputFuncKey{}, fn)
+}
+
+// OutputFuncFrom 返回 ctx 携带的输出回调（未设置时为 nil）
+func OutputFuncFrom(ctx context.Context) OutputFunc {
+	fn, _ := ctx.Value(outputFuncKey{}).(OutputFunc)
+	return fn
+}
+
 // readResponse 读取 Q CLI 的响应（发送 prompt 后调用）
 // 使用智能超时策略：看到响应内容和提示符后缩短等待时间
 func (c *Client) readResponse(ctx context.Context, idle time.Duration) (string, error) {
 	var buf bytes.Buffer
 	msgCount := 0
+	onOutput := OutputFuncFrom(ctx)
 
-	if ttydDebugEnabled() {
-		log.Printf("ttyd: reading response (NO ReadDeadline, rely on context timeout)")
-	}
+	logx.Debugf(ctx, "ttyd: reading response (read deadline follows context)")
+	defer c.interruptOn(ctx)()
 
 	for {
 		select {
 		case <-ctx.Done():
-			log.Printf("ttyd: context cancelled after %d messages", msgCount)
+			// 回答仍在输出，下一次 Ask 会读到残留内容，连接不再复用
+			c.markDead()
+			logx.Infof(ctx, "ttyd: context cancelled after %d messages", msgCount)
 			return "", ctx.Err()
 		default:
 		}
 
-		typ, data, err := c.conn.ReadMessage()
+		typ, data, err := c.readFrame(ctx)
 		if err != nil {
-			// 超时检查：如果 buf 里已有提示符，说明响应完成
-			if netErr, ok := err.(net.Error); ok && netErr.Timeout() {
-				tail := buf.Bytes()
-				if len(tail) > 500 {
-					tail = tail[len(tail)-500:]
-				}
-				cleaned := ansiRegex.ReplaceAllString(string(tail), "")
-				cleaned = strings.TrimRight(cleaned, " \r\n\t")
-				if strings.HasSuffix(cleaned, ">") && len(cleaned) > 0 {
-					if len(cleaned) == 1 || !isAlnum(cleaned[len(cleaned)-2]) {
-						log.Printf("ttyd: timeout but response looks complete (msgs:%d, size:%d)", msgCount, buf.Len())
-						return buf.String(), nil
-					}
-				}
-			}
-			if websocket.IsCloseError(err, websocket.CloseNormalClosure, websocket.CloseGoingAway, websocket.CloseAbnormalClosure) {
-				log.Printf("ttyd: peer closed connection during response read: %v", err)
-			} else if ttydDebugEnabled() {
-				log.Printf("ttyd: read error after %d messages: %v", msgCount, err)
+			if peerClosed(err) {
+				logx.Warnf(ctx, "ttyd: peer closed connection during response read: %v", err)
+			} else {
+				logx.Debugf(ctx, "ttyd: read error after %d messages: %v", msgCount, err)
 			}
 			return "", err
 		}
@@ -442,22 +649,21 @@ func (c *Client) readResponse(ctx context.Context, idle time.Duration) (string,
 				if len(data) > 1 {
 					actualContent := data[1:]
 					buf.Write(actualContent)
-					capBuffer(&buf)
+					capBuffer(ctx, &buf)
+					if onOutput != nil {
+						onOutput(actualContent)
+					}
 				}
 				msgCount++
 			} else {
 				// 其他类型，忽略
-				if ttydDebugEnabled() {
-					log.Printf("ttyd: ignoring message type '%c'", msgType)
-				}
+				logx.Debugf(ctx, "ttyd: ignoring message type '%c'", msgType)
 			}
 		}
 
 		// 快速检测提示符（低开销）
 		if hasPromptFast(&buf) {
-			if ttydDebugEnabled() {
-				log.Printf("ttyd: response complete after %d messages, buf size: %d", msgCount, buf.Len())
-			}
+			logx.Debugf(ctx, "ttyd: response complete after %d messages, buf size: %d", msgCount, buf.Len())
 			return buf.String(), nil
 		}
 	}
@@ -467,6 +673,10 @@ func (c *Client) Ask(ctx context.Context, prompt string, idle time.Duration) (st
 	if strings.TrimSpace(prompt) == "" {
 		return "", errors.New("empty prompt")
 	}
+	// 之前读失败或超时的连接不再发送（尚未发送，上层可以安全地重连后重试）
+	if atomic.LoadInt32(&c.dead) != 0 {
+		return "", qerr.Errorf(qerr.ErrConnLost, "ttyd: connection is no longer usable")
+	}
 	// 检查 context 是否已取消
 	select {
 	case <-ctx.Done():
@@ -481,9 +691,9 @@ func (c *Client) Ask(ctx context.Context, prompt string, idle time.Duration) (st
 	if len(promptPreview) > 200 {
 		promptPreview = promptPreview[:200] + "... (truncated, total " + fmt.Sprintf("%d", len(prompt)) + " chars)"
 	}
-	log.Printf("ttyd: sending prompt: %q", promptPreview)
+	logx.Infof(ctx, "ttyd: sending prompt: %q", promptPreview)
 
-	if err := c.SendLine(prompt); err != nil {
+	if err := c.sendLine(ctx, prompt); err != nil {
 		return "", err
 	}
 
@@ -509,16 +719,9 @@ func (c *Client) Ask(ctx context.Context, prompt string, idle time.Duration) (st
 	response, err := c.readResponse(useCtx, idle)
 	if err != nil {
 		// 记录一次错误，便于与上层日志对齐
-		log.Printf("ttyd: readResponse error: %v", err)
+		logx.Warnf(ctx, "ttyd: readResponse error: %v", err)
 		return "", err
 	}
-	// 读取完成后，尝试消费可能的附加控制帧，避免残留阻塞（非致命）
-	_ = c.conn.SetReadDeadline(time.Now().Add(10 * time.Millisecond))
-	_, _, _ = c.conn.ReadMessage()
-	_ = c.conn.SetReadDeadline(time.Time{})
-
-	// 不设置 ReadDeadline！保持连接永不超时
-
 	return response, err
 }
 
@@ -527,12 +730,16 @@ func (c *Client) Ask(ctx context.Context, prompt string, idle time.Duration) (st
 func (c *Client) Close() error {
 	c.mu.Lock()
 	defer c.mu.Unlock()
-	log.Printf("ttyd: client.Close() called by local code, closing websocket")
+	logx.Infof(c.lctx, "ttyd: client.Close() called by local code, closing websocket")
+	_ = c.rec.Close()
 	return c.conn.Close()
 }
 
-// Ping 健康探针
+// Ping 健康探针；读失败或放弃过回答的连接直接返回错误（写 ping 仍会成功，不能以此判断）
 func (c *Client) Ping(ctx context.Context) error {
+	if atomic.LoadInt32(&c.dead) != 0 {
+		return qerr.Errorf(qerr.ErrConnLost, "ttyd: connection is no longer usable")
+	}
 	// 让 Ping 遵循调用方的超时（默认 5s 上限）
 	to := 5 * time.Second
 	if dl, ok := ctx.Deadline(); ok {
@@ -3,6 +3,7 @@
 set -e
 
 # Configuration
+export QPROXY_BACKEND=optimized
 export QPROXY_POOL_SIZE=2
 export QPROXY_CONV_ROOT=./conversations
 export QPROXY_SOPMAP_PATH=./conversations/_sopmap.json
@@ -24,7 +25,7 @@ echo "Conversation root: $QPROXY_CONV_ROOT"
 echo "HTTP address: $QPROXY_HTTP_ADDR"
 
 # Start the service in background
-nohup ./bin/incident-worker-optimized > logs/optimized-test.log 2>&1 &
+nohup ./bin/incident-worker > logs/optimized-test.log 2>&1 &
 PID=$!
 echo $PID > logs/incident-worker-optimized.pid
 
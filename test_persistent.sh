@@ -3,6 +3,7 @@
 set -e
 
 # Configuration
+export QPROXY_BACKEND=persistent
 export QPROXY_POOL_SIZE=2
 export QPROXY_CONV_ROOT=./conversations
 export QPROXY_SOPMAP_PATH=./conversations/_sopmap.json
@@ -30,7 +31,7 @@ echo "Conversation root: $QPROXY_CONV_ROOT"
 echo "HTTP address: $QPROXY_HTTP_ADDR"
 
 # Start the service in background
-nohup ./bin/incident-worker-persistent > logs/persistent-test.log 2>&1 &
+nohup ./bin/incident-worker > logs/persistent-test.log 2>&1 &
 PID=$!
 echo $PID > logs/incident-worker-persistent.pid
 
@@ -20,6 +20,7 @@ done
 
 # Set environment variables
 export Q_BIN=q
+export QPROXY_BACKEND=oneshot
 export QPROXY_POOL_SIZE=3
 export QPROXY_CONV_ROOT=./conversations
 export QPROXY_HTTP_ADDR=:8080
@@ -29,7 +30,7 @@ export QPROXY_MEMLOG_SEC=30
 mkdir -p conversations logs
 
 echo "1. Starting pooled server..."
-./bin/incident-worker-pooled > logs/pooled-test.log 2>&1 &
+./bin/incident-worker > logs/pooled-test.log 2>&1 &
 SERVER_PID=$!
 echo $SERVER_PID > logs/incident-worker-pooled.pid
 
@@ -52,7 +53,7 @@ echo "2. Testing pool health..."
 # Test health check
 echo "   Testing /healthz..."
 HEALTH_RESPONSE=$(curl -s http://localhost:8080/healthz)
-if echo "$HEALTH_RESPONSE" | jq -e '.mode == "pooled"' > /dev/null; then
+if echo "$HEALTH_RESPONSE" | jq -e '.backend == "oneshot"' > /dev/null; then
     POOL_SIZE=$(echo "$HEALTH_RESPONSE" | jq -r '.size')
     POOL_READY=$(echo "$HEALTH_RESPONSE" | jq -r '.ready')
     echo "   ✅ Health check passed - Pool size: $POOL_SIZE, Ready: $POOL_READY"